@@ -0,0 +1,383 @@
+// Package analytics : room_historyとplayer_logから部屋やプレイヤーの統計を集計する.
+//
+// player_logは部屋ごとに記録順に並べ、Create/Join/Rejoinから次のLeaveまでを1つのセッションとする.
+// Leaveが記録されていないセッションは部屋の終了時刻に終わったものとする.
+package analytics
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"wsnet2/storage"
+)
+
+// player_log.message (see: game.PlayerLogMsg)
+const (
+	msgCreate = "Create"
+	msgJoin   = "Join"
+	msgRejoin = "Rejoin"
+	msgLeave  = "Leave"
+	msgAttach = "Attach"
+	msgDetach = "Detach"
+)
+
+// playerLogChunk : PlayerLogsを一度に取得する部屋の数
+const playerLogChunk = 1000
+
+// LifetimeBuckets : 部屋の存続時間の分布の区切り
+var LifetimeBuckets = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	3 * time.Hour,
+}
+
+// Options : 集計の条件
+type Options struct {
+	// From, To : 集計期間. この期間に存在していた部屋を対象にする
+	From time.Time
+	To   time.Time
+
+	// Interval : 同時に存在する部屋やプレイヤーを数える間隔
+	Interval time.Duration
+}
+
+// Report : 集計結果
+type Report struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+
+	Concurrency []*Concurrency `json:"concurrency"`
+	Sessions    *Stats         `json:"sessions"`
+	Reconnects  []*Reconnects  `json:"reconnects"`
+	Lifetimes   []*Lifetimes   `json:"lifetimes"`
+	Abandonment *Abandonment   `json:"abandonment"`
+}
+
+// Concurrency : ある時刻に存在していた部屋とプレイヤーの数
+type Concurrency struct {
+	Time    time.Time `json:"time"`
+	Rooms   int       `json:"rooms"`
+	Players int       `json:"players"`
+}
+
+// Stats : 時間の統計 (秒)
+type Stats struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean_sec"`
+	P50   float64 `json:"p50_sec"`
+	P90   float64 `json:"p90_sec"`
+	Max   float64 `json:"max_sec"`
+}
+
+// Reconnects : プレイヤーごとの再接続の回数.
+// Attachは最初の接続でも記録されるので、セッションごとに2回目以降のAttachとRejoinを再接続として数える
+type Reconnects struct {
+	PlayerID   string `json:"player_id"`
+	Sessions   int    `json:"sessions"`
+	Attaches   int    `json:"attaches"`
+	Detaches   int    `json:"detaches"`
+	Reconnects int    `json:"reconnects"`
+}
+
+// Lifetimes : search_groupごとの部屋の存続時間.
+// Bucketsの要素数は len(LifetimeBuckets)+1 で、i番目は LifetimeBuckets[i-1] 以上 LifetimeBuckets[i] 未満
+type Lifetimes struct {
+	SearchGroup uint32 `json:"search_group"`
+	Stats
+	Buckets []int `json:"buckets"`
+}
+
+// Abandonment : 途中で放棄された部屋やセッションの割合.
+//   - 放棄された部屋: 作成したプレイヤー以外が入室しないまま終了した部屋
+//   - 放棄されたセッション: 他のプレイヤーが残っているうちに退室したセッション
+type Abandonment struct {
+	Rooms             int     `json:"rooms"`
+	AbandonedRooms    int     `json:"abandoned_rooms"`
+	RoomRate          float64 `json:"room_rate"`
+	Sessions          int     `json:"sessions"`
+	AbandonedSessions int     `json:"abandoned_sessions"`
+	SessionRate       float64 `json:"session_rate"`
+}
+
+// session : 1人のプレイヤーが部屋に入室してから退室するまで
+type session struct {
+	playerID  string
+	start     time.Time
+	end       time.Time
+	attaches  int
+	detaches  int
+	rejoins   int
+	abandoned bool
+}
+
+// Load : 期間内に存在していた部屋の履歴と入退室の記録を読み込む. appIdが空なら全てのapp
+func Load(ctx context.Context, store storage.AdminStorage, appId string, from, to time.Time) ([]*storage.RoomHistory, []*storage.PlayerLog, error) {
+	histories, err := store.RoomHistories(ctx, &storage.RoomHistoryFilter{
+		AppId:         appId,
+		CreatedBefore: &to,
+		ClosedAfter:   &from,
+	})
+	if err != nil {
+		return nil, nil, xerrors.Errorf("room histories: %w", err)
+	}
+
+	plogs := []*storage.PlayerLog{}
+	for i := 0; i < len(histories); i += playerLogChunk {
+		end := i + playerLogChunk
+		if end > len(histories) {
+			end = len(histories)
+		}
+		ids := make([]string, 0, end-i)
+		for _, h := range histories[i:end] {
+			ids = append(ids, h.RoomID)
+		}
+		l, err := store.PlayerLogs(ctx, ids)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("player logs: %w", err)
+		}
+		plogs = append(plogs, l...)
+	}
+	return histories, plogs, nil
+}
+
+// Analyze : 部屋の履歴と入退室の記録を集計する.
+// plogsは部屋ごとに記録順に並んでいること (see: storage.AdminStorage.PlayerLogs)
+func Analyze(histories []*storage.RoomHistory, plogs []*storage.PlayerLog, opt *Options) *Report {
+	rooms := make(map[string]*storage.RoomHistory, len(histories))
+	for _, h := range histories {
+		rooms[h.RoomID] = h
+	}
+	roomLogs := make(map[string][]*storage.PlayerLog, len(histories))
+	for _, l := range plogs {
+		if _, ok := rooms[l.RoomID]; ok {
+			roomLogs[l.RoomID] = append(roomLogs[l.RoomID], l)
+		}
+	}
+
+	var sessions []*session
+	abandonment := &Abandonment{Rooms: len(histories)}
+	for _, h := range histories {
+		ss := buildSessions(roomLogs[h.RoomID], h.Closed)
+		sessions = append(sessions, ss...)
+
+		players := make(map[string]bool)
+		for _, s := range ss {
+			players[s.playerID] = true
+		}
+		if len(players) <= 1 {
+			abandonment.AbandonedRooms++
+		}
+	}
+	abandonment.Sessions = len(sessions)
+	for _, s := range sessions {
+		if s.abandoned {
+			abandonment.AbandonedSessions++
+		}
+	}
+	abandonment.RoomRate = rate(abandonment.AbandonedRooms, abandonment.Rooms)
+	abandonment.SessionRate = rate(abandonment.AbandonedSessions, abandonment.Sessions)
+
+	return &Report{
+		From:        opt.From,
+		To:          opt.To,
+		Concurrency: concurrency(histories, sessions, opt),
+		Sessions:    sessionStats(sessions),
+		Reconnects:  reconnects(sessions),
+		Lifetimes:   lifetimes(histories),
+		Abandonment: abandonment,
+	}
+}
+
+// buildSessions : 1つの部屋の入退室の記録をセッションにする
+func buildSessions(plogs []*storage.PlayerLog, closed time.Time) []*session {
+	var sessions []*session
+	open := make(map[string]*session)
+	for _, l := range plogs {
+		s := open[l.PlayerID]
+		switch l.Message {
+		case msgCreate, msgJoin, msgRejoin:
+			if s != nil {
+				s.rejoins++
+				continue
+			}
+			s = &session{playerID: l.PlayerID, start: l.Datetime}
+			open[l.PlayerID] = s
+			sessions = append(sessions, s)
+		case msgAttach:
+			if s != nil {
+				s.attaches++
+			}
+		case msgDetach:
+			if s != nil {
+				s.detaches++
+			}
+		case msgLeave:
+			if s == nil {
+				continue
+			}
+			s.end = l.Datetime
+			delete(open, l.PlayerID)
+			s.abandoned = len(open) > 0
+		}
+	}
+	for _, s := range open {
+		s.end = closed
+	}
+	return sessions
+}
+
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// concurrency : From から Interval ごとに、その時刻に存在していた部屋とプレイヤーを数える
+func concurrency(histories []*storage.RoomHistory, sessions []*session, opt *Options) []*Concurrency {
+	if opt.Interval <= 0 || !opt.From.Before(opt.To) {
+		return []*Concurrency{}
+	}
+	var times []time.Time
+	for t := opt.From; t.Before(opt.To); t = t.Add(opt.Interval) {
+		times = append(times, t)
+	}
+
+	roomSpans := make([]span, len(histories))
+	for i, h := range histories {
+		roomSpans[i] = span{h.Created, h.Closed}
+	}
+	sessionSpans := make([]span, len(sessions))
+	for i, s := range sessions {
+		sessionSpans[i] = span{s.start, s.end}
+	}
+	rooms := countAt(roomSpans, times)
+	players := countAt(sessionSpans, times)
+
+	cs := make([]*Concurrency, len(times))
+	for i, t := range times {
+		cs[i] = &Concurrency{Time: t, Rooms: rooms[i], Players: players[i]}
+	}
+	return cs
+}
+
+// span : [start, end)
+type span struct {
+	start, end time.Time
+}
+
+// countAt : 昇順のtimesそれぞれについて、その時刻を含むspanの数
+func countAt(spans []span, times []time.Time) []int {
+	starts := make([]time.Time, len(spans))
+	ends := make([]time.Time, len(spans))
+	for i, s := range spans {
+		starts[i], ends[i] = s.start, s.end
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	sort.Slice(ends, func(i, j int) bool { return ends[i].Before(ends[j]) })
+
+	counts := make([]int, len(times))
+	si, ei := 0, 0
+	for i, t := range times {
+		for si < len(starts) && !starts[si].After(t) {
+			si++
+		}
+		for ei < len(ends) && !ends[ei].After(t) {
+			ei++
+		}
+		counts[i] = si - ei
+	}
+	return counts
+}
+
+func sessionStats(sessions []*session) *Stats {
+	ds := make([]time.Duration, 0, len(sessions))
+	for _, s := range sessions {
+		ds = append(ds, s.end.Sub(s.start))
+	}
+	return newStats(ds)
+}
+
+func newStats(ds []time.Duration) *Stats {
+	st := &Stats{Count: len(ds)}
+	if len(ds) == 0 {
+		return st
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	st.Mean = (sum / time.Duration(len(ds))).Seconds()
+	st.P50 = percentile(ds, 50).Seconds()
+	st.P90 = percentile(ds, 90).Seconds()
+	st.Max = ds[len(ds)-1].Seconds()
+	return st
+}
+
+// percentile : 昇順のdsのpパーセンタイル (nearest-rank)
+func percentile(ds []time.Duration, p int) time.Duration {
+	n := (len(ds)*p + 99) / 100
+	if n < 1 {
+		n = 1
+	}
+	return ds[n-1]
+}
+
+func reconnects(sessions []*session) []*Reconnects {
+	m := make(map[string]*Reconnects)
+	for _, s := range sessions {
+		r, ok := m[s.playerID]
+		if !ok {
+			r = &Reconnects{PlayerID: s.playerID}
+			m[s.playerID] = r
+		}
+		r.Sessions++
+		r.Attaches += s.attaches
+		r.Detaches += s.detaches
+		r.Reconnects += s.rejoins
+		if s.attaches > 1 {
+			r.Reconnects += s.attaches - 1
+		}
+	}
+
+	rs := make([]*Reconnects, 0, len(m))
+	for _, r := range m {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Reconnects != rs[j].Reconnects {
+			return rs[i].Reconnects > rs[j].Reconnects
+		}
+		return rs[i].PlayerID < rs[j].PlayerID
+	})
+	return rs
+}
+
+func lifetimes(histories []*storage.RoomHistory) []*Lifetimes {
+	groups := make(map[uint32][]time.Duration)
+	for _, h := range histories {
+		groups[h.SearchGroup] = append(groups[h.SearchGroup], h.Closed.Sub(h.Created))
+	}
+
+	ls := make([]*Lifetimes, 0, len(groups))
+	for g, ds := range groups {
+		l := &Lifetimes{
+			SearchGroup: g,
+			Buckets:     make([]int, len(LifetimeBuckets)+1),
+		}
+		for _, d := range ds {
+			l.Buckets[sort.Search(len(LifetimeBuckets), func(i int) bool { return d < LifetimeBuckets[i] })]++
+		}
+		l.Stats = *newStats(ds)
+		ls = append(ls, l)
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].SearchGroup < ls[j].SearchGroup })
+	return ls
+}
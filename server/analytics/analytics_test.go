@@ -0,0 +1,192 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"wsnet2/pb"
+	"wsnet2/storage"
+)
+
+var base = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func at(min int) time.Time {
+	return base.Add(time.Duration(min) * time.Minute)
+}
+
+func plog(room, player, msg string, min int) *storage.PlayerLog {
+	return &storage.PlayerLog{RoomID: room, PlayerID: player, Message: msg, Datetime: at(min)}
+}
+
+func testData() ([]*storage.RoomHistory, []*storage.PlayerLog) {
+	histories := []*storage.RoomHistory{
+		{AppID: "app1", RoomID: "room1", SearchGroup: 1, Created: at(0), Closed: at(30)},
+		{AppID: "app1", RoomID: "room2", SearchGroup: 1, Created: at(10), Closed: at(12)},
+		{AppID: "app1", RoomID: "room3", SearchGroup: 2, Created: at(20), Closed: at(120)},
+	}
+	plogs := []*storage.PlayerLog{
+		// room1: p1とp2. p2は途中で再接続し、p1より先に退室
+		plog("room1", "p1", msgCreate, 0),
+		plog("room1", "p1", msgAttach, 0),
+		plog("room1", "p2", msgJoin, 5),
+		plog("room1", "p2", msgAttach, 5),
+		plog("room1", "p2", msgDetach, 8),
+		plog("room1", "p2", msgAttach, 9),
+		plog("room1", "p2", msgRejoin, 10),
+		plog("room1", "p2", msgLeave, 15),
+		plog("room1", "p1", msgLeave, 30),
+		// room2: p3だけで終了
+		plog("room2", "p3", msgCreate, 10),
+		plog("room2", "p3", msgAttach, 10),
+		plog("room2", "p3", msgLeave, 12),
+		// room3: Leaveが記録されないまま終了
+		plog("room3", "p1", msgCreate, 20),
+		plog("room3", "p1", msgAttach, 20),
+		plog("room3", "p3", msgJoin, 40),
+		plog("room3", "p3", msgAttach, 40),
+		// 対象外の部屋
+		plog("room9", "p9", msgCreate, 0),
+	}
+	return histories, plogs
+}
+
+func TestAnalyze(t *testing.T) {
+	histories, plogs := testData()
+	r := Analyze(histories, plogs, &Options{From: at(0), To: at(60), Interval: 10 * time.Minute})
+
+	wantConc := [][2]int{ // rooms, players
+		{1, 1}, // 0
+		{2, 3}, // 10: room1(p1,p2), room2(p3)
+		{2, 2}, // 20: room1(p1), room3(p1)
+		{1, 1}, // 30: room3(p1)
+		{1, 2}, // 40
+		{1, 2}, // 50
+	}
+	if len(r.Concurrency) != len(wantConc) {
+		t.Fatalf("len(Concurrency) = %v, want %v", len(r.Concurrency), len(wantConc))
+	}
+	for i, c := range r.Concurrency {
+		if !c.Time.Equal(at(i*10)) || c.Rooms != wantConc[i][0] || c.Players != wantConc[i][1] {
+			t.Errorf("Concurrency[%v] = %+v, want %v %v", i, c, at(i*10), wantConc[i])
+		}
+	}
+
+	// sessions: 30m, 10m, 2m, 100m, 80m
+	wantSessions := Stats{Count: 5, Mean: 2664, P50: 1800, P90: 6000, Max: 6000}
+	if *r.Sessions != wantSessions {
+		t.Errorf("Sessions = %+v, want %+v", r.Sessions, wantSessions)
+	}
+
+	wantReconnects := []Reconnects{
+		{PlayerID: "p2", Sessions: 1, Attaches: 2, Detaches: 1, Reconnects: 2},
+		{PlayerID: "p1", Sessions: 2, Attaches: 2},
+		{PlayerID: "p3", Sessions: 2, Attaches: 2},
+	}
+	if len(r.Reconnects) != len(wantReconnects) {
+		t.Fatalf("Reconnects = %v", r.Reconnects)
+	}
+	for i, rc := range r.Reconnects {
+		if *rc != wantReconnects[i] {
+			t.Errorf("Reconnects[%v] = %+v, want %+v", i, rc, wantReconnects[i])
+		}
+	}
+
+	if len(r.Lifetimes) != 2 {
+		t.Fatalf("Lifetimes = %v", r.Lifetimes)
+	}
+	if l := r.Lifetimes[0]; l.SearchGroup != 1 || l.Count != 2 || l.Max != 1800 ||
+		!equalInts(l.Buckets, []int{0, 1, 0, 0, 1, 0, 0}) {
+		t.Errorf("Lifetimes[0] = %+v", l)
+	}
+	if l := r.Lifetimes[1]; l.SearchGroup != 2 || l.Count != 1 ||
+		!equalInts(l.Buckets, []int{0, 0, 0, 0, 0, 1, 0}) {
+		t.Errorf("Lifetimes[1] = %+v", l)
+	}
+
+	a := r.Abandonment
+	if a.Rooms != 3 || a.AbandonedRooms != 1 || a.Sessions != 5 || a.AbandonedSessions != 1 {
+		t.Errorf("Abandonment = %+v", a)
+	}
+	if a.RoomRate != 1.0/3 || a.SessionRate != 0.2 {
+		t.Errorf("Abandonment rates = %v, %v", a.RoomRate, a.SessionRate)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemory(&pb.App{Id: "app1", Key: "key1"})
+	histories, plogs := testData()
+	for _, h := range histories {
+		if err := s.InsertRoomHistory(ctx, h); err != nil {
+			t.Fatalf("InsertRoomHistory: %+v", err)
+		}
+	}
+	for _, l := range plogs {
+		if err := s.InsertPlayerLog(ctx, l); err != nil {
+			t.Fatalf("InsertPlayerLog: %+v", err)
+		}
+	}
+
+	hs, ls, err := Load(ctx, s, "app1", at(25), at(60))
+	if err != nil {
+		t.Fatalf("Load: %+v", err)
+	}
+	if len(hs) != 2 {
+		t.Fatalf("histories = %v", hs)
+	}
+	for _, l := range ls {
+		if l.RoomID != "room1" && l.RoomID != "room3" {
+			t.Errorf("unexpected player log: %+v", l)
+		}
+	}
+	if len(ls) != 13 {
+		t.Errorf("len(player logs) = %v, want 13", len(ls))
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	histories, plogs := testData()
+	r := Analyze(histories, plogs, &Options{From: at(0), To: at(20), Interval: 10 * time.Minute})
+
+	tests := map[string]string{
+		"concurrency": "time,rooms,players\n2026-01-01T00:00:00Z,1,1\n2026-01-01T00:10:00Z,2,3\n",
+		"sessions":    "count,mean_sec,p50_sec,p90_sec,max_sec\n5,2664,1800,6000,6000\n",
+		"abandonment": "rooms,abandoned_rooms,room_rate,sessions,abandoned_sessions,session_rate\n3,1,0.3333333333333333,5,1,0.2\n",
+	}
+	for table, want := range tests {
+		var buf bytes.Buffer
+		if err := WriteCSV(&buf, r, table); err != nil {
+			t.Fatalf("WriteCSV(%v): %+v", table, err)
+		}
+		if buf.String() != want {
+			t.Errorf("WriteCSV(%v) =\n%v\nwant\n%v", table, buf.String(), want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, r, "lifetimes"); err != nil {
+		t.Fatalf("WriteCSV(lifetimes): %+v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "search_group,count,mean_sec,p50_sec,p90_sec,max_sec,<1m0s,") {
+		t.Errorf("WriteCSV(lifetimes) =\n%v", buf.String())
+	}
+
+	if err := WriteCSV(&buf, r, "unknown"); err == nil {
+		t.Errorf("WriteCSV(unknown) must fail")
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package analytics
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Tables : CSVで出力できる表の名前
+var Tables = []string{"concurrency", "sessions", "reconnects", "lifetimes", "abandonment"}
+
+// WriteJSON : 集計結果をJSONで出力する
+func WriteJSON(w io.Writer, r *Report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV : 集計結果のうちtableで指定した表をヘッダ付きのCSVで出力する
+func WriteCSV(w io.Writer, r *Report, table string) error {
+	var rows [][]string
+	switch table {
+	case "concurrency":
+		rows = append(rows, []string{"time", "rooms", "players"})
+		for _, c := range r.Concurrency {
+			rows = append(rows, []string{c.Time.Format(time.RFC3339), itoa(c.Rooms), itoa(c.Players)})
+		}
+	case "sessions":
+		rows = append(rows, append([]string{}, statsHeader...))
+		rows = append(rows, statsRow(r.Sessions))
+	case "reconnects":
+		rows = append(rows, []string{"player_id", "sessions", "attaches", "detaches", "reconnects"})
+		for _, c := range r.Reconnects {
+			rows = append(rows, []string{c.PlayerID, itoa(c.Sessions), itoa(c.Attaches), itoa(c.Detaches), itoa(c.Reconnects)})
+		}
+	case "lifetimes":
+		header := append([]string{"search_group"}, statsHeader...)
+		for i := range LifetimeBuckets {
+			header = append(header, "<"+LifetimeBuckets[i].String())
+		}
+		header = append(header, ">="+LifetimeBuckets[len(LifetimeBuckets)-1].String())
+		rows = append(rows, header)
+		for _, l := range r.Lifetimes {
+			row := append([]string{strconv.FormatUint(uint64(l.SearchGroup), 10)}, statsRow(&l.Stats)...)
+			for _, n := range l.Buckets {
+				row = append(row, itoa(n))
+			}
+			rows = append(rows, row)
+		}
+	case "abandonment":
+		a := r.Abandonment
+		rows = append(rows,
+			[]string{"rooms", "abandoned_rooms", "room_rate", "sessions", "abandoned_sessions", "session_rate"},
+			[]string{itoa(a.Rooms), itoa(a.AbandonedRooms), ftoa(a.RoomRate), itoa(a.Sessions), itoa(a.AbandonedSessions), ftoa(a.SessionRate)})
+	default:
+		return xerrors.Errorf("unknown table: %q", table)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(rows); err != nil {
+		return xerrors.Errorf("write csv: %w", err)
+	}
+	return nil
+}
+
+var statsHeader = []string{"count", "mean_sec", "p50_sec", "p90_sec", "max_sec"}
+
+func statsRow(s *Stats) []string {
+	return []string{itoa(s.Count), ftoa(s.Mean), ftoa(s.P50), ftoa(s.P90), ftoa(s.Max)}
+}
+
+func itoa(n int) string {
+	return strconv.Itoa(n)
+}
+
+func ftoa(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,217 @@
+// Package archive : 古いroom_historyとplayer_logを圧縮したNDJSONファイルに書き出して削除する.
+//
+// ファイルはテーブルごとに "<table>-<before>.ndjson.gz" という名前で作成する.
+// バッチごとにファイルへ書き出して同期してから削除するので、途中で中断しても書き出していない行が消えることはない.
+// ただし書き出した後の削除に失敗した行は、次回のアーカイブで別のファイルにも書き出される.
+package archive
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"wsnet2/storage"
+)
+
+const (
+	TableRoomHistory = "room_history"
+	TablePlayerLog   = "player_log"
+
+	fileExt = ".ndjson.gz"
+)
+
+// Options : アーカイブの条件
+type Options struct {
+	// Dir : アーカイブファイルを作成するディレクトリ
+	Dir string
+	// Before : この日時より前の行をアーカイブする
+	Before time.Time
+	// BatchSize : 1回に書き出して削除する行数
+	BatchSize int
+	// Wait : テーブルをロックし続けないようにバッチの間に待つ時間
+	Wait time.Duration
+}
+
+// Result : テーブルごとのアーカイブの結果
+type Result struct {
+	Table string
+	// File : 作成したファイル. 1行もアーカイブしなかったときは空
+	File string
+	Rows int
+}
+
+// Archive : room_historyとplayer_logをアーカイブする.
+// エラーのときもそれまでの結果を返す
+func Archive(ctx context.Context, store storage.AdminStorage, opt *Options) ([]*Result, error) {
+	if opt.BatchSize <= 0 {
+		return nil, xerrors.Errorf("invalid batch size: %v", opt.BatchSize)
+	}
+
+	results := make([]*Result, 0, 2)
+	res, err := archiveTable(ctx, TableRoomHistory, opt, store.ArchiveRoomHistories)
+	results = append(results, res)
+	if err != nil {
+		return results, err
+	}
+	res, err = archiveTable(ctx, TablePlayerLog, opt, store.ArchivePlayerLogs)
+	results = append(results, res)
+	return results, err
+}
+
+// FileName : アーカイブファイルの名前
+func FileName(table string, before time.Time) string {
+	return table + "-" + before.UTC().Format("20060102T150405Z") + fileExt
+}
+
+// TableOf : アーカイブファイルの名前からテーブル名を得る
+func TableOf(path string) (string, error) {
+	name := filepath.Base(path)
+	for _, t := range []string{TableRoomHistory, TablePlayerLog} {
+		if strings.HasPrefix(name, t+"-") {
+			return t, nil
+		}
+	}
+	return "", xerrors.Errorf("unknown archive file: %v", path)
+}
+
+type archiveFunc[T any] func(ctx context.Context, before time.Time, limit int, archive func([]T) error) (int, error)
+
+func archiveTable[T any](ctx context.Context, table string, opt *Options, archive archiveFunc[T]) (res *Result, err error) {
+	res = &Result{Table: table}
+	var w *writer
+	defer func() {
+		if w == nil {
+			return
+		}
+		if e := w.close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	for {
+		n, err := archive(ctx, opt.Before, opt.BatchSize, func(rows []T) error {
+			if w == nil {
+				var err error
+				w, err = create(filepath.Join(opt.Dir, FileName(table, opt.Before)))
+				if err != nil {
+					return err
+				}
+				res.File = w.path
+			}
+			return writeRows(w, rows)
+		})
+		res.Rows += n
+		if err != nil {
+			return res, xerrors.Errorf("archive %v: %w", table, err)
+		}
+		if n < opt.BatchSize {
+			return res, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-time.After(opt.Wait):
+		}
+	}
+}
+
+// writer : gzip圧縮したNDJSONファイル
+type writer struct {
+	path string
+	f    *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+func create(path string) (*writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, xerrors.Errorf("create archive file: %w", err)
+	}
+	gz := gzip.NewWriter(f)
+	return &writer{
+		path: path,
+		f:    f,
+		gz:   gz,
+		enc:  json.NewEncoder(gz),
+	}, nil
+}
+
+// writeRows : 削除する前に確実にファイルに残すため、書き出すたびにディスクまで同期する
+func writeRows[T any](w *writer, rows []T) error {
+	for _, r := range rows {
+		if err := w.enc.Encode(r); err != nil {
+			return xerrors.Errorf("encode: %w", err)
+		}
+	}
+	if err := w.gz.Flush(); err != nil {
+		return xerrors.Errorf("flush: %w", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return xerrors.Errorf("sync: %w", err)
+	}
+	return nil
+}
+
+func (w *writer) close() error {
+	if err := w.gz.Close(); err != nil {
+		w.f.Close()
+		return xerrors.Errorf("close gzip: %w", err)
+	}
+	if err := w.f.Close(); err != nil {
+		return xerrors.Errorf("close file: %w", err)
+	}
+	return nil
+}
+
+// Restore : アーカイブファイルの行をテーブルに書き戻し、書き戻した行数を返す.
+// 調査用に本番とは別のDBへ書き戻すことを想定している
+func Restore(ctx context.Context, store storage.RoomStorage, path string) (int, error) {
+	table, err := TableOf(path)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, xerrors.Errorf("open archive file: %w", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, xerrors.Errorf("gzip: %w", err)
+	}
+	dec := json.NewDecoder(gz)
+
+	switch table {
+	case TableRoomHistory:
+		return restoreRows(ctx, dec, store.InsertRoomHistory)
+	default:
+		return restoreRows(ctx, dec, store.InsertPlayerLog)
+	}
+}
+
+func restoreRows[T any](ctx context.Context, dec *json.Decoder, insert func(context.Context, *T) error) (int, error) {
+	n := 0
+	for {
+		var row T
+		err := dec.Decode(&row)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, xerrors.Errorf("decode line %v: %w", n+1, err)
+		}
+		if err := insert(ctx, &row); err != nil {
+			return n, xerrors.Errorf("insert line %v: %w", n+1, err)
+		}
+		n++
+	}
+}
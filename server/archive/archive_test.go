@@ -0,0 +1,94 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"wsnet2/pb"
+	"wsnet2/storage"
+)
+
+func TestArchiveAndRestore(t *testing.T) {
+	ctx := context.Background()
+	base := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	src := storage.NewMemory(&pb.App{Id: "app1", Key: "key1"})
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("room%d", i)
+		created := base.Add(time.Duration(i) * 24 * time.Hour)
+		src.InsertRoomHistory(ctx, &storage.RoomHistory{
+			AppID: "app1", HostID: 1, RoomID: id, PublicProps: []byte{byte(i)}, Created: created, Closed: created.Add(time.Hour),
+		})
+		src.InsertPlayerLog(ctx, &storage.PlayerLog{RoomID: id, PlayerID: "p1", Message: "Create", Datetime: created})
+		src.InsertPlayerLog(ctx, &storage.PlayerLog{RoomID: id, PlayerID: "p1", Message: "Leave", Datetime: created.Add(time.Minute)})
+	}
+
+	dir := t.TempDir()
+	opt := &Options{
+		Dir:       dir,
+		Before:    base.Add(3 * 24 * time.Hour),
+		BatchSize: 2,
+		Wait:      time.Millisecond,
+	}
+	results, err := Archive(ctx, src, opt)
+	if err != nil {
+		t.Fatalf("Archive: %+v", err)
+	}
+	wants := []*Result{
+		{Table: TableRoomHistory, File: filepath.Join(dir, "room_history-20230404T120000Z.ndjson.gz"), Rows: 3},
+		{Table: TablePlayerLog, File: filepath.Join(dir, "player_log-20230404T120000Z.ndjson.gz"), Rows: 6},
+	}
+	for i, r := range results {
+		if *r != *wants[i] {
+			t.Errorf("results[%v] = %+v, wants %+v", i, r, wants[i])
+		}
+	}
+
+	hs, _ := src.RoomHistories(ctx, &storage.RoomHistoryFilter{})
+	if len(hs) != 2 {
+		t.Fatalf("remaining histories: %v", hs)
+	}
+
+	// 対象がなければファイルを作らない
+	results, err = Archive(ctx, src, opt)
+	if err != nil {
+		t.Fatalf("Archive: %+v", err)
+	}
+	for _, r := range results {
+		if r.File != "" || r.Rows != 0 {
+			t.Errorf("result = %+v, wants empty", r)
+		}
+	}
+
+	dst := storage.NewMemory(&pb.App{Id: "app1", Key: "key1"})
+	for i, w := range wants {
+		n, err := Restore(ctx, dst, w.File)
+		if err != nil {
+			t.Fatalf("Restore(%v): %+v", w.File, err)
+		}
+		if n != w.Rows {
+			t.Errorf("Restore(%v) = %v, wants %v", i, n, w.Rows)
+		}
+	}
+	hs, _ = dst.RoomHistories(ctx, &storage.RoomHistoryFilter{})
+	if len(hs) != 3 || hs[0].RoomID != "room2" || hs[0].PublicProps[0] != 2 || !hs[0].Closed.Equal(base.Add(48*time.Hour+time.Hour)) {
+		t.Fatalf("restored histories: %v", hs)
+	}
+	ls, _ := dst.PlayerLogs(ctx, []string{"room0", "room1", "room2"})
+	if len(ls) != 6 || ls[1].Message != "Leave" || !ls[1].Datetime.Equal(base.Add(time.Minute)) {
+		t.Fatalf("restored player logs: %v", ls)
+	}
+}
+
+func TestRestoreUnknownFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "room-20230401T000000Z.ndjson.gz")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(context.Background(), storage.NewMemory(&pb.App{}), path); err == nil {
+		t.Fatalf("Restore must fail")
+	}
+}
@@ -5,16 +5,80 @@ import (
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
 	"hash"
+	"strconv"
 	"strings"
 
 	"golang.org/x/xerrors"
 )
 
+// MACScheme : Msgのメッセージ認証方式
+type MACScheme uint32
+
+const (
+	// MACSchemeSHA1 : HMAC-SHA1 (従来方式)
+	MACSchemeSHA1 MACScheme = iota
+
+	// MACSchemeSHA256 : HMAC-SHA256.
+	// 接続毎のnonceと送信フレーム番号をMACに含め、再接続を跨いだリプレイを防ぐ.
+	MACSchemeSHA256
+)
+
+// macSchemePrefix : 暗号化前のMACKeyに付与して方式を伝える.
+// MACKeyはbase64なので':'を含まない.
+var macSchemePrefix = map[MACScheme]string{
+	MACSchemeSHA256: "sha256:",
+}
+
+func (s MACScheme) String() string {
+	switch s {
+	case MACSchemeSHA1:
+		return "sha1"
+	case MACSchemeSHA256:
+		return "sha256"
+	}
+	return "MACScheme(" + strconv.Itoa(int(s)) + ")"
+}
+
+// NewMsgHMAC returns the hash for the Msg authentication.
+func NewMsgHMAC(scheme MACScheme, macKey string) (hash.Hash, error) {
+	switch scheme {
+	case MACSchemeSHA1:
+		return hmac.New(sha1.New, []byte(macKey)), nil
+	case MACSchemeSHA256:
+		return hmac.New(sha256.New, []byte(macKey)), nil
+	}
+	return nil, xerrors.Errorf("unknown mac scheme: %v", scheme)
+}
+
 // DecryptMACKey decodes a MACKey
 func DecryptMACKey(appKey, encMKey string) (string, error) {
+	key, _, err := DecryptMACKeyWithScheme(appKey, encMKey)
+	return key, err
+}
+
+// DecryptMACKeyWithScheme decodes a MACKey and the MACScheme requested by the client.
+// 方式の指定がないMACKeyはMACSchemeSHA1とみなす.
+func DecryptMACKeyWithScheme(appKey, encMKey string) (string, MACScheme, error) {
+	key, err := decryptMACKey(appKey, encMKey)
+	if err != nil {
+		return "", 0, err
+	}
+	for scheme, prefix := range macSchemePrefix {
+		if k, ok := strings.CutPrefix(key, prefix); ok {
+			return k, scheme, nil
+		}
+	}
+	if strings.Contains(key, ":") {
+		return "", 0, xerrors.Errorf("unknown mac scheme: %q", key[:strings.Index(key, ":")])
+	}
+	return key, MACSchemeSHA1, nil
+}
+
+func decryptMACKey(appKey, encMKey string) (string, error) {
 	data, err := base64.StdEncoding.DecodeString(encMKey)
 	if err != nil {
 		return "", err
@@ -40,6 +104,16 @@ func DecryptMACKey(appKey, encMKey string) (string, error) {
 
 // EncryptMAckey encrypts macKey and returns base64 string
 func EncryptMACKey(appKey, macKey string) (string, error) {
+	return EncryptMACKeyWithScheme(appKey, macKey, MACSchemeSHA1)
+}
+
+// EncryptMACKeyWithScheme encrypts macKey with the requested MACScheme and returns base64 string
+func EncryptMACKeyWithScheme(appKey, macKey string, scheme MACScheme) (string, error) {
+	if _, ok := macSchemePrefix[scheme]; !ok && scheme != MACSchemeSHA1 {
+		return "", xerrors.Errorf("unknown mac scheme: %v", scheme)
+	}
+	macKey = macSchemePrefix[scheme] + macKey
+
 	ckey := sha256.Sum256([]byte(appKey))
 	b, err := aes.NewCipher(ckey[:])
 	if err != nil {
@@ -70,15 +144,27 @@ func EncryptMACKey(appKey, macKey string) (string, error) {
 
 // ValidateMsgHMAC validates the hmac of a websocket message.
 func ValidateMsgHMAC(mac hash.Hash, data []byte) ([]byte, bool) {
+	return ValidateMsgHMACWithBinding(mac, nil, data)
+}
+
+// ValidateMsgHMACWithBinding validates the hmac of a websocket message calculated with the binding.
+func ValidateMsgHMACWithBinding(mac hash.Hash, binding, data []byte) ([]byte, bool) {
 	dlen := len(data) - mac.Size()
 	if dlen < 0 {
 		return nil, false
 	}
 	data, h := data[:dlen], data[dlen:]
-	return data, hmac.Equal(h, CalculateMsgHMAC(mac, data))
+	return data, hmac.Equal(h, CalculateMsgHMACWithBinding(mac, binding, data))
 }
 
 func CalculateMsgHMAC(mac hash.Hash, data []byte) []byte {
+	return CalculateMsgHMACWithBinding(mac, nil, data)
+}
+
+// CalculateMsgHMACWithBinding calculates the hmac of binding+data.
+// bindingはフレームには含めず、送受信の双方が同じ値を持つ.
+func CalculateMsgHMACWithBinding(mac hash.Hash, binding, data []byte) []byte {
+	mac.Write(binding)
 	mac.Write(data)
 	defer mac.Reset()
 	return mac.Sum(nil)
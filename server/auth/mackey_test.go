@@ -20,3 +20,54 @@ func TestMACKey(t *testing.T) {
 		t.Fatalf("decrypted = %q, wants %q", r, mackey)
 	}
 }
+
+func TestMACKeyWithScheme(t *testing.T) {
+	appkey := "testkey3"
+	mackey := GenMACKey()
+
+	for _, scheme := range []MACScheme{MACSchemeSHA1, MACSchemeSHA256} {
+		encMkey, err := EncryptMACKeyWithScheme(appkey, mackey, scheme)
+		if err != nil {
+			t.Fatalf("EncryptMACKeyWithScheme(%v): %v", scheme, err)
+		}
+
+		r, s, err := DecryptMACKeyWithScheme(appkey, encMkey)
+		if err != nil {
+			t.Fatalf("DecryptMACKeyWithScheme(%v): %v", scheme, err)
+		}
+		if r != mackey || s != scheme {
+			t.Fatalf("decrypted = (%q, %v), wants (%q, %v)", r, s, mackey, scheme)
+		}
+	}
+
+	if _, err := EncryptMACKeyWithScheme(appkey, mackey, MACScheme(99)); err == nil {
+		t.Fatalf("EncryptMACKeyWithScheme(99) must error")
+	}
+	encMkey, _ := EncryptMACKey(appkey, "md5:"+mackey)
+	if _, _, err := DecryptMACKeyWithScheme(appkey, encMkey); err == nil {
+		t.Fatalf("DecryptMACKeyWithScheme(md5) must error")
+	}
+}
+
+func TestMsgHMACWithBinding(t *testing.T) {
+	mac, err := NewMsgHMAC(MACSchemeSHA256, GenMACKey())
+	if err != nil {
+		t.Fatalf("NewMsgHMAC: %v", err)
+	}
+	data := []byte("message")
+	binding := []byte{1, 2, 3, 4}
+
+	frame := append(append([]byte{}, data...), CalculateMsgHMACWithBinding(mac, binding, data)...)
+	if len(frame) != len(data)+32 {
+		t.Fatalf("frame length = %v, wants %v", len(frame), len(data)+32)
+	}
+	if d, ok := ValidateMsgHMACWithBinding(mac, binding, frame); !ok || string(d) != string(data) {
+		t.Fatalf("ValidateMsgHMACWithBinding = (%q, %v)", d, ok)
+	}
+	if _, ok := ValidateMsgHMACWithBinding(mac, []byte{1, 2, 3, 5}, frame); ok {
+		t.Fatalf("ValidateMsgHMACWithBinding with another binding must fail")
+	}
+	if _, ok := ValidateMsgHMAC(mac, frame); ok {
+		t.Fatalf("ValidateMsgHMAC without binding must fail")
+	}
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// RoomKeySize : Targets/Broadcastのpayloadを暗号化する部屋鍵のサイズ (AES-256)
+const RoomKeySize = 32
+
+// GenRoomKey generates a new room key.
+// 部屋鍵はクライアント間でのみ共有し、サーバは暗号文を中継するだけ.
+func GenRoomKey() ([]byte, error) {
+	key := make([]byte, RoomKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, xerrors.Errorf("generate room key: %w", err)
+	}
+	return key, nil
+}
+
+// EncryptPayload encrypts the payload with the room key (AES-256-GCM).
+// format: | nonce (12byte) | ciphertext + tag |
+func EncryptPayload(roomKey, payload []byte) ([]byte, error) {
+	aead, err := newGCM(roomKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(payload)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, xerrors.Errorf("generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, payload, nil), nil
+}
+
+// DecryptPayload decrypts the payload encrypted by EncryptPayload.
+func DecryptPayload(roomKey, data []byte) ([]byte, error) {
+	aead, err := newGCM(roomKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, xerrors.Errorf("data too short: %v", len(data))
+	}
+	ns := aead.NonceSize()
+	p, err := aead.Open(nil, data[:ns], data[ns:], nil)
+	if err != nil {
+		return nil, xerrors.Errorf("decrypt payload: %w", err)
+	}
+	return p, nil
+}
+
+// KeyExchange : 部屋鍵の受け渡しに使うX25519の鍵ペア
+//
+// 公開鍵はClientのpropsなどで他のプレイヤーに公開し、
+// 部屋鍵はSealRoomKeyで相手の公開鍵に向けて暗号化してMsgRoomKeyで送る.
+//
+// 公開鍵はサーバが中継するため、サーバ（またはサーバを乗っ取った者）が自身の公開鍵に
+// 差し替えると部屋鍵を読めてしまう. app keyはサーバも持っているので、app keyでの署名では防げない.
+// サーバを信頼しない場合は、Fingerprintをプレイヤー同士がサーバを介さない手段
+// （画面に表示して見比べるなど）で照合すること.
+type KeyExchange struct {
+	priv *ecdh.PrivateKey
+}
+
+// NewKeyExchange generates a new key pair.
+func NewKeyExchange() (*KeyExchange, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, xerrors.Errorf("generate key: %w", err)
+	}
+	return &KeyExchange{priv}, nil
+}
+
+// PublicKey returns the public key bytes.
+func (k *KeyExchange) PublicKey() []byte {
+	return k.priv.PublicKey().Bytes()
+}
+
+// SealRoomKey encrypts the room key for the owner of peerPub.
+// peerPubが本人のものかは検証しない (see: KeyExchange, Fingerprint).
+func (k *KeyExchange) SealRoomKey(peerPub, roomKey []byte) ([]byte, error) {
+	key, err := k.sharedKey(peerPub)
+	if err != nil {
+		return nil, err
+	}
+	return EncryptPayload(key, roomKey)
+}
+
+// OpenRoomKey decrypts the room key sealed by the owner of peerPub.
+// peerPubが本人のものかは検証しない (see: KeyExchange, Fingerprint).
+func (k *KeyExchange) OpenRoomKey(peerPub, sealed []byte) ([]byte, error) {
+	key, err := k.sharedKey(peerPub)
+	if err != nil {
+		return nil, err
+	}
+	roomKey, err := DecryptPayload(key, sealed)
+	if err != nil {
+		return nil, xerrors.Errorf("open room key: %w", err)
+	}
+	if len(roomKey) != RoomKeySize {
+		return nil, xerrors.Errorf("invalid room key size: %v", len(roomKey))
+	}
+	return roomKey, nil
+}
+
+// Fingerprint returns the fingerprint of the key pair shared with the owner of peerPub.
+// 双方で同じ値になるので、サーバを介さずに照合すれば公開鍵の差し替えを検出できる.
+func (k *KeyExchange) Fingerprint(peerPub []byte) string {
+	return KeyFingerprint(k.PublicKey(), peerPub)
+}
+
+// KeyFingerprint : 2つの公開鍵の組のfingerprint. 引数の順序によらず同じ値になる.
+// format: 4桁の16進数を空白区切りで8組
+func KeyFingerprint(pub1, pub2 []byte) string {
+	if bytes.Compare(pub1, pub2) > 0 {
+		pub1, pub2 = pub2, pub1
+	}
+	h := sha256.New()
+	h.Write(pub1)
+	h.Write(pub2)
+	sum := hex.EncodeToString(h.Sum(nil)[:16])
+	groups := make([]string, 0, len(sum)/4)
+	for i := 0; i < len(sum); i += 4 {
+		groups = append(groups, sum[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+func (k *KeyExchange) sharedKey(peerPub []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid public key: %w", err)
+	}
+	secret, err := k.priv.ECDH(pub)
+	if err != nil {
+		return nil, xerrors.Errorf("ecdh: %w", err)
+	}
+	key := sha256.Sum256(secret)
+	return key[:], nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, xerrors.Errorf("cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, xerrors.Errorf("gcm: %w", err)
+	}
+	return aead, nil
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptPayload(t *testing.T) {
+	key, err := GenRoomKey()
+	if err != nil {
+		t.Fatalf("GenRoomKey: %v", err)
+	}
+	payload := []byte("game data")
+
+	enc, err := EncryptPayload(key, payload)
+	if err != nil {
+		t.Fatalf("EncryptPayload: %v", err)
+	}
+	if bytes.Contains(enc, payload) {
+		t.Fatalf("encrypted data contains the payload: %v", enc)
+	}
+
+	dec, err := DecryptPayload(key, enc)
+	if err != nil {
+		t.Fatalf("DecryptPayload: %v", err)
+	}
+	if !bytes.Equal(dec, payload) {
+		t.Fatalf("decrypted = %q, wants %q", dec, payload)
+	}
+
+	enc[len(enc)-1] ^= 1
+	if _, err := DecryptPayload(key, enc); err == nil {
+		t.Fatalf("DecryptPayload of modified data must error")
+	}
+}
+
+func TestSealRoomKey(t *testing.T) {
+	master, _ := NewKeyExchange()
+	player, _ := NewKeyExchange()
+	other, _ := NewKeyExchange()
+	roomKey, _ := GenRoomKey()
+
+	sealed, err := master.SealRoomKey(player.PublicKey(), roomKey)
+	if err != nil {
+		t.Fatalf("SealRoomKey: %v", err)
+	}
+
+	k, err := player.OpenRoomKey(master.PublicKey(), sealed)
+	if err != nil {
+		t.Fatalf("OpenRoomKey: %v", err)
+	}
+	if !bytes.Equal(k, roomKey) {
+		t.Fatalf("opened key = %x, wants %x", k, roomKey)
+	}
+
+	if _, err := other.OpenRoomKey(master.PublicKey(), sealed); err == nil {
+		t.Fatalf("OpenRoomKey by other must error")
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	master, _ := NewKeyExchange()
+	player, _ := NewKeyExchange()
+	mitm, _ := NewKeyExchange()
+
+	fp := master.Fingerprint(player.PublicKey())
+	if fp2 := player.Fingerprint(master.PublicKey()); fp != fp2 {
+		t.Fatalf("fingerprints differ: %q, %q", fp, fp2)
+	}
+	if len(fp) != 39 {
+		t.Fatalf("fingerprint format: %q", fp)
+	}
+
+	// 公開鍵が差し替えられていれば一致しない
+	if fp2 := player.Fingerprint(mitm.PublicKey()); fp == fp2 {
+		t.Fatalf("fingerprint with substituted key must differ: %q", fp2)
+	}
+}
@@ -1,6 +1,8 @@
 package binary
 
 import (
+	"time"
+
 	"wsnet2/pb"
 
 	"golang.org/x/xerrors"
@@ -14,9 +16,22 @@ const responseEvType = 128
 const (
 	// NewEvPeerReady : Peer準備完了イベント
 	// payload:
-	// | 24bit-be msg sequence number |
+	// | 24bit-be msg sequence number | (64bit nonce: auth.MACSchemeSHA256のみ) |
 	EvTypePeerReady EvType = 1 + iota
 	EvTypePong
+
+	// EvTypeRewatch : hubが停止するので、lobbyから観戦し直すよう通知する
+	// ProtocolVersion2以上のクライアントにのみ送信される.
+	// payload:
+	//  - UInt: grace period (seconds). 経過するとhubから切断される
+	EvTypeRewatch
+
+	// EvTypeEventGap : hubとgameの接続が切れていた間のイベントが届かなかった
+	// hubは部屋の状態を取り直しているが、観戦者の部屋の状態はずれている可能性がある.
+	// 正確な状態が必要ならlobbyから観戦し直す.
+	// ProtocolVersion2以上のクライアントにのみ送信される.
+	// payload: (empty)
+	EvTypeEventGap
 )
 const (
 	// EvTypeJoined : クライアントが入室した
@@ -61,6 +76,36 @@ const (
 	//  - str8: client ID
 	//  - Dict: properties
 	EvTypeRejoined
+
+	// EvTypeWatcherMessage : 観戦者同士のチャット
+	// ProtocolVersion2以上の観戦者にのみ送信される.
+	// payload: EvTypeMessageと同じ (see: UnmarshalEvMessage)
+	//  - str8: sender client ID
+	//  - marshaled data...
+	EvTypeWatcherMessage
+
+	// EvTypeRoomState : 部屋の状態 (room state) の更新
+	// ProtocolVersion2以上のクライアントにのみ送信される.
+	// payload:
+	//  - Dict: state (modified keys only. 空の値はキーの削除)
+	EvTypeRoomState
+
+	// EvTypeTopicMessage : トピック付きのBroadcast
+	// ProtocolVersion2以上のクライアントにのみ送信される.
+	// それ以外のクライアントにはEvTypeMessageとして送信される.
+	// payload:
+	//  - str8: topic
+	//  - str8: sender client ID
+	//  - marshaled data...
+	EvTypeTopicMessage
+
+	// EvTypeRoomKey : 他のプレイヤーから暗号化された部屋鍵が届いた
+	// 再接続中に届いても失われないようRegularEventとしてバッファする.
+	// ProtocolVersion2以上のクライアントにのみ送信される.
+	// payload:
+	//  - str8: sender client ID
+	//  - sealed room key (see: auth.KeyExchange)
+	EvTypeRoomKey
 )
 const (
 	// EvTypeSucceeded:
@@ -179,6 +224,20 @@ func NewEvPeerReady(seqNum int) *SystemEvent {
 	}
 }
 
+// NewEvPeerReadyWithNonce : MsgMACBindingのnonceを含むPeer準備完了イベント
+// auth.MACSchemeSHA256のクライアントに送る.
+// payload:
+// | 24bit-be msg sequence number | 64bit nonce |
+func NewEvPeerReadyWithNonce(seqNum int, nonce []byte) *SystemEvent {
+	payload := make([]byte, 3+len(nonce))
+	put24(payload, int64(seqNum))
+	copy(payload[3:], nonce)
+	return &SystemEvent{
+		etype:   EvTypePeerReady,
+		payload: payload,
+	}
+}
+
 func UnmarshalEvPeerReadyPayload(payload []byte) (int, error) {
 	if len(payload) < 3 {
 		return 0, xerrors.Errorf("data length not enough: %v", len(payload))
@@ -187,6 +246,56 @@ func UnmarshalEvPeerReadyPayload(payload []byte) (int, error) {
 	return get24(payload), nil
 }
 
+// UnmarshalEvPeerReadyNonce returns the nonce for MsgMACBinding.
+func UnmarshalEvPeerReadyNonce(payload []byte) ([]byte, error) {
+	if len(payload) != 3+MsgMACBindingNonceSize {
+		return nil, xerrors.Errorf("invalid data length: %v", len(payload))
+	}
+	return payload[3:], nil
+}
+
+// NewEvRoomKey : 部屋鍵イベント
+// サーバは暗号化された部屋鍵を中継するだけで中身は扱わない.
+func NewEvRoomKey(senderId string, sealed []byte) *RegularEvent {
+	payload := MarshalStr8(senderId)
+	payload = append(payload, sealed...)
+	return &RegularEvent{EvTypeRoomKey, payload}
+}
+
+// UnmarshalEvRoomKeyPayload returns the sender id and the sealed room key.
+func UnmarshalEvRoomKeyPayload(payload []byte) (string, []byte, error) {
+	d, l, e := UnmarshalAs(payload, TypeStr8)
+	if e != nil {
+		return "", nil, xerrors.Errorf("Invalid EvRoomKey payload (sender id): %w", e)
+	}
+	return d.(string), payload[l:], nil
+}
+
+// NewEvRewatch : hub停止の通知イベント
+func NewEvRewatch(grace time.Duration) *SystemEvent {
+	return &SystemEvent{
+		etype:   EvTypeRewatch,
+		payload: MarshalUInt(int(grace / time.Second)),
+	}
+}
+
+// UnmarshalEvRewatchPayload returns the grace period.
+func UnmarshalEvRewatchPayload(payload []byte) (time.Duration, error) {
+	d, _, err := UnmarshalAs(payload, TypeUInt)
+	if err != nil {
+		return 0, xerrors.Errorf("Invalid EvRewatch payload: %w", err)
+	}
+	return time.Duration(d.(int)) * time.Second, nil
+}
+
+// NewEvEventGap : イベント欠落の通知イベント
+func NewEvEventGap() *SystemEvent {
+	return &SystemEvent{
+		etype:   EvTypeEventGap,
+		payload: []byte{},
+	}
+}
+
 // NewEvPong : Pongイベント
 // payload:
 // - unsigned 64bit-be: timestamp on ping sent.
@@ -423,6 +532,45 @@ func NewEvMessage(cliId string, body []byte) *RegularEvent {
 	return &RegularEvent{EvTypeMessage, payload}
 }
 
+// NewEvRoomState : room stateの更新イベント
+func NewEvRoomState(modified Dict) *RegularEvent {
+	return &RegularEvent{EvTypeRoomState, MarshalDict(modified)}
+}
+
+func UnmarshalEvRoomStatePayload(payload []byte) (Dict, error) {
+	d, _, err := UnmarshalNullDict(payload)
+	if err != nil {
+		return nil, xerrors.Errorf("state: %w", err)
+	}
+	return d, nil
+}
+
+// NewEvWatcherMessage : 観戦者チャットのイベント
+func NewEvWatcherMessage(cliId string, body []byte) *RegularEvent {
+	ev := NewEvMessage(cliId, body)
+	ev.etype = EvTypeWatcherMessage
+	return ev
+}
+
+// NewEvTopicMessage : トピック付きBroadcastのイベント
+func NewEvTopicMessage(topic, cliId string, body []byte) *RegularEvent {
+	payload := make([]byte, 0, len(topic)+len(cliId)+2+len(body))
+	payload = append(payload, MarshalStr8(topic)...)
+	payload = append(payload, MarshalStr8(cliId)...)
+	payload = append(payload, body...)
+	return &RegularEvent{EvTypeTopicMessage, payload}
+}
+
+// UnmarshalEvTopicMessage : EvTypeTopicMessageのpayloadからtopicを取り出す.
+// 残りはEvTypeMessageのpayloadと同じ (see: UnmarshalEvMessage)
+func UnmarshalEvTopicMessage(payload []byte) (topic string, msg []byte, err error) {
+	d, p, e := UnmarshalAs(payload, TypeStr8)
+	if e != nil {
+		return "", nil, xerrors.Errorf("topic: %w", e)
+	}
+	return d.(string), payload[p:], nil
+}
+
 func UnmarshalEvMessage(payload []byte) (cliId string, body []byte, err error) {
 	d, p, e := UnmarshalAs(payload, TypeStr8)
 	if e != nil {
@@ -652,7 +652,11 @@ func MarshalChars(vals []rune) []byte {
 		return MarshalNull()
 	}
 
-	s := utf16.Encode(vals)
+	return marshalCharUnits(utf16.Encode(vals))
+}
+
+// marshalCharUnits marshals UTF-16 code units as Chars.
+func marshalCharUnits(s []uint16) []byte {
 	count := len(s)
 	if count > math.MaxUint16 {
 		count = math.MaxUint16
@@ -669,6 +673,15 @@ func MarshalChars(vals []rune) []byte {
 }
 
 func unmarshalChars(src []byte) ([]rune, int, error) {
+	s, l, err := unmarshalCharUnits(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	return utf16.Decode(s), l, nil
+}
+
+// unmarshalCharUnits unmarshals Chars as UTF-16 code units.
+func unmarshalCharUnits(src []byte) ([]uint16, int, error) {
 	if len(src) < 3 {
 		return nil, 0, xerrors.Errorf("Unmarshal UShorts error: not enough data (%v)", len(src))
 	}
@@ -681,7 +694,7 @@ func unmarshalChars(src []byte) ([]rune, int, error) {
 	for i := 0; i < count; i++ {
 		s[i] = uint16(get16(src[3+i*CharDataSize:]))
 	}
-	return utf16.Decode(s), l, nil
+	return s, l, nil
 }
 
 // MarshalShorts marshals signed 16bit integer array
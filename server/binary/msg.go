@@ -19,10 +19,14 @@ import (
 // - MsgTypePing
 // binary format:
 // | 8bit MsgType | payload ... |
+//
+// 末尾にはHMACが付与される.
+// auth.MACSchemeSHA256では接続毎のbinding (see: MsgMACBinding) を含めて計算する.
 type Msg interface {
 	Type() MsgType
 	Payload() []byte
 	Marshal(hmac hash.Hash) []byte
+	MarshalWithBinding(hmac hash.Hash, binding []byte) []byte
 }
 
 type RegularMsg interface {
@@ -96,8 +100,132 @@ const (
 	// - str8: client id
 	// - string: message
 	MsgTypeKick
+
+	// MsgTypeRoomKey : 暗号化した部屋鍵を特定のプレイヤーに送る
+	// 宛先にはEvTypeRoomKeyとして届く.
+	// payload:
+	// - str8: client id
+	// - sealed room key (see: auth.KeyExchange)
+	MsgTypeRoomKey
+
+	// MsgTypeWatcherChat : 観戦者同士のチャット
+	// 観戦者からのみ有効. gameのプレイヤーには届かず、
+	// 同じhub（またはgameに直接接続している観戦者同士）にEvTypeWatcherMessageとして届く.
+	// 無効な部屋や流量制限を超えたときは送信者にEvTypePermissionDeniedが届く.
+	// payload: marshaled data...
+	MsgTypeWatcherChat
+
+	// MsgTypeScopedBroadcast : 配信先を限定して全員に送信する
+	// MasterClientからのみ有効.
+	// 受信側にはMsgTypeBroadcastと同じくEvTypeMessageとして届く.
+	// payload:
+	// - Byte: scope (see: BroadcastScope)
+	// - marshaled data...
+	MsgTypeScopedBroadcast
+
+	// MsgTypeRoomState : 部屋の状態 (room state) の更新
+	// MasterClientからのみ有効.
+	// room stateはサーバが保持し、入室・観戦時のJoinedRoomResで渡される.
+	// payload:
+	// - Dict: state (modified keys only. 空の値はキーの削除)
+	MsgTypeRoomState
+
+	// MsgTypeTopicBroadcast : トピックを付けて全員に送信する
+	// プレイヤーには常に届き、観戦者には購読しているトピックのものだけ届く.
+	// 受信側にはEvTypeTopicMessageとして届く.
+	// payload:
+	// - str8: topic
+	// - marshaled data...
+	MsgTypeTopicBroadcast
+
+	// MsgTypeSubscribe : 観戦者が受け取るトピックの設定
+	// 観戦者からのみ有効. 空のリストは全トピックの購読.
+	// トピックの無いBroadcastは購読に関わらず届く.
+	// payload:
+	// - List: topics (str8)
+	MsgTypeSubscribe
+
+	// MsgTypeBan : プレイヤーをkickし、この部屋に入室できなくする
+	// MasterClientからのみ有効. 退室済みのプレイヤーも対象にできる.
+	// payload:
+	// - str8: client id
+	// - UInt: duration (秒. 0なら部屋が終了するまで)
+	// - string: message
+	MsgTypeBan
 )
 
+// BroadcastScope : Broadcastの配信先
+//
+//go:generate stringer -type=BroadcastScope -trimprefix=BroadcastScope
+type BroadcastScope byte
+
+const (
+	// BroadcastScopeAll : プレイヤーと観戦者の全員
+	BroadcastScopeAll BroadcastScope = iota
+	// BroadcastScopePlayers : プレイヤーのみ (観戦者やhubには送らない)
+	BroadcastScopePlayers
+	// BroadcastScopeWatchers : 観戦者のみ
+	BroadcastScopeWatchers
+)
+
+func (s BroadcastScope) ToPlayers() bool {
+	return s != BroadcastScopeWatchers
+}
+
+func (s BroadcastScope) ToWatchers() bool {
+	return s != BroadcastScopePlayers
+}
+
+// MarshalScopedBroadcastPayload : MsgTypeScopedBroadcastのpayload
+func MarshalScopedBroadcastPayload(scope BroadcastScope, data []byte) []byte {
+	payload := make([]byte, 0, 2+len(data))
+	payload = append(payload, MarshalByte(int(scope))...)
+	return append(payload, data...)
+}
+
+func UnmarshalScopedBroadcastPayload(payload []byte) (BroadcastScope, []byte, error) {
+	d, l, err := UnmarshalAs(payload, TypeByte)
+	if err != nil {
+		return 0, nil, xerrors.Errorf("scope: %w", err)
+	}
+	scope := BroadcastScope(d.(int))
+	if scope > BroadcastScopeWatchers {
+		return 0, nil, xerrors.Errorf("invalid scope: %v", scope)
+	}
+	return scope, payload[l:], nil
+}
+
+// MarshalTopicBroadcastPayload : MsgTypeTopicBroadcastのpayload
+func MarshalTopicBroadcastPayload(topic string, data []byte) []byte {
+	payload := make([]byte, 0, len(topic)+2+len(data))
+	payload = append(payload, MarshalStr8(topic)...)
+	return append(payload, data...)
+}
+
+func UnmarshalTopicBroadcastPayload(payload []byte) (string, []byte, error) {
+	d, l, err := UnmarshalAs(payload, TypeStr8)
+	if err != nil {
+		return "", nil, xerrors.Errorf("topic: %w", err)
+	}
+	if d.(string) == "" {
+		return "", nil, xerrors.Errorf("topic: empty")
+	}
+	return d.(string), payload[l:], nil
+}
+
+// MarshalSubscribePayload : MsgTypeSubscribeのpayload
+func MarshalSubscribePayload(topics []string) []byte {
+	return MarshalStrings(topics)
+}
+
+func UnmarshalSubscribePayload(payload []byte) ([]string, error) {
+	topics, _, err := UnmarshalTargetsAndData(payload)
+	if err != nil {
+		return nil, xerrors.Errorf("topics: %w", err)
+	}
+	return topics, nil
+}
+
 type nonregularMsg struct {
 	mtype   MsgType
 	payload []byte
@@ -106,10 +234,13 @@ type nonregularMsg struct {
 func (m *nonregularMsg) Type() MsgType   { return m.mtype }
 func (m *nonregularMsg) Payload() []byte { return m.payload }
 func (m *nonregularMsg) Marshal(hmac hash.Hash) []byte {
+	return m.MarshalWithBinding(hmac, nil)
+}
+func (m *nonregularMsg) MarshalWithBinding(hmac hash.Hash, binding []byte) []byte {
 	data := make([]byte, 1+len(m.payload)+hmac.Size())
 	data[0] = byte(m.mtype)
 	copy(data[1:], m.payload)
-	copy(data[1+len(m.payload):], auth.CalculateMsgHMAC(hmac, data[:1+len(m.payload)]))
+	copy(data[1+len(m.payload):], auth.CalculateMsgHMACWithBinding(hmac, binding, data[:1+len(m.payload)]))
 	return data
 }
 
@@ -123,21 +254,51 @@ func (m *regularMsg) Type() MsgType    { return m.mtype }
 func (m *regularMsg) Payload() []byte  { return m.payload }
 func (m *regularMsg) SequenceNum() int { return m.seqNum }
 func (m *regularMsg) Marshal(hmac hash.Hash) []byte {
-	return BuildRegularMsgFrame(m.mtype, m.seqNum, m.payload, hmac)
+	return m.MarshalWithBinding(hmac, nil)
+}
+func (m *regularMsg) MarshalWithBinding(hmac hash.Hash, binding []byte) []byte {
+	return buildRegularMsgFrame(m.mtype, m.seqNum, m.payload, hmac, binding)
+}
+
+// NewRegularMsg constructs RegularMsg
+func NewRegularMsg(t MsgType, seq int, payload []byte) RegularMsg {
+	return &regularMsg{t, seq, payload}
 }
 
 func BuildRegularMsgFrame(t MsgType, seq int, payload []byte, hmac hash.Hash) []byte {
+	return buildRegularMsgFrame(t, seq, payload, hmac, nil)
+}
+
+func buildRegularMsgFrame(t MsgType, seq int, payload []byte, hmac hash.Hash, binding []byte) []byte {
 	data := make([]byte, 1+3+len(payload)+hmac.Size())
 	data[0] = byte(t)
 	put24(data[1:4], int64(seq))
 	copy(data[4:], payload)
-	copy(data[4+len(payload):], auth.CalculateMsgHMAC(hmac, data[:4+len(payload)]))
+	copy(data[4+len(payload):], auth.CalculateMsgHMACWithBinding(hmac, binding, data[:4+len(payload)]))
 	return data
 }
 
+// MsgMACBindingNonceSize : MsgMACBindingに使うnonceのサイズ
+const MsgMACBindingNonceSize = 8
+
+// MsgMACBinding : auth.MACSchemeSHA256でHMACに含めるbinding.
+// | nonce (EvPeerReadyで通知) | 32bit-be 接続開始からのフレーム番号 (1から) |
+// nonceにより他の接続で送られたフレームを、フレーム番号により同じ接続内での再送を拒否できる.
+func MsgMACBinding(nonce []byte, frameNum uint32) []byte {
+	b := make([]byte, len(nonce)+4)
+	copy(b, nonce)
+	put32(b[len(nonce):], int64(frameNum))
+	return b
+}
+
 // ParseMsg parse binary data to Msg struct
 func UnmarshalMsg(hmac hash.Hash, data []byte) (Msg, error) {
-	data, ok := auth.ValidateMsgHMAC(hmac, data)
+	return UnmarshalMsgWithBinding(hmac, nil, data)
+}
+
+// UnmarshalMsgWithBinding parse binary data which hmac is calculated with the binding
+func UnmarshalMsgWithBinding(hmac hash.Hash, binding, data []byte) (Msg, error) {
+	data, ok := auth.ValidateMsgHMACWithBinding(hmac, binding, data)
 	if !ok {
 		return nil, xerrors.Errorf("invalid msg")
 	}
@@ -406,6 +567,62 @@ func UnmarshalTargetsAndData(payload []byte) ([]string, []byte, error) {
 	return targets, payload[l:], nil
 }
 
+// MarshalBanPayload marshals MsgBan payload
+func MarshalBanPayload(target string, duration time.Duration, message string) []byte {
+	p := MarshalStr8(target)
+	p = append(p, MarshalUInt(int(duration/time.Second))...)
+	return append(p, MarshalStr16(message)...)
+}
+
+// UnmarshalBanPayload parses payload of MsgTypeBan
+func UnmarshalBanPayload(payload []byte) (string, time.Duration, string, error) {
+	d, l, e := UnmarshalAs(payload, TypeStr8)
+	if e != nil {
+		return "", 0, "", xerrors.Errorf("Invalid MsgBan payload (client id): %w", e)
+	}
+	target := d.(string)
+	if target == "" {
+		return "", 0, "", xerrors.Errorf("Invalid MsgBan payload (client id): empty")
+	}
+	payload = payload[l:]
+	d, l, e = UnmarshalAs(payload, TypeUInt)
+	if e != nil {
+		return target, 0, "", xerrors.Errorf("Invalid MsgBan payload (duration): %w", e)
+	}
+	duration := time.Duration(d.(int)) * time.Second
+	m, _, e := Unmarshal(payload[l:])
+	if e != nil {
+		return target, duration, "", xerrors.Errorf("Invalid MsgBan payload (message): %w", e)
+	}
+	msg, ok := m.(string)
+	if !ok {
+		return target, duration, "", xerrors.Errorf("Invalid MsgBan payload (message): %T", m)
+	}
+	if msg == "" {
+		msg = "banned"
+	}
+
+	return target, duration, msg, nil
+}
+
+// MarshalRoomKeyPayload marshals MsgRoomKey payload
+func MarshalRoomKeyPayload(target string, sealed []byte) []byte {
+	p := MarshalStr8(target)
+	return append(p, sealed...)
+}
+
+// UnmarshalRoomKeyPayload parses payload of MsgTypeRoomKey
+func UnmarshalRoomKeyPayload(payload []byte) (string, []byte, error) {
+	d, l, e := UnmarshalAs(payload, TypeStr8)
+	if e != nil {
+		return "", nil, xerrors.Errorf("Invalid MsgRoomKey payload (client id): %w", e)
+	}
+	if len(payload) == l {
+		return "", nil, xerrors.Errorf("Invalid MsgRoomKey payload (sealed key): empty")
+	}
+	return d.(string), payload[l:], nil
+}
+
 // UnmarshalKickPayload parses payload of MsgTypeKick
 func UnmarshalKickPayload(payload []byte) (string, string, error) {
 	d, l, e := UnmarshalAs(payload, TypeStr8)
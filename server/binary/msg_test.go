@@ -3,6 +3,9 @@ package binary
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"wsnet2/auth"
 )
 
 func TestUnmarshalNullDict(t *testing.T) {
@@ -149,3 +152,188 @@ func TestSwitchMasterPayload(t *testing.T) {
 		t.Fatalf("new master: %v, wants %v", u, newmaster)
 	}
 }
+
+func TestMsgWithBinding(t *testing.T) {
+	mac, _ := auth.NewMsgHMAC(auth.MACSchemeSHA256, auth.GenMACKey())
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	msg := NewRegularMsg(MsgTypeBroadcast, 5, []byte{1, 2, 3})
+	frame := msg.MarshalWithBinding(mac, MsgMACBinding(nonce, 1))
+
+	m, err := UnmarshalMsgWithBinding(mac, MsgMACBinding(nonce, 1), frame)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(m, msg) {
+		t.Fatalf("msg = %#v, wants %#v", m, msg)
+	}
+
+	// 別のフレーム番号や接続(nonce)では受け付けない
+	if _, err := UnmarshalMsgWithBinding(mac, MsgMACBinding(nonce, 2), frame); err == nil {
+		t.Fatalf("unmarshal with another frame number must error")
+	}
+	if _, err := UnmarshalMsgWithBinding(mac, MsgMACBinding([]byte{8, 7, 6, 5, 4, 3, 2, 1}, 1), frame); err == nil {
+		t.Fatalf("unmarshal with another nonce must error")
+	}
+
+	ev := NewEvPeerReadyWithNonce(5, nonce)
+	seq, err := UnmarshalEvPeerReadyPayload(ev.Payload())
+	if err != nil || seq != 5 {
+		t.Fatalf("UnmarshalEvPeerReadyPayload = (%v, %v), wants 5", seq, err)
+	}
+	n, err := UnmarshalEvPeerReadyNonce(ev.Payload())
+	if err != nil || !reflect.DeepEqual(n, nonce) {
+		t.Fatalf("UnmarshalEvPeerReadyNonce = (%v, %v), wants %v", n, err, nonce)
+	}
+	if _, err := UnmarshalEvPeerReadyNonce(NewEvPeerReady(5).Payload()); err == nil {
+		t.Fatalf("UnmarshalEvPeerReadyNonce without nonce must error")
+	}
+}
+
+func TestScopedBroadcastPayload(t *testing.T) {
+	data := []byte{1, 2, 3}
+	for _, scope := range []BroadcastScope{BroadcastScopeAll, BroadcastScopePlayers, BroadcastScopeWatchers} {
+		s, d, err := UnmarshalScopedBroadcastPayload(MarshalScopedBroadcastPayload(scope, data))
+		if err != nil {
+			t.Fatalf("unmarshal(%v): %v", scope, err)
+		}
+		if s != scope || !reflect.DeepEqual(d, data) {
+			t.Fatalf("unmarshal = (%v, %v), wants (%v, %v)", s, d, scope, data)
+		}
+	}
+	if _, _, err := UnmarshalScopedBroadcastPayload(MarshalScopedBroadcastPayload(3, data)); err == nil {
+		t.Fatalf("unmarshal invalid scope must error")
+	}
+	if BroadcastScopePlayers.ToWatchers() || BroadcastScopeWatchers.ToPlayers() {
+		t.Fatalf("scope filter is wrong")
+	}
+}
+
+func TestRoomKeyPayload(t *testing.T) {
+	sealed := []byte{1, 2, 3, 4}
+
+	p := MarshalRoomKeyPayload("target", sealed)
+	target, s, err := UnmarshalRoomKeyPayload(p)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if target != "target" || !reflect.DeepEqual(s, sealed) {
+		t.Fatalf("unmarshal = (%q, %v), wants (%q, %v)", target, s, "target", sealed)
+	}
+	if _, _, err := UnmarshalRoomKeyPayload(MarshalStr8("target")); err == nil {
+		t.Fatalf("unmarshal without sealed key must error")
+	}
+
+	// 再接続時に再送されるようRegularEventとして送る
+	e, seq, err := UnmarshalEvent(NewEvRoomKey("sender", sealed).Marshal(5))
+	if err != nil {
+		t.Fatalf("UnmarshalEvent: %v", err)
+	}
+	ev, ok := e.(*RegularEvent)
+	if !ok || seq != 5 {
+		t.Fatalf("EvRoomKey = (%T, %v), wants (*RegularEvent, 5)", e, seq)
+	}
+	sender, s, err := UnmarshalEvRoomKeyPayload(ev.Payload())
+	if err != nil {
+		t.Fatalf("UnmarshalEvRoomKeyPayload: %v", err)
+	}
+	if sender != "sender" || !reflect.DeepEqual(s, sealed) {
+		t.Fatalf("UnmarshalEvRoomKeyPayload = (%q, %v), wants (%q, %v)", sender, s, "sender", sealed)
+	}
+	if v := ev.Type().ProtocolVersion(); v != ProtocolVersion2 {
+		t.Fatalf("EvTypeRoomKey protocol version = %v, wants %v", v, ProtocolVersion2)
+	}
+}
+
+func TestEvRewatch(t *testing.T) {
+	ev := NewEvRewatch(30 * time.Second)
+	grace, err := UnmarshalEvRewatchPayload(ev.Payload())
+	if err != nil {
+		t.Fatalf("UnmarshalEvRewatchPayload: %v", err)
+	}
+	if grace != 30*time.Second {
+		t.Fatalf("grace = %v, wants %v", grace, 30*time.Second)
+	}
+	if v := ev.Type().ProtocolVersion(); v != ProtocolVersion2 {
+		t.Fatalf("EvTypeRewatch protocol version = %v, wants %v", v, ProtocolVersion2)
+	}
+}
+
+func TestEvWatcherMessage(t *testing.T) {
+	body := MarshalStr8("hello")
+	ev := NewEvWatcherMessage("watcher1", body)
+	if ev.Type() != EvTypeWatcherMessage {
+		t.Fatalf("type = %v, wants %v", ev.Type(), EvTypeWatcherMessage)
+	}
+	sender, b, err := UnmarshalEvMessage(ev.Payload())
+	if err != nil {
+		t.Fatalf("UnmarshalEvMessage: %v", err)
+	}
+	if sender != "watcher1" || !reflect.DeepEqual(b, body) {
+		t.Fatalf("UnmarshalEvMessage = (%q, %v), wants (%q, %v)", sender, b, "watcher1", body)
+	}
+	if v := ev.Type().ProtocolVersion(); v != ProtocolVersion2 {
+		t.Fatalf("EvTypeWatcherMessage protocol version = %v, wants %v", v, ProtocolVersion2)
+	}
+}
+
+func TestTopicBroadcastPayload(t *testing.T) {
+	data := []byte{1, 2, 3}
+	topic, d, err := UnmarshalTopicBroadcastPayload(MarshalTopicBroadcastPayload("score", data))
+	if err != nil {
+		t.Fatalf("UnmarshalTopicBroadcastPayload: %v", err)
+	}
+	if topic != "score" || !reflect.DeepEqual(d, data) {
+		t.Fatalf("UnmarshalTopicBroadcastPayload = (%q, %v), wants (%q, %v)", topic, d, "score", data)
+	}
+	if _, _, err := UnmarshalTopicBroadcastPayload(MarshalTopicBroadcastPayload("", data)); err == nil {
+		t.Fatalf("empty topic must error")
+	}
+
+	ev := NewEvTopicMessage("score", "user1", data)
+	topic, msg, err := UnmarshalEvTopicMessage(ev.Payload())
+	if err != nil {
+		t.Fatalf("UnmarshalEvTopicMessage: %v", err)
+	}
+	sender, body, err := UnmarshalEvMessage(msg)
+	if err != nil {
+		t.Fatalf("UnmarshalEvMessage: %v", err)
+	}
+	if topic != "score" || sender != "user1" || !reflect.DeepEqual(body, data) {
+		t.Fatalf("event = (%q, %q, %v), wants (%q, %q, %v)", topic, sender, body, "score", "user1", data)
+	}
+}
+
+func TestSubscribePayload(t *testing.T) {
+	for _, topics := range [][]string{{"score", "chat"}, {}} {
+		ts, err := UnmarshalSubscribePayload(MarshalSubscribePayload(topics))
+		if err != nil {
+			t.Fatalf("UnmarshalSubscribePayload(%v): %v", topics, err)
+		}
+		if !reflect.DeepEqual(ts, topics) {
+			t.Fatalf("UnmarshalSubscribePayload = %v, wants %v", ts, topics)
+		}
+	}
+}
+
+func TestBanPayload(t *testing.T) {
+	target, d, msg, err := UnmarshalBanPayload(MarshalBanPayload("user1", 90*time.Second, "bye"))
+	if err != nil {
+		t.Fatalf("UnmarshalBanPayload: %v", err)
+	}
+	if target != "user1" || d != 90*time.Second || msg != "bye" {
+		t.Fatalf("UnmarshalBanPayload = (%q, %v, %q), wants (%q, %v, %q)", target, d, msg, "user1", 90*time.Second, "bye")
+	}
+	if _, _, msg, _ := UnmarshalBanPayload(MarshalBanPayload("user1", 0, "")); msg != "banned" {
+		t.Fatalf("default message = %q, wants %q", msg, "banned")
+	}
+	if _, _, _, err := UnmarshalBanPayload(MarshalBanPayload("", 0, "bye")); err == nil {
+		t.Fatalf("empty client id must error")
+	}
+	if _, _, _, err := UnmarshalBanPayload(MarshalStr8("user1")); err == nil {
+		t.Fatalf("payload without duration must error")
+	}
+	if s := MsgTypeBan.String(); s != "MsgTypeBan" {
+		t.Fatalf("MsgTypeBan.String() = %q", s)
+	}
+}
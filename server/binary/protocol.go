@@ -0,0 +1,95 @@
+package binary
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// websocketのプロトコルバージョン.
+// websocketのサブプロトコルでネゴシエートする.
+const (
+	// ProtocolVersion1 : 初期バージョン (subprotocol: "wsnet2")
+	// サブプロトコル未指定の接続もこのバージョンとみなす.
+	ProtocolVersion1 = 1 + iota
+
+	// ProtocolVersion2 : バージョンネゴシエーション対応 (subprotocol: "wsnet2.v2")
+	// 以降に追加されるSystemEventはこのバージョン以上のクライアントにのみ送信する.
+	ProtocolVersion2
+
+	// ProtocolVersionLatest : 最新バージョン
+	ProtocolVersionLatest = ProtocolVersion2
+)
+
+const subprotocolName = "wsnet2"
+
+// Subprotocol returns the subprotocol name of the version.
+func Subprotocol(ver int) string {
+	if ver <= ProtocolVersion1 {
+		return subprotocolName
+	}
+	return fmt.Sprintf("%s.v%d", subprotocolName, ver)
+}
+
+// Subprotocols returns the subprotocol names from the latest version down to minVer.
+// 先頭ほど優先してネゴシエートされる.
+func Subprotocols(minVer int) []string {
+	if minVer < ProtocolVersion1 {
+		minVer = ProtocolVersion1
+	}
+	protos := make([]string, 0, ProtocolVersionLatest-minVer+1)
+	for v := ProtocolVersionLatest; v >= minVer; v-- {
+		protos = append(protos, Subprotocol(v))
+	}
+	return protos
+}
+
+// ParseSubprotocol returns the protocol version of the negotiated subprotocol.
+func ParseSubprotocol(proto string) (int, error) {
+	if proto == "" || proto == subprotocolName {
+		return ProtocolVersion1, nil
+	}
+	v, ok := strings.CutPrefix(proto, subprotocolName+".v")
+	if !ok {
+		return 0, xerrors.Errorf("unknown subprotocol: %q", proto)
+	}
+	ver, err := strconv.Atoi(v)
+	if err != nil || ver <= ProtocolVersion1 {
+		return 0, xerrors.Errorf("invalid subprotocol version: %q", proto)
+	}
+	return ver, nil
+}
+
+// evTypeProtocolVersion : ProtocolVersion1より後に追加されたEvTypeと、それを受信できるバージョン
+var evTypeProtocolVersion = map[EvType]int{
+	EvTypeRoomKey:        ProtocolVersion2,
+	EvTypeWatcherMessage: ProtocolVersion2,
+	EvTypeRoomState:      ProtocolVersion2,
+	EvTypeRewatch:        ProtocolVersion2,
+	EvTypeEventGap:       ProtocolVersion2,
+	EvTypeTopicMessage:   ProtocolVersion2,
+}
+
+// ProtocolVersion returns the minimum protocol version which can receive this event type.
+func (t EvType) ProtocolVersion() int {
+	if v, ok := evTypeProtocolVersion[t]; ok {
+		return v
+	}
+	return ProtocolVersion1
+}
+
+// DowngradeEvent returns the event which the client of the protocol version can receive.
+// EvTypeTopicMessageはEvTypeMessageに変換する. 代わりのイベントが無ければfalseを返す.
+func DowngradeEvent(ev *RegularEvent, ver int) (*RegularEvent, bool) {
+	if ev.Type().ProtocolVersion() <= ver {
+		return ev, true
+	}
+	if ev.Type() == EvTypeTopicMessage {
+		if _, msg, err := UnmarshalEvTopicMessage(ev.Payload()); err == nil {
+			return &RegularEvent{EvTypeMessage, msg}, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,63 @@
+package binary
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSubprotocols(t *testing.T) {
+	if diff := cmp.Diff(Subprotocols(0), []string{"wsnet2.v2", "wsnet2"}); diff != "" {
+		t.Fatalf("Subprotocols(0) (-got +want)\n%s", diff)
+	}
+	if diff := cmp.Diff(Subprotocols(ProtocolVersion2), []string{"wsnet2.v2"}); diff != "" {
+		t.Fatalf("Subprotocols(2) (-got +want)\n%s", diff)
+	}
+}
+
+func TestParseSubprotocol(t *testing.T) {
+	tests := map[string]int{
+		"":          ProtocolVersion1,
+		"wsnet2":    ProtocolVersion1,
+		"wsnet2.v2": ProtocolVersion2,
+		"wsnet2.v9": 9,
+	}
+	for proto, exp := range tests {
+		ver, err := ParseSubprotocol(proto)
+		if err != nil {
+			t.Fatalf("ParseSubprotocol(%q): %v", proto, err)
+		}
+		if ver != exp {
+			t.Fatalf("ParseSubprotocol(%q) = %v, wants %v", proto, ver, exp)
+		}
+		if ver > ProtocolVersion1 && Subprotocol(ver) != proto {
+			t.Fatalf("Subprotocol(%v) = %q, wants %q", ver, Subprotocol(ver), proto)
+		}
+	}
+
+	for _, proto := range []string{"wsnet", "wsnet2.v", "wsnet2.v1", "wsnet2.vx", "wsnet2.2"} {
+		if _, err := ParseSubprotocol(proto); err == nil {
+			t.Fatalf("ParseSubprotocol(%q) must error", proto)
+		}
+	}
+}
+
+func TestDowngradeEvent(t *testing.T) {
+	msg := NewEvMessage("user1", []byte{1, 2})
+	topic := NewEvTopicMessage("score", "user1", []byte{1, 2})
+	state := NewEvRoomState(Dict{"k": MarshalInt(1)})
+
+	if ev, ok := DowngradeEvent(topic, ProtocolVersion2); !ok || ev != topic {
+		t.Fatalf("DowngradeEvent(topic, v2) = %v, %v", ev, ok)
+	}
+	ev, ok := DowngradeEvent(topic, ProtocolVersion1)
+	if !ok {
+		t.Fatalf("DowngradeEvent(topic, v1) must be converted")
+	}
+	if diff := cmp.Diff(ev.Marshal(1), msg.Marshal(1)); diff != "" {
+		t.Fatalf("DowngradeEvent(topic, v1) (-got +want)\n%s", diff)
+	}
+	if ev, ok := DowngradeEvent(state, ProtocolVersion1); ok {
+		t.Fatalf("DowngradeEvent(state, v1) = %v, wants removed", ev)
+	}
+}
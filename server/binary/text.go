@@ -0,0 +1,779 @@
+package binary
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/xerrors"
+)
+
+// テキスト表現
+//
+// 全てのTypeを曖昧さなく表現し、ParseTextで元のバイナリに戻せる書式.
+//
+//	Null:        null
+//	Bool:        true, false
+//	Int:         123  (型名を省略した整数はInt)
+//	数値:        SByte(-1), Byte(1), Short(-1), UShort(1), UInt(1), Long(-1), ULong(1), Float(1.5), Double(1.5)
+//	Char:        Char('a'), Char(0xd800)
+//	Str8:        "abc"  (型名を省略した文字列はStr8. 256byte以上ならStr16)
+//	Str16:       Str16("abc")
+//	Obj:         Obj(1)[v1,v2,...]  (bodyを値の列として解釈できないときは Obj(1)<0a0b0c>)
+//	List:        [v1,v2,...]
+//	Dict:        {"key1":v1,"key2":v2,...}
+//	配列:        Bools[true,false], SBytes[-1,2], Bytes[1,2], Shorts[..], UShorts[..], Ints[..], UInts[..],
+//	             Longs[..], ULongs[..], Floats[1.5,2], Doubles[1.5,2]
+//	Chars:       Chars("abc")  (サロゲート単体は Chars("\U0000d800") のように出力)
+//
+// 型名を省略した小数は Double、Int の範囲を超える整数は Long として解釈する.
+// Decimal/Decimals は未実装.
+
+// FormatText formats a marshaled value to the text representation.
+func FormatText(src []byte) (string, error) {
+	buf, n, err := appendText(nil, src)
+	if err != nil {
+		return string(buf), err
+	}
+	if n != len(src) {
+		return string(buf), xerrors.Errorf("FormatText: trailing data (%v bytes)", len(src)-n)
+	}
+	return string(buf), nil
+}
+
+func appendText(dst, src []byte) ([]byte, int, error) {
+	if len(src) == 0 {
+		return dst, 0, xerrors.Errorf("FormatText error: empty")
+	}
+	t := Type(src[0])
+	switch t {
+	case TypeObj:
+		return appendObjText(dst, src)
+	case TypeChars:
+		return appendCharsText(dst, src)
+	case TypeDecimal, TypeDecimals:
+		return dst, 0, xerrors.Errorf("FormatText error: %v is not supported", t)
+	}
+
+	u, n, err := Unmarshal(src)
+	if err != nil {
+		return dst, 0, err
+	}
+
+	switch v := u.(type) {
+	case nil:
+		dst = append(dst, "null"...)
+	case bool:
+		dst = strconv.AppendBool(dst, v)
+	case int:
+		if t != TypeInt {
+			dst = append(dst, t.String()...)
+			dst = append(dst, '(')
+		}
+		dst = strconv.AppendInt(dst, int64(v), 10)
+		if t != TypeInt {
+			dst = append(dst, ')')
+		}
+	case rune:
+		dst = append(dst, "Char("...)
+		dst = appendRuneText(dst, v)
+		dst = append(dst, ')')
+	case int64:
+		dst = append(dst, "Long("...)
+		dst = strconv.AppendInt(dst, v, 10)
+		dst = append(dst, ')')
+	case uint64:
+		dst = append(dst, "ULong("...)
+		dst = strconv.AppendUint(dst, v, 10)
+		dst = append(dst, ')')
+	case float32:
+		dst = append(dst, "Float("...)
+		dst = strconv.AppendFloat(dst, float64(v), 'g', -1, 32)
+		dst = append(dst, ')')
+	case float64:
+		dst = append(dst, "Double("...)
+		dst = strconv.AppendFloat(dst, v, 'g', -1, 64)
+		dst = append(dst, ')')
+	case string:
+		if t == TypeStr16 {
+			dst = append(dst, "Str16("...)
+			dst = strconv.AppendQuote(dst, v)
+			dst = append(dst, ')')
+		} else {
+			dst = strconv.AppendQuote(dst, v)
+		}
+	case List:
+		dst = append(dst, '[')
+		for i, e := range v {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst, err = appendElemText(dst, e)
+			if err != nil {
+				return dst, 0, xerrors.Errorf("List[%v]: %w", i, err)
+			}
+		}
+		dst = append(dst, ']')
+	case Dict:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		dst = append(dst, '{')
+		for i, k := range keys {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = strconv.AppendQuote(dst, k)
+			dst = append(dst, ':')
+			dst, err = appendElemText(dst, v[k])
+			if err != nil {
+				return dst, 0, xerrors.Errorf("Dict[%q]: %w", k, err)
+			}
+		}
+		dst = append(dst, '}')
+	case []bool:
+		dst = appendArrayText(dst, t, v, strconv.AppendBool)
+	case []int:
+		dst = appendArrayText(dst, t, v, func(b []byte, e int) []byte {
+			return strconv.AppendInt(b, int64(e), 10)
+		})
+	case []int64:
+		dst = appendArrayText(dst, t, v, func(b []byte, e int64) []byte {
+			return strconv.AppendInt(b, e, 10)
+		})
+	case []uint64:
+		dst = appendArrayText(dst, t, v, func(b []byte, e uint64) []byte {
+			return strconv.AppendUint(b, e, 10)
+		})
+	case []float32:
+		dst = appendArrayText(dst, t, v, func(b []byte, e float32) []byte {
+			return strconv.AppendFloat(b, float64(e), 'g', -1, 32)
+		})
+	case []float64:
+		dst = appendArrayText(dst, t, v, func(b []byte, e float64) []byte {
+			return strconv.AppendFloat(b, e, 'g', -1, 64)
+		})
+	default:
+		return dst, 0, xerrors.Errorf("FormatText error: unexpected value %T", u)
+	}
+
+	return dst, n, nil
+}
+
+// appendElemText formats an element of List/Dict which must be exactly one value.
+func appendElemText(dst, src []byte) ([]byte, error) {
+	dst, n, err := appendText(dst, src)
+	if err != nil {
+		return dst, err
+	}
+	if n != len(src) {
+		return dst, xerrors.Errorf("trailing data (%v bytes)", len(src)-n)
+	}
+	return dst, nil
+}
+
+func appendObjText(dst, src []byte) ([]byte, int, error) {
+	obj, n, err := unmarshalObj(src)
+	if err != nil {
+		return dst, 0, err
+	}
+	dst = append(dst, "Obj("...)
+	dst = strconv.AppendUint(dst, uint64(obj.ClassId), 10)
+	dst = append(dst, ')')
+
+	// bodyは値の列として解釈を試み、失敗したら生のバイト列を出力する
+	body := make([]byte, 0, len(obj.Body)*2)
+	body = append(body, '[')
+	for b := obj.Body; len(b) > 0; {
+		if len(body) > 1 {
+			body = append(body, ',')
+		}
+		var n1 int
+		body, n1, err = appendText(body, b)
+		if err != nil {
+			dst = append(dst, '<')
+			dst = append(dst, hex.EncodeToString(obj.Body)...)
+			return append(dst, '>'), n, nil
+		}
+		b = b[n1:]
+	}
+	body = append(body, ']')
+
+	return append(dst, body...), n, nil
+}
+
+// appendCharsText formats Chars from UTF-16 code units so that unpaired surrogates are kept.
+func appendCharsText(dst, src []byte) ([]byte, int, error) {
+	units, n, err := unmarshalCharUnits(src)
+	if err != nil {
+		return dst, 0, err
+	}
+	dst = append(dst, "Chars(\""...)
+	var q []byte
+	for i := 0; i < len(units); i++ {
+		r := rune(units[i])
+		if utf16.IsSurrogate(r) {
+			if i+1 < len(units) {
+				if pr := utf16.DecodeRune(r, rune(units[i+1])); pr != utf8.RuneError {
+					r = pr
+					i++
+				}
+			}
+			if utf16.IsSurrogate(r) {
+				// 文字列として表現できないので\Uエスケープ
+				dst = append(dst, fmt.Sprintf("\\U%08x", r)...)
+				continue
+			}
+		}
+		q = strconv.AppendQuote(q[:0], string(r))
+		dst = append(dst, q[1:len(q)-1]...)
+	}
+	return append(dst, "\")"...), n, nil
+}
+
+func appendArrayText[T any](dst []byte, t Type, vals []T, f func([]byte, T) []byte) []byte {
+	dst = append(dst, t.String()...)
+	dst = append(dst, '[')
+	for i, v := range vals {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = f(dst, v)
+	}
+	return append(dst, ']')
+}
+
+func appendRuneText(dst []byte, r rune) []byte {
+	if !utf8.ValidRune(r) {
+		// サロゲート単体は文字として表現できないので数値で出力
+		dst = append(dst, "0x"...)
+		return strconv.AppendUint(dst, uint64(r), 16)
+	}
+	return strconv.AppendQuoteRune(dst, r)
+}
+
+// ParseText parses the text representation and returns marshaled bytes.
+func ParseText(s string) ([]byte, error) {
+	p := &textParser{src: s}
+	b, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected trailing text")
+	}
+	return b, nil
+}
+
+// ParseTextDict parses the text representation of Dict.
+func ParseTextDict(s string) (Dict, error) {
+	b, err := ParseText(s)
+	if err != nil {
+		return nil, err
+	}
+	u, _, err := UnmarshalAs(b, TypeDict)
+	if err != nil {
+		return nil, err
+	}
+	return u.(Dict), nil
+}
+
+type textParser struct {
+	src string
+	pos int
+}
+
+func (p *textParser) errorf(format string, args ...any) error {
+	return xerrors.Errorf("ParseText error at %v: %s", p.pos, xerrors.Errorf(format, args...))
+}
+
+func (p *textParser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *textParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *textParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("%q expected", c)
+	}
+	p.pos++
+	return nil
+}
+
+// token reads an identifier or a number literal.
+func (p *textParser) token() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '+' || c == '-' || c == '.' || c == '_' ||
+			('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.src[start:p.pos]
+}
+
+// quoted reads a quoted string or rune literal.
+func (p *textParser) quoted() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return "", p.errorf("quoted string expected")
+	}
+	q := p.src[p.pos]
+	if q != '"' && q != '\'' {
+		return "", p.errorf("quoted string expected")
+	}
+	for i := p.pos + 1; i < len(p.src); i++ {
+		switch p.src[i] {
+		case '\\':
+			i++
+		case q:
+			s, err := strconv.Unquote(p.src[p.pos : i+1])
+			if err != nil {
+				return "", p.errorf("%w", err)
+			}
+			p.pos = i + 1
+			return s, nil
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// quotedCharUnits reads a quoted string as UTF-16 code units.
+// strconv.Unquoteが受け付けない "\Ud800" のようなサロゲート単体のエスケープも解釈する.
+func (p *textParser) quotedCharUnits() ([]uint16, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) || p.src[p.pos] != '"' {
+		return nil, p.errorf("quoted string expected")
+	}
+	units := []uint16{}
+	s := p.src[p.pos+1:]
+	for len(s) > 0 && s[0] != '"' {
+		if len(s) >= 10 && s[0] == '\\' && s[1] == 'U' {
+			if v, err := strconv.ParseUint(s[2:10], 16, 32); err == nil && utf16.IsSurrogate(rune(v)) {
+				units = append(units, uint16(v))
+				s = s[10:]
+				continue
+			}
+		}
+		r, _, tail, err := strconv.UnquoteChar(s, '"')
+		if err != nil {
+			return nil, p.errorf("%w", err)
+		}
+		units = append(units, utf16.Encode([]rune{r})...)
+		s = tail
+	}
+	if len(s) == 0 {
+		return nil, p.errorf("unterminated string")
+	}
+	p.pos = len(p.src) - len(s) + 1
+	return units, nil
+}
+
+// list calls f for each element in the brackets.
+func (p *textParser) list(open, close byte, f func() error) error {
+	if err := p.expect(open); err != nil {
+		return err
+	}
+	if p.peek() == close {
+		p.pos++
+		return nil
+	}
+	for {
+		if err := f(); err != nil {
+			return err
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case close:
+			p.pos++
+			return nil
+		default:
+			return p.errorf("',' or %q expected", close)
+		}
+	}
+}
+
+func (p *textParser) value() ([]byte, error) {
+	switch c := p.peek(); {
+	case c == 0:
+		return nil, p.errorf("value expected")
+	case c == '"':
+		s, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		if len(s) > math.MaxUint8 {
+			return str16(s)
+		}
+		return MarshalStr8(s), nil
+	case c == '[':
+		return p.listValue()
+	case c == '{':
+		return p.dictValue()
+	case c == '-' || c == '+' || c == '.' || ('0' <= c && c <= '9'):
+		return p.bareNumber()
+	}
+
+	start := p.pos
+	name := p.token()
+	switch name {
+	case "":
+		return nil, p.errorf("unexpected character %q", p.src[p.pos])
+	case "null":
+		return MarshalNull(), nil
+	case "true":
+		return MarshalBool(true), nil
+	case "false":
+		return MarshalBool(false), nil
+	case "NaN", "Inf":
+		p.pos = start
+		return p.bareNumber()
+	case "Obj":
+		return p.objValue()
+	}
+
+	switch c := p.peek(); c {
+	case '(':
+		return p.scalarValue(name)
+	case '[':
+		return p.arrayValue(name)
+	}
+	p.pos = start
+	return nil, p.errorf("unknown value: %q", name)
+}
+
+func (p *textParser) bareNumber() ([]byte, error) {
+	tok := p.token()
+	if i, err := strconv.ParseInt(tok, 0, 64); err == nil {
+		if math.MinInt32 <= i && i <= math.MaxInt32 {
+			return MarshalInt(int(i)), nil
+		}
+		return MarshalLong(i), nil
+	}
+	f, err := strconv.ParseFloat(tok, 64)
+	if err != nil {
+		return nil, p.errorf("invalid number %q", tok)
+	}
+	return MarshalDouble(f), nil
+}
+
+func (p *textParser) scalarValue(name string) ([]byte, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	var b []byte
+	var err error
+	switch name {
+	case "Str8", "Str16":
+		var s string
+		s, err = p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "Str8":
+			if len(s) > math.MaxUint8 {
+				return nil, p.errorf("too long Str8: %v", len(s))
+			}
+			b = MarshalStr8(s)
+		case "Str16":
+			b, err = str16(s)
+		}
+	case "Chars":
+		var units []uint16
+		units, err = p.quotedCharUnits()
+		if err != nil {
+			return nil, err
+		}
+		b = marshalCharUnits(units)
+	case "Char":
+		var r rune
+		r, err = p.runeElem()
+		b = MarshalChar(r)
+	case "Float":
+		var f float64
+		f, err = p.floatElem(32)
+		b = MarshalFloat(float32(f))
+	case "Double":
+		var f float64
+		f, err = p.floatElem(64)
+		b = MarshalDouble(f)
+	case "Long":
+		var i int64
+		i, err = p.intElem(math.MinInt64, math.MaxInt64)
+		b = MarshalLong(i)
+	case "ULong":
+		var u uint64
+		u, err = p.uintElem()
+		b = MarshalULong(u)
+	default:
+		t, ok := textIntTypes[name]
+		if !ok {
+			return nil, p.errorf("unknown type: %q", name)
+		}
+		var i int64
+		i, err = p.intElem(t.min, t.max)
+		b = t.marshal(int(i))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (p *textParser) arrayValue(name string) ([]byte, error) {
+	switch name {
+	case "Bools":
+		vals := []bool{}
+		err := p.list('[', ']', func() error {
+			switch tok := p.token(); tok {
+			case "true":
+				vals = append(vals, true)
+			case "false":
+				vals = append(vals, false)
+			default:
+				return p.errorf("invalid bool %q", tok)
+			}
+			return nil
+		})
+		return MarshalBools(vals), err
+	case "Longs":
+		vals := []int64{}
+		err := p.list('[', ']', func() error {
+			v, err := p.intElem(math.MinInt64, math.MaxInt64)
+			vals = append(vals, v)
+			return err
+		})
+		return MarshalLongs(vals), err
+	case "ULongs":
+		vals := []uint64{}
+		err := p.list('[', ']', func() error {
+			v, err := p.uintElem()
+			vals = append(vals, v)
+			return err
+		})
+		return MarshalULongs(vals), err
+	case "Floats":
+		vals := []float32{}
+		err := p.list('[', ']', func() error {
+			v, err := p.floatElem(32)
+			vals = append(vals, float32(v))
+			return err
+		})
+		return MarshalFloats(vals), err
+	case "Doubles":
+		vals := []float64{}
+		err := p.list('[', ']', func() error {
+			v, err := p.floatElem(64)
+			vals = append(vals, v)
+			return err
+		})
+		return MarshalDoubles(vals), err
+	}
+
+	t, ok := textIntArrayTypes[name]
+	if !ok {
+		return nil, p.errorf("unknown type: %q", name)
+	}
+	e := textIntTypes[NumListElementType[t.typ].String()]
+	vals := []int{}
+	err := p.list('[', ']', func() error {
+		v, err := p.intElem(e.min, e.max)
+		vals = append(vals, int(v))
+		return err
+	})
+	return t.marshal(vals), err
+}
+
+func (p *textParser) objValue() ([]byte, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	id, err := p.intElem(0, math.MaxUint8)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if p.peek() == '<' {
+		p.pos++
+		end := strings.IndexByte(p.src[p.pos:], '>')
+		if end < 0 {
+			return nil, p.errorf("unterminated Obj body")
+		}
+		body, err = hex.DecodeString(p.src[p.pos : p.pos+end])
+		if err != nil {
+			return nil, p.errorf("invalid Obj body: %w", err)
+		}
+		p.pos += end + 1
+	} else {
+		body = []byte{}
+		err = p.list('[', ']', func() error {
+			v, err := p.value()
+			body = append(body, v...)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(body) > math.MaxUint16 {
+		return nil, p.errorf("too large Obj body: %v", len(body))
+	}
+	return MarshalObj(&Obj{ClassId: byte(id), Body: body}), nil
+}
+
+func (p *textParser) listValue() ([]byte, error) {
+	list := List{}
+	err := p.list('[', ']', func() error {
+		v, err := p.value()
+		list = append(list, v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(list) > math.MaxUint8 {
+		return nil, p.errorf("too many List elements: %v", len(list))
+	}
+	return MarshalList(list), nil
+}
+
+func (p *textParser) dictValue() ([]byte, error) {
+	dict := Dict{}
+	err := p.list('{', '}', func() error {
+		k, err := p.quoted()
+		if err != nil {
+			return err
+		}
+		if len(k) > math.MaxUint8 {
+			return p.errorf("too long Dict key: %q", k)
+		}
+		if _, ok := dict[k]; ok {
+			return p.errorf("duplicated Dict key: %q", k)
+		}
+		if err := p.expect(':'); err != nil {
+			return err
+		}
+		v, err := p.value()
+		dict[k] = v
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(dict) > math.MaxUint8 {
+		return nil, p.errorf("too many Dict elements: %v", len(dict))
+	}
+	return MarshalDict(dict), nil
+}
+
+func (p *textParser) intElem(min, max int64) (int64, error) {
+	tok := p.token()
+	i, err := strconv.ParseInt(tok, 0, 64)
+	if err != nil {
+		return 0, p.errorf("invalid integer %q", tok)
+	}
+	if i < min || max < i {
+		return 0, p.errorf("out of range %v..%v: %v", min, max, i)
+	}
+	return i, nil
+}
+
+func (p *textParser) uintElem() (uint64, error) {
+	tok := p.token()
+	u, err := strconv.ParseUint(tok, 0, 64)
+	if err != nil {
+		return 0, p.errorf("invalid unsigned integer %q", tok)
+	}
+	return u, nil
+}
+
+func (p *textParser) floatElem(bitSize int) (float64, error) {
+	tok := p.token()
+	f, err := strconv.ParseFloat(tok, bitSize)
+	if err != nil {
+		return 0, p.errorf("invalid float %q", tok)
+	}
+	return f, nil
+}
+
+func (p *textParser) runeElem() (rune, error) {
+	if c := p.peek(); c != '\'' && c != '"' {
+		i, err := p.intElem(0, math.MaxUint16)
+		return rune(i), err
+	}
+	s, err := p.quoted()
+	if err != nil {
+		return 0, err
+	}
+	r, n := utf8.DecodeRuneInString(s)
+	if n != len(s) || r > math.MaxUint16 {
+		return 0, p.errorf("invalid Char %q", s)
+	}
+	return r, nil
+}
+
+func str16(s string) ([]byte, error) {
+	if len(s) > math.MaxUint16 {
+		return nil, xerrors.Errorf("ParseText error: too long Str16: %v", len(s))
+	}
+	return MarshalStr16(s), nil
+}
+
+var textIntTypes = map[string]struct {
+	min, max int64
+	marshal  func(int) []byte
+}{
+	"SByte":  {math.MinInt8, math.MaxInt8, MarshalSByte},
+	"Byte":   {0, math.MaxUint8, MarshalByte},
+	"Short":  {math.MinInt16, math.MaxInt16, MarshalShort},
+	"UShort": {0, math.MaxUint16, MarshalUShort},
+	"Int":    {math.MinInt32, math.MaxInt32, MarshalInt},
+	"UInt":   {0, math.MaxUint32, MarshalUInt},
+}
+
+var textIntArrayTypes = map[string]struct {
+	typ     Type
+	marshal func([]int) []byte
+}{
+	"SBytes":  {TypeSBytes, MarshalSBytes},
+	"Bytes":   {TypeBytes, MarshalBytes},
+	"Shorts":  {TypeShorts, MarshalShorts},
+	"UShorts": {TypeUShorts, MarshalUShorts},
+	"Ints":    {TypeInts, MarshalInts},
+	"UInts":   {TypeUInts, MarshalUInts},
+}
@@ -0,0 +1,192 @@
+package binary_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"wsnet2/binary"
+)
+
+func TestFormatText(t *testing.T) {
+	tests := []struct {
+		data []byte
+		exp  string
+	}{
+		{binary.MarshalNull(), `null`},
+		{binary.MarshalBool(true), `true`},
+		{binary.MarshalBool(false), `false`},
+		{binary.MarshalSByte(-1), `SByte(-1)`},
+		{binary.MarshalByte(255), `Byte(255)`},
+		{binary.MarshalChar('あ'), `Char('あ')`},
+		{binary.MarshalChar(0xd800), `Char(0xd800)`},
+		{binary.MarshalShort(-300), `Short(-300)`},
+		{binary.MarshalUShort(300), `UShort(300)`},
+		{binary.MarshalInt(-12345), `-12345`},
+		{binary.MarshalUInt(12345), `UInt(12345)`},
+		{binary.MarshalLong(math.MinInt64), `Long(-9223372036854775808)`},
+		{binary.MarshalULong(math.MaxUint64), `ULong(18446744073709551615)`},
+		{binary.MarshalFloat(1.41), `Float(1.41)`},
+		{binary.MarshalDouble(math.Inf(-1)), `Double(-Inf)`},
+		{binary.MarshalStr8("a\"b\n"), `"a\"b\n"`},
+		{binary.MarshalStr16("abc"), `Str16("abc")`},
+		{binary.MarshalObj(&binary.Obj{ClassId: 3, Body: []byte{}}), `Obj(3)[]`},
+		{
+			binary.MarshalObj(&binary.Obj{ClassId: 3, Body: append(binary.MarshalInt(1), binary.MarshalStr8("x")...)}),
+			`Obj(3)[1,"x"]`,
+		},
+		{binary.MarshalObj(&binary.Obj{ClassId: 4, Body: []byte{0xff, 0x01}}), `Obj(4)<ff01>`},
+		{binary.MarshalList(binary.List{binary.MarshalNull(), binary.MarshalStrings([]string{"a"})}), `[null,["a"]]`},
+		{
+			binary.MarshalDict(binary.Dict{"b": binary.MarshalInt(2), "a": binary.MarshalDict(binary.Dict{})}),
+			`{"a":{},"b":2}`,
+		},
+		{binary.MarshalBools([]bool{true, false}), `Bools[true,false]`},
+		{binary.MarshalSBytes([]int{-128, 127}), `SBytes[-128,127]`},
+		{binary.MarshalBytes([]int{}), `Bytes[]`},
+		{binary.MarshalChars([]rune("abc")), `Chars("abc")`},
+		{binary.MarshalShorts([]int{-1, 1}), `Shorts[-1,1]`},
+		{binary.MarshalUShorts([]int{1, 2}), `UShorts[1,2]`},
+		{binary.MarshalInts([]int{1, -2}), `Ints[1,-2]`},
+		{binary.MarshalUInts([]int{1, 2}), `UInts[1,2]`},
+		{binary.MarshalLongs([]int64{-1, 1}), `Longs[-1,1]`},
+		{binary.MarshalULongs([]uint64{1000, 2000}), `ULongs[1000,2000]`},
+		{binary.MarshalFloats([]float32{1, 1.41, 1.73}), `Floats[1,1.41,1.73]`},
+		{binary.MarshalDoubles([]float64{2.71, 3.14}), `Doubles[2.71,3.14]`},
+	}
+
+	for _, test := range tests {
+		str, err := binary.FormatText(test.data)
+		if err != nil {
+			t.Fatalf("FormatText(% x): %v", test.data, err)
+		}
+		if str != test.exp {
+			t.Fatalf("FormatText(% x) = %s, wants %s", test.data, str, test.exp)
+		}
+
+		b, err := binary.ParseText(str)
+		if err != nil {
+			t.Fatalf("ParseText(%s): %v", str, err)
+		}
+		if diff := cmp.Diff(unmarshalForCmp(t, b), unmarshalForCmp(t, test.data)); diff != "" {
+			t.Fatalf("ParseText(%s) (-got +want)\n%s", str, diff)
+		}
+	}
+}
+
+func TestParseText(t *testing.T) {
+	tests := []struct {
+		text string
+		exp  []byte
+	}{
+		{` 1 `, binary.MarshalInt(1)},
+		{`0x10`, binary.MarshalInt(16)},
+		{`4294967296`, binary.MarshalLong(4294967296)},
+		{`1.5`, binary.MarshalDouble(1.5)},
+		{`-Inf`, binary.MarshalDouble(math.Inf(-1))},
+		{`Char(97)`, binary.MarshalChar('a')},
+		{`Char("a")`, binary.MarshalChar('a')},
+		{`Str8("a")`, binary.MarshalStr8("a")},
+		{`"` + strings.Repeat("a", 256) + `"`, binary.MarshalStr16(strings.Repeat("a", 256))},
+		{
+			`Obj(1)[ Obj(2)[true], {"k" : [Byte(1)]} ]`,
+			binary.MarshalObj(&binary.Obj{ClassId: 1, Body: append(
+				binary.MarshalObj(&binary.Obj{ClassId: 2, Body: binary.MarshalBool(true)}),
+				binary.MarshalDict(binary.Dict{"k": binary.MarshalList(binary.List{binary.MarshalByte(1)})})...)}),
+		},
+	}
+
+	for _, test := range tests {
+		b, err := binary.ParseText(test.text)
+		if err != nil {
+			t.Fatalf("ParseText(%s): %v", test.text, err)
+		}
+		if diff := cmp.Diff(unmarshalForCmp(t, b), unmarshalForCmp(t, test.exp)); diff != "" {
+			t.Fatalf("ParseText(%s) (-got +want)\n%s", test.text, diff)
+		}
+	}
+}
+
+func TestCharsTextRoundTrip(t *testing.T) {
+	// Charsは UTF-16 のコード単位列なので、サロゲート単体も含めて元のバイト列に戻ること
+	tests := []struct {
+		data []byte
+		exp  string
+	}{
+		{binary.MarshalChars([]rune("a\"\n\u200b")), `Chars("a\"\n\u200b")`},
+		{binary.MarshalChars([]rune("😀")), `Chars("😀")`},
+		{[]byte{byte(binary.TypeChars), 0, 2, 0, 'a', 0xd8, 0x00}, `Chars("a\U0000d800")`},
+		{[]byte{byte(binary.TypeChars), 0, 2, 0xdc, 0x00, 0xd8, 0x3d}, `Chars("\U0000dc00\U0000d83d")`},
+	}
+
+	for _, test := range tests {
+		str, err := binary.FormatText(test.data)
+		if err != nil {
+			t.Fatalf("FormatText(% x): %v", test.data, err)
+		}
+		if str != test.exp {
+			t.Fatalf("FormatText(% x) = %s, wants %s", test.data, str, test.exp)
+		}
+		b, err := binary.ParseText(str)
+		if err != nil {
+			t.Fatalf("ParseText(%s): %v", str, err)
+		}
+		if diff := cmp.Diff(b, test.data); diff != "" {
+			t.Fatalf("ParseText(%s) (-got +want)\n%s", str, diff)
+		}
+	}
+}
+
+func TestParseTextError(t *testing.T) {
+	tests := []string{
+		``,
+		`nil`,
+		`Byte(256)`,
+		`SBytes[1,-129]`,
+		`Int(1`,
+		`[1,2`,
+		`{"a":1,"a":2}`,
+		`{a:1}`,
+		`"abc`,
+		`Char("ab")`,
+		`Chars("abc`,
+		`Obj(256)[]`,
+		`Obj(1)<zz>`,
+		`1 2`,
+		`Decimal(1)`,
+	}
+
+	for _, text := range tests {
+		if b, err := binary.ParseText(text); err == nil {
+			t.Fatalf("ParseText(%s) must error: % x", text, b)
+		}
+	}
+}
+
+func TestParseTextDict(t *testing.T) {
+	dict, err := binary.ParseTextDict(`{"k1": 1, "k2": "a"}`)
+	if err != nil {
+		t.Fatalf("ParseTextDict: %v", err)
+	}
+	exp := binary.Dict{"k1": binary.MarshalInt(1), "k2": binary.MarshalStr8("a")}
+	if diff := cmp.Diff(dict, exp); diff != "" {
+		t.Fatalf("ParseTextDict (-got +want)\n%s", diff)
+	}
+
+	if _, err := binary.ParseTextDict(`[1]`); err == nil {
+		t.Fatalf("ParseTextDict([1]) must error")
+	}
+}
+
+// unmarshalForCmp unmarshals the data to compare regardless of the Dict order.
+// Returns the data itself if it cannot be unmarshaled recursively (e.g. Obj with raw body).
+func unmarshalForCmp(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	u, err := binary.UnmarshalRecursive(data)
+	if err != nil {
+		return data
+	}
+	return []interface{}{binary.Type(data[0]), u}
+}
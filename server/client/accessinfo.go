@@ -14,18 +14,22 @@ type AccessInfo struct {
 	MACKey    string
 	Bearer    string
 	EncMACKey string
+
+	// Region : 優先するgame/hubサーバのリージョン (空なら指定なし)
+	Region string
 }
 
 // GenAccessinfo : AccessInfoを生成
 //
 // appkeyを知らないクライアントサイドは、この関数を使わずサーバから貰うこと
+// MACKeyはauth.MACSchemeSHA256を要求する
 func GenAccessInfo(lobby, appid, appkey, userid string) (*AccessInfo, error) {
 	bearer, err := auth.GenerateAuthData(appkey, userid, time.Now())
 	if err != nil {
 		return nil, err
 	}
 	mackey := auth.GenMACKey()
-	encmackey, err := auth.EncryptMACKey(appkey, mackey)
+	encmackey, err := auth.EncryptMACKeyWithScheme(appkey, mackey, auth.MACSchemeSHA256)
 	if err != nil {
 		return nil, err
 	}
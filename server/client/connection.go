@@ -2,8 +2,6 @@ package client
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha1"
 	"errors"
 	"hash"
 	"net/http"
@@ -15,6 +13,7 @@ import (
 	"github.com/shiguredo/websocket"
 	"golang.org/x/xerrors"
 
+	"wsnet2"
 	"wsnet2/auth"
 	"wsnet2/binary"
 	"wsnet2/common"
@@ -24,9 +23,10 @@ import (
 const reconnectInterval = 3 * time.Second
 
 var dialer = &websocket.Dialer{
-	Subprotocols:    []string{"wsnet2"},
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	Subprotocols:      binary.Subprotocols(binary.ProtocolVersion1),
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true,
 }
 
 type msgerr struct {
@@ -34,11 +34,6 @@ type msgerr struct {
 	err error
 }
 
-type marshaledMsg struct {
-	seq   int
-	frame []byte
-}
-
 type unrecoverableError struct {
 	error
 }
@@ -62,8 +57,11 @@ type Connection struct {
 
 	mumsg  sync.Mutex
 	msgseq int
-	msgbuf *common.RingBuf[marshaledMsg]
-	hmac   hash.Hash
+	msgbuf *common.RingBuf[binary.RegularMsg]
+
+	// hmac : 送信時にwsWriterのロック内で使う
+	hmac      hash.Hash
+	macScheme auth.MACScheme
 
 	lastev int
 	evch   chan binary.Event
@@ -71,6 +69,12 @@ type Connection struct {
 	sysmsg chan binary.Msg
 
 	done chan msgerr
+
+	// compThreshold : このサイズ以上のメッセージを圧縮する. 0なら圧縮しない.
+	compThreshold int
+
+	// protoVer : ネゴシエートされたプロトコルバージョン
+	protoVer atomic.Int32
 }
 
 // Send : Msg (RegularMsg) を送信（バッファに書き込み、自動再送対象）
@@ -78,10 +82,7 @@ func (r *Connection) Send(typ binary.MsgType, payload []byte) error {
 	r.mumsg.Lock()
 	defer r.mumsg.Unlock()
 	next := r.msgseq + 1
-	err := r.msgbuf.Write(marshaledMsg{
-		next,
-		binary.BuildRegularMsgFrame(typ, next, payload, r.hmac),
-	})
+	err := r.msgbuf.Write(binary.NewRegularMsg(typ, next, payload))
 	if err != nil {
 		return xerrors.Errorf("write to msgbuf: %w", err)
 	}
@@ -102,6 +103,16 @@ func (r *Connection) SendSystemMsg(msg binary.Msg) error {
 	}
 }
 
+// CompressionThreshold : メッセージを圧縮するサイズの閾値 (0は圧縮しない)
+func (c *Connection) CompressionThreshold() int {
+	return c.compThreshold
+}
+
+// ProtocolVersion : 直近の接続でネゴシエートされたプロトコルバージョン
+func (c *Connection) ProtocolVersion() int {
+	return int(c.protoVer.Load())
+}
+
 // Events : Eventが流れてくるチャネル
 func (c *Connection) Events() <-chan binary.Event {
 	return c.evch
@@ -125,7 +136,11 @@ func newConn(ctx context.Context, accinfo *AccessInfo, joined *pb.JoinedRoomRes,
 		return nil, xerrors.Errorf("bearer: %w", err)
 	}
 
-	mac := hmac.New(sha1.New, []byte(accinfo.MACKey))
+	macScheme := auth.MACScheme(joined.MacScheme)
+	mac, err := auth.NewMsgHMAC(macScheme, accinfo.MACKey)
+	if err != nil {
+		return nil, xerrors.Errorf("hmac: %w", err)
+	}
 
 	conn := &Connection{
 		appid:  accinfo.AppId,
@@ -133,16 +148,65 @@ func newConn(ctx context.Context, accinfo *AccessInfo, joined *pb.JoinedRoomRes,
 		url:    joined.Url,
 		bearer: "Bearer " + bearer,
 
-		msgbuf: common.NewRingBuf[marshaledMsg](32),
-		hmac:   mac,
+		msgbuf: common.NewRingBuf[binary.RegularMsg](32),
+
+		hmac:      mac,
+		macScheme: macScheme,
 
 		evch:   make(chan binary.Event, 32),
 		sysmsg: make(chan binary.Msg),
 		done:   make(chan msgerr, 1),
+
+		compThreshold: int(joined.CompressionThreshold),
 	}
 
 	conn.deadline.Store(joined.Deadline)
+	conn.start(ctx, warn)
+
+	return conn, nil
+}
+
+// Resume : 切断したConnectionと同じクライアントとして接続し直す.
+// 受信済みの最後のEventの通番をWsnet2-LastEventSeqで送り、続きのEventを受け取る. 未送信のMsgも引き継ぐ.
+// Waitが返った後に呼ぶこと.
+// 接続先にクライアントが残っていない、または続きのEventが再送バッファに無いときは、EvPeerReadyを受け取る前に終了する.
+func (c *Connection) Resume(ctx context.Context, warn func(error)) *Connection {
+	c.mumsg.Lock()
+	msgseq := c.msgseq
+	c.mumsg.Unlock()
+
+	conn := &Connection{
+		appid:  c.appid,
+		userid: c.userid,
+		url:    c.url,
+		bearer: c.bearer,
+
+		msgseq: msgseq,
+		msgbuf: c.msgbuf,
+
+		hmac:      c.hmac,
+		macScheme: c.macScheme,
+
+		lastev: c.lastev,
+		evch:   make(chan binary.Event, 32),
+		sysmsg: make(chan binary.Msg),
+		done:   make(chan msgerr, 1),
+
+		compThreshold: c.compThreshold,
+	}
+
+	conn.deadline.Store(c.deadline.Load())
+	conn.start(ctx, warn)
+
+	return conn
+}
 
+// LastEventSeq : 受信済みの最後のRegularEventの通番. Waitが返った後に呼ぶこと
+func (c *Connection) LastEventSeq() int {
+	return c.lastev
+}
+
+func (conn *Connection) start(ctx context.Context, warn func(error)) {
 	if warn == nil {
 		warn = func(error) {}
 	}
@@ -152,8 +216,6 @@ func newConn(ctx context.Context, accinfo *AccessInfo, joined *pb.JoinedRoomRes,
 		conn.done <- msgerr{msg, err}
 		close(conn.evch)
 	}()
-
-	return conn, nil
 }
 
 func (conn *Connection) connect(ctx context.Context, warn func(error)) (string, error) {
@@ -179,6 +241,7 @@ func (conn *Connection) connect(ctx context.Context, warn func(error)) (string,
 		hdr.Add("Wsnet2-User", conn.userid)
 		hdr.Add("Wsnet2-LastEventSeq", strconv.Itoa(conn.lastev))
 		hdr.Add("Authorization", conn.bearer)
+		hdr.Add("Wsnet2-ClientVersion", "wsnet2-go/"+wsnet2.Version)
 
 		ws, res, err := dialer.DialContext(ctx, conn.url, hdr)
 		if err != nil {
@@ -195,25 +258,32 @@ func (conn *Connection) connect(ctx context.Context, warn func(error)) (string,
 			}
 		}
 
+		ver, err := binary.ParseSubprotocol(ws.Subprotocol())
+		if err != nil {
+			ws.Close()
+			return "unknown protocol", xerrors.Errorf("dial: %w", err)
+		}
+		conn.protoVer.Store(int32(ver))
+
 		conctx, cancel := context.WithCancel(ctx)
 		done := make(chan error, 4)
 		var wg sync.WaitGroup
 		wg.Add(1)
 		go func() {
-			done <- conn.receiver(conctx, ws, func(lastmsgseq int) {
+			done <- conn.receiver(conctx, ws, func(lastmsgseq int, nonce []byte) {
 				retrylimit = nil
-				var mu sync.Mutex
+				w := &wsWriter{ws: ws, nonce: nonce}
 				wg.Add(3)
 				go func() {
-					done <- conn.pinger(conctx, ws, &mu)
+					done <- conn.pinger(conctx, w)
 					wg.Done()
 				}()
 				go func() {
-					done <- conn.sender(conctx, ws, &mu, lastmsgseq)
+					done <- conn.sender(conctx, w, lastmsgseq)
 					wg.Done()
 				}()
 				go func() {
-					done <- conn.systemSender(conctx, ws, &mu)
+					done <- conn.systemSender(conctx, w)
 					wg.Done()
 				}()
 			})
@@ -227,6 +297,10 @@ func (conn *Connection) connect(ctx context.Context, warn func(error)) (string,
 		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 			return err.(*websocket.CloseError).Text, nil
 		}
+		if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			// プロトコルバージョンが受け入れられないなど. 再接続しても同じ.
+			return err.(*websocket.CloseError).Text, err
+		}
 		if ue := unrecoverable(nil); errors.As(err, &ue) {
 			return "give up on reconnection", ue.Unwrap()
 		}
@@ -242,7 +316,7 @@ func (conn *Connection) connect(ctx context.Context, warn func(error)) (string,
 	}
 }
 
-func (conn *Connection) receiver(ctx context.Context, ws *websocket.Conn, startsender func(int)) error {
+func (conn *Connection) receiver(ctx context.Context, ws *websocket.Conn, startsender func(int, []byte)) error {
 	for {
 		select {
 		case <-ctx.Done():
@@ -275,7 +349,14 @@ func (conn *Connection) receiver(ctx context.Context, ws *websocket.Conn, starts
 			if err != nil {
 				return xerrors.Errorf("unmarshal peer-ready payload %v: %w", ev.Type(), err)
 			}
-			startsender(msgseq)
+			var nonce []byte
+			if conn.macScheme == auth.MACSchemeSHA256 {
+				nonce, err = binary.UnmarshalEvPeerReadyNonce(ev.Payload())
+				if err != nil {
+					return xerrors.Errorf("unmarshal peer-ready nonce: %w", err)
+				}
+			}
+			startsender(msgseq, nonce)
 
 		case binary.EvTypeRoomProp:
 			deadline, err := binary.GetRoomPropClientDeadline(ev.Payload())
@@ -301,16 +382,9 @@ func (conn *Connection) receiver(ctx context.Context, ws *websocket.Conn, starts
 	}
 }
 
-func (conn *Connection) pinger(ctx context.Context, ws *websocket.Conn, mu *sync.Mutex) error {
+func (conn *Connection) pinger(ctx context.Context, w *wsWriter) error {
 	for {
-		conn.mumsg.Lock()
-		msg := binary.NewMsgPing(time.Now()).Marshal(conn.hmac)
-		conn.mumsg.Unlock()
-
-		mu.Lock()
-		ws.SetWriteDeadline(time.Now().Add(time.Second))
-		err := ws.WriteMessage(websocket.BinaryMessage, msg)
-		mu.Unlock()
+		err := conn.writeMsg(w, binary.NewMsgPing(time.Now()))
 		if err != nil {
 			return xerrors.Errorf("pinger: %w", err)
 		}
@@ -324,7 +398,7 @@ func (conn *Connection) pinger(ctx context.Context, ws *websocket.Conn, mu *sync
 	}
 }
 
-func (conn *Connection) sender(ctx context.Context, ws *websocket.Conn, mu *sync.Mutex, lastseq int) error {
+func (conn *Connection) sender(ctx context.Context, w *wsWriter, lastseq int) error {
 	for {
 		msgs, err := conn.msgbuf.Read(lastseq)
 		if err != nil {
@@ -337,14 +411,11 @@ func (conn *Connection) sender(ctx context.Context, ws *websocket.Conn, mu *sync
 				return ctx.Err()
 			default:
 			}
-			mu.Lock()
-			ws.SetWriteDeadline(time.Now().Add(time.Second))
-			err := ws.WriteMessage(websocket.BinaryMessage, msg.frame)
-			mu.Unlock()
+			err := conn.writeMsg(w, msg)
 			if err != nil {
-				return xerrors.Errorf("sender write(%v): %w", msg.seq, err)
+				return xerrors.Errorf("sender write(%v): %w", msg.SequenceNum(), err)
 			}
-			lastseq = msg.seq
+			lastseq = msg.SequenceNum()
 		}
 
 		select {
@@ -355,7 +426,7 @@ func (conn *Connection) sender(ctx context.Context, ws *websocket.Conn, mu *sync
 	}
 }
 
-func (conn *Connection) systemSender(ctx context.Context, ws *websocket.Conn, mu *sync.Mutex) error {
+func (conn *Connection) systemSender(ctx context.Context, w *wsWriter) error {
 	for {
 		var msg binary.Msg
 		select {
@@ -364,16 +435,44 @@ func (conn *Connection) systemSender(ctx context.Context, ws *websocket.Conn, mu
 		case msg = <-conn.sysmsg:
 		}
 
-		conn.mumsg.Lock()
-		frame := msg.Marshal(conn.hmac)
-		conn.mumsg.Unlock()
-
-		mu.Lock()
-		ws.SetWriteDeadline(time.Now().Add(time.Second))
-		err := ws.WriteMessage(websocket.BinaryMessage, frame)
-		mu.Unlock()
+		err := conn.writeMsg(w, msg)
 		if err != nil {
 			return xerrors.Errorf("systemSender write: %w", err)
 		}
 	}
 }
+
+// wsWriter : 1つのwebsocket接続への送信
+type wsWriter struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+
+	// nonce : EvPeerReadyで通知されたnonce (auth.MACSchemeSHA256のみ)
+	nonce []byte
+	// frames : この接続で送信したフレーム数
+	frames uint32
+}
+
+// writeMsg : MsgにHMACを付与して送信する.
+// HMACは送信順に決まるフレーム番号を含むため、送信用のmutex内で計算する.
+func (conn *Connection) writeMsg(w *wsWriter, msg binary.Msg) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var data []byte
+	if w.nonce != nil {
+		w.frames++
+		data = msg.MarshalWithBinding(conn.hmac, binary.MsgMACBinding(w.nonce, w.frames))
+	} else {
+		data = msg.Marshal(conn.hmac)
+	}
+	return conn.writeMessage(w.ws, data)
+}
+
+// writeMessage : サイズに応じて圧縮を切り替えて送信する.
+// 送信用のmutexを取得してから呼び出す.
+func (conn *Connection) writeMessage(ws *websocket.Conn, data []byte) error {
+	ws.EnableWriteCompression(conn.compThreshold > 0 && len(data) >= conn.compThreshold)
+	ws.SetWriteDeadline(time.Now().Add(time.Second))
+	return ws.WriteMessage(websocket.BinaryMessage, data)
+}
@@ -0,0 +1,844 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"wsnet2/binary"
+	"wsnet2/client"
+	"wsnet2/common"
+	"wsnet2/pb"
+	"wsnet2/storage"
+	"wsnet2/testserver"
+)
+
+func startTestServer(t *testing.T) *testserver.Server {
+	t.Helper()
+	ts, err := testserver.Start(nil)
+	if err != nil {
+		t.Fatalf("testserver.Start: %+v", err)
+	}
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func accessInfo(t *testing.T, ts *testserver.Server, userId string) *client.AccessInfo {
+	t.Helper()
+	accinfo, err := ts.AccessInfo(userId)
+	if err != nil {
+		t.Fatalf("AccessInfo(%v): %+v", userId, err)
+	}
+	return accinfo
+}
+
+// waitMessage : EvTypeMessageを受け取るまで待つ
+func waitMessage(t *testing.T, ctx context.Context, conn *client.Connection) (string, []byte) {
+	t.Helper()
+	for {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("waiting message: %v", ctx.Err())
+		case ev, ok := <-conn.Events():
+			if !ok {
+				t.Fatalf("connection closed")
+			}
+			if ev.Type() != binary.EvTypeMessage {
+				continue
+			}
+			sender, body, err := binary.UnmarshalEvMessage(ev.Payload())
+			if err != nil {
+				t.Fatalf("UnmarshalEvMessage: %+v", err)
+			}
+			return sender, body
+		}
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	ts := startTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	warn := func(err error) { t.Logf("warn: %+v", err) }
+
+	roomopt := &pb.RoomOption{
+		Visible:     true,
+		Joinable:    true,
+		Watchable:   true,
+		WithNumber:  true,
+		SearchGroup: 1,
+		MaxPlayers:  4,
+		PublicProps: binary.MarshalDict(binary.Dict{"mode": binary.MarshalStr8("e2e")}),
+	}
+	room, conn1, err := client.Create(ctx, accessInfo(t, ts, "user1"), roomopt, &pb.ClientInfo{Id: "user1"}, warn)
+	if err != nil {
+		t.Fatalf("Create: %+v", err)
+	}
+	if room.Number == nil || *room.Number == 0 {
+		t.Fatalf("room number is not assigned: %v", room.Number)
+	}
+
+	_, conn2, err := client.JoinByNumber(ctx, accessInfo(t, ts, "user2"), *room.Number, client.NewQuery(), &pb.ClientInfo{Id: "user2"}, warn)
+	if err != nil {
+		t.Fatalf("JoinByNumber: %+v", err)
+	}
+
+	_, conn3, err := client.Watch(ctx, accessInfo(t, ts, "watcher1"), room.Id, nil, warn)
+	if err != nil {
+		t.Fatalf("Watch: %+v", err)
+	}
+
+	hubs, err := ts.Storage.GetRoomHubs(ctx, room.Id)
+	if err != nil || len(hubs) != 1 || hubs[0].HostId != ts.HubHostId {
+		t.Fatalf("watcher is not watching via the hub: hubs=%v, err=%v", hubs, err)
+	}
+
+	msg := binary.MarshalStr8("hello")
+	if err := conn1.Send(binary.MsgTypeBroadcast, msg); err != nil {
+		t.Fatalf("Send: %+v", err)
+	}
+
+	for name, conn := range map[string]*client.Connection{"player": conn2, "watcher": conn3} {
+		sender, body := waitMessage(t, ctx, conn)
+		if sender != "user1" || string(body) != string(msg) {
+			t.Errorf("%v received (%v, %v), wants (user1, %v)", name, sender, body, msg)
+		}
+	}
+
+	rooms, err := ts.Storage.SearchRooms(ctx, testserver.DefaultAppId, 1, 10)
+	if err != nil || len(rooms) != 1 || rooms[0].Id != room.Id {
+		t.Fatalf("SearchRooms: rooms=%v, err=%v", rooms, err)
+	}
+
+	for _, conn := range []*client.Connection{conn1, conn2, conn3} {
+		conn.Send(binary.MsgTypeLeave, binary.MarshalLeavePayload("bye"))
+		if _, err := conn.Wait(ctx); err != nil {
+			t.Errorf("Wait: %+v", err)
+		}
+	}
+
+	// player_eventは非同期に書き込まれる
+	evs := waitPlayerEvents(t, ctx, ts, "user2", "Disconnect")
+	details := make(map[string]map[string]any)
+	for _, ev := range evs {
+		if ev.RoomID != room.Id {
+			t.Errorf("event room = %v, wants %v", ev.RoomID, room.Id)
+		}
+		var d map[string]any
+		if err := json.Unmarshal([]byte(ev.Detail), &d); err != nil {
+			t.Fatalf("detail of %v: %v", ev.Event, ev.Detail)
+		}
+		details[ev.Event] = d
+	}
+	if src := details["Join"]["source"]; src != common.JoinSourceNumber {
+		t.Errorf("join source = %v, wants %v", src, common.JoinSourceNumber)
+	}
+	if v, _ := details["Connect"]["client_version"].(string); !strings.HasPrefix(v, "wsnet2-go/") {
+		t.Errorf("client version = %v", details["Connect"])
+	}
+	if details["Connect"]["remote_addr"] == "" {
+		t.Errorf("remote addr is empty: %v", details["Connect"])
+	}
+	if details["Leave"]["cause"] != "bye" {
+		t.Errorf("leave cause = %v", details["Leave"])
+	}
+	if sent, _ := details["Disconnect"]["bytes_sent"].(float64); sent == 0 {
+		t.Errorf("bytes sent = %v", details["Disconnect"])
+	}
+	if recv, _ := details["Disconnect"]["bytes_received"].(float64); recv == 0 {
+		t.Errorf("bytes received = %v", details["Disconnect"])
+	}
+
+	evs = waitPlayerEvents(t, ctx, ts, "user1", "Leave")
+	if evs[0].Event != "Join" || evs[0].Detail != `{"source":"create"}` {
+		t.Errorf("first event of user1 = %+v", evs[0])
+	}
+	if evs, _ := ts.Storage.PlayerEvents(ctx, &storage.PlayerEventFilter{PlayerId: "watcher1"}); len(evs) != 0 {
+		t.Errorf("watcher events are recorded: %v", evs)
+	}
+}
+
+// waitPlayerEvents : eventが記録されるまで待って、そのプレイヤーのplayer_eventを返す
+func waitPlayerEvents(t *testing.T, ctx context.Context, ts *testserver.Server, playerId, event string) []*storage.PlayerEvent {
+	t.Helper()
+	for {
+		evs, err := ts.Storage.PlayerEvents(ctx, &storage.PlayerEventFilter{PlayerId: playerId})
+		if err != nil {
+			t.Fatalf("PlayerEvents: %+v", err)
+		}
+		for _, ev := range evs {
+			if ev.Event == event {
+				return evs
+			}
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("waiting player event %v of %v: %v", event, playerId, evs)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestEndToEndReconnectOldProtocol(t *testing.T) {
+	ts := startTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	warn := func(err error) { t.Logf("warn: %+v", err) }
+
+	roomopt := &pb.RoomOption{Visible: true, Joinable: true, MaxPlayers: 4}
+	room, conn1, err := client.Create(ctx, accessInfo(t, ts, "user1"), roomopt, &pb.ClientInfo{Id: "user1"}, warn)
+	if err != nil {
+		t.Fatalf("Create: %+v", err)
+	}
+	conns := client.SetDialHook(t, binary.ProtocolVersion2)
+	_, conn2, err := client.Join(ctx, accessInfo(t, ts, "user2"), room.Id, client.NewQuery(), &pb.ClientInfo{Id: "user2"}, warn)
+	if err != nil {
+		t.Fatalf("Join: %+v", err)
+	}
+	conn1.Send(binary.MsgTypeBroadcast, binary.MarshalStr8("hello"))
+	waitMessage(t, ctx, conn2)
+	if v := conn2.ProtocolVersion(); v != binary.ProtocolVersion2 {
+		t.Fatalf("protocol version = %v, wants %v", v, binary.ProtocolVersion2)
+	}
+
+	// v2でのみ受信できるイベントが積まれている間に、v1で再接続する
+	client.SetDialHook(t, binary.ProtocolVersion1)
+	conns.CloseAll()
+	conn1.Send(binary.MsgTypeRoomState, binary.MarshalDict(binary.Dict{"turn": binary.MarshalInt(1)}))
+	conn1.Send(binary.MsgTypeTopicBroadcast, binary.MarshalTopicBroadcastPayload("score", binary.MarshalStr8("topic")))
+	conn1.Send(binary.MsgTypeBroadcast, binary.MarshalStr8("plain"))
+
+	// トピック付きのBroadcastはEvTypeMessageに変換され、room stateは届かない
+	for _, want := range []string{"topic", "plain"} {
+		var ev binary.Event
+		for ev == nil || binary.IsSystemEvent(ev) {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("waiting %q: %v", want, ctx.Err())
+			case ev = <-conn2.Events():
+			}
+		}
+		if ev.Type() != binary.EvTypeMessage {
+			t.Fatalf("event type = %v, wants %v", ev.Type(), binary.EvTypeMessage)
+		}
+		_, body, err := binary.UnmarshalEvMessage(ev.Payload())
+		if err != nil {
+			t.Fatalf("UnmarshalEvMessage: %+v", err)
+		}
+		if string(body) != string(binary.MarshalStr8(want)) {
+			t.Fatalf("message = %v, wants %q", body, want)
+		}
+	}
+	if v := conn2.ProtocolVersion(); v != binary.ProtocolVersion1 {
+		t.Fatalf("protocol version = %v, wants %v", v, binary.ProtocolVersion1)
+	}
+
+	conn2.Send(binary.MsgTypeLeave, binary.MarshalLeavePayload("bye"))
+	if _, err := conn2.Wait(ctx); err != nil {
+		t.Errorf("Wait: %+v", err)
+	}
+	conn1.Send(binary.MsgTypeLeave, binary.MarshalLeavePayload("bye"))
+	if _, err := conn1.Wait(ctx); err != nil {
+		t.Errorf("Wait: %+v", err)
+	}
+}
+
+func TestEndToEndWatcherChatRateLimit(t *testing.T) {
+	ts := startTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	warn := func(err error) { t.Logf("warn: %+v", err) }
+
+	roomopt := &pb.RoomOption{Visible: true, Joinable: true, Watchable: true, MaxPlayers: 4}
+	room, conn1, err := client.Create(ctx, accessInfo(t, ts, "user1"), roomopt, &pb.ClientInfo{Id: "user1"}, warn)
+	if err != nil {
+		t.Fatalf("Create: %+v", err)
+	}
+
+	// hub経由の観戦者とgameに直接接続した観戦者
+	_, hubWatcher, err := client.Watch(ctx, accessInfo(t, ts, "watcher1"), room.Id, nil, warn)
+	if err != nil {
+		t.Fatalf("Watch: %+v", err)
+	}
+	gconn, err := grpc.Dial(fmt.Sprintf("%s:%d", ts.Config.Game.Hostname, ts.Config.Game.GRPCPort),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.Dial: %+v", err)
+	}
+	defer gconn.Close()
+	wshost := fmt.Sprintf("%s:%d", ts.Config.Game.Hostname, ts.Config.Game.WebsocketPort)
+	_, gameWatcher, err := client.WatchDirect(ctx, gconn, wshost, testserver.DefaultAppId, room.Id, &pb.ClientInfo{Id: "watcher2"}, warn)
+	if err != nil {
+		t.Fatalf("WatchDirect: %+v", err)
+	}
+
+	burst := ts.Config.Game.ClientConf.WatcherChatBurst
+	for name, conn := range map[string]*client.Connection{"hub": hubWatcher, "game": gameWatcher} {
+		for i := 0; i <= burst; i++ {
+			conn.Send(binary.MsgTypeWatcherChat, binary.MarshalStr8("hi"))
+		}
+		// 流量制限を超えた分は送信者に拒否が通知される
+		for denied := false; !denied; {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("%v: waiting permission denied: %v", name, ctx.Err())
+			case ev := <-conn.Events():
+				denied = ev.Type() == binary.EvTypePermissionDenied
+			}
+		}
+	}
+
+	for _, conn := range []*client.Connection{hubWatcher, gameWatcher, conn1} {
+		conn.Send(binary.MsgTypeLeave, binary.MarshalLeavePayload("bye"))
+		if _, err := conn.Wait(ctx); err != nil {
+			t.Errorf("Wait: %+v", err)
+		}
+	}
+}
+
+func TestEndToEndWatchDelayHubTree(t *testing.T) {
+	conf := testserver.DefaultConfig()
+	conf.Lobby.HubMaxWatchers = 1
+	ts, err := testserver.Start(&testserver.Options{Config: conf, Hubs: 2})
+	if err != nil {
+		t.Fatalf("testserver.Start: %+v", err)
+	}
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	warn := func(err error) { t.Logf("warn: %+v", err) }
+
+	const delay = time.Second
+	roomopt := &pb.RoomOption{
+		Visible:    true,
+		Joinable:   true,
+		Watchable:  true,
+		MaxPlayers: 4,
+		WatchDelay: uint32(delay / time.Second),
+	}
+	room, conn1, err := client.Create(ctx, accessInfo(t, ts, "user1"), roomopt, &pb.ClientInfo{Id: "user1"}, warn)
+	if err != nil {
+		t.Fatalf("Create: %+v", err)
+	}
+
+	_, conn2, err := client.Watch(ctx, accessInfo(t, ts, "watcher1"), room.Id, nil, warn)
+	if err != nil {
+		t.Fatalf("Watch: %+v", err)
+	}
+
+	// 1台目のhubがhub_max_watchersに達したら、2人目は子hubに割り当てられる
+	for {
+		hubs, _ := ts.Storage.GetRoomHubs(ctx, room.Id)
+		if len(hubs) == 1 && hubs[0].Watchers >= conf.Lobby.HubMaxWatchers {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("waiting hub watchers: %v", ctx.Err())
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	room3, conn3, err := client.Watch(ctx, accessInfo(t, ts, "watcher2"), room.Id, nil, warn)
+	if err != nil {
+		t.Fatalf("Watch: %+v", err)
+	}
+	if hubs, err := ts.Storage.GetRoomHubs(ctx, room.Id); err != nil || len(hubs) != 2 {
+		t.Fatalf("watcher2 is not watching via a child hub: hubs=%v, err=%v", hubs, err)
+	}
+	if room3.WatchDelay != roomopt.WatchDelay {
+		t.Errorf("child hub WatchDelay = %v, wants %v", room3.WatchDelay, roomopt.WatchDelay)
+	}
+
+	start := time.Now()
+	if err := conn1.Send(binary.MsgTypeBroadcast, binary.MarshalStr8("hello")); err != nil {
+		t.Fatalf("Send: %+v", err)
+	}
+
+	// 遅延は親hubでのみ行われ、子hubで重ならない
+	for name, conn := range map[string]*client.Connection{"parent": conn2, "child": conn3} {
+		waitMessage(t, ctx, conn)
+		if d := time.Since(start); d < delay || d >= delay*3/2 {
+			t.Errorf("%v hub watcher received after %v, wants %v", name, d, delay)
+		}
+	}
+
+	for _, conn := range []*client.Connection{conn3, conn2, conn1} {
+		conn.Send(binary.MsgTypeLeave, binary.MarshalLeavePayload("bye"))
+		if _, err := conn.Wait(ctx); err != nil {
+			t.Errorf("Wait: %+v", err)
+		}
+	}
+}
+
+func TestEndToEndRoomRegistry(t *testing.T) {
+	ts := startTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	warn := func(err error) { t.Logf("warn: %+v", err) }
+
+	roomopt := &pb.RoomOption{
+		Visible:     true,
+		Joinable:    true,
+		SearchGroup: 2,
+		MaxPlayers:  4,
+	}
+	room, conn1, err := client.Create(ctx, accessInfo(t, ts, "user1"), roomopt, &pb.ClientInfo{Id: "user1"}, warn)
+	if err != nil {
+		t.Fatalf("Create: %+v", err)
+	}
+
+	// DBから部屋を消しても、gameサーバから同期された部屋でlobbyが検索できる
+	if err := ts.Storage.DeleteRoom(ctx, room.Id); err != nil {
+		t.Fatalf("DeleteRoom: %+v", err)
+	}
+
+	var conn2 *client.Connection
+	for conn2 == nil {
+		joined, conn, err := client.RandomJoin(ctx, accessInfo(t, ts, "user2"), 2, client.NewQuery(), &pb.ClientInfo{Id: "user2"}, warn)
+		if err == nil {
+			if joined.Id != room.Id {
+				t.Fatalf("RandomJoin: room=%v, wants %v", joined.Id, room.Id)
+			}
+			conn2 = conn
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("RandomJoin: %+v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	for _, conn := range []*client.Connection{conn1, conn2} {
+		conn.Send(binary.MsgTypeLeave, binary.MarshalLeavePayload("bye"))
+		if _, err := conn.Wait(ctx); err != nil {
+			t.Errorf("Wait: %+v", err)
+		}
+	}
+}
+
+func TestEndToEndGameAdmin(t *testing.T) {
+	ts := startTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	warn := func(err error) { t.Logf("warn: %+v", err) }
+
+	roomopt := &pb.RoomOption{
+		Visible:     true,
+		Joinable:    true,
+		SearchGroup: 3,
+		MaxPlayers:  4,
+	}
+	room, conn1, err := client.Create(ctx, accessInfo(t, ts, "user1"), roomopt, &pb.ClientInfo{Id: "user1"}, warn)
+	if err != nil {
+		t.Fatalf("Create: %+v", err)
+	}
+
+	gconn, err := grpc.Dial(fmt.Sprintf("%s:%d", ts.Config.Game.Hostname, ts.Config.Game.GRPCPort),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.Dial: %+v", err)
+	}
+	defer gconn.Close()
+	admin := pb.NewGameAdminClient(gconn)
+	appId := testserver.DefaultAppId
+
+	var group uint32 = 3
+	list, err := admin.ListRooms(ctx, &pb.ListRoomsReq{AppId: appId, SearchGroup: &group, ClientId: "user1"})
+	if err != nil || len(list.Rooms) != 1 || list.Rooms[0].Id != room.Id {
+		t.Fatalf("ListRooms: %v, %v", list, err)
+	}
+	list, err = admin.ListRooms(ctx, &pb.ListRoomsReq{AppId: appId, ClientId: "user2"})
+	if err != nil || len(list.Rooms) != 0 {
+		t.Fatalf("ListRooms(user2): %v, %v", list, err)
+	}
+
+	stream, err := admin.WatchRoom(ctx, &pb.AdminRoomReq{AppId: appId, RoomId: room.Id})
+	if err != nil {
+		t.Fatalf("WatchRoom: %+v", err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatalf("WatchRoom header: %+v", err)
+	}
+
+	msg := binary.MarshalStr8("notice")
+	if _, err := admin.Broadcast(ctx, &pb.AdminBroadcastReq{AppId: appId, RoomId: room.Id, Data: msg}); err != nil {
+		t.Fatalf("Broadcast: %+v", err)
+	}
+	if sender, body := waitMessage(t, ctx, conn1); sender != "" || string(body) != string(msg) {
+		t.Fatalf("player received (%q, %v), wants (\"\", %v)", sender, body, msg)
+	}
+	ev, err := stream.Recv()
+	if err != nil || binary.EvType(ev.Type) != binary.EvTypeMessage {
+		t.Fatalf("WatchRoom Recv: %v, %v", ev, err)
+	}
+
+	visible := false
+	_, err = admin.UpdateRoomProps(ctx, &pb.UpdateRoomPropsReq{
+		AppId:       appId,
+		RoomId:      room.Id,
+		Visible:     &visible,
+		PublicProps: binary.MarshalDict(binary.Dict{"key": binary.MarshalInt(1)}),
+	})
+	if err != nil {
+		t.Fatalf("UpdateRoomProps: %+v", err)
+	}
+	ev, err = stream.Recv()
+	if err != nil || binary.EvType(ev.Type) != binary.EvTypeRoomProp {
+		t.Fatalf("WatchRoom Recv: %v, %v", ev, err)
+	}
+	rpp, err := binary.UnmarshalEvRoomPropPayload(ev.Payload)
+	if err != nil || rpp.Visible || !rpp.Joinable || rpp.SearchGroup != 3 || rpp.MaxPlayer != 4 {
+		t.Fatalf("EvRoomProp: %+v, %v", rpp, err)
+	}
+
+	if _, err := admin.SetRoomLogLevel(ctx, &pb.SetRoomLogLevelReq{AppId: appId, RoomId: room.Id, LogLevel: 0}); err == nil {
+		t.Fatalf("SetRoomLogLevel with invalid level must fail")
+	}
+	if _, err := admin.SetRoomLogLevel(ctx, &pb.SetRoomLogLevelReq{AppId: appId, RoomId: room.Id, LogLevel: 4}); err != nil {
+		t.Fatalf("SetRoomLogLevel: %+v", err)
+	}
+
+	if _, err := admin.CloseRoom(ctx, &pb.CloseRoomReq{AppId: appId, RoomId: room.Id, Reason: "maintenance"}); err != nil {
+		t.Fatalf("CloseRoom: %+v", err)
+	}
+	if _, err := conn1.Wait(ctx); err != nil {
+		t.Errorf("Wait: %+v", err)
+	}
+	// 部屋が終了するとstreamも終わる
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("WatchRoom Recv: %+v", err)
+		}
+	}
+}
+
+func TestEndToEndDrain(t *testing.T) {
+	ts := startTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	warn := func(err error) { t.Logf("warn: %+v", err) }
+
+	roomopt := &pb.RoomOption{Visible: true, Joinable: true, MaxPlayers: 4}
+	_, conn1, err := client.Create(ctx, accessInfo(t, ts, "user1"), roomopt, &pb.ClientInfo{Id: "user1"}, warn)
+	if err != nil {
+		t.Fatalf("Create: %+v", err)
+	}
+
+	for _, port := range []int{ts.Config.Game.GRPCPort, ts.Config.Hub.GRPCPort} {
+		gconn, err := grpc.Dial(fmt.Sprintf("%s:%d", ts.Config.Game.Hostname, port),
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatalf("grpc.Dial: %+v", err)
+		}
+		defer gconn.Close()
+		if _, err := pb.NewGameAdminClient(gconn).Drain(ctx, &pb.Empty{}); err != nil {
+			t.Fatalf("Drain(%v): %+v", port, err)
+		}
+	}
+
+	games, err := ts.Storage.GameServers(ctx)
+	if err != nil || len(games) != 1 || games[0].Status != common.HostStatusClosing {
+		t.Fatalf("game server is not closing: %v, %v", games, err)
+	}
+	hubs, err := ts.Storage.HubServers(ctx)
+	if err != nil || len(hubs) != 1 || hubs[0].Status != common.HostStatusClosing {
+		t.Fatalf("hub server is not closing: %v, %v", hubs, err)
+	}
+
+	// 停止中のgameサーバには新しい部屋を作らない
+	for {
+		_, conn, err := client.Create(ctx, accessInfo(t, ts, "user2"), roomopt, &pb.ClientInfo{Id: "user2"}, warn)
+		if err != nil {
+			break
+		}
+		conn.Send(binary.MsgTypeLeave, binary.MarshalLeavePayload("bye"))
+		select {
+		case <-ctx.Done():
+			t.Fatalf("room is created on the closing server")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// 既存の部屋はそのまま使える
+	conn1.Send(binary.MsgTypeLeave, binary.MarshalLeavePayload("bye"))
+	if _, err := conn1.Wait(ctx); err != nil {
+		t.Errorf("Wait: %+v", err)
+	}
+}
+
+func TestEndToEndBan(t *testing.T) {
+	ts := startTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	warn := func(err error) { t.Logf("warn: %+v", err) }
+
+	roomopt := &pb.RoomOption{Visible: true, Joinable: true, MaxPlayers: 4}
+	room, conn1, err := client.Create(ctx, accessInfo(t, ts, "user1"), roomopt, &pb.ClientInfo{Id: "user1"}, warn)
+	if err != nil {
+		t.Fatalf("Create: %+v", err)
+	}
+	_, conn2, err := client.Join(ctx, accessInfo(t, ts, "user2"), room.Id, client.NewQuery(), &pb.ClientInfo{Id: "user2"}, warn)
+	if err != nil {
+		t.Fatalf("Join: %+v", err)
+	}
+
+	conn1.Send(binary.MsgTypeBan, binary.MarshalBanPayload("user2", time.Hour, "bye"))
+	if _, err := conn2.Wait(ctx); err != nil {
+		t.Logf("Wait(user2): %+v", err)
+	}
+
+	// banされた部屋には再入室できない
+	_, _, err = client.Join(ctx, accessInfo(t, ts, "user2"), room.Id, client.NewQuery(), &pb.ClientInfo{Id: "user2"}, warn)
+	if err == nil || !strings.Contains(err.Error(), "Banned") {
+		t.Fatalf("Join after ban must be Banned: %v", err)
+	}
+
+	appId := testserver.DefaultAppId
+	for {
+		bans, err := ts.Storage.Bans(ctx, &storage.BanFilter{AppId: appId, UserId: "user2"})
+		if err != nil {
+			t.Fatalf("Bans: %+v", err)
+		}
+		if len(bans) == 1 {
+			if bans[0].RoomID != room.Id || bans[0].BannedBy != "user1" || !bans[0].Expires.Valid {
+				t.Fatalf("room ban: %+v", bans[0])
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("room ban is not stored")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// app全体のbanは部屋の作成も拒否する
+	err = ts.Storage.InsertBan(ctx, &storage.Ban{AppID: appId, UserID: "user3", Reason: "cheat", Created: time.Now()})
+	if err != nil {
+		t.Fatalf("InsertBan: %+v", err)
+	}
+	time.Sleep(time.Duration(ts.Config.Lobby.BanCacheExpire) * 2)
+	_, _, err = client.Create(ctx, accessInfo(t, ts, "user3"), roomopt, &pb.ClientInfo{Id: "user3"}, warn)
+	if err == nil || !strings.Contains(err.Error(), "Banned") {
+		t.Fatalf("Create by banned user must be Banned: %v", err)
+	}
+
+	conn1.Send(binary.MsgTypeLeave, binary.MarshalLeavePayload("bye"))
+	if _, err := conn1.Wait(ctx); err != nil {
+		t.Errorf("Wait: %+v", err)
+	}
+}
+
+func TestEndToEndBanWatch(t *testing.T) {
+	ts := startTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	warn := func(err error) { t.Logf("warn: %+v", err) }
+
+	roomopt := &pb.RoomOption{Visible: true, Joinable: true, Watchable: true, WithNumber: true, MaxPlayers: 4}
+	room, conn1, err := client.Create(ctx, accessInfo(t, ts, "user1"), roomopt, &pb.ClientInfo{Id: "user1"}, warn)
+	if err != nil {
+		t.Fatalf("Create: %+v", err)
+	}
+
+	// 部屋にいないプレイヤーもbanできる
+	conn1.Send(binary.MsgTypeBan, binary.MarshalBanPayload("watcher1", 0, "bye"))
+	appId := testserver.DefaultAppId
+	for {
+		bans, _ := ts.Storage.Bans(ctx, &storage.BanFilter{AppId: appId, UserId: "watcher1"})
+		if len(bans) == 1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("room ban is not stored")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	time.Sleep(time.Duration(ts.Config.Lobby.BanCacheExpire) * 2)
+
+	// lobby経由の観戦
+	_, _, err = client.Watch(ctx, accessInfo(t, ts, "watcher1"), room.Id, nil, warn)
+	if err == nil || !strings.Contains(err.Error(), "Banned") {
+		t.Errorf("Watch by banned user must be Banned: %v", err)
+	}
+	_, _, err = client.WatchByNumber(ctx, accessInfo(t, ts, "watcher1"), *room.Number, nil, warn)
+	if err == nil || !strings.Contains(err.Error(), "Banned") {
+		t.Errorf("WatchByNumber by banned user must be Banned: %v", err)
+	}
+
+	// game, hubへの直接の観戦
+	hosts := map[string][2]string{
+		"game": {
+			fmt.Sprintf("%s:%d", ts.Config.Game.Hostname, ts.Config.Game.GRPCPort),
+			fmt.Sprintf("%s:%d", ts.Config.Game.Hostname, ts.Config.Game.WebsocketPort),
+		},
+		"hub": {
+			fmt.Sprintf("%s:%d", ts.Config.Hub.Hostname, ts.Config.Hub.GRPCPort),
+			fmt.Sprintf("%s:%d", ts.Config.Hub.Hostname, ts.Config.Hub.WebsocketPort),
+		},
+	}
+	for name, host := range hosts {
+		conn, err := grpc.Dial(host[0], grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatalf("grpc.Dial: %+v", err)
+		}
+		defer conn.Close()
+		_, _, err = client.WatchDirect(ctx, conn, host[1], appId, room.Id, &pb.ClientInfo{Id: "watcher1"}, warn)
+		if err == nil || !strings.Contains(err.Error(), "PermissionDenied") {
+			t.Errorf("%v: WatchDirect by banned user must be PermissionDenied: %v", name, err)
+		}
+	}
+
+	// 部屋の終了時に部屋のbanは削除される
+	conn1.Send(binary.MsgTypeLeave, binary.MarshalLeavePayload("bye"))
+	if _, err := conn1.Wait(ctx); err != nil {
+		t.Errorf("Wait: %+v", err)
+	}
+	for {
+		bans, _ := ts.Storage.Bans(ctx, &storage.BanFilter{AppId: appId, UserId: "watcher1"})
+		if len(bans) == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("room ban is not deleted: %v", bans)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestEndToEndResume(t *testing.T) {
+	conf := testserver.DefaultConfig()
+	conf.Game.EventBufSize = 8
+	ts, err := testserver.Start(&testserver.Options{Config: conf})
+	if err != nil {
+		t.Fatalf("testserver.Start: %+v", err)
+	}
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	warn := func(err error) { t.Logf("warn: %+v", err) }
+
+	roomopt := &pb.RoomOption{Visible: true, Joinable: true, MaxPlayers: 4}
+	room, conn1, err := client.Create(ctx, accessInfo(t, ts, "user1"), roomopt, &pb.ClientInfo{Id: "user1"}, warn)
+	if err != nil {
+		t.Fatalf("Create: %+v", err)
+	}
+
+	ctx2, cancel2 := context.WithCancel(ctx)
+	_, conn2, err := client.Join(ctx2, accessInfo(t, ts, "user2"), room.Id, client.NewQuery(), &pb.ClientInfo{Id: "user2"}, warn)
+	if err != nil {
+		t.Fatalf("Join: %+v", err)
+	}
+	if err := conn1.Send(binary.MsgTypeBroadcast, binary.MarshalStr8("first")); err != nil {
+		t.Fatalf("Send: %+v", err)
+	}
+	waitMessage(t, ctx, conn2)
+	cancel2()
+	conn2.Wait(ctx)
+	lastev := conn2.LastEventSeq()
+
+	// 切断中のEventは続きから受け取れる
+	msg := binary.MarshalStr8("while away")
+	if err := conn1.Send(binary.MsgTypeBroadcast, msg); err != nil {
+		t.Fatalf("Send: %+v", err)
+	}
+	ctx3, cancel3 := context.WithCancel(ctx)
+	conn3 := conn2.Resume(ctx3, warn)
+	if sender, body := waitMessage(t, ctx, conn3); sender != "user1" || string(body) != string(msg) {
+		t.Fatalf("resumed connection received (%v, %v), wants (user1, %v)", sender, body, msg)
+	}
+	cancel3()
+	conn3.Wait(ctx)
+	if conn3.LastEventSeq() <= lastev {
+		t.Fatalf("last event seq = %v, wants > %v", conn3.LastEventSeq(), lastev)
+	}
+
+	// 再送バッファから溢れたら、EvPeerReadyの前に終了する
+	for i := 0; i < conf.Game.EventBufSize+1; i++ {
+		if err := conn1.Send(binary.MsgTypeBroadcast, msg); err != nil {
+			t.Fatalf("Send: %+v", err)
+		}
+	}
+	waitMessage(t, ctx, conn1)
+	time.Sleep(100 * time.Millisecond)
+	conn4 := conn3.Resume(ctx, warn)
+	for ev := range conn4.Events() {
+		if ev.Type() == binary.EvTypePeerReady {
+			t.Fatalf("resumed after the events were lost")
+		}
+	}
+}
+
+func TestEndToEndBroadcastHook(t *testing.T) {
+	secret := binary.MarshalStr8("hand")
+	public := binary.MarshalStr8("score")
+	ts, err := testserver.Start(&testserver.Options{
+		// 観戦者に見せない情報をサーバ側でプレイヤーのみに限定する
+		BroadcastHook: func(room *pb.RoomInfo, sender *pb.ClientInfo, scope binary.BroadcastScope, data []byte) binary.BroadcastScope {
+			if string(data) == string(secret) {
+				return binary.BroadcastScopePlayers
+			}
+			return scope
+		},
+	})
+	if err != nil {
+		t.Fatalf("testserver.Start: %+v", err)
+	}
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	warn := func(err error) { t.Logf("warn: %+v", err) }
+
+	roomopt := &pb.RoomOption{Visible: true, Joinable: true, Watchable: true, MaxPlayers: 4}
+	room, conn1, err := client.Create(ctx, accessInfo(t, ts, "user1"), roomopt, &pb.ClientInfo{Id: "user1"}, warn)
+	if err != nil {
+		t.Fatalf("Create: %+v", err)
+	}
+	_, conn2, err := client.Join(ctx, accessInfo(t, ts, "user2"), room.Id, client.NewQuery(), &pb.ClientInfo{Id: "user2"}, warn)
+	if err != nil {
+		t.Fatalf("Join: %+v", err)
+	}
+	_, conn3, err := client.Watch(ctx, accessInfo(t, ts, "watcher1"), room.Id, nil, warn)
+	if err != nil {
+		t.Fatalf("Watch: %+v", err)
+	}
+
+	// Masterでなくてもhookにより限定される
+	for _, msg := range [][]byte{secret, public} {
+		if err := conn2.Send(binary.MsgTypeBroadcast, msg); err != nil {
+			t.Fatalf("Send: %+v", err)
+		}
+	}
+
+	for _, want := range [][]byte{secret, public} {
+		if _, body := waitMessage(t, ctx, conn1); string(body) != string(want) {
+			t.Errorf("player received %v, wants %v", body, want)
+		}
+	}
+	if _, body := waitMessage(t, ctx, conn3); string(body) != string(public) {
+		t.Errorf("watcher received %v, wants %v", body, public)
+	}
+}
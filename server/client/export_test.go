@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"wsnet2/binary"
+)
+
+// NetConns : SetDialHook以降にdialした接続
+type NetConns struct {
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// CloseAll : 接続を切断してConnectionに再接続させる
+func (c *NetConns) CloseAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+}
+
+// SetDialHook : 以降の接続で送るsubprotocolをprotoVer以下に制限し、dialした接続を記録する
+func SetDialHook(t *testing.T, protoVer int) *NetConns {
+	t.Helper()
+	conns := &NetConns{}
+	orig := *dialer
+	t.Cleanup(func() { *dialer = orig })
+
+	var protos []string
+	for _, p := range orig.Subprotocols {
+		if v, err := binary.ParseSubprotocol(p); err == nil && v <= protoVer {
+			protos = append(protos, p)
+		}
+	}
+	dialer.Subprotocols = protos
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err == nil {
+			conns.mu.Lock()
+			conns.conns = append(conns.conns, conn)
+			conns.mu.Unlock()
+		}
+		return conn, err
+	}
+	return conns
+}
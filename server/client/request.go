@@ -101,8 +101,38 @@ func Watch(ctx context.Context, accinfo *AccessInfo, roomid string, query *Query
 	return connectToRoom(ctx, accinfo, res.Room, warn)
 }
 
+// WatchByNumber : 部屋番号で観戦入室
+func WatchByNumber(ctx context.Context, accinfo *AccessInfo, number int32, query *Query, warn func(error)) (*Room, *Connection, error) {
+	var q []lobby.PropQueries
+	if query != nil {
+		q = []lobby.PropQueries(*query)
+	}
+	param := lobby.JoinParam{
+		Queries:    q,
+		ClientInfo: &pb.ClientInfo{Id: accinfo.UserId},
+		EncMACKey:  accinfo.EncMACKey,
+	}
+
+	res, err := lobbyRequest(ctx, accinfo, fmt.Sprintf("/rooms/watch/number/%d", number), param)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("lobbyRequest: %w", err)
+	}
+
+	return connectToRoom(ctx, accinfo, res.Room, warn)
+}
+
 // WatchDirect : gameサーバに直接接続して観戦する（hub->game用）
 func WatchDirect(ctx context.Context, grpccon *grpc.ClientConn, wshost, appid, roomid string, clinfo *pb.ClientInfo, warn func(error)) (*Room, *Connection, error) {
+	return watchDirect(ctx, grpccon, wshost, appid, roomid, clinfo, "", "", warn)
+}
+
+// WatchParentHub : 親hubに接続して観戦する（多段hubのhub->hub用）
+// 親hubに部屋のhubが無いときに作成できるよう、gameのgRPC/WebSocketのホストも渡す.
+func WatchParentHub(ctx context.Context, grpccon *grpc.ClientConn, wshost, appid, roomid string, clinfo *pb.ClientInfo, gameGrpcHost, gameWsHost string, warn func(error)) (*Room, *Connection, error) {
+	return watchDirect(ctx, grpccon, wshost, appid, roomid, clinfo, gameGrpcHost, gameWsHost, warn)
+}
+
+func watchDirect(ctx context.Context, grpccon *grpc.ClientConn, wshost, appid, roomid string, clinfo *pb.ClientInfo, gameGrpcHost, gameWsHost string, warn func(error)) (*Room, *Connection, error) {
 	accinfo := &AccessInfo{
 		AppId:  appid,
 		UserId: clinfo.Id,
@@ -114,6 +144,9 @@ func WatchDirect(ctx context.Context, grpccon *grpc.ClientConn, wshost, appid, r
 		RoomId:     roomid,
 		ClientInfo: clinfo,
 		MacKey:     accinfo.MACKey,
+		MacScheme:  uint32(auth.MACSchemeSHA256),
+		GrpcHost:   gameGrpcHost,
+		WsHost:     gameWsHost,
 	}
 
 	res, err := pb.NewGameClient(grpccon).Watch(ctx, req)
@@ -148,6 +181,9 @@ func lobbyRequest(ctx context.Context, accinfo *AccessInfo, path string, param i
 	req.Header.Add("Wsnet2-App", accinfo.AppId)
 	req.Header.Add("Wsnet2-User", accinfo.UserId)
 	req.Header.Add("Authorization", "Bearer "+accinfo.Bearer)
+	if accinfo.Region != "" {
+		req.Header.Add("Wsnet2-Region", accinfo.Region)
+	}
 
 	r, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -9,6 +9,10 @@ import (
 	"wsnet2/pb"
 )
 
+// WatchDelayProp : RoomOptionでwatch_delayを指定しない場合に、
+// hubからの観戦配信の遅延秒数を指定する部屋のpublic propsのキー
+const WatchDelayProp = "wsnet2.watchdelay"
+
 type Room struct {
 	Id             string
 	Number         *int32
@@ -21,11 +25,14 @@ type Room struct {
 	PublicProps    binary.Dict
 	PrivateProps   binary.Dict
 	Created        time.Time
+	WatchDelay     uint32
+	WatcherChat    bool
 	ClientDeadline uint32
 	Players        map[string]*Player
 	Me             *Player
 	Master         *Player
 	LastMsgTimes   binary.Dict
+	State          binary.Dict
 }
 
 type Player struct {
@@ -33,6 +40,44 @@ type Player struct {
 	Props binary.Dict
 }
 
+// Clone returns a deep copy of the room.
+func (r *Room) Clone() *Room {
+	c := *r
+	if r.Number != nil {
+		n := *r.Number
+		c.Number = &n
+	}
+	c.PublicProps = cloneDict(r.PublicProps)
+	c.PrivateProps = cloneDict(r.PrivateProps)
+	c.LastMsgTimes = cloneDict(r.LastMsgTimes)
+	c.State = cloneDict(r.State)
+	c.Players = make(map[string]*Player, len(r.Players))
+	for id, p := range r.Players {
+		c.Players[id] = &Player{
+			Id:    p.Id,
+			Props: cloneDict(p.Props),
+		}
+	}
+	if r.Me != nil {
+		c.Me = c.Players[r.Me.Id]
+	}
+	if r.Master != nil {
+		c.Master = c.Players[r.Master.Id]
+	}
+	return &c
+}
+
+func cloneDict(d binary.Dict) binary.Dict {
+	if d == nil {
+		return nil
+	}
+	c := make(binary.Dict, len(d))
+	for k, v := range d {
+		c[k] = v
+	}
+	return c
+}
+
 func newRoom(joined *pb.JoinedRoomRes, myid string) (*Room, error) {
 	var num *int32 = nil
 	if joined.RoomInfo.Number != nil {
@@ -50,6 +95,14 @@ func newRoom(joined *pb.JoinedRoomRes, myid string) (*Room, error) {
 		return nil, xerrors.Errorf("private props: %w", err)
 	}
 
+	state, _, err := binary.UnmarshalNullDict(joined.RoomState)
+	if err != nil {
+		return nil, xerrors.Errorf("room state: %w", err)
+	}
+	if state == nil {
+		state = make(binary.Dict)
+	}
+
 	players := make(map[string]*Player, len(joined.Players))
 	for _, p := range joined.Players {
 		props, _, err := binary.UnmarshalNullDict(p.Props)
@@ -74,11 +127,14 @@ func newRoom(joined *pb.JoinedRoomRes, myid string) (*Room, error) {
 		PublicProps:    pubProps,
 		PrivateProps:   privProps,
 		Created:        joined.RoomInfo.Created.Time(),
+		WatchDelay:     joined.RoomInfo.WatchDelay,
+		WatcherChat:    !joined.RoomInfo.WatcherChatDisabled,
 		ClientDeadline: joined.Deadline,
 		Players:        players,
 		Me:             players[myid],
 		Master:         players[joined.MasterId],
 		LastMsgTimes:   make(binary.Dict),
+		State:          state,
 	}, nil
 }
 
@@ -101,6 +157,8 @@ func (r *Room) Update(ev binary.Event) error {
 		return r.onEvRejoined(ev)
 	case binary.EvTypePong:
 		return r.onEvPong(ev)
+	case binary.EvTypeRoomState:
+		return r.onEvRoomState(ev)
 	}
 	return nil
 }
@@ -189,6 +247,24 @@ func (r *Room) onEvRejoined(ev binary.Event) error {
 	return nil
 }
 
+func (r *Room) onEvRoomState(ev binary.Event) error {
+	state, err := binary.UnmarshalEvRoomStatePayload(ev.Payload())
+	if err != nil {
+		return xerrors.Errorf("Room.onEvRoomState: payload: %w", err)
+	}
+	if r.State == nil {
+		r.State = make(binary.Dict)
+	}
+	for k, v := range state {
+		if len(v) == 0 {
+			delete(r.State, k)
+		} else {
+			r.State[k] = v
+		}
+	}
+	return nil
+}
+
 func (r *Room) onEvPong(ev binary.Event) error {
 	p, err := binary.UnmarshalEvPongPayload(ev.Payload())
 	if err != nil {
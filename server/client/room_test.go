@@ -224,3 +224,48 @@ func TestRoom_Update_onEvPong(t *testing.T) {
 		t.Fatalf("Watchers = %v, wants %v", room.Watchers, watchers)
 	}
 }
+
+func TestRoom_Clone(t *testing.T) {
+	room := newRoom()
+	c := room.Clone()
+	if !reflect.DeepEqual(c, room) {
+		t.Fatalf("clone = %v, wants %v", c, room)
+	}
+	if c.Master != c.Players["user1"] || c.Me != c.Players["user2"] {
+		t.Fatalf("Master/Me must point to the cloned players")
+	}
+
+	err := c.Update(binary.NewEvClientProp("user1",
+		binary.MarshalDict(binary.Dict{"cli1": binary.MarshalInt(200)})))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(room.Players["user1"].Props["cli1"], binary.MarshalInt(100)) {
+		t.Fatalf("original props modified: %v", room.Players["user1"].Props)
+	}
+}
+
+func TestRoom_Update_onEvRoomState(t *testing.T) {
+	room := newRoom()
+	room.State = binary.Dict{
+		"turn":  binary.MarshalInt(1),
+		"board": binary.MarshalStr8("...."),
+	}
+	ev := binary.NewEvRoomState(binary.Dict{
+		"turn":  binary.MarshalInt(2),
+		"board": []byte{},
+		"score": binary.MarshalInt(10),
+	})
+
+	if err := room.Update(ev); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	want := binary.Dict{
+		"turn":  binary.MarshalInt(2),
+		"score": binary.MarshalInt(10),
+	}
+	if !reflect.DeepEqual(room.State, want) {
+		t.Fatalf("State = %v, wants %v", room.State, want)
+	}
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"sync"
+
+	"golang.org/x/xerrors"
+
+	"wsnet2/auth"
+	"wsnet2/binary"
+)
+
+// PublicKeyProp : 部屋鍵の受け渡しに使う公開鍵を格納するClientのpropsのキー
+const PublicKeyProp = "wsnet2.pubkey"
+
+// RoomKey : Targets/Broadcastのpayloadをエンドツーエンドで暗号化する部屋鍵
+//
+// 部屋鍵はクライアント間でのみ共有する.
+//   - 各クライアントはPublicKeyPropに公開鍵を設定して入室する
+//   - 部屋の作成者はGenerateで部屋鍵を生成する
+//   - 部屋鍵を持つプレイヤーは、入室してきたプレイヤーにSealした部屋鍵をMsgTypeRoomKeyで送る
+//   - 受け取ったプレイヤーはEvTypeRoomKeyをOpenして部屋鍵を得る
+//
+// 公開鍵はサーバが中継するPlayerのpropsから取り出すので、サーバが差し替えれば部屋鍵を読めてしまう.
+// サーバを信頼しない場合は、Fingerprintをサーバを介さない手段でプレイヤー同士が照合すること.
+type RoomKey struct {
+	kx *auth.KeyExchange
+
+	mu  sync.RWMutex
+	key []byte
+}
+
+// NewRoomKey generates a new key pair for the room key exchange.
+func NewRoomKey() (*RoomKey, error) {
+	kx, err := auth.NewKeyExchange()
+	if err != nil {
+		return nil, err
+	}
+	return &RoomKey{kx: kx}, nil
+}
+
+// PublicKey returns the marshaled public key to be set as PublicKeyProp.
+func (k *RoomKey) PublicKey() []byte {
+	pub := k.kx.PublicKey()
+	vals := make([]int, len(pub))
+	for i, b := range pub {
+		vals[i] = int(b)
+	}
+	return binary.MarshalBytes(vals)
+}
+
+// Generate : 部屋鍵を生成する (部屋の作成者が呼ぶ)
+func (k *RoomKey) Generate() error {
+	key, err := auth.GenRoomKey()
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.key = key
+	k.mu.Unlock()
+	return nil
+}
+
+// Ready : 部屋鍵を持っているか
+func (k *RoomKey) Ready() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.key != nil
+}
+
+// MsgPayload returns the MsgTypeRoomKey payload which delivers the room key to the player.
+func (k *RoomKey) MsgPayload(player *Player) ([]byte, error) {
+	key := k.roomKey()
+	if key == nil {
+		return nil, xerrors.Errorf("no room key")
+	}
+	pub, err := publicKeyFromProps(player.Props)
+	if err != nil {
+		return nil, xerrors.Errorf("player %v: %w", player.Id, err)
+	}
+	sealed, err := k.kx.SealRoomKey(pub, key)
+	if err != nil {
+		return nil, xerrors.Errorf("player %v: %w", player.Id, err)
+	}
+	return binary.MarshalRoomKeyPayload(player.Id, sealed), nil
+}
+
+// Open : EvTypeRoomKeyから部屋鍵を取り出す.
+// 送信元のプレイヤーの公開鍵を使うため、roomは最新の状態であること.
+func (k *RoomKey) Open(room *Room, ev binary.Event) error {
+	if ev.Type() != binary.EvTypeRoomKey {
+		return xerrors.Errorf("not a room key event: %v", ev.Type())
+	}
+	sender, sealed, err := binary.UnmarshalEvRoomKeyPayload(ev.Payload())
+	if err != nil {
+		return err
+	}
+	p, ok := room.Players[sender]
+	if !ok {
+		return xerrors.Errorf("sender not found: %v", sender)
+	}
+	pub, err := publicKeyFromProps(p.Props)
+	if err != nil {
+		return xerrors.Errorf("sender %v: %w", sender, err)
+	}
+	key, err := k.kx.OpenRoomKey(pub, sealed)
+	if err != nil {
+		return xerrors.Errorf("sender %v: %w", sender, err)
+	}
+	k.mu.Lock()
+	k.key = key
+	k.mu.Unlock()
+	return nil
+}
+
+// Fingerprint : playerとの間の公開鍵の組のfingerprint.
+// 双方で同じ値になるので、画面に表示して見比べるなどサーバを介さずに照合する.
+func (k *RoomKey) Fingerprint(player *Player) (string, error) {
+	pub, err := publicKeyFromProps(player.Props)
+	if err != nil {
+		return "", xerrors.Errorf("player %v: %w", player.Id, err)
+	}
+	return k.kx.Fingerprint(pub), nil
+}
+
+// Encrypt : Targets/Broadcastで送るデータを暗号化する
+func (k *RoomKey) Encrypt(data []byte) ([]byte, error) {
+	key := k.roomKey()
+	if key == nil {
+		return nil, xerrors.Errorf("no room key")
+	}
+	return auth.EncryptPayload(key, data)
+}
+
+// Decrypt : EvTypeMessageのbodyを復号する
+func (k *RoomKey) Decrypt(data []byte) ([]byte, error) {
+	key := k.roomKey()
+	if key == nil {
+		return nil, xerrors.Errorf("no room key")
+	}
+	return auth.DecryptPayload(key, data)
+}
+
+func (k *RoomKey) roomKey() []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.key
+}
+
+func publicKeyFromProps(props binary.Dict) ([]byte, error) {
+	v, ok := props[PublicKeyProp]
+	if !ok {
+		return nil, xerrors.Errorf("no public key")
+	}
+	d, _, err := binary.UnmarshalAs(v, binary.TypeBytes)
+	if err != nil {
+		return nil, xerrors.Errorf("public key: %w", err)
+	}
+	vals := d.([]int)
+	pub := make([]byte, len(vals))
+	for i, b := range vals {
+		pub[i] = byte(b)
+	}
+	return pub, nil
+}
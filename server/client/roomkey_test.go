@@ -0,0 +1,71 @@
+package client_test
+
+import (
+	"bytes"
+	"testing"
+
+	"wsnet2/binary"
+	"wsnet2/client"
+)
+
+func TestRoomKey(t *testing.T) {
+	masterKey, _ := client.NewRoomKey()
+	playerKey, _ := client.NewRoomKey()
+	if err := masterKey.Generate(); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	room := newRoom()
+	room.Players["user1"].Props[client.PublicKeyProp] = masterKey.PublicKey()
+	room.Players["user2"].Props[client.PublicKeyProp] = playerKey.PublicKey()
+
+	payload, err := masterKey.MsgPayload(room.Players["user2"])
+	if err != nil {
+		t.Fatalf("MsgPayload: %v", err)
+	}
+	target, sealed, err := binary.UnmarshalRoomKeyPayload(payload)
+	if err != nil {
+		t.Fatalf("UnmarshalRoomKeyPayload: %v", err)
+	}
+	if target != "user2" {
+		t.Fatalf("target = %q, wants %q", target, "user2")
+	}
+
+	if playerKey.Ready() {
+		t.Fatalf("player must not have the room key yet")
+	}
+	if err := playerKey.Open(room, binary.NewEvRoomKey("user1", sealed)); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	data := []byte{1, 2, 3}
+	enc, err := masterKey.Encrypt(data)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	dec, err := playerKey.Decrypt(enc)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if !bytes.Equal(dec, data) {
+		t.Fatalf("decrypted = %v, wants %v", dec, data)
+	}
+
+	// fingerprintは双方で一致する
+	fp1, err := masterKey.Fingerprint(room.Players["user2"])
+	if err != nil {
+		t.Fatalf("Fingerprint: %v", err)
+	}
+	fp2, err := playerKey.Fingerprint(room.Players["user1"])
+	if err != nil {
+		t.Fatalf("Fingerprint: %v", err)
+	}
+	if fp1 != fp2 {
+		t.Fatalf("fingerprints differ: %q, %q", fp1, fp2)
+	}
+
+	// 送信元が部屋にいなければ公開鍵がわからない
+	if err := playerKey.Open(room, binary.NewEvRoomKey("user3", sealed)); err == nil {
+		t.Fatalf("Open from unknown sender must error")
+	}
+}
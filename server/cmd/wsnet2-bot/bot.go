@@ -2,8 +2,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"hash"
@@ -19,6 +17,7 @@ import (
 
 	"wsnet2/auth"
 	"wsnet2/binary"
+	"wsnet2/client"
 	"wsnet2/lobby"
 	"wsnet2/pb"
 )
@@ -38,8 +37,24 @@ type bot struct {
 	macKey      string
 	hmac        hash.Hash
 	encMACKey   string
+	macNonce    []byte
+	frames      uint32
+	early       [][]byte
+	roomKey     *client.RoomKey
+	players     map[string]*client.Player
+	masterId    string
 	stat        statics
 	muStat      sync.Mutex
+
+	// 再接続用
+	url       string
+	authKey   string
+	lastEvSeq int
+
+	// onMessage : EvTypeMessageの (復号した) bodyを受け取る
+	onMessage func(body []byte)
+	// onPong : Pingの往復時間を受け取る
+	onPong func(rtt time.Duration)
 }
 
 type statics struct {
@@ -52,8 +67,19 @@ type statics struct {
 
 func NewBot(appId, appKey, userId string, props binary.Dict) *bot {
 	macKey := auth.GenMACKey()
-	hmac := hmac.New(sha1.New, []byte(macKey))
-	emk, _ := auth.EncryptMACKey(appKey, macKey)
+	hmac, _ := auth.NewMsgHMAC(macScheme, macKey)
+	emk, _ := auth.EncryptMACKeyWithScheme(appKey, macKey, macScheme)
+
+	var roomKey *client.RoomKey
+	if e2eEncryption {
+		roomKey, _ = client.NewRoomKey()
+		p := make(binary.Dict, len(props)+1)
+		for k, v := range props {
+			p[k] = v
+		}
+		p[client.PublicKeyProp] = roomKey.PublicKey()
+		props = p
+	}
 
 	return &bot{
 		appId:  appId,
@@ -61,7 +87,7 @@ func NewBot(appId, appKey, userId string, props binary.Dict) *bot {
 		userId: userId,
 		props:  props,
 		ws: &websocket.Dialer{
-			Subprotocols:    []string{},
+			Subprotocols:    binary.Subprotocols(binary.ProtocolVersion1),
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
 		},
@@ -69,9 +95,31 @@ func NewBot(appId, appKey, userId string, props binary.Dict) *bot {
 		macKey:    macKey,
 		hmac:      hmac,
 		encMACKey: emk,
+		roomKey:   roomKey,
+		players:   make(map[string]*client.Player),
 	}
 }
 
+// setRoom : 入室時の部屋情報を記録する
+func (b *bot) setRoom(room *pb.JoinedRoomRes) {
+	b.deadline = time.Duration(room.Deadline) * time.Second
+	b.masterId = room.MasterId
+	b.url = room.Url
+	b.authKey = room.AuthKey
+	for _, p := range room.Players {
+		b.addPlayer(p)
+	}
+}
+
+func (b *bot) addPlayer(p *pb.ClientInfo) {
+	props, _, err := binary.UnmarshalNullDict(p.Props)
+	if err != nil {
+		logger.Errorf("[bot:%v] player %v props: %v", b.userId, p.Id, err)
+		return
+	}
+	b.players[p.Id] = &client.Player{Id: p.Id, Props: props}
+}
+
 func (b *bot) CreateRoom(props binary.Dict) (*pb.JoinedRoomRes, error) {
 	param := &lobby.CreateParam{
 		RoomOption: &pb.RoomOption{
@@ -101,7 +149,12 @@ func (b *bot) CreateRoom(props binary.Dict) (*pb.JoinedRoomRes, error) {
 	}
 
 	room := res.Room
-	b.deadline = time.Duration(room.Deadline) * time.Second
+	b.setRoom(room)
+	if b.roomKey != nil {
+		if err := b.roomKey.Generate(); err != nil {
+			return nil, err
+		}
+	}
 	logger.Debugf("[bot:%v] Create success, WebSocket=%s", b.userId, room.Url)
 
 	return room, nil
@@ -142,7 +195,7 @@ func (b *bot) joinRoom(watch bool, roomId string, queries []lobby.PropQuery) (*p
 	}
 
 	room := res.Room
-	b.deadline = time.Duration(room.Deadline) * time.Second
+	b.setRoom(room)
 	logger.Debugf("[bot:%v] Join success, WebSocket=%s", b.userId, room.Url)
 
 	return room, nil
@@ -170,7 +223,7 @@ func (b *bot) JoinRoomByNumber(roomNumber int32, queries []lobby.PropQuery) (*pb
 	}
 
 	room := res.Room
-	b.deadline = time.Duration(room.Deadline) * time.Second
+	b.setRoom(room)
 	logger.Debugf("[bot:%v] Join by room number success, WebSocket=%s", b.userId, room.Url)
 
 	return room, nil
@@ -198,7 +251,7 @@ func (b *bot) JoinRoomAtRandom(searchGroup uint32, queries []lobby.PropQuery) (*
 	}
 
 	room := res.Room
-	b.deadline = time.Duration(room.Deadline) * time.Second
+	b.setRoom(room)
 	logger.Debugf("[bot:%v] Join at random success, WebSocket=%s", b.userId, room.Url)
 	return room, nil
 }
@@ -291,6 +344,21 @@ func (b *bot) DialGame(url, authKey string, seq int) error {
 	}
 	logger.Debugf("[bot:%v] response: %v", b.userId, res)
 
+	b.macNonce = nil
+	b.frames = 0
+	b.early = nil
+	if macScheme == auth.MACSchemeSHA256 {
+		// 最初のEvPeerReadyで通知されるnonceをMsgのHMACに含める
+		nonce, early, err := readPeerReadyNonce(conn)
+		if err != nil {
+			logger.Errorf("[bot:%v] peer ready error: %v", b.userId, err)
+			conn.Close()
+			return err
+		}
+		b.macNonce = nonce
+		b.early = early
+	}
+
 	b.conn = conn
 	b.done = make(chan bool)
 	b.stat = statics{
@@ -310,17 +378,125 @@ func (b *bot) WriteMessage(messageType int, data []byte) error {
 func (b *bot) SendMessage(msgType binary.MsgType, payload []byte) error {
 	b.muWrite.Lock()
 	defer b.muWrite.Unlock()
+	payload, err := b.encryptPayload(msgType, payload)
+	if err != nil {
+		return err
+	}
 	b.seq++
-	msg := binary.BuildRegularMsgFrame(msgType, b.seq, payload, b.hmac)
+	msg := binary.NewRegularMsg(msgType, b.seq, payload)
 	logger.Debugf("[bot:%v] %v: seq=%v, %v", b.userId, msgType, b.seq, payload)
-	return b.conn.WriteMessage(websocket.BinaryMessage, msg)
+	return b.conn.WriteMessage(websocket.BinaryMessage, b.marshalMsg(msg))
 }
 
 func (b *bot) SendPingMessage(t time.Time) error {
 	b.muWrite.Lock()
 	defer b.muWrite.Unlock()
 	msg := binary.NewMsgPing(t)
-	return b.conn.WriteMessage(websocket.BinaryMessage, msg.Marshal(b.hmac))
+	return b.conn.WriteMessage(websocket.BinaryMessage, b.marshalMsg(msg))
+}
+
+// encryptPayload : 部屋鍵を持っていればTargets/Broadcastのデータを暗号化する
+func (b *bot) encryptPayload(msgType binary.MsgType, payload []byte) ([]byte, error) {
+	if b.roomKey == nil || !b.roomKey.Ready() {
+		return payload, nil
+	}
+	switch msgType {
+	case binary.MsgTypeBroadcast:
+		return b.roomKey.Encrypt(payload)
+	case binary.MsgTypeScopedBroadcast:
+		scope, data, err := binary.UnmarshalScopedBroadcastPayload(payload)
+		if err != nil {
+			return nil, err
+		}
+		data, err = b.roomKey.Encrypt(data)
+		if err != nil {
+			return nil, err
+		}
+		return binary.MarshalScopedBroadcastPayload(scope, data), nil
+	case binary.MsgTypeTopicBroadcast:
+		topic, data, err := binary.UnmarshalTopicBroadcastPayload(payload)
+		if err != nil {
+			return nil, err
+		}
+		data, err = b.roomKey.Encrypt(data)
+		if err != nil {
+			return nil, err
+		}
+		return binary.MarshalTopicBroadcastPayload(topic, data), nil
+	case binary.MsgTypeTargets:
+		targets, data, err := binary.UnmarshalTargetsAndData(payload)
+		if err != nil {
+			return nil, err
+		}
+		data, err = b.roomKey.Encrypt(data)
+		if err != nil {
+			return nil, err
+		}
+		return MarshalTargetsAndData(targets, data), nil
+	}
+	return payload, nil
+}
+
+// sendRoomKey : Masterが入室してきたプレイヤーに部屋鍵を送る
+func (b *bot) sendRoomKey(playerId string) {
+	if b.roomKey == nil || !b.roomKey.Ready() || b.masterId != b.userId {
+		return
+	}
+	p, ok := b.players[playerId]
+	if !ok {
+		return
+	}
+	payload, err := b.roomKey.MsgPayload(p)
+	if err != nil {
+		logger.Errorf("[bot:%v] room key for %v: %v", b.userId, playerId, err)
+		return
+	}
+	b.SendMessage(binary.MsgTypeRoomKey, payload)
+}
+
+// marshalMsg : muWriteのロック内で呼ぶ
+func (b *bot) marshalMsg(msg binary.Msg) []byte {
+	if b.macNonce == nil {
+		return msg.Marshal(b.hmac)
+	}
+	b.frames++
+	return msg.MarshalWithBinding(b.hmac, binary.MsgMACBinding(b.macNonce, b.frames))
+}
+
+// readPeerReadyNonce : EvPeerReadyを待ってnonceを返す.
+// EvPeerReadyより先に届いたRegularEvent (入室時のEvJoinedなど) はEventLoopで処理するために返す
+func readPeerReadyNonce(conn *websocket.Conn) ([]byte, [][]byte, error) {
+	var early [][]byte
+	for {
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			return nil, nil, err
+		}
+		ev, _, err := binary.UnmarshalEvent(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ev.Type() != binary.EvTypePeerReady {
+			if !binary.IsRegularEvent(ev) {
+				return nil, nil, fmt.Errorf("unexpected event: %v", ev.Type())
+			}
+			early = append(early, p)
+			continue
+		}
+		nonce, err := binary.UnmarshalEvPeerReadyNonce(ev.Payload())
+		return nonce, early, err
+	}
+}
+
+// readMessage : EvPeerReadyより先に届いていたものから順に受信したメッセージを返す
+func (b *bot) readMessage() ([]byte, error) {
+	if len(b.early) > 0 {
+		p := b.early[0]
+		b.early = b.early[1:]
+		return p, nil
+	}
+	_, p, err := b.conn.ReadMessage()
+	return p, err
 }
 
 func (b *bot) Close() error {
@@ -354,7 +530,7 @@ func (b *bot) pinger() {
 func (b *bot) EventLoop() {
 	defer close(b.done)
 	for {
-		_, p, err := b.conn.ReadMessage()
+		p, err := b.readMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				logger.Debugf("[bot:%v] ReadMessage: %v", b.userId, err)
@@ -372,6 +548,10 @@ func (b *bot) EventLoop() {
 			continue
 		}
 
+		if seq > 0 {
+			b.lastEvSeq = seq
+		}
+
 		ty := ev.Type()
 		lg := logger.With("userId", b.userId, "seq", seq, "event", ty.String())
 
@@ -384,6 +564,21 @@ func (b *bot) EventLoop() {
 				panic(err)
 			}
 			lg.Debugf("name=%v props=%v", name, props)
+			if b.roomKey != nil {
+				if cli, err := binary.UnmarshalEvJoinedPayload(ev.Payload()); err == nil {
+					b.addPlayer(cli)
+					b.sendRoomKey(cli.Id)
+				}
+			}
+		case binary.EvTypeRoomKey:
+			if b.roomKey == nil {
+				break
+			}
+			if err := b.roomKey.Open(&client.Room{Players: b.players}, ev); err != nil {
+				lg.Errorf("failed to open room key: %v", err)
+				break
+			}
+			lg.Debugf("room key received")
 		case binary.EvTypeRejoined:
 			namelen := int(p[6])
 			name := string(p[7 : 7+namelen])
@@ -407,6 +602,14 @@ func (b *bot) EventLoop() {
 				lg.Errorf("error: failed to unmarshal EvTypeMessage: %v", err)
 				break
 			}
+			if b.roomKey != nil && b.roomKey.Ready() {
+				if dec, err := b.roomKey.Decrypt(body); err == nil {
+					body = dec
+				}
+			}
+			if b.onMessage != nil {
+				b.onMessage(body)
+			}
 			val, _, err := binary.Unmarshal(body)
 			if err != nil {
 				lg.Debugf("sender=%v body=%q", senderId, body)
@@ -420,6 +623,8 @@ func (b *bot) EventLoop() {
 				break
 			}
 			lg.Debugf("left=%q master=%q", left.ClientId, left.MasterId)
+			b.masterId = left.MasterId
+			delete(b.players, left.ClientId)
 		case binary.EvTypePong:
 			pongPayload, err := binary.UnmarshalEvPongPayload(ev.Payload())
 			if err != nil {
@@ -439,12 +644,16 @@ func (b *bot) EventLoop() {
 			b.stat.sum2 += rtt * rtt
 			b.stat.received++
 			b.muStat.Unlock()
+			if b.onPong != nil {
+				b.onPong(time.Duration(rtt) * time.Microsecond)
+			}
 		case binary.EvTypeMasterSwitched:
 			newMasterId, err := binary.UnmarshalEvMasterSwitchedPayload(ev.Payload())
 			if err != nil {
 				panic(err)
 			}
 			lg.Debugf("new masterId=%v", newMasterId)
+			b.masterId = newMasterId
 		case binary.EvTypeClientProp:
 			cp, err := binary.UnmarshalEvClientPropPayload(ev.Payload())
 			if err != nil {
@@ -464,8 +673,20 @@ func (b *bot) LeaveAndClose() {
 	b.Close()
 }
 
+// Reconnect : websocketを切断し、downtime後に最後に受信したイベントの続きから再接続する
+func (b *bot) Reconnect(downtime time.Duration) error {
+	b.Close()
+	<-b.done
+	time.Sleep(downtime)
+	if err := b.DialGame(b.url, b.authKey, b.lastEvSeq); err != nil {
+		return err
+	}
+	go b.EventLoop()
+	return nil
+}
+
 func SpawnMaster(name string) (*bot, string, error) {
-	bot := NewBot(appID, appKey, name, binary.Dict{})
+	bot := NewBot(appID, appKey, name, botProps)
 
 	logger.Debugf("spawnMaster: %v", name)
 	room, err := bot.CreateRoom(binary.Dict{})
@@ -486,7 +707,7 @@ func SpawnMaster(name string) (*bot, string, error) {
 }
 
 func SpawnPlayer(roomId, userId string, queries []lobby.PropQuery) (*bot, error) {
-	bot := NewBot(appID, appKey, userId, binary.Dict{})
+	bot := NewBot(appID, appKey, userId, botProps)
 
 	room, err := bot.JoinRoom(roomId, queries)
 	if err != nil {
@@ -506,7 +727,7 @@ func SpawnPlayer(roomId, userId string, queries []lobby.PropQuery) (*bot, error)
 }
 
 func SpawnWatcher(roomId, userId string) (*bot, error) {
-	bot := NewBot(appID, appKey, userId, binary.Dict{})
+	bot := NewBot(appID, appKey, userId, botProps)
 
 	room, err := bot.WatchRoom(roomId, nil)
 	if err != nil {
@@ -526,7 +747,7 @@ func SpawnWatcher(roomId, userId string) (*bot, error) {
 }
 
 func SpawnPlayerByNumber(roomNumber int32, userId string, queries []lobby.PropQuery) (*bot, error) {
-	bot := NewBot(appID, appKey, userId, binary.Dict{})
+	bot := NewBot(appID, appKey, userId, botProps)
 
 	room, err := bot.JoinRoomByNumber(roomNumber, queries)
 	if err != nil {
@@ -547,7 +768,7 @@ func SpawnPlayerByNumber(roomNumber int32, userId string, queries []lobby.PropQu
 
 func SpawnPlayerAtRandom(userId string, searchGroup uint32, queries []lobby.PropQuery) (*bot, error) {
 	logger.Infof("SpawnPlayerAtRandom(%v,%v,%v)", userId, searchGroup, queries)
-	bot := NewBot(appID, appKey, userId, binary.Dict{})
+	bot := NewBot(appID, appKey, userId, botProps)
 
 	room, err := bot.JoinRoomAtRandom(searchGroup, queries)
 	if err != nil {
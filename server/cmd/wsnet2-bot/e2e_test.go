@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"wsnet2/binary"
+	"wsnet2/config"
+	"wsnet2/testserver"
+)
+
+func startTestServer(t *testing.T) {
+	t.Helper()
+	ts, err := testserver.Start(nil)
+	if err != nil {
+		t.Fatalf("testserver.Start: %+v", err)
+	}
+	t.Cleanup(ts.Close)
+
+	origPrefix, origID, origKey, origLogger := lobbyPrefix, appID, appKey, logger
+	t.Cleanup(func() {
+		lobbyPrefix, appID, appKey, logger = origPrefix, origID, origKey, origLogger
+	})
+	lobbyPrefix = ts.LobbyURL
+	appID = testserver.DefaultAppId
+	appKey = testserver.DefaultAppKey
+	logger = zap.NewNop().Sugar()
+}
+
+func TestLoadSampleScenario(t *testing.T) {
+	sc, err := loadScenario("scenarios/sample.toml")
+	if err != nil {
+		t.Fatalf("loadScenario: %+v", err)
+	}
+	if len(sc.roles) != 10 {
+		t.Errorf("roles = %v, wants 10 roles", sc.roles)
+	}
+}
+
+func TestEndToEndScenario(t *testing.T) {
+	startTestServer(t)
+
+	sc := &scenario{
+		Name:     "e2e",
+		Duration: config.Duration(3 * time.Second),
+		RampUp:   config.Duration(500 * time.Millisecond),
+		Bots:     4,
+		Ratio:    scenarioRatio{Create: 1, Join: 2, Watch: 1},
+		Messages: []*scenarioMessage{
+			{Type: "Broadcast", Rate: 5, Size: 16},
+			{Type: "TopicBroadcast", Topic: "score", Rate: 2, Size: 8, Roles: []string{roleCreate}},
+		},
+		RoomProp: scenarioRoomProp{Interval: config.Duration(500 * time.Millisecond), Size: 8},
+		Reconnect: scenarioReconnect{
+			Interval: config.Duration(time.Second),
+			Downtime: config.Duration(100 * time.Millisecond),
+			Roles:    []string{roleJoin},
+		},
+	}
+	if err := sc.validate(); err != nil {
+		t.Fatalf("validate: %+v", err)
+	}
+
+	rep := newScenarioRunner(sc).Run()
+
+	// 作成前の部屋が無いときのjoin/watchは待つだけなのでエラーにならない
+	if len(rep.Errors) != 0 {
+		t.Errorf("errors: %v", rep.Errors)
+	}
+	if rep.Throughput.Sent[binary.MsgTypeBroadcast.String()] == 0 {
+		t.Errorf("no Broadcast sent: %v", rep.Throughput.Sent)
+	}
+	if rep.Throughput.Received == 0 {
+		t.Errorf("no message received")
+	}
+	for _, op := range []string{"lobby.create", "dial", "message"} {
+		if rep.Latency[op].Count == 0 {
+			t.Errorf("no latency samples for %q: %v", op, rep.Latency)
+		}
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"go.uber.org/zap/zapcore"
 
 	"wsnet2"
+	"wsnet2/auth"
+	"wsnet2/binary"
 )
 
 var (
@@ -17,6 +19,15 @@ var (
 	appKey = "testapppkey"
 
 	logger *zap.SugaredLogger
+
+	// botProps is the client props of spawned bots
+	botProps = binary.Dict{}
+
+	// macScheme is the message authentication scheme requested by bots
+	macScheme = auth.MACSchemeSHA256
+
+	// e2eEncryption enables the end-to-end encryption of Targets/Broadcast payloads
+	e2eEncryption = false
 )
 
 type subcmd interface {
@@ -29,6 +40,7 @@ var cmds = []subcmd{
 	NewStressBot(),
 	NewStaticBot(),
 	NewWatcherBot(),
+	NewScenarioBot(),
 }
 
 var lobbyPrefix string = "http://192.168.0.1:3000"
@@ -36,6 +48,9 @@ var lobbyPrefix string = "http://192.168.0.1:3000"
 func main() {
 	verbose := flag.Bool("v", false, "verbose")
 	flag.StringVar(&lobbyPrefix, "lobby", "http://localhost:8080", "lobby schema://host:port")
+	props := flag.String("props", "", `client props in the text representation (e.g. {"key":Int(1)})`)
+	mac := flag.String("mac", macScheme.String(), "message authentication scheme (sha1 or sha256)")
+	flag.BoolVar(&e2eEncryption, "e2e", false, "encrypt Targets/Broadcast payloads with the room key")
 	flag.Parse()
 
 	cfg := zap.NewDevelopmentConfig()
@@ -51,6 +66,22 @@ func main() {
 
 	logger = lg.Sugar()
 
+	if *props != "" {
+		botProps, err = binary.ParseTextDict(*props)
+		if err != nil {
+			logger.Fatalf("invalid props: %v", err)
+		}
+	}
+
+	switch *mac {
+	case auth.MACSchemeSHA1.String():
+		macScheme = auth.MACSchemeSHA1
+	case auth.MACSchemeSHA256.String():
+		macScheme = auth.MACSchemeSHA256
+	default:
+		logger.Fatalf("invalid mac scheme: %v", *mac)
+	}
+
 	fmt.Println("WSNet2-Bot")
 	fmt.Println("WSNet2Version:", wsnet2.Version)
 	if bi, ok := debug.ReadBuildInfo(); ok {
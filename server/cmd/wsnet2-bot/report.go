@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"wsnet2/binary"
+)
+
+// maxSamples : 計測項目ごとに保持するレイテンシのサンプル数 (超えたらreservoir sampling)
+const maxSamples = 100000
+
+type samples struct {
+	count  int64
+	sum    time.Duration
+	values []time.Duration
+}
+
+func (s *samples) add(d time.Duration) {
+	s.count++
+	s.sum += d
+	if len(s.values) < maxSamples {
+		s.values = append(s.values, d)
+		return
+	}
+	if i := rand.Int63n(s.count); i < maxSamples {
+		s.values[i] = d
+	}
+}
+
+// metrics : シナリオ実行中の計測値
+type metrics struct {
+	mu sync.Mutex
+
+	start     time.Time
+	latencies map[string]*samples
+	sentMsgs  map[string]int64
+	received  int64
+	errors    map[string]int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		start:     time.Now(),
+		latencies: make(map[string]*samples),
+		sentMsgs:  make(map[string]int64),
+		errors:    make(map[string]int64),
+	}
+}
+
+func (m *metrics) observe(name string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.latencies[name]
+	if !ok {
+		s = &samples{}
+		m.latencies[name] = s
+	}
+	s.add(d)
+}
+
+func (m *metrics) sent(t binary.MsgType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sentMsgs[t.String()]++
+}
+
+// onMessage : EvTypeMessageの先頭の送信時刻からレイテンシを計る (see: scenarioBody)
+func (m *metrics) onMessage(body []byte) {
+	d, _, err := binary.UnmarshalAs(body, binary.TypeULong)
+	m.mu.Lock()
+	m.received++
+	m.mu.Unlock()
+	if err != nil {
+		return
+	}
+	sent := time.UnixMicro(int64(d.(uint64)))
+	m.observe("message", time.Since(sent))
+}
+
+func (m *metrics) error(op string, err error) {
+	logger.Debugf("%v: %v", op, err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[op+": "+errorCause(err)]++
+}
+
+// errorCause : 接続先のアドレスなどを除いたエラーの原因
+func errorCause(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Err != nil {
+		return opErr.Op + ": " + opErr.Err.Error()
+	}
+	return err.Error()
+}
+
+type latencyStats struct {
+	Count int64   `json:"count"`
+	Mean  float64 `json:"mean"`
+	Min   float64 `json:"min"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+type throughputStats struct {
+	Sent           map[string]int64 `json:"sent"`
+	SentPerSec     float64          `json:"sent_per_sec"`
+	Received       int64            `json:"received"`
+	ReceivedPerSec float64          `json:"received_per_sec"`
+}
+
+// scenarioReport : シナリオの実行結果. レイテンシはミリ秒
+type scenarioReport struct {
+	Scenario   string                  `json:"scenario"`
+	Bots       int                     `json:"bots"`
+	Elapsed    float64                 `json:"elapsed_sec"`
+	Latency    map[string]latencyStats `json:"latency_ms"`
+	Throughput throughputStats         `json:"throughput"`
+	Errors     map[string]int64        `json:"errors"`
+}
+
+func (m *metrics) report(sc *scenario) *scenarioReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elapsed := time.Since(m.start).Seconds()
+	rep := &scenarioReport{
+		Scenario: sc.Name,
+		Bots:     sc.Bots,
+		Elapsed:  elapsed,
+		Latency:  make(map[string]latencyStats, len(m.latencies)),
+		Throughput: throughputStats{
+			Sent:     m.sentMsgs,
+			Received: m.received,
+		},
+		Errors: m.errors,
+	}
+
+	for name, s := range m.latencies {
+		rep.Latency[name] = s.stats()
+	}
+
+	var sent int64
+	for _, n := range m.sentMsgs {
+		sent += n
+	}
+	if elapsed > 0 {
+		rep.Throughput.SentPerSec = float64(sent) / elapsed
+		rep.Throughput.ReceivedPerSec = float64(m.received) / elapsed
+	}
+	return rep
+}
+
+func (s *samples) stats() latencyStats {
+	if len(s.values) == 0 {
+		return latencyStats{}
+	}
+	vals := make([]time.Duration, len(s.values))
+	copy(vals, s.values)
+	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+
+	percentile := func(p float64) float64 {
+		i := int(float64(len(vals)-1) * p)
+		return msec(vals[i])
+	}
+	return latencyStats{
+		Count: s.count,
+		Mean:  msec(s.sum) / float64(s.count),
+		Min:   msec(vals[0]),
+		P50:   percentile(0.50),
+		P90:   percentile(0.90),
+		P95:   percentile(0.95),
+		P99:   percentile(0.99),
+		Max:   msec(vals[len(vals)-1]),
+	}
+}
+
+func msec(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
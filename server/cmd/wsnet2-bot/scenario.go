@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+
+	"wsnet2/binary"
+	"wsnet2/config"
+)
+
+// scenarioBot : シナリオファイルに従って負荷をかける
+//
+//	wsnet2-bot scenario <scenario.toml> [report.json]
+//
+// 終了後にレイテンシとスループットのレポートをJSONで出力する (省略時は標準出力).
+// シナリオファイルの書式は scenarios/sample.toml を参照.
+type scenarioBot struct {
+	name string
+}
+
+func NewScenarioBot() *scenarioBot {
+	return &scenarioBot{"scenario"}
+}
+
+func (cmd *scenarioBot) Name() string {
+	return cmd.name
+}
+
+func (cmd *scenarioBot) Execute(args []string) {
+	if len(args) < 1 {
+		logger.Fatalf("usage: scenario <scenario.toml> [report.json]")
+	}
+	sc, err := loadScenario(args[0])
+	if err != nil {
+		logger.Fatalf("load scenario: %v", err)
+	}
+	logger.Infof("scenario %q: bots=%v, duration=%v, ramp_up=%v",
+		sc.Name, sc.Bots, time.Duration(sc.Duration), time.Duration(sc.RampUp))
+
+	rep := newScenarioRunner(sc).Run()
+
+	out := os.Stdout
+	if len(args) > 1 {
+		f, err := os.Create(args[1])
+		if err != nil {
+			logger.Fatalf("create report: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rep); err != nil {
+		logger.Fatalf("write report: %v", err)
+	}
+	logger.Info("scenario bot finished.")
+}
+
+const (
+	roleCreate = "create"
+	roleJoin   = "join"
+	roleWatch  = "watch"
+)
+
+type scenario struct {
+	Name string `toml:"name"`
+
+	// Duration : シナリオの実行時間
+	Duration config.Duration `toml:"duration"`
+	// RampUp : 全てのbotを起動し終えるまでの時間. botは等間隔で起動する
+	RampUp config.Duration `toml:"ramp_up"`
+	// Bots : botの総数
+	Bots int `toml:"bots"`
+
+	// Ratio : 部屋を作成/入室/観戦するbotの比率
+	Ratio scenarioRatio `toml:"ratio"`
+
+	// RoomLifetime : 部屋を作成したbotが退室して部屋を作り直すまでの時間 (0なら終了まで)
+	RoomLifetime config.Duration `toml:"room_lifetime"`
+
+	Messages  []*scenarioMessage `toml:"message"`
+	RoomProp  scenarioRoomProp   `toml:"room_prop"`
+	Reconnect scenarioReconnect  `toml:"reconnect"`
+
+	roles []string
+}
+
+type scenarioRatio struct {
+	Create int `toml:"create"`
+	Join   int `toml:"join"`
+	Watch  int `toml:"watch"`
+}
+
+// scenarioMessage : botが送信するメッセージ
+type scenarioMessage struct {
+	// Type : MsgTypeの名前 (Broadcast, ToMaster, Targets, TopicBroadcast, ClientProp)
+	Type string `toml:"type"`
+	// Rate : bot当たりの毎秒の送信数 (送信間隔は指数分布)
+	Rate float64 `toml:"rate"`
+	// Size : データのサイズ (byte)
+	Size int `toml:"size"`
+	// Topic : TopicBroadcastのトピック
+	Topic string `toml:"topic"`
+	// Roles : 送信するbotの役割 (省略時は create, join)
+	Roles []string `toml:"roles"`
+
+	msgType binary.MsgType
+}
+
+// scenarioRoomProp : 部屋を作成したbotによる部屋のpropsの更新
+type scenarioRoomProp struct {
+	Interval config.Duration `toml:"interval"`
+	Size     int             `toml:"size"`
+}
+
+// scenarioReconnect : botの切断と再接続
+type scenarioReconnect struct {
+	// Interval : bot当たりの切断の平均間隔 (0なら切断しない)
+	Interval config.Duration `toml:"interval"`
+	// Downtime : 切断してから再接続するまでの時間
+	Downtime config.Duration `toml:"downtime"`
+	// Roles : 切断するbotの役割 (省略時は全て)
+	Roles []string `toml:"roles"`
+}
+
+var scenarioMsgTypes = map[string]binary.MsgType{
+	"Broadcast":      binary.MsgTypeBroadcast,
+	"ToMaster":       binary.MsgTypeToMaster,
+	"Targets":        binary.MsgTypeTargets,
+	"TopicBroadcast": binary.MsgTypeTopicBroadcast,
+	"ClientProp":     binary.MsgTypeClientProp,
+}
+
+func loadScenario(path string) (*scenario, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := &scenario{}
+	if err := toml.Unmarshal(b, sc); err != nil {
+		return nil, err
+	}
+	if err := sc.validate(); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return sc, nil
+}
+
+func (sc *scenario) validate() error {
+	if sc.Duration <= 0 {
+		return fmt.Errorf("duration is required")
+	}
+	if sc.Bots <= 0 {
+		return fmt.Errorf("bots is required")
+	}
+	if sc.Ratio.Create < 0 || sc.Ratio.Join < 0 || sc.Ratio.Watch < 0 {
+		return fmt.Errorf("ratio must not be negative: %+v", sc.Ratio)
+	}
+	if sc.Ratio.Create == 0 {
+		return fmt.Errorf("ratio.create is required")
+	}
+	sc.roles = nil
+	for _, r := range []struct {
+		role string
+		n    int
+	}{{roleCreate, sc.Ratio.Create}, {roleJoin, sc.Ratio.Join}, {roleWatch, sc.Ratio.Watch}} {
+		for i := 0; i < r.n; i++ {
+			sc.roles = append(sc.roles, r.role)
+		}
+	}
+
+	for i, m := range sc.Messages {
+		t, ok := scenarioMsgTypes[m.Type]
+		if !ok {
+			return fmt.Errorf("message[%v]: unsupported type: %q", i, m.Type)
+		}
+		m.msgType = t
+		if m.Rate <= 0 {
+			return fmt.Errorf("message[%v]: rate must be positive", i)
+		}
+		if t == binary.MsgTypeTopicBroadcast && m.Topic == "" {
+			return fmt.Errorf("message[%v]: topic is required", i)
+		}
+		if len(m.Roles) == 0 {
+			m.Roles = []string{roleCreate, roleJoin}
+		}
+		if err := validRoles(m.Roles); err != nil {
+			return fmt.Errorf("message[%v]: %w", i, err)
+		}
+	}
+	if len(sc.Reconnect.Roles) == 0 {
+		sc.Reconnect.Roles = []string{roleCreate, roleJoin, roleWatch}
+	}
+	if err := validRoles(sc.Reconnect.Roles); err != nil {
+		return fmt.Errorf("reconnect: %w", err)
+	}
+	return nil
+}
+
+func validRoles(roles []string) error {
+	for _, r := range roles {
+		switch r {
+		case roleCreate, roleJoin, roleWatch:
+		default:
+			return fmt.Errorf("unknown role: %q", r)
+		}
+	}
+	return nil
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// scenarioRunner : シナリオの実行
+type scenarioRunner struct {
+	sc      *scenario
+	metrics *metrics
+	end     time.Time
+
+	muRooms sync.Mutex
+	rooms   []string
+}
+
+func newScenarioRunner(sc *scenario) *scenarioRunner {
+	return &scenarioRunner{
+		sc:      sc,
+		metrics: newMetrics(),
+	}
+}
+
+func (r *scenarioRunner) Run() *scenarioReport {
+	start := time.Now()
+	r.end = start.Add(time.Duration(r.sc.Duration))
+	r.metrics.start = start
+
+	var interval time.Duration
+	if r.sc.RampUp > 0 {
+		interval = time.Duration(r.sc.RampUp) / time.Duration(r.sc.Bots)
+	}
+
+	pid := os.Getpid()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < r.sc.Bots; i++ {
+		if time.Now().After(r.end) {
+			break
+		}
+		role := r.sc.roles[i%len(r.sc.roles)]
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.runBot(fmt.Sprintf("%s-%d:%05d", role, pid, i), role)
+		}(i)
+		time.Sleep(interval)
+	}
+	wg.Wait()
+
+	return r.metrics.report(r.sc)
+}
+
+func (r *scenarioRunner) addRoom(id string) {
+	r.muRooms.Lock()
+	defer r.muRooms.Unlock()
+	r.rooms = append(r.rooms, id)
+}
+
+func (r *scenarioRunner) removeRoom(id string) {
+	r.muRooms.Lock()
+	defer r.muRooms.Unlock()
+	for i, rid := range r.rooms {
+		if rid == id {
+			r.rooms = append(r.rooms[:i], r.rooms[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *scenarioRunner) randRoom() string {
+	r.muRooms.Lock()
+	defer r.muRooms.Unlock()
+	if len(r.rooms) == 0 {
+		return ""
+	}
+	return r.rooms[rand.Intn(len(r.rooms))]
+}
+
+// runBot : 終了時刻まで入室 (作成/観戦) と活動を繰り返す
+func (r *scenarioRunner) runBot(userId, role string) {
+	for time.Now().Before(r.end) {
+		b := NewBot(appID, appKey, userId, botProps)
+		b.onMessage = r.metrics.onMessage
+		b.onPong = func(rtt time.Duration) { r.metrics.observe("ping", rtt) }
+
+		roomId, ok := r.enter(b, role)
+		if !ok {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		until := r.end
+		if role == roleCreate {
+			r.addRoom(roomId)
+			if lt := time.Duration(r.sc.RoomLifetime); lt > 0 && time.Now().Add(lt).Before(until) {
+				until = time.Now().Add(lt)
+			}
+		}
+
+		r.play(b, role, until)
+
+		if role == roleCreate {
+			r.removeRoom(roomId)
+		}
+		select {
+		case <-b.done:
+		default:
+			b.LeaveAndClose()
+			<-b.done
+		}
+	}
+}
+
+// enter : 役割に応じて部屋を作成/入室/観戦し、websocketで接続する
+func (r *scenarioRunner) enter(b *bot, role string) (string, bool) {
+	var roomId string
+	if role != roleCreate {
+		roomId = r.randRoom()
+		if roomId == "" {
+			return "", false
+		}
+	}
+
+	t := time.Now()
+	var err error
+	switch role {
+	case roleCreate:
+		res, e := b.CreateRoom(binary.Dict{})
+		if e == nil {
+			roomId = res.RoomInfo.Id
+		}
+		err = e
+	case roleJoin:
+		_, err = b.JoinRoom(roomId, nil)
+	case roleWatch:
+		_, err = b.WatchRoom(roomId, nil)
+	}
+	if err != nil {
+		r.metrics.error(role, err)
+		return "", false
+	}
+	r.metrics.observe("lobby."+role, time.Since(t))
+
+	t = time.Now()
+	if err := b.DialGame(b.url, b.authKey, 0); err != nil {
+		r.metrics.error("dial", err)
+		return "", false
+	}
+	r.metrics.observe("dial", time.Since(t))
+	go b.EventLoop()
+
+	return roomId, true
+}
+
+type scenarioAction struct {
+	next time.Time
+	do   func() (time.Duration, error)
+	op   string
+}
+
+// play : untilまでメッセージの送信、部屋のpropsの更新、再接続を行う
+func (r *scenarioRunner) play(b *bot, role string, until time.Time) {
+	now := time.Now()
+	var actions []*scenarioAction
+	for _, m := range r.sc.Messages {
+		if !hasRole(m.Roles, role) {
+			continue
+		}
+		m := m
+		actions = append(actions, &scenarioAction{
+			next: now.Add(expInterval(m.Rate)),
+			op:   "send",
+			do: func() (time.Duration, error) {
+				return expInterval(m.Rate), r.sendMessage(b, m)
+			},
+		})
+	}
+	if rp := r.sc.RoomProp; role == roleCreate && rp.Interval > 0 {
+		n := 0
+		actions = append(actions, &scenarioAction{
+			next: now.Add(time.Duration(rp.Interval)),
+			op:   "send",
+			do: func() (time.Duration, error) {
+				n++
+				return time.Duration(rp.Interval), r.sendRoomProp(b, n, rp.Size)
+			},
+		})
+	}
+	if rc := r.sc.Reconnect; rc.Interval > 0 && hasRole(rc.Roles, role) {
+		rate := float64(time.Second) / float64(rc.Interval)
+		actions = append(actions, &scenarioAction{
+			next: now.Add(expInterval(rate)),
+			op:   "reconnect",
+			do: func() (time.Duration, error) {
+				t := time.Now()
+				err := b.Reconnect(time.Duration(rc.Downtime))
+				if err == nil {
+					r.metrics.observe("reconnect", time.Since(t)-time.Duration(rc.Downtime))
+				}
+				return expInterval(rate), err
+			},
+		})
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		var next *scenarioAction
+		for _, a := range actions {
+			if next == nil || a.next.Before(next.next) {
+				next = a
+			}
+		}
+		wake := until
+		if next != nil && next.next.Before(until) {
+			wake = next.next
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(wake))
+
+		select {
+		case <-b.done:
+			// 部屋が終了したか切断された
+			return
+		case <-timer.C:
+		}
+		if !time.Now().Before(until) {
+			return
+		}
+
+		d, err := next.do()
+		if err != nil {
+			r.metrics.error(next.op, err)
+			if next.op == "reconnect" {
+				return
+			}
+		}
+		next.next = time.Now().Add(d)
+	}
+}
+
+// expInterval : 毎秒rate回のポアソン過程の送信間隔
+func expInterval(rate float64) time.Duration {
+	return time.Duration(rand.ExpFloat64() / rate * float64(time.Second))
+}
+
+// scenarioBody : 受信側でレイテンシを計測するため、送信時刻 (unix micro) を先頭に付ける
+func scenarioBody(size int) []byte {
+	body := binary.MarshalULong(uint64(time.Now().UnixMicro()))
+	if size > 0 {
+		body = append(body, binary.MarshalStr16(randomString(size))...)
+	}
+	return body
+}
+
+func randomString(n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+func (r *scenarioRunner) sendMessage(b *bot, m *scenarioMessage) error {
+	var payload []byte
+	switch m.msgType {
+	case binary.MsgTypeBroadcast, binary.MsgTypeToMaster:
+		payload = scenarioBody(m.Size)
+	case binary.MsgTypeTargets:
+		// playersはEventLoopで更新されるので、自分自身に送って往復のレイテンシを計る
+		payload = MarshalTargetsAndData([]string{b.userId}, scenarioBody(m.Size))
+	case binary.MsgTypeTopicBroadcast:
+		payload = binary.MarshalTopicBroadcastPayload(m.Topic, scenarioBody(m.Size))
+	case binary.MsgTypeClientProp:
+		payload = binary.MarshalClientPropPayload(binary.Dict{
+			"scenario": binary.MarshalStr16(randomString(m.Size)),
+		})
+	}
+	if err := b.SendMessage(m.msgType, payload); err != nil {
+		return err
+	}
+	r.metrics.sent(m.msgType)
+	return nil
+}
+
+func (r *scenarioRunner) sendRoomProp(b *bot, n, size int) error {
+	props := binary.Dict{
+		"churn": binary.MarshalInt(n),
+	}
+	if size > 0 {
+		props["data"] = binary.MarshalStr16(randomString(size))
+	}
+	payload := binary.MarshalRoomPropPayload(true, true, true, 1, 6, 0, props, binary.Dict{})
+	if err := b.SendMessage(binary.MsgTypeRoomProp, payload); err != nil {
+		return err
+	}
+	r.metrics.sent(binary.MsgTypeRoomProp)
+	return nil
+}
@@ -8,15 +8,12 @@ import (
 	"runtime/debug"
 	"strings"
 	"syscall"
-	"time"
-
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/jmoiron/sqlx"
 
 	"wsnet2"
 	"wsnet2/config"
 	"wsnet2/game/service"
 	"wsnet2/log"
+	"wsnet2/storage"
 )
 
 func main() {
@@ -40,16 +37,19 @@ func main() {
 		}
 	}
 
-	db := sqlx.MustOpen("mysql", conf.Db.DSN())
+	store, err := storage.Open(&conf.Db)
+	if err != nil {
+		panic(fmt.Errorf("%+v\n", err))
+	}
+	log.Infof("Database: %v", conf.Db.Driver)
 	maxConns := conf.Game.DbMaxConns
 	if maxConns > 0 {
-		db.SetMaxOpenConns(maxConns)
-		db.SetMaxIdleConns(maxConns)
+		store.DB().SetMaxOpenConns(maxConns)
+		store.DB().SetMaxIdleConns(maxConns)
 		log.Infof("DbMaxConns: %v", maxConns)
 	}
-	db.SetConnMaxLifetime(time.Duration(conf.Db.ConnMaxLifetime))
 
-	service, err := service.New(db, &conf.Game)
+	service, err := service.New(store, &conf.Game)
 	if err != nil {
 		panic(fmt.Errorf("%+v\n", err))
 	}
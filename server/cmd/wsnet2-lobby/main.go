@@ -6,15 +6,12 @@ import (
 	"os"
 	"runtime/debug"
 	"strings"
-	"time"
-
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/jmoiron/sqlx"
 
 	"wsnet2"
 	"wsnet2/config"
 	"wsnet2/lobby/service"
 	"wsnet2/log"
+	"wsnet2/storage"
 )
 
 func main() {
@@ -38,16 +35,19 @@ func main() {
 		}
 	}
 
-	db := sqlx.MustOpen("mysql", conf.Db.DSN())
+	store, err := storage.Open(&conf.Db)
+	if err != nil {
+		panic(fmt.Errorf("%+v\n", err))
+	}
+	log.Infof("Database: %v", conf.Db.Driver)
 	maxConns := conf.Lobby.DbMaxConns
 	if maxConns > 0 {
-		db.SetMaxOpenConns(maxConns)
-		db.SetMaxIdleConns(maxConns)
+		store.DB().SetMaxOpenConns(maxConns)
+		store.DB().SetMaxIdleConns(maxConns)
 		log.Infof("DbMaxConns: %v", maxConns)
 	}
-	db.SetConnMaxLifetime(time.Duration(conf.Db.ConnMaxLifetime))
 
-	service, err := service.New(db, &conf.Lobby)
+	service, err := service.New(store, &conf.Lobby)
 	if err != nil {
 		panic(fmt.Errorf("%+v\n", err))
 	}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"wsnet2/analytics"
+)
+
+var (
+	analyticsFrom     string
+	analyticsTo       string
+	analyticsApp      string
+	analyticsInterval time.Duration
+	analyticsFormat   string
+	analyticsTable    string
+)
+
+// analyticsCmd represents the analytics command
+var analyticsCmd = &cobra.Command{
+	Use:   "analytics",
+	Short: "Show statistics of closed rooms and players",
+	Long: `Show statistics aggregated from room_history and player_log.
+Rooms existed between --from and --to are aggregated (default: last 24 hours).
+
+Tables (--format csv):
+  concurrency  number of rooms and players at each --interval
+  sessions     session length statistics
+  reconnects   attach/detach and reconnect counts per player
+  lifetimes    room lifetime distribution per search group
+  abandonment  abandoned room and session rates`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		to := time.Now()
+		if t, err := parseTime(analyticsTo); err != nil {
+			return err
+		} else if t != nil {
+			to = *t
+		}
+		from := to.Add(-24 * time.Hour)
+		if t, err := parseTime(analyticsFrom); err != nil {
+			return err
+		} else if t != nil {
+			from = *t
+		}
+		if !from.Before(to) {
+			return xerrors.Errorf("--from must be before --to")
+		}
+
+		histories, plogs, err := analytics.Load(cmd.Context(), store, analyticsApp, from, to)
+		if err != nil {
+			return err
+		}
+		report := analytics.Analyze(histories, plogs, &analytics.Options{
+			From:     from,
+			To:       to,
+			Interval: analyticsInterval,
+		})
+
+		switch analyticsFormat {
+		case "json":
+			return analytics.WriteJSON(os.Stdout, report)
+		case "csv":
+			return analytics.WriteCSV(os.Stdout, report, analyticsTable)
+		}
+		return xerrors.Errorf("unknown format: %v", analyticsFormat)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(analyticsCmd)
+
+	analyticsCmd.Flags().StringVarP(&analyticsFrom, "from", "", "", "Start of the period")
+	analyticsCmd.Flags().StringVarP(&analyticsTo, "to", "", "", "End of the period")
+	analyticsCmd.Flags().StringVarP(&analyticsApp, "app", "a", "", "App ID (default: all apps)")
+	analyticsCmd.Flags().DurationVarP(&analyticsInterval, "interval", "i", time.Hour, "Sampling interval of the concurrency")
+	analyticsCmd.Flags().StringVarP(&analyticsFormat, "format", "o", "csv", "Output format: csv, json")
+	analyticsCmd.Flags().StringVarP(&analyticsTable, "table", "t", "concurrency",
+		"Table to be shown in csv: "+strings.Join(analytics.Tables, ", "))
+}
@@ -6,22 +6,13 @@ import (
 	"github.com/spf13/cobra"
 )
 
-type app struct {
-	Id   string `db:"id"`
-	Name string `db:"name"`
-	Key  string `db:"key"`
-}
-
 // appsCmd represents the apps command
 var appsCmd = &cobra.Command{
 	Use:   "apps",
 	Short: "Show applications",
 	Long:  "Show applications registered on the DB",
 	Run: func(cmd *cobra.Command, args []string) {
-		const sql = "SELECT `id`, `key`, `name` FROM `app`"
-
-		var apps []*app
-		err := db.SelectContext(cmd.Context(), &apps, sql)
+		apps, err := store.AppList(cmd.Context())
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"wsnet2/archive"
+)
+
+var (
+	archiveDir       string
+	archiveRetention string
+	archiveBatch     int
+	archiveWait      time.Duration
+)
+
+// archiveCmd represents the archive command
+var archiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "Archive old room_history and player_log to files",
+	Long: `Write room_history and player_log older than the retention period
+to gzip compressed NDJSON files and delete them.
+Rows are archived in batches of --batch rows, waiting --wait between batches
+so that the tables are not locked for a long time.
+Run periodically (e.g. cron) to keep the tables small.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		retention, err := parseRetention(archiveRetention)
+		if err != nil {
+			return err
+		}
+		if archiveDir == "" {
+			return xerrors.Errorf("need --dir option")
+		}
+
+		results, err := archive.Archive(cmd.Context(), store, &archive.Options{
+			Dir:       archiveDir,
+			Before:    time.Now().Add(-retention),
+			BatchSize: archiveBatch,
+			Wait:      archiveWait,
+		})
+
+		cmd.SetOut(os.Stdout)
+		for _, r := range results {
+			file := r.File
+			if file == "" {
+				file = "-"
+			}
+			cmd.Printf("%v\t%v\t%v\n", r.Table, r.Rows, file)
+		}
+		return err
+	},
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore <file>...",
+	Short: "Restore archived room_history and player_log",
+	Long: `Insert rows in the archive files created by the archive command.
+Specify the database for investigation by --config (e.g. sqlite3) rather than the production one.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return xerrors.Errorf("need archive files")
+		}
+
+		cmd.SetOut(os.Stdout)
+		for _, path := range args {
+			n, err := archive.Restore(cmd.Context(), store, path)
+			cmd.Printf("%v\t%v\n", path, n)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(archiveCmd)
+	rootCmd.AddCommand(restoreCmd)
+
+	archiveCmd.Flags().StringVarP(&archiveDir, "dir", "d", "", "Directory to write archive files")
+	archiveCmd.Flags().StringVarP(&archiveRetention, "retention", "r", "90d", "Retention period (e.g. 90d, 720h)")
+	archiveCmd.Flags().IntVarP(&archiveBatch, "batch", "b", 1000, "Number of rows archived at once")
+	archiveCmd.Flags().DurationVarP(&archiveWait, "wait", "w", 100*time.Millisecond, "Wait time between batches")
+}
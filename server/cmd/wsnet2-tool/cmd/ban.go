@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"wsnet2/storage"
+)
+
+var (
+	banRoom     string
+	banDuration string
+	banReason   string
+
+	bansUser  string
+	bansAll   bool
+	bansLimit int
+)
+
+// banCmd represents the ban command
+var banCmd = &cobra.Command{
+	Use:   "ban <app> <user>",
+	Short: "Ban the user",
+	Long: `Ban the user from the app or the specified room.
+The lobby rejects the user within a few seconds. Use kick to remove the user from the current room.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return xerrors.Errorf("need app and user")
+		}
+		ban, err := newBan(args[0], args[1], banRoom, banDuration, banReason, time.Now())
+		if err != nil {
+			return err
+		}
+		return store.InsertBan(cmd.Context(), ban)
+	},
+}
+
+// unbanCmd represents the unban command
+var unbanCmd = &cobra.Command{
+	Use:   "unban <app> <user>",
+	Short: "Unban the user",
+	Long:  `Unban the user from the app or the specified room`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return xerrors.Errorf("need app and user")
+		}
+		err := store.DeleteBan(cmd.Context(), args[0], args[1], banRoom)
+		if xerrors.Is(err, storage.ErrNotFound) {
+			return xerrors.Errorf("ban not found: app=%v user=%v room=%q", args[0], args[1], banRoom)
+		}
+		return err
+	},
+}
+
+// bansCmd represents the bans command
+var bansCmd = &cobra.Command{
+	Use:   "bans [app]",
+	Short: "Show ban list",
+	Long:  `Show active bans in order of newest first`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter := &storage.BanFilter{
+			UserId: bansUser,
+			Limit:  bansLimit,
+		}
+		if len(args) > 0 {
+			filter.AppId = args[0]
+		}
+		if !bansAll {
+			now := time.Now()
+			filter.ActiveAt = &now
+		}
+
+		bans, err := store.Bans(cmd.Context(), filter)
+		if err != nil {
+			return err
+		}
+
+		cmd.SetOut(os.Stdout)
+		if verbose {
+			cmd.Println("app\tuser\troom\texpires\tbanned_by\tcreated\treason")
+		}
+		for _, b := range bans {
+			room := b.RoomID
+			if room == "" {
+				room = "-"
+			}
+			expires := "-"
+			if b.Expires.Valid {
+				expires = b.Expires.Time.String()
+			}
+			cmd.Printf("%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+				b.AppID, b.UserID, room, expires, b.BannedBy, b.Created, b.Reason)
+		}
+		return nil
+	},
+}
+
+// newBan : durationが空なら無期限
+func newBan(app, user, room, duration, reason string, now time.Time) (*storage.Ban, error) {
+	ban := &storage.Ban{
+		AppID:    app,
+		UserID:   user,
+		RoomID:   room,
+		Reason:   reason,
+		BannedBy: "admin",
+		Created:  now,
+	}
+	if duration != "" {
+		d, err := parseDuration(duration)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid duration: %w", err)
+		}
+		if d <= 0 {
+			return nil, xerrors.Errorf("duration must be positive: %v", duration)
+		}
+		ban.Expires = sql.NullTime{Time: now.Add(d), Valid: true}
+	}
+	return ban, nil
+}
+
+func init() {
+	rootCmd.AddCommand(banCmd)
+	rootCmd.AddCommand(unbanCmd)
+	rootCmd.AddCommand(bansCmd)
+
+	for _, c := range []*cobra.Command{banCmd, unbanCmd} {
+		c.Flags().StringVarP(&banRoom, "room", "r", "", "Room ID (default: the whole app)")
+	}
+	banCmd.Flags().StringVarP(&banDuration, "duration", "d", "", "Ban duration such as 12h or 7d (default: permanent)")
+	banCmd.Flags().StringVarP(&banReason, "reason", "m", "", "Reason of the ban")
+
+	bansCmd.Flags().StringVarP(&bansUser, "user", "u", "", "User ID")
+	bansCmd.Flags().BoolVarP(&bansAll, "all", "A", false, "Show expired bans too")
+	bansCmd.Flags().IntVarP(&bansLimit, "limit", "l", 100, "Upper limit of the ban count to be shown")
+}
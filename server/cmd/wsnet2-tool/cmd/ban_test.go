@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewBan(t *testing.T) {
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	b, err := newBan("app1", "user1", "", "", "cheat", now)
+	if err != nil {
+		t.Fatalf("newBan: %+v", err)
+	}
+	if b.Expires.Valid || b.RoomID != "" || b.Reason != "cheat" || b.BannedBy != "admin" || !b.Created.Equal(now) {
+		t.Errorf("permanent ban = %+v", b)
+	}
+
+	b, err = newBan("app1", "user1", "room1", "7d", "", now)
+	if err != nil {
+		t.Fatalf("newBan(7d): %+v", err)
+	}
+	if !b.Expires.Valid || !b.Expires.Time.Equal(now.Add(7*24*time.Hour)) || b.RoomID != "room1" {
+		t.Errorf("7d ban = %+v", b)
+	}
+
+	for _, d := range []string{"x", "0d", "-1h"} {
+		if _, err := newBan("app1", "user1", "", d, "", now); err == nil {
+			t.Errorf("newBan(duration=%q) must fail", d)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"wsnet2/binary"
+	"wsnet2/pb"
+)
+
+var broadcastText bool
+
+// broadcastCmd represents the broadcast command
+var broadcastCmd = &cobra.Command{
+	Use:   "broadcast <room> <message>",
+	Short: "Send a system message to the room",
+	Long: `Send a message to all the players and watchers in the room.
+The message is delivered as a string whose sender is empty.
+With --text, the message is parsed as the text representation (see: props command).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return xerrors.Errorf("need room and message")
+		}
+
+		msg := strings.Join(args[1:], " ")
+		data := binary.MarshalStr16(msg)
+		if broadcastText {
+			var err error
+			data, err = binary.ParseText(msg)
+			if err != nil {
+				return err
+			}
+		}
+
+		svr, err := selectGrpcServer(cmd.Context(), args[0])
+		if err != nil {
+			return err
+		}
+		conn, err := svr.Dial()
+		if err != nil {
+			return err
+		}
+
+		_, err = pb.NewGameAdminClient(conn).Broadcast(cmd.Context(), &pb.AdminBroadcastReq{
+			AppId:  svr.App,
+			RoomId: svr.Room,
+			Data:   data,
+		})
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(broadcastCmd)
+
+	broadcastCmd.Flags().BoolVarP(&broadcastText, "text", "t", false, "Parse the message as the text representation")
+}
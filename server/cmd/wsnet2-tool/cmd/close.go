@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"wsnet2/pb"
+)
+
+var closeReason string
+
+// closeCmd represents the close command
+var closeCmd = &cobra.Command{
+	Use:   "close <room>",
+	Short: "Close the room",
+	Long:  `Close the room forcibly. All the players and watchers leave the room with the reason.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return xerrors.Errorf("need room")
+		}
+
+		svr, err := selectGrpcServer(cmd.Context(), args[0])
+		if err != nil {
+			return err
+		}
+		conn, err := svr.Dial()
+		if err != nil {
+			return err
+		}
+
+		_, err = pb.NewGameAdminClient(conn).CloseRoom(cmd.Context(), &pb.CloseRoomReq{
+			AppId:  svr.App,
+			RoomId: svr.Room,
+			Reason: closeReason,
+		})
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(closeCmd)
+
+	closeCmd.Flags().StringVarP(&closeReason, "reason", "r", "closed by admin", "Reason notified to the clients")
+}
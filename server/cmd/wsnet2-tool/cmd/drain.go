@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"wsnet2/pb"
+)
+
+var drainHub bool
+
+// drainCmd represents the drain command
+var drainCmd = &cobra.Command{
+	Use:   "drain <host>",
+	Short: "Put the game/hub server in closing state",
+	Long: `Put the game server (or the hub server with --hub) in closing state.
+The server no longer accepts new rooms/watchers, and exits after all of them are closed.
+The host is specified by its id or hostname.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return xerrors.Errorf("need host")
+		}
+
+		svr, err := selectHostGrpcServer(cmd.Context(), args[0], drainHub)
+		if err != nil {
+			return err
+		}
+		conn, err := svr.Dial()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		_, err = pb.NewGameAdminClient(conn).Drain(cmd.Context(), &pb.Empty{})
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(drainCmd)
+
+	drainCmd.Flags().BoolVarP(&drainHub, "hub", "u", false, "Drain the hub server")
+}
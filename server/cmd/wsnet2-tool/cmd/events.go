@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"wsnet2/storage"
+)
+
+var (
+	eventsApp   string
+	eventsRoom  string
+	eventsSince string
+	eventsUntil string
+	eventsLimit int
+)
+
+// eventsCmd represents the events command
+var eventsCmd = &cobra.Command{
+	Use:   "events <userid>",
+	Short: "Show session events of the player",
+	Long: `Show session events of the player across rooms in chronological order.
+Events: Join, Leave, Connect, Disconnect, Kick, MasterSwitch, ClientError`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 && eventsRoom == "" {
+			return xerrors.Errorf("need userid or --room")
+		}
+		filter := &storage.PlayerEventFilter{
+			AppId:  eventsApp,
+			RoomId: eventsRoom,
+			Limit:  eventsLimit,
+		}
+		if len(args) > 0 {
+			filter.PlayerId = args[0]
+		}
+		var err error
+		if filter.Since, err = parseTime(eventsSince); err != nil {
+			return err
+		}
+		if filter.Until, err = parseTime(eventsUntil); err != nil {
+			return err
+		}
+
+		events, err := store.PlayerEvents(cmd.Context(), filter)
+		if err != nil {
+			return err
+		}
+
+		cmd.SetOut(os.Stdout)
+		if verbose {
+			cmd.Println("datetime\tapp\troom\tplayer\tevent\tdetail")
+		}
+		for _, ev := range events {
+			cmd.Printf("%v\t%v\t%v\t%v\t%v\t%v\n",
+				ev.Datetime, ev.AppID, ev.RoomID, ev.PlayerID, ev.Event, ev.Detail)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(eventsCmd)
+
+	eventsCmd.Flags().StringVarP(&eventsApp, "app", "a", "", "App ID")
+	eventsCmd.Flags().StringVarP(&eventsRoom, "room", "r", "", "Room ID")
+	eventsCmd.Flags().StringVarP(&eventsSince, "since", "s", "", "Show events at or after the specified time")
+	eventsCmd.Flags().StringVarP(&eventsUntil, "until", "u", "", "Show events before the specified time")
+	eventsCmd.Flags().IntVarP(&eventsLimit, "limit", "l", 1000, "Upper limit of the event count to be shown")
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"wsnet2/pb"
+)
+
+var (
+	liveroomsApp       string
+	liveroomsGroup     uint32
+	liveroomsClient    string
+	liveroomsJoinable  bool
+	liveroomsWatchable bool
+	liveroomsLimit     uint32
+)
+
+// liveroomsCmd represents the liverooms command
+var liveroomsCmd = &cobra.Command{
+	Use:   "liverooms",
+	Short: "Show room list from the game servers",
+	Long: `Show active room list queried from each running game server.
+Unlike the rooms command, it shows the current state held by the game servers.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		hosts, err := hostMap(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		req := &pb.ListRoomsReq{
+			AppId:         liveroomsApp,
+			ClientId:      liveroomsClient,
+			JoinableOnly:  liveroomsJoinable,
+			WatchableOnly: liveroomsWatchable,
+			Limit:         liveroomsLimit,
+		}
+		if cmd.Flags().Changed("group") {
+			req.SearchGroup = &liveroomsGroup
+		}
+
+		since := time.Now().Add(-time.Duration(conf.Lobby.ValidHeartBeat)).Unix()
+		rooms := []*pb.RoomInfo{}
+		for _, h := range hosts {
+			if h.Heartbeat < since {
+				continue
+			}
+			conn, err := hostGrpcServer(h).Dial()
+			if err != nil {
+				return err
+			}
+			res, err := pb.NewGameAdminClient(conn).ListRooms(cmd.Context(), req)
+			conn.Close()
+			if err != nil {
+				cmd.PrintErrf("ListRooms(%v): %v\n", h.Hostname, err)
+				continue
+			}
+			rooms = append(rooms, res.Rooms...)
+		}
+
+		sort.Slice(rooms, func(i, j int) bool { return rooms[i].Id < rooms[j].Id })
+		if liveroomsLimit > 0 && len(rooms) > int(liveroomsLimit) {
+			rooms = rooms[:liveroomsLimit]
+		}
+
+		cmd.SetOut(os.Stdout)
+		if verbose {
+			printRoomsHeader(cmd)
+		}
+		for _, r := range rooms {
+			err := printRoom(cmd, r, hosts)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(liveroomsCmd)
+
+	liveroomsCmd.Flags().StringVarP(&liveroomsApp, "app", "a", "", "App ID")
+	liveroomsCmd.Flags().Uint32VarP(&liveroomsGroup, "group", "g", 0, "Search group")
+	liveroomsCmd.Flags().StringVarP(&liveroomsClient, "client", "c", "", "Rooms the client joined as a player")
+	liveroomsCmd.Flags().BoolVarP(&liveroomsJoinable, "joinable", "j", false, "Joinable rooms only")
+	liveroomsCmd.Flags().BoolVarP(&liveroomsWatchable, "watchable", "w", false, "Watchable rooms only")
+	liveroomsCmd.Flags().Uint32VarP(&liveroomsLimit, "limit", "n", 0, "Max number of rooms (0: no limit)")
+}
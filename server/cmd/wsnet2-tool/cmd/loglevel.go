@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"wsnet2/log"
+	"wsnet2/pb"
+)
+
+// loglevelCmd represents the loglevel command
+var loglevelCmd = &cobra.Command{
+	Use:   "loglevel <room> <level>",
+	Short: "Change the log level of the room",
+	Long: `Change the log level of the room at runtime.
+Level: NOLOG(1), ERROR(2), INFO(3), DEBUG(4), ALL(5)`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return xerrors.Errorf("need room and level")
+		}
+
+		lv, err := parseLogLevel(args[1])
+		if err != nil {
+			return err
+		}
+
+		svr, err := selectGrpcServer(cmd.Context(), args[0])
+		if err != nil {
+			return err
+		}
+		conn, err := svr.Dial()
+		if err != nil {
+			return err
+		}
+
+		_, err = pb.NewGameAdminClient(conn).SetRoomLogLevel(cmd.Context(), &pb.SetRoomLogLevelReq{
+			AppId:    svr.App,
+			RoomId:   svr.Room,
+			LogLevel: uint32(lv),
+		})
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(loglevelCmd)
+}
+
+func parseLogLevel(s string) (log.Level, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < int(log.NOLOG) || n > int(log.ALL) {
+			return 0, xerrors.Errorf("invalid log level: %v", s)
+		}
+		return log.Level(n), nil
+	}
+	for l := log.NOLOG; l <= log.ALL; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, xerrors.Errorf("invalid log level: %v", s)
+}
@@ -2,41 +2,28 @@ package cmd
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"os"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	"github.com/spf13/cobra"
 	"golang.org/x/xerrors"
 
 	"wsnet2/binary"
 	"wsnet2/game"
+	"wsnet2/storage"
 )
 
 type roomHistory struct {
-	ID           int           `db:"id"`
-	AppID        string        `db:"app_id"`
-	HostID       uint32        `db:"host_id"`
-	RoomID       string        `db:"room_id"`
-	Number       sql.NullInt32 `db:"number"`
-	SearchGroup  uint32        `db:"search_group"`
-	MaxPlayers   uint32        `db:"max_players"`
-	PublicProps  []byte        `db:"public_props"`
-	PrivateProps []byte        `db:"private_props"`
-	Created      time.Time     `db:"created"`
-	Closed       time.Time     `db:"closed"`
+	*storage.RoomHistory
 
 	PlayerLogs []*playerLog
 }
 
 type playerLog struct {
-	ID       int               `db:"id" json:"-"`
-	RoomID   string            `db:"room_id" json:"-"`
-	PlayerID string            `db:"player_id" json:"player_id"`
-	Message  game.PlayerLogMsg `db:"message" json:"message"`
-	Datetime time.Time         `db:"datetime" json:"datetime"`
+	PlayerID string            `json:"player_id"`
+	Message  game.PlayerLogMsg `json:"message"`
+	Datetime time.Time         `json:"datetime"`
 }
 
 // oldroomCmd represents the oldroom command
@@ -83,39 +70,36 @@ func init() {
 }
 
 func selectRoomHistoryByIds(ctx context.Context, ids []string) (map[string]*roomHistory, error) {
-	q, p, err := sqlx.In("SELECT * FROM room_history WHERE room_id IN (?)", ids)
-	if err != nil {
-		return nil, err
-	}
-	_, rooms, err := selectRoomHistory(ctx, q, p...)
+	_, rooms, err := selectRoomHistory(ctx, &storage.RoomHistoryFilter{RoomIds: ids})
 	return rooms, err
 }
 
-func selectRoomHistory(ctx context.Context, q string, p ...any) ([]*roomHistory, map[string]*roomHistory, error) {
-	var rooms []*roomHistory
-	err := db.SelectContext(ctx, &rooms, q, p...)
-	if err != nil || len(rooms) == 0 {
-		return rooms, map[string]*roomHistory{}, err
+func selectRoomHistory(ctx context.Context, filter *storage.RoomHistoryFilter) ([]*roomHistory, map[string]*roomHistory, error) {
+	histories, err := store.RoomHistories(ctx, filter)
+	if err != nil || len(histories) == 0 {
+		return []*roomHistory{}, map[string]*roomHistory{}, err
 	}
-	m := make(map[string]*roomHistory, len(rooms))
-	rids := make([]string, 0, len(rooms))
-	for _, r := range rooms {
+	rooms := make([]*roomHistory, 0, len(histories))
+	m := make(map[string]*roomHistory, len(histories))
+	rids := make([]string, 0, len(histories))
+	for _, h := range histories {
+		r := &roomHistory{RoomHistory: h}
+		rooms = append(rooms, r)
 		m[r.RoomID] = r
 		rids = append(rids, r.RoomID)
 	}
 
-	q, p, err = sqlx.In("SELECT * FROM player_log WHERE room_id IN (?) ORDER BY id", rids)
-	if err != nil {
-		return nil, nil, err
-	}
-	var plogs []*playerLog
-	err = db.SelectContext(ctx, &plogs, q, p...)
+	plogs, err := store.PlayerLogs(ctx, rids)
 	if err != nil {
 		return nil, nil, err
 	}
 	for _, p := range plogs {
 		rid := p.RoomID
-		m[rid].PlayerLogs = append(m[rid].PlayerLogs, p)
+		m[rid].PlayerLogs = append(m[rid].PlayerLogs, &playerLog{
+			PlayerID: p.PlayerID,
+			Message:  game.PlayerLogMsg(p.Message),
+			Datetime: p.Datetime,
+		})
 	}
 
 	return rooms, m, nil
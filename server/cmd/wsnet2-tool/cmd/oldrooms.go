@@ -8,6 +8,8 @@ import (
 
 	"github.com/spf13/cobra"
 	"golang.org/x/xerrors"
+
+	"wsnet2/storage"
 )
 
 var (
@@ -51,9 +53,9 @@ var oldroomsCmd = &cobra.Command{
 			printOldRoomsHeader(cmd)
 		}
 		for _, r := range rooms {
-			err := printOldRoom(cmd, r, hosts)
-			if err != nil {
-				return err
+			// propsが読めなくても読めた分を出力して続ける
+			if err := printOldRoom(cmd, r, hosts); err != nil {
+				cmd.PrintErrf("room %v: %v\n", r.RoomID, err)
 			}
 		}
 
@@ -68,6 +70,7 @@ func init() {
 	oldroomsCmd.Flags().StringVarP(&oldroomsBefore, "before", "b", "", "Show rooms created before the specified time")
 	oldroomsCmd.Flags().StringVarP(&oldroomsAfter, "after", "a", "", "Show rooms created after the specified time")
 	oldroomsCmd.Flags().IntVarP(&oldroomsLimit, "limit", "l", 100, "Upper limit of the room count to be shown")
+	oldroomsCmd.Flags().BoolVarP(&propsText, "text", "t", false, "Show props in the text representation instead of JSON")
 }
 
 func parseTime(t string) (*time.Time, error) {
@@ -98,30 +101,12 @@ func parseTime(t string) (*time.Time, error) {
 }
 
 func selectRoomHistoryForList(ctx context.Context, limit int, before, after, at *time.Time) ([]*roomHistory, error) {
-	q := "SELECT * FROM room_history"
-	p := []any{}
-	var where []string
-	if before != nil {
-		where = append(where, "created <= ?")
-		p = append(p, before)
-	}
-	if after != nil {
-		where = append(where, "created >= ?")
-		p = append(p, after)
-	}
-	if at != nil {
-		where = append(where, "created <= ?")
-		where = append(where, "closed >= ?")
-		p = append(p, at)
-		p = append(p, at)
-	}
-	if where != nil {
-		q += " WHERE " + strings.Join(where, " AND ")
-	}
-	q += " ORDER BY created DESC LIMIT ?"
-	p = append(p, limit)
-
-	rooms, _, err := selectRoomHistory(ctx, q, p...)
+	rooms, _, err := selectRoomHistory(ctx, &storage.RoomHistoryFilter{
+		CreatedBefore: before,
+		CreatedAfter:  after,
+		At:            at,
+		Limit:         limit,
+	})
 	return rooms, err
 }
 
@@ -144,10 +129,10 @@ func printOldRoomsHeader(cmd *cobra.Command) {
 	cmd.Println("id\tapp\thost\tnumber\tgroup\tmax_players\tplayers\tcreated\tclosed\tprops")
 }
 
-func printOldRoom(cmd *cobra.Command, r *roomHistory, hosts map[uint32]*server) error {
+func printOldRoom(cmd *cobra.Command, r *roomHistory, hosts map[uint32]*storage.ServerInfo) error {
 	host := "-"
 	if h, ok := hosts[r.HostID]; ok {
-		host = h.HostName
+		host = h.Hostname
 	}
 
 	var number int32
@@ -157,7 +142,7 @@ func printOldRoom(cmd *cobra.Command, r *roomHistory, hosts map[uint32]*server)
 
 	players := playerIds(r.PlayerLogs)
 
-	props, err := parsePropsSimple(r.PublicProps)
+	props, err := formatProps(r.PublicProps, propsText)
 
 	cmd.Printf("%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
 		r.RoomID,
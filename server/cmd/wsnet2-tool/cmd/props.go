@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"wsnet2/binary"
+)
+
+var propsDecode bool
+
+// propsCmd represents the props command
+var propsCmd = &cobra.Command{
+	Use:   "props <text>|<hex>",
+	Short: "Convert props between text and binary",
+	Long: `Convert props written in the text representation to hex-encoded binary,
+or hex-encoded binary to the text representation with --decode.
+
+Text representation:
+  null, true, false, 123 (Int), 1.5 (Double), "str" (Str8),
+  SByte(-1), Byte(1), Char('a'), Short(-1), UShort(1), UInt(1),
+  Long(-1), ULong(1), Float(1.5), Double(1.5), Str16("str"),
+  Obj(1)[v1,v2], [v1,v2] (List), {"key":v} (Dict),
+  Bools[true], SBytes[-1], Bytes[1], Chars("abc"), Shorts[-1], UShorts[1],
+  Ints[1], UInts[1], Longs[-1], ULongs[1], Floats[1.5], Doubles[1.5]`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil // DBは使わない
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return xerrors.Errorf("need props\n")
+		}
+
+		out, err := convertProps(strings.Join(args, " "), propsDecode)
+		if err != nil {
+			return err
+		}
+
+		cmd.SetOut(os.Stdout)
+		cmd.Println(out)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(propsCmd)
+
+	propsCmd.Flags().BoolVarP(&propsDecode, "decode", "d", false, "Decode hex-encoded binary to text")
+}
+
+func convertProps(src string, decode bool) (string, error) {
+	if decode {
+		b, err := hex.DecodeString(strings.ReplaceAll(src, " ", ""))
+		if err != nil {
+			return "", xerrors.Errorf("decode hex: %w", err)
+		}
+		return binary.FormatText(b)
+	}
+
+	b, err := binary.ParseText(src)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
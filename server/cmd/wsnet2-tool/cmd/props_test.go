@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestConvertProps(t *testing.T) {
+	tests := map[string]struct {
+		src    string
+		decode bool
+		exp    string
+	}{
+		"encode": {
+			src: `{"k1": Byte(1)}`,
+			exp: "1301026b3100020401",
+		},
+		"decode": {
+			src:    "13 01 02 6b 31 00 02 04 01",
+			decode: true,
+			exp:    `{"k1":Byte(1)}`,
+		},
+		"obj": {
+			src:    "1103000102",
+			decode: true,
+			exp:    `Obj(3)[true]`,
+		},
+	}
+
+	for k, test := range tests {
+		out, err := convertProps(test.src, test.decode)
+		if err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+		if out != test.exp {
+			t.Fatalf("%s: %q, wants %q", k, out, test.exp)
+		}
+	}
+
+	if _, err := convertProps("zz", true); err == nil {
+		t.Fatalf("decode invalid hex must error")
+	}
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+)
+
+var (
+	purgeRetention string
+	purgeBatch     int
+	purgeDryRun    bool
+)
+
+// purgeCmd represents the purge command
+var purgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Delete old room_history and player_log",
+	Long: `Delete room_history and player_log older than the retention period.
+Rows are deleted in batches of --batch rows.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		retention, err := parseRetention(purgeRetention)
+		if err != nil {
+			return err
+		}
+		if purgeBatch <= 0 {
+			return xerrors.Errorf("--batch must be positive")
+		}
+		before := time.Now().Add(-retention)
+
+		cmd.SetOut(os.Stdout)
+		if purgeDryRun {
+			cmd.Printf("room_history and player_log before %v will be deleted\n", before.Format(time.RFC3339))
+			return nil
+		}
+
+		ctx := cmd.Context()
+		rooms, err := purgeAll(ctx, before, store.PurgeRoomHistories)
+		if err != nil {
+			return err
+		}
+		logs, err := purgeAll(ctx, before, store.PurgePlayerLogs)
+		if err != nil {
+			return err
+		}
+		cmd.Printf("deleted: room_history=%v player_log=%v (before %v)\n", rooms, logs, before.Format(time.RFC3339))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(purgeCmd)
+
+	purgeCmd.Flags().StringVarP(&purgeRetention, "retention", "r", "90d", "Retention period (e.g. 90d, 720h)")
+	purgeCmd.Flags().IntVarP(&purgeBatch, "batch", "b", 1000, "Number of rows deleted at once")
+	purgeCmd.Flags().BoolVarP(&purgeDryRun, "dry-run", "n", false, "Show the threshold without deleting")
+}
+
+func purgeAll(ctx context.Context, before time.Time, purge func(context.Context, time.Time, int) (int, error)) (int, error) {
+	total := 0
+	for {
+		n, err := purge(ctx, before, purgeBatch)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < purgeBatch {
+			return total, nil
+		}
+	}
+}
+
+// parseRetention : 保持期間. parseDurationの形式で正の値
+func parseRetention(s string) (time.Duration, error) {
+	d, err := parseDuration(s)
+	if err != nil {
+		return 0, xerrors.Errorf("invalid retention: %w", err)
+	}
+	if d <= 0 {
+		return 0, xerrors.Errorf("retention must be positive: %v", s)
+	}
+	return d, nil
+}
+
+// parseDuration : time.ParseDuration に加えて日数 ("90d") を受け付ける
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, xerrors.Errorf("invalid days: %v", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
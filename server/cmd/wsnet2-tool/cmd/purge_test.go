@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := map[string]time.Duration{
+		"90d":  90 * 24 * time.Hour,
+		"1d":   24 * time.Hour,
+		"720h": 720 * time.Hour,
+		"30m":  30 * time.Minute,
+	}
+	for s, want := range tests {
+		d, err := parseRetention(s)
+		if err != nil {
+			t.Fatalf("parseRetention(%q): %+v", s, err)
+		}
+		if d != want {
+			t.Errorf("parseRetention(%q) = %v, want %v", s, d, want)
+		}
+	}
+
+	for _, s := range []string{"", "d", "xd", "0d", "-1h", "10"} {
+		if _, err := parseRetention(s); err == nil {
+			t.Errorf("parseRetention(%q) must fail", s)
+		}
+	}
+}
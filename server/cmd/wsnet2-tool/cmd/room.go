@@ -5,11 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 	"wsnet2/binary"
 	"wsnet2/pb"
+	"wsnet2/storage"
 
-	"github.com/jmoiron/sqlx"
 	"github.com/spf13/cobra"
 	"golang.org/x/xerrors"
 	"google.golang.org/grpc"
@@ -17,32 +18,79 @@ import (
 )
 
 type grpcServer struct {
-	Room string `db:"room_id"`
-	App  string `db:"app_id"`
-	Host string `db:"hostname"`
-	Port int    `db:"grpc_port"`
+	Room string
+	App  string
+	Host string
+	Port int
 }
 
 func selectGrpcServers(ctx context.Context, ids []string) (map[string]*grpcServer, error) {
-	q, p, err := sqlx.In(
-		"SELECT r.id room_id, r.app_id, s.hostname, s.grpc_port FROM room r JOIN game_server s ON r.host_id = s.id WHERE r.id IN (?)", ids)
+	rooms, err := store.Rooms(ctx, ids)
 	if err != nil {
-		return nil, xerrors.Errorf("build query: %w", err)
+		return nil, xerrors.Errorf("select rooms: %w", err)
 	}
-	var svrs []*grpcServer
-	err = db.SelectContext(ctx, &svrs, q, p...)
+	hosts, err := hostMap(ctx)
 	if err != nil {
-		return nil, xerrors.Errorf("select grpc servers: %w", err)
+		return nil, xerrors.Errorf("select game servers: %w", err)
 	}
 
 	m := make(map[string]*grpcServer)
-	for _, s := range svrs {
-		m[s.Room] = s
+	for _, r := range rooms {
+		h, ok := hosts[r.HostId]
+		if !ok {
+			continue
+		}
+		m[r.Id] = &grpcServer{
+			Room: r.Id,
+			App:  r.AppId,
+			Host: h.Hostname,
+			Port: h.GRPCPort,
+		}
 	}
 
 	return m, nil
 }
 
+// selectGrpcServer : 部屋が存在するgameサーバ
+func selectGrpcServer(ctx context.Context, id string) (*grpcServer, error) {
+	svrs, err := selectGrpcServers(ctx, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	svr, ok := svrs[id]
+	if !ok {
+		return nil, xerrors.Errorf("room not found: %v", id)
+	}
+	return svr, nil
+}
+
+// hostGrpcServer : 部屋によらないgame/hubサーバのgRPCの接続先
+func hostGrpcServer(h *storage.ServerInfo) *grpcServer {
+	return &grpcServer{Host: h.Hostname, Port: h.GRPCPort}
+}
+
+// selectHostGrpcServer : idまたはhostnameが一致するgameサーバ (hubがtrueならhubサーバ)
+func selectHostGrpcServer(ctx context.Context, host string, hub bool) (*grpcServer, error) {
+	var servers []*storage.ServerInfo
+	var err error
+	if hub {
+		servers, err = store.HubServers(ctx)
+	} else {
+		servers, err = store.GameServers(ctx)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("select servers: %w", err)
+	}
+
+	id, perr := strconv.ParseUint(host, 10, 32)
+	for _, s := range servers {
+		if s.Hostname == host || (perr == nil && s.Id == uint32(id)) {
+			return hostGrpcServer(s), nil
+		}
+	}
+	return nil, xerrors.Errorf("server not found: %v", host)
+}
+
 func (s *grpcServer) Dial() (*grpc.ClientConn, error) {
 	return grpc.Dial(fmt.Sprintf("%s:%d", s.Host, s.Port),
 		grpc.WithTransportCredentials(insecure.NewCredentials()))
@@ -4,14 +4,19 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sort"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/xerrors"
 
 	"wsnet2/binary"
 	"wsnet2/pb"
+	"wsnet2/storage"
 )
 
+// propsText : rooms/oldroomsのpropsをJSONではなくtext表現で出力する
+var propsText bool
+
 // roomsCmd represents the rooms command
 var roomsCmd = &cobra.Command{
 	Use:   "rooms",
@@ -23,9 +28,7 @@ var roomsCmd = &cobra.Command{
 			return err
 		}
 
-		const roomsql = "SELECT * FROM room"
-		var rooms []*pb.RoomInfo
-		err = db.SelectContext(cmd.Context(), &rooms, roomsql)
+		rooms, err := store.Rooms(cmd.Context(), nil)
 		if err != nil {
 			return err
 		}
@@ -36,9 +39,9 @@ var roomsCmd = &cobra.Command{
 		}
 
 		for _, r := range rooms {
-			err := printRoom(cmd, r, hosts)
-			if err != nil {
-				return err
+			// propsが読めなくても読めた分を出力して続ける
+			if err := printRoom(cmd, r, hosts); err != nil {
+				cmd.PrintErrf("room %v: %v\n", r.Id, err)
 			}
 		}
 
@@ -48,19 +51,19 @@ var roomsCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(roomsCmd)
+
+	roomsCmd.Flags().BoolVarP(&propsText, "text", "t", false, "Show props in the text representation instead of JSON")
 }
 
-func hostMap(ctx context.Context) (map[uint32]*server, error) {
-	const hostsql = "SELECT * FROM game_server"
-	var hosts []*server
-	err := db.SelectContext(ctx, &hosts, hostsql)
+func hostMap(ctx context.Context) (map[uint32]*storage.ServerInfo, error) {
+	hosts, err := store.GameServers(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	m := make(map[uint32]*server)
+	m := make(map[uint32]*storage.ServerInfo)
 	for _, h := range hosts {
-		m[uint32(h.Id)] = h
+		m[h.Id] = h
 	}
 
 	return m, nil
@@ -70,16 +73,16 @@ func printRoomsHeader(cmd *cobra.Command) {
 	cmd.Println("id\tapp\thost\tflags\tnumber\tgroup\tmax_players\tplayers\twatchers\tcreated\tprops")
 }
 
-func printRoom(cmd *cobra.Command, r *pb.RoomInfo, h map[uint32]*server) error {
+func printRoom(cmd *cobra.Command, r *pb.RoomInfo, h map[uint32]*storage.ServerInfo) error {
 	var num int32
 	if r.Number != nil {
 		num = r.Number.Number
 	}
 
-	p, err := parsePropsSimple(r.PublicProps)
+	p, err := formatProps(r.PublicProps, propsText)
 
 	cmd.Printf("%v\t%v\t%v\t%v\t%06d\t%d\t%d\t%d\t%d\t%v\t%s\n",
-		r.Id, r.AppId, h[r.HostId].HostName, roomFlags(r), num,
+		r.Id, r.AppId, h[r.HostId].Hostname, roomFlags(r), num,
 		r.SearchGroup, r.MaxPlayers, r.Players, r.Watchers,
 		r.Created.Time(), p)
 
@@ -100,90 +103,142 @@ func roomFlags(r *pb.RoomInfo) string {
 	return string(f)
 }
 
-func parsePropsSimple(data []byte) (string, error) {
+// formatProps : propsを一覧用に整形する. 読めない値があっても、読めた分を返す
+func formatProps(data []byte, text bool) (string, error) {
+	if text {
+		return formatPropsText(data)
+	}
+	return parsePropsSimple(data)
+}
+
+// propsKeys : 出力を安定させるためにkeyを整列する
+func propsKeys(dic binary.Dict) []string {
+	keys := make([]string, 0, len(dic))
+	for k := range dic {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatPropsText : propsをtext表現で出力する. 読めない値は"!error"として続ける
+func formatPropsText(data []byte) (string, error) {
 	u, _, err := binary.UnmarshalAs(data, binary.TypeDict, binary.TypeNull)
 	if err != nil {
 		return "", err
 	}
 	dic, _ := u.(binary.Dict)
+	var errs []error
 	out := []byte{'{'}
-	for k, d := range dic {
-		if len(d) == 0 {
-			return string(out), xerrors.Errorf("No payload: key=%v", k)
+	for _, k := range propsKeys(dic) {
+		v, err := binary.FormatText(dic[k])
+		if err != nil {
+			errs = append(errs, xerrors.Errorf("key=%v: %w", k, err))
+			out = fmt.Appendf(out, "%q:%q,", k, "!error")
+			continue
 		}
+		out = fmt.Appendf(out, "%q:%s,", k, v)
+	}
+	if len(out) > 1 {
+		out = out[:len(out)-1]
+	}
+	out = append(out, '}')
 
-		out = fmt.Appendf(out, "%q:", k)
-
-		t := binary.Type(d[0])
-		switch t {
-		case binary.TypeNull:
-			out = fmt.Append(out, "null,")
-		case binary.TypeTrue:
-			out = fmt.Append(out, "true,")
-		case binary.TypeFalse:
-			out = fmt.Append(out, "false,")
-		case binary.TypeSByte, binary.TypeByte, binary.TypeChar, binary.TypeShort, binary.TypeUShort,
-			binary.TypeInt, binary.TypeUInt, binary.TypeLong, binary.TypeULong,
-			binary.TypeFloat, binary.TypeDouble, binary.TypeDecimal:
-			v, _, err := binary.Unmarshal(d)
-			if err != nil {
-				return string(out), err
-			}
-			out = fmt.Appendf(out, "%v,", v)
-		case binary.TypeStr8, binary.TypeStr16:
-			v, _, err := binary.Unmarshal(d)
-			if err != nil {
-				return string(out), err
-			}
-			out = fmt.Appendf(out, "%q,", v)
-		case binary.TypeObj:
-			out = fmt.Appendf(out, `"Obj(%d)",`, d[1])
-		case binary.TypeBools:
-			out, err = appendPrimitiveArraySimple[bool](out, d)
-			if err != nil {
-				return string(out), err
-			}
-		case binary.TypeSBytes, binary.TypeBytes, binary.TypeShorts, binary.TypeUShorts,
-			binary.TypeInts, binary.TypeUInts, binary.TypeLongs:
-			out, err = appendPrimitiveArraySimple[int](out, d)
-			if err != nil {
-				return string(out), err
-			}
-		case binary.TypeChars:
-			out, err = appendPrimitiveArraySimple[rune](out, d)
-			if err != nil {
-				return string(out), err
-			}
-		case binary.TypeULongs:
-			out, err = appendPrimitiveArraySimple[uint64](out, d)
-			if err != nil {
-				return string(out), err
-			}
-		case binary.TypeFloats:
-			out, err = appendPrimitiveArraySimple[float32](out, d)
-			if err != nil {
-				return string(out), err
-			}
-		case binary.TypeDoubles:
-			out, err = appendPrimitiveArraySimple[float64](out, d)
-			if err != nil {
-				return string(out), err
-			}
-		case binary.TypeList:
-			out = fmt.Appendf(out, `"List[%d]",`, d[1])
-		default:
-			out = fmt.Appendf(out, "%q,", t)
+	return string(out), propsError(errs)
+}
+
+// parsePropsSimple : propsを一覧用の簡易なJSONで出力する. 読めない値は"!error"として続ける
+func parsePropsSimple(data []byte) (string, error) {
+	u, _, err := binary.UnmarshalAs(data, binary.TypeDict, binary.TypeNull)
+	if err != nil {
+		return "", err
+	}
+	dic, _ := u.(binary.Dict)
+	var errs []error
+	out := []byte{'{'}
+	for _, k := range propsKeys(dic) {
+		v, err := appendPropSimple(nil, dic[k])
+		if err != nil {
+			errs = append(errs, xerrors.Errorf("key=%v: %w", k, err))
+			v = fmt.Appendf(nil, "%q,", "!error")
 		}
+		out = fmt.Appendf(out, "%q:%s", k, v)
 	}
 	if len(out) > 1 {
 		out = out[:len(out)-1]
 	}
 	out = append(out, '}')
 
-	return string(out), nil
+	return string(out), propsError(errs)
+}
+
+func propsError(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return xerrors.Errorf("props: %v", errs)
+}
+
+func appendPropSimple(out, d []byte) ([]byte, error) {
+	if len(d) == 0 {
+		return out, xerrors.Errorf("No payload")
+	}
+
+	t := binary.Type(d[0])
+	switch t {
+	case binary.TypeNull:
+		out = fmt.Append(out, "null,")
+	case binary.TypeTrue:
+		out = fmt.Append(out, "true,")
+	case binary.TypeFalse:
+		out = fmt.Append(out, "false,")
+	case binary.TypeSByte, binary.TypeByte, binary.TypeChar, binary.TypeShort, binary.TypeUShort,
+		binary.TypeInt, binary.TypeUInt, binary.TypeLong, binary.TypeULong,
+		binary.TypeFloat, binary.TypeDouble, binary.TypeDecimal:
+		v, _, err := binary.Unmarshal(d)
+		if err != nil {
+			return out, err
+		}
+		out = fmt.Appendf(out, "%v,", v)
+	case binary.TypeStr8, binary.TypeStr16:
+		v, _, err := binary.Unmarshal(d)
+		if err != nil {
+			return out, err
+		}
+		out = fmt.Appendf(out, "%q,", v)
+	case binary.TypeObj:
+		if len(d) < 2 {
+			return out, xerrors.Errorf("No class id")
+		}
+		out = fmt.Appendf(out, `"Obj(%d)",`, d[1])
+	case binary.TypeBools:
+		return appendPrimitiveArraySimple[bool](out, d)
+	case binary.TypeSBytes, binary.TypeBytes, binary.TypeShorts, binary.TypeUShorts,
+		binary.TypeInts, binary.TypeUInts, binary.TypeLongs:
+		return appendPrimitiveArraySimple[int](out, d)
+	case binary.TypeChars:
+		return appendPrimitiveArraySimple[rune](out, d)
+	case binary.TypeULongs:
+		return appendPrimitiveArraySimple[uint64](out, d)
+	case binary.TypeFloats:
+		return appendPrimitiveArraySimple[float32](out, d)
+	case binary.TypeDoubles:
+		return appendPrimitiveArraySimple[float64](out, d)
+	case binary.TypeList:
+		if len(d) < 2 {
+			return out, xerrors.Errorf("No list length")
+		}
+		out = fmt.Appendf(out, `"List[%d]",`, d[1])
+	default:
+		out = fmt.Appendf(out, "%q,", t)
+	}
+	return out, nil
 }
 
 func appendPrimitiveArraySimple[T any](out, data []byte) ([]byte, error) {
+	if len(data) < 3 {
+		return out, xerrors.Errorf("No array length: %v", binary.Type(data[0]))
+	}
 	if n := int(data[1])<<8 + int(data[2]); n > 4 {
 		return fmt.Appendf(out, "\"%v[%d]\",", binary.Type(data[0]), n), nil
 	}
@@ -197,7 +252,7 @@ func appendPrimitiveArraySimple[T any](out, data []byte) ([]byte, error) {
 	for _, v := range l {
 		out = fmt.Appendf(out, "%v,", v)
 	}
-	if len(out) > 1 {
+	if out[len(out)-1] == ',' {
 		out = out[:len(out)-1]
 	}
 	return fmt.Append(out, "],"), nil
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -96,3 +97,46 @@ func TestAppendPrimitiveArraySimple(t *testing.T) {
 		}
 	}
 }
+
+func TestFormatPropsText(t *testing.T) {
+	data := binary.MarshalDict(binary.Dict{
+		"k1": binary.MarshalByte(1),
+		"k2": binary.MarshalStr8("hoge"),
+		"k3": binary.MarshalInts([]int{1, 2, 3, 4, 5}),
+	})
+	exp := `{"k1":Byte(1),"k2":"hoge","k3":Ints[1,2,3,4,5]}`
+
+	str, err := formatProps(data, true)
+	if err != nil {
+		t.Fatalf("formatProps: %v - %v", err, str)
+	}
+	if str != exp {
+		t.Fatalf("formatProps: %q, wants %q", str, exp)
+	}
+}
+
+func TestFormatPropsPartial(t *testing.T) {
+	// 読めない値があっても、読めた分は出力する
+	data := binary.MarshalDict(binary.Dict{
+		"k1":  binary.MarshalByte(1),
+		"bad": {byte(binary.TypeStr8), 10, 'a'},
+		"k2":  binary.MarshalStr8("hoge"),
+	})
+	tests := map[string]struct {
+		text bool
+		exp  string
+	}{
+		"json": {false, `{"bad":"!error","k1":1,"k2":"hoge"}`},
+		"text": {true, `{"bad":"!error","k1":Byte(1),"k2":"hoge"}`},
+	}
+
+	for k, test := range tests {
+		str, err := formatProps(data, test.text)
+		if err == nil || !strings.Contains(err.Error(), "key=bad") {
+			t.Fatalf("%s: error must point the bad key: %v", k, err)
+		}
+		if str != test.exp {
+			t.Fatalf("%s: %q, wants %q", k, str, test.exp)
+		}
+	}
+}
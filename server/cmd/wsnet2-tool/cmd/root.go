@@ -4,18 +4,17 @@ import (
 	"fmt"
 	"os"
 
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/jmoiron/sqlx"
 	"github.com/spf13/cobra"
 
 	"wsnet2"
 	"wsnet2/config"
+	"wsnet2/storage"
 )
 
 var (
 	confFile string
 	conf     *config.Config
-	db       *sqlx.DB
+	store    storage.Database
 	verbose  bool
 )
 
@@ -34,7 +33,7 @@ var rootCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		db, err = sqlx.Open("mysql", conf.Db.DSN())
+		store, err = storage.Open(&conf.Db)
 		if err != nil {
 			return err
 		}
@@ -59,5 +58,4 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVarP(&confFile, "config", "f", "", "Config toml file")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Verbose output")
-	_ = rootCmd.MarkPersistentFlagRequired("config")
 }
@@ -5,31 +5,24 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
+
+	"wsnet2/storage"
 )
 
 var (
-	serversGameOnly bool
-	serversHubOnly  bool
-	serversAll      bool
+	serversGameOnly  bool
+	serversHubOnly   bool
+	serversLobbyOnly bool
+	serversAll       bool
 
 	serverStatusStr = []string{"Starting", "Running", "Closing"}
 )
 
-type server struct {
-	Id            int    `db:"id"`
-	HostName      string `db:"hostname"`
-	PublicName    string `db:"public_name"`
-	GRPCPort      int    `db:"grpc_port"`
-	WebSocketPort int    `db:"ws_port"`
-	Status        int    `db:"status"`
-	HeartBeat     int64  `db:"heartbeat"`
-}
-
 // serversCmd represents the servers command
 var serversCmd = &cobra.Command{
 	Use:   "servers",
-	Short: "Show all game/hub servers",
-	Long:  "Show all game and/or hub servers",
+	Short: "Show all game/hub/lobby servers",
+	Long:  "Show all game, hub and/or lobby servers",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cmd.SetOut(os.Stdout)
 
@@ -37,10 +30,10 @@ var serversCmd = &cobra.Command{
 			printServersHeader(cmd)
 		}
 
-		if !serversHubOnly {
-			const sql = "select * from game_server"
-			var servers []server
-			err := db.SelectContext(cmd.Context(), &servers, sql)
+		all := !serversGameOnly && !serversHubOnly && !serversLobbyOnly
+
+		if all || serversGameOnly {
+			servers, err := store.GameServers(cmd.Context())
 			if err != nil {
 				return err
 			}
@@ -48,10 +41,8 @@ var serversCmd = &cobra.Command{
 				printServer(cmd, "game", s)
 			}
 		}
-		if !serversGameOnly {
-			const sql = "select * from hub_server"
-			var servers []server
-			err := db.SelectContext(cmd.Context(), &servers, sql)
+		if all || serversHubOnly {
+			servers, err := store.HubServers(cmd.Context())
 			if err != nil {
 				return err
 			}
@@ -59,6 +50,15 @@ var serversCmd = &cobra.Command{
 				printServer(cmd, "hub", s)
 			}
 		}
+		if all || serversLobbyOnly {
+			servers, err := store.LobbyServers(cmd.Context())
+			if err != nil {
+				return err
+			}
+			for _, s := range servers {
+				printServer(cmd, "lobby", s)
+			}
+		}
 		return nil
 	},
 }
@@ -68,16 +68,17 @@ func init() {
 
 	serversCmd.Flags().BoolVarP(&serversGameOnly, "game", "g", false, "show game servers only")
 	serversCmd.Flags().BoolVarP(&serversHubOnly, "hub", "u", false, "show hub servers only")
+	serversCmd.Flags().BoolVarP(&serversLobbyOnly, "lobby", "l", false, "show lobby servers only")
 	serversCmd.Flags().BoolVarP(&serversAll, "all", "a", false, "show all servers including dead servers")
 }
 
 func printServersHeader(cmd *cobra.Command) {
-	cmd.Println("type\tid\thost\tpublic\tgrpc\twebsocket\tstatus\theartbeat")
+	cmd.Println("type\tid\thost\tpublic\tgrpc\twebsocket\tregion\tstatus\theartbeat")
 }
 
-func printServer(cmd *cobra.Command, typ string, s server) {
+func printServer(cmd *cobra.Command, typ string, s *storage.ServerInfo) {
 	st := serverStatusStr[s.Status]
-	hb := time.Unix(s.HeartBeat, 0)
+	hb := time.Unix(s.Heartbeat, 0)
 	v := time.Duration(conf.Lobby.ValidHeartBeat)
 	ok := "Available"
 	if hb.Before(time.Now().Add(-v)) {
@@ -87,6 +88,6 @@ func printServer(cmd *cobra.Command, typ string, s server) {
 		ok = "Dead"
 	}
 
-	cmd.Printf("%s\t%d\t%s\t%s\t%d\t%d\t%s:%s\t%v\n",
-		typ, s.Id, s.HostName, s.PublicName, s.GRPCPort, s.WebSocketPort, st, ok, hb)
+	cmd.Printf("%s\t%d\t%s\t%s\t%d\t%d\t%s\t%s:%s\t%v\n",
+		typ, s.Id, s.Hostname, s.PublicName, s.GRPCPort, s.WebSocketPort, s.Region, st, ok, hb)
 }
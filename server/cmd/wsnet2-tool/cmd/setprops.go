@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"wsnet2/binary"
+	"wsnet2/pb"
+)
+
+var (
+	setpropsPrivate     bool
+	setpropsVisible     bool
+	setpropsJoinable    bool
+	setpropsWatchable   bool
+	setpropsSearchGroup uint32
+	setpropsMaxPlayers  uint32
+)
+
+// setpropsCmd represents the setprops command
+var setpropsCmd = &cobra.Command{
+	Use:   "setprops <room> [key=value]...",
+	Short: "Update the room properties",
+	Long: `Update the room properties as the server.
+Values are written in the text representation (see: props command).
+An empty value removes the key (e.g. "key=").
+Flags of the room are changed only when specified.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return xerrors.Errorf("need room")
+		}
+
+		props, err := parseKeyValues(args[1:])
+		if err != nil {
+			return err
+		}
+
+		svr, err := selectGrpcServer(cmd.Context(), args[0])
+		if err != nil {
+			return err
+		}
+
+		req := &pb.UpdateRoomPropsReq{
+			AppId:  svr.App,
+			RoomId: svr.Room,
+		}
+		if len(props) > 0 {
+			if setpropsPrivate {
+				req.PrivateProps = binary.MarshalDict(props)
+			} else {
+				req.PublicProps = binary.MarshalDict(props)
+			}
+		}
+		flags := cmd.Flags()
+		if flags.Changed("visible") {
+			req.Visible = &setpropsVisible
+		}
+		if flags.Changed("joinable") {
+			req.Joinable = &setpropsJoinable
+		}
+		if flags.Changed("watchable") {
+			req.Watchable = &setpropsWatchable
+		}
+		if flags.Changed("group") {
+			req.SearchGroup = &setpropsSearchGroup
+		}
+		if flags.Changed("max-players") {
+			req.MaxPlayers = &setpropsMaxPlayers
+		}
+
+		conn, err := svr.Dial()
+		if err != nil {
+			return err
+		}
+
+		_, err = pb.NewGameAdminClient(conn).UpdateRoomProps(cmd.Context(), req)
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(setpropsCmd)
+
+	setpropsCmd.Flags().BoolVarP(&setpropsPrivate, "private", "p", false, "Update private props instead of public props")
+	setpropsCmd.Flags().BoolVar(&setpropsVisible, "visible", false, "Visible flag")
+	setpropsCmd.Flags().BoolVar(&setpropsJoinable, "joinable", false, "Joinable flag")
+	setpropsCmd.Flags().BoolVar(&setpropsWatchable, "watchable", false, "Watchable flag")
+	setpropsCmd.Flags().Uint32VarP(&setpropsSearchGroup, "group", "g", 0, "Search group")
+	setpropsCmd.Flags().Uint32VarP(&setpropsMaxPlayers, "max-players", "m", 0, "Max players")
+}
+
+// parseKeyValues : key=value形式の引数をDictにする. 値は空 (削除) かテキスト表現
+func parseKeyValues(args []string) (binary.Dict, error) {
+	props := make(binary.Dict, len(args))
+	for _, arg := range args {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok || k == "" {
+			return nil, xerrors.Errorf("invalid key=value: %q", arg)
+		}
+		if v == "" {
+			props[k] = []byte{}
+			continue
+		}
+		b, err := binary.ParseText(v)
+		if err != nil {
+			return nil, xerrors.Errorf("value of %q: %w", k, err)
+		}
+		props[k] = b
+	}
+	return props, nil
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"wsnet2/binary"
+)
+
+func TestParseKeyValues(t *testing.T) {
+	props, err := parseKeyValues([]string{`a=1`, `b="x=y"`, `c=`, `d=Byte(2)`})
+	if err != nil {
+		t.Fatalf("parseKeyValues: %+v", err)
+	}
+	exp := binary.Dict{
+		"a": binary.MarshalInt(1),
+		"b": binary.MarshalStr8("x=y"),
+		"c": []byte{},
+		"d": binary.MarshalByte(2),
+	}
+	if diff := cmp.Diff(props, exp); diff != "" {
+		t.Fatalf("props (-got +want)\n%s", diff)
+	}
+
+	for _, arg := range []string{"a", "=1", "a=unknown"} {
+		if _, err := parseKeyValues([]string{arg}); err == nil {
+			t.Errorf("parseKeyValues(%q) must fail", arg)
+		}
+	}
+}
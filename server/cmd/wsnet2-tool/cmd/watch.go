@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"wsnet2/binary"
+	"wsnet2/pb"
+)
+
+// watchCmd represents the watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch <room>",
+	Short: "Tail the events of the room",
+	Long: `Print the events of the room until the room is closed.
+The watch is not counted as a watcher of the room.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return xerrors.Errorf("need room")
+		}
+
+		svr, err := selectGrpcServer(cmd.Context(), args[0])
+		if err != nil {
+			return err
+		}
+		conn, err := svr.Dial()
+		if err != nil {
+			return err
+		}
+
+		stream, err := pb.NewGameAdminClient(conn).WatchRoom(cmd.Context(), &pb.AdminRoomReq{
+			AppId:  svr.App,
+			RoomId: svr.Room,
+		})
+		if err != nil {
+			return err
+		}
+
+		cmd.SetOut(os.Stdout)
+		for {
+			ev, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			j, err := json.Marshal(formatRoomEvent(ev, time.Now()))
+			if err != nil {
+				return err
+			}
+			cmd.Println(string(j))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+}
+
+func formatRoomEvent(ev *pb.RoomEvent, t time.Time) map[string]any {
+	m := map[string]any{
+		"time": t,
+		"type": binary.EvType(ev.Type).String(),
+	}
+	if len(ev.Payload) == 0 {
+		return m
+	}
+	p, err := binary.UnmarshalRecursive(ev.Payload)
+	if err != nil {
+		// 削除されたキーを含むDictなどは復元できないのでそのまま出力
+		m["raw"] = hex.EncodeToString(ev.Payload)
+		return m
+	}
+	m["payload"] = p
+	return m
+}
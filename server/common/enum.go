@@ -5,3 +5,11 @@ const (
 	HostStatusRunning  = 1
 	HostStatusClosing  = 2
 )
+
+// JoinSource : 入室時の部屋の指定方法. player_eventに記録する
+const (
+	JoinSourceCreate = "create"
+	JoinSourceId     = "id"
+	JoinSourceNumber = "number"
+	JoinSourceRandom = "random"
+)
@@ -29,21 +29,17 @@ func NewRingBuf[T any](size int) *RingBuf[T] {
 // Write to buffer from Room.MsgLoop goroutine.
 // It returns an error when buffer is full.
 func (b *RingBuf[T]) Write(data T) error {
-	// MsgLoopは単一goroutineで、wSeqはここでしか書き換えない
-	// rSeqがwSeqを超えることは無いのでロックし続けなくてよい
-	b.mu.RLock()
+	// Rewriteが未読のデータを詰めることがあるので、書き込みもロックする
+	b.mu.Lock()
 	r, w := b.rSeq, b.wSeq
-	b.mu.RUnlock()
-
 	s := len(b.buf)
 
 	if w-s == r {
+		b.mu.Unlock()
 		return xerrors.Errorf("RingBuf overflow: size=%v, read=%v, write=%v", s, r, w)
 	}
 
 	b.buf[w%s] = data
-
-	b.mu.Lock()
 	b.wSeq++
 	b.mu.Unlock()
 
@@ -65,19 +61,18 @@ func (b *RingBuf[T]) Read(seq int) ([]T, error) {
 	size := len(b.buf)
 
 	b.mu.Lock()
+	defer b.mu.Unlock()
 	r, w := b.rSeq, b.wSeq
 	if seq < r {
 		// rewind read seq num
 		if w-seq >= size {
-			b.mu.Unlock()
 			return nil, xerrors.Errorf("RingBuf too old seq num: %v, size:%v write:%v", seq, size, w)
 		}
-		b.rSeq = seq
 		r = seq
 	}
-	b.mu.Unlock() // wSeqがrSeqを超えることは無いのでロックし続けなくて良い
 
 	if r == w {
+		b.rSeq = w
 		return []T{}, nil
 	}
 	count := w - r
@@ -85,10 +80,39 @@ func (b *RingBuf[T]) Read(seq int) ([]T, error) {
 	for i := 0; i < count; i++ {
 		buf[i] = b.buf[(r+i)%size]
 	}
-
-	b.mu.Lock()
 	b.rSeq = w
-	b.mu.Unlock()
 
 	return buf, nil
 }
+
+// Rewrite replaces data after seq with f(data), or removes it if f returns false.
+// 後続のデータは詰めるので、seqより後を読み込んだReaderがいないときだけ呼ぶ.
+// It returns the number of removed data.
+func (b *RingBuf[T]) Rewrite(seq int, f func(T) (T, bool)) int {
+	size := len(b.buf)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w := b.wSeq
+	if seq >= w || w-seq >= size {
+		// 古すぎるseqはReadがエラーにする
+		return 0
+	}
+
+	n := seq
+	for i := seq; i < w; i++ {
+		if d, ok := f(b.buf[i%size]); ok {
+			b.buf[n%size] = d
+			n++
+		}
+	}
+	var zero T
+	for i := n; i < w; i++ {
+		b.buf[i%size] = zero
+	}
+	b.wSeq = n
+	if b.rSeq > n {
+		b.rSeq = n
+	}
+	return w - n
+}
@@ -125,3 +125,44 @@ func TestReadWithRewind(t *testing.T) {
 		t.Fatalf("Read(2) must error")
 	}
 }
+
+func TestRewrite(t *testing.T) {
+	buf := NewEvBuf(5)
+
+	for i := 1; i <= 4; i++ {
+		if e := buf.Write(binary.NewRegularEvent(binary.EvType(i), nil)); e != nil {
+			t.Fatalf("Write(%v) error: %v", i, e)
+		}
+	}
+	buf.Read(0)
+
+	// seq=1より後の偶数を取り除き、3は書き換える
+	n := buf.Rewrite(1, func(ev *binary.RegularEvent) (*binary.RegularEvent, bool) {
+		if ev.Type() == 3 {
+			return binary.NewRegularEvent(30, nil), true
+		}
+		return ev, ev.Type()%2 == 1
+	})
+	if n != 2 {
+		t.Fatalf("Rewrite removed %v, wants 2", n)
+	}
+
+	if e := buf.Write(binary.NewRegularEvent(5, nil)); e != nil {
+		t.Fatalf("Write(5) error: %v", e)
+	}
+	r, e := buf.Read(1)
+	if e != nil {
+		t.Fatalf("Read(1) error: %v", e)
+	}
+	wants := []*binary.RegularEvent{
+		binary.NewRegularEvent(30, nil),
+		binary.NewRegularEvent(5, nil),
+	}
+	if !reflect.DeepEqual(r, wants) {
+		t.Fatalf("Read(1) %v, wants %v", r, wants)
+	}
+
+	if n := buf.Rewrite(3, func(ev *binary.RegularEvent) (*binary.RegularEvent, bool) { return nil, false }); n != 0 {
+		t.Fatalf("Rewrite after the last data removed %v, wants 0", n)
+	}
+}
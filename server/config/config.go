@@ -35,6 +35,8 @@ type LogConf struct {
 }
 
 type DbConf struct {
+	// Driver : "mysql" か "sqlite3". sqlite3ではDBNameをファイルのパスとして使う
+	Driver          string
 	Host            string
 	Port            int
 	DBName          string
@@ -49,6 +51,8 @@ type GameConf struct {
 	Hostname string
 	// PublicName : クライアントからのアクセス名. see Load()
 	PublicName string `toml:"public_name"`
+	// Region : 配置されたリージョン/ゾーン. Lobbyのサーバ選択で優先される. see Load()
+	Region string `toml:"region"`
 
 	GRPCPort      int `toml:"grpc_port"`
 	WebsocketPort int `toml:"websocket_port"`
@@ -70,8 +74,24 @@ type GameConf struct {
 	DefaultDeadline   uint32 `toml:"default_deadline"`
 	DefaultLoglevel   uint32 `toml:"default_loglevel"`
 
+	// MaxRoomStateSize : room state (MsgTypeRoomState) のmarshal後の最大サイズ
+	MaxRoomStateSize int `toml:"max_room_state_size"`
+
 	HeartBeatInterval Duration `toml:"heartbeat_interval"`
 
+	// LobbyValidHeartBeat : lobbyのHeartBeatの有効期間. 有効なlobbyに部屋の状態を送る
+	LobbyValidHeartBeat Duration `toml:"lobby_valid_heartbeat"`
+
+	// PlayerEventBufSize : 書き込み待ちのplayer_eventの上限. 溢れて書き込めなかった分は記録しない
+	PlayerEventBufSize int `toml:"player_event_buf_size"`
+	// PlayerEventBatchSize : player_eventをまとめて書き込む最大数
+	PlayerEventBatchSize int `toml:"player_event_batch_size"`
+	// PlayerEventFlushInterval : 溜まったplayer_eventを書き込む間隔
+	PlayerEventFlushInterval Duration `toml:"player_event_flush_interval"`
+
+	// RoomUpdateInterval : 部屋の更新をroomテーブルに書き込む間隔. lobbyへはLobbySyncで即座に送る
+	RoomUpdateInterval Duration `toml:"room_update_interval"`
+
 	DbMaxConns int `toml:"db_max_conns"`
 
 	ClientConf
@@ -83,6 +103,8 @@ type HubConf struct {
 	Hostname string
 	// PublicName : クライアントからのアクセス名. see Load()
 	PublicName string `toml:"public_name"`
+	// Region : 配置されたリージョン/ゾーン. Lobbyのサーバ選択で優先される. see Load()
+	Region string `toml:"region"`
 
 	GRPCPort      int `toml:"grpc_port"`
 	WebsocketPort int `toml:"websocket_port"`
@@ -102,6 +124,15 @@ type HubConf struct {
 	HeartBeatInterval Duration `toml:"heartbeat_interval"`
 	NodeCountInterval Duration `toml:"nodecount_interval"`
 
+	// MaxWatchDelay : 観戦者への配信遅延の上限
+	MaxWatchDelay Duration `toml:"max_watch_delay"`
+
+	// ShutdownGracePeriod : 停止時に観戦者へEvTypeRewatchを送ってから切断するまでの猶予
+	ShutdownGracePeriod Duration `toml:"shutdown_grace_period"`
+
+	// UpstreamRetryTimeout : game（または親hub）との接続が切れたとき、観戦し直しを試みる期間
+	UpstreamRetryTimeout Duration `toml:"upstream_retry_timeout"`
+
 	DbMaxConns int `toml:"db_max_conns"`
 
 	ClientConf
@@ -115,6 +146,14 @@ type ClientConf struct {
 	WaitAfterClose Duration `toml:"wait_after_close"`
 
 	AuthKeyLen int `toml:"auth_key_len"`
+
+	// MinProtocolVersion : 接続を受け付ける最小のプロトコルバージョン
+	MinProtocolVersion int `toml:"min_protocol_version"`
+
+	// WatcherChatRate : 観戦者チャットの観戦者毎の流量制限 (件/秒). 0以下は無制限
+	WatcherChatRate float64 `toml:"watcher_chat_rate"`
+	// WatcherChatBurst : 観戦者チャットの連続送信を許容する件数
+	WatcherChatBurst int `toml:"watcher_chat_burst"`
 }
 
 type LobbyConf struct {
@@ -124,6 +163,15 @@ type LobbyConf struct {
 	Port      int
 	PprofPort int `toml:"pprof_port"`
 
+	// GRPCHost : gameサーバからのアクセス名. see Default()
+	GRPCHost string `toml:"grpc_host"`
+	// GRPCPort : gameサーバから部屋の状態を受け取るgRPCの待受けポート.
+	// 0なら受け取らずに部屋の検索は全てDBを使う
+	GRPCPort int `toml:"grpc_port"`
+
+	// HeartBeatInterval : lobby_serverテーブルのHeartBeatの間隔 (GRPCPortを指定したときのみ)
+	HeartBeatInterval Duration `toml:"heartbeat_interval"`
+
 	Loglevel uint32 `toml:"loglevel"`
 
 	// ValidHeartBeat : HeartBeatの有効期間
@@ -135,6 +183,12 @@ type LobbyConf struct {
 
 	HubMaxWatchers int `toml:"hub_max_watchers"`
 
+	// GameMaxUsage : 部屋数・クライアント数の上限やCPUに対する使用率がこれ以上のgameサーバでは部屋を作成しない (0なら制限しない)
+	GameMaxUsage float64 `toml:"game_max_usage"`
+
+	// BanCacheExpire : banの一覧をDBから読み直す間隔. DBでの追加・削除はこの間隔で反映される
+	BanCacheExpire Duration `toml:"ban_cache_expire"`
+
 	DbMaxConns int `toml:"db_max_conns"`
 
 	LogConf
@@ -148,22 +202,16 @@ func (d *Duration) UnmarshalText(text []byte) error {
 	return err
 }
 
-// Load : tomlファイルから読み込む
-//
-// 次の環境変数はtomlより優先される.
-// - WSNET2_GAME_HOSTNAME:   Config.{Game,Hub}.Hostname
-// - WSNET2_GAME_PUBLICNAME: Config.{Game,Hub}.PublicName
-// - WSNET2_GAME_GRPCPORT:   Config.{Game,Hub}.GRPCPort
-// - WSNET2_GAME_WSPORT:     Config.{Game,Hub}.WebsocketPort
-func Load(conffile string) (*Config, error) {
+// Default : 既定値の設定. Load() ではtomlの内容をこの上に読み込む
+func Default() *Config {
 	hostname, _ := os.Hostname()
 	if hostname == "" {
 		hostname = "localhost"
 	}
 
-	c := &Config{
-		// set default values before decode file.
+	return &Config{
 		Db: DbConf{
+			Driver:          "mysql",
 			ConnMaxLifetime: Duration(3 * time.Minute),
 		},
 		Game: GameConf{
@@ -180,14 +228,29 @@ func Load(conffile string) (*Config, error) {
 			DefaultDeadline:   5,
 			DefaultLoglevel:   2,
 
+			MaxRoomStateSize: 64 * 1024,
+
 			HeartBeatInterval: Duration(2 * time.Second),
 
+			LobbyValidHeartBeat: Duration(5 * time.Second),
+
+			PlayerEventBufSize:       10000,
+			PlayerEventBatchSize:     100,
+			PlayerEventFlushInterval: Duration(time.Second),
+
+			RoomUpdateInterval: Duration(5 * time.Second),
+
 			DbMaxConns: 0,
 
 			ClientConf: ClientConf{
 				EventBufSize:   128,
 				WaitAfterClose: Duration(30 * time.Second),
 				AuthKeyLen:     32,
+
+				MinProtocolVersion: 1,
+
+				WatcherChatRate:  1,
+				WatcherChatBurst: 5,
 			},
 
 			LogConf: LogConf{
@@ -212,12 +275,22 @@ func Load(conffile string) (*Config, error) {
 			HeartBeatInterval: Duration(2 * time.Second),
 			NodeCountInterval: Duration(1 * time.Second),
 
+			MaxWatchDelay: Duration(10 * time.Minute),
+
+			ShutdownGracePeriod:  Duration(30 * time.Second),
+			UpstreamRetryTimeout: Duration(30 * time.Second),
+
 			DbMaxConns: 0,
 
 			ClientConf: ClientConf{
 				EventBufSize:   128,
 				WaitAfterClose: Duration(30 * time.Second),
 				AuthKeyLen:     32,
+
+				MinProtocolVersion: 1,
+
+				WatcherChatRate:  1,
+				WatcherChatBurst: 5,
 			},
 
 			LogConf: LogConf{
@@ -230,11 +303,17 @@ func Load(conffile string) (*Config, error) {
 			},
 		},
 		Lobby: LobbyConf{
+			GRPCHost:          hostname,
+			GRPCPort:          19080,
+			HeartBeatInterval: Duration(2 * time.Second),
+
 			ValidHeartBeat: Duration(5 * time.Second),
 			Loglevel:       2,
 			AuthDataExpire: Duration(time.Minute),
 			ApiTimeout:     Duration(5 * time.Second),
 			HubMaxWatchers: 10000,
+			GameMaxUsage:   0.9,
+			BanCacheExpire: Duration(5 * time.Second),
 
 			DbMaxConns: 0,
 
@@ -248,6 +327,18 @@ func Load(conffile string) (*Config, error) {
 			},
 		},
 	}
+}
+
+// Load : tomlファイルから読み込む
+//
+// 次の環境変数はtomlより優先される.
+// - WSNET2_GAME_HOSTNAME:   Config.{Game,Hub}.Hostname
+// - WSNET2_GAME_PUBLICNAME: Config.{Game,Hub}.PublicName
+// - WSNET2_GAME_GRPCPORT:   Config.{Game,Hub}.GRPCPort
+// - WSNET2_GAME_WSPORT:     Config.{Game,Hub}.WebsocketPort
+// - WSNET2_GAME_REGION:     Config.{Game,Hub}.Region
+func Load(conffile string) (*Config, error) {
+	c := Default()
 
 	confBytes, err := os.ReadFile(conffile)
 	if err != nil {
@@ -292,6 +383,10 @@ func (db *DbConf) loadAuthfile(conffile string) error {
 }
 
 func (db *DbConf) DSN() string {
+	if db.Driver == "sqlite3" {
+		// game/hub/lobbyの複数プロセスから書き込むのでWALにしてロック待ちする
+		return fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL", db.DBName)
+	}
 	user := db.User
 	if db.Password != "" {
 		user = fmt.Sprintf("%s:%s", db.User, db.Password)
@@ -309,6 +404,10 @@ func (c *Config) applyEnvVar() {
 		c.Game.PublicName = v
 		c.Hub.PublicName = v
 	}
+	if v := os.Getenv("WSNET2_GAME_REGION"); v != "" {
+		c.Game.Region = v
+		c.Hub.Region = v
+	}
 	if v, err := strconv.Atoi(os.Getenv("WSNET2_GAME_WSPORT")); err == nil {
 		c.Game.WebsocketPort = v
 		c.Hub.WebsocketPort = v
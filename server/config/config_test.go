@@ -17,6 +17,7 @@ func TestLoad(t *testing.T) {
 	}
 
 	db := DbConf{
+		Driver:          "mysql",
 		Host:            "localhost",
 		Port:            3306,
 		DBName:          "wsnet2",
@@ -43,12 +44,27 @@ func TestLoad(t *testing.T) {
 		DefaultDeadline:   5,
 		DefaultLoglevel:   2,
 
+		MaxRoomStateSize: 64 * 1024,
+
 		HeartBeatInterval: Duration(time.Second * 10),
 
+		LobbyValidHeartBeat: Duration(time.Second * 5),
+
+		PlayerEventBufSize:       10000,
+		PlayerEventBatchSize:     100,
+		PlayerEventFlushInterval: Duration(time.Second),
+
+		RoomUpdateInterval: Duration(5 * time.Second),
+
 		ClientConf: ClientConf{
 			EventBufSize:   512,
 			WaitAfterClose: Duration(time.Second * 60),
 			AuthKeyLen:     32,
+
+			MinProtocolVersion: 1,
+
+			WatcherChatRate:  1,
+			WatcherChatBurst: 5,
 		},
 
 		LogConf: LogConf{
@@ -70,11 +86,18 @@ func TestLoad(t *testing.T) {
 		UnixPath:       "/tmp/sock",
 		Net:            "tcp",
 		Port:           8080,
+		GRPCHost:       hostname,
+		GRPCPort:       19080,
 		Loglevel:       2,
 		ValidHeartBeat: Duration(time.Second * 30),
 		AuthDataExpire: Duration(time.Second * 10),
 		ApiTimeout:     Duration(time.Second * 5),
 		HubMaxWatchers: 10000,
+		GameMaxUsage:   0.9,
+		BanCacheExpire: Duration(time.Second * 5),
+
+		HeartBeatInterval: Duration(time.Second * 2),
+
 		LogConf: LogConf{
 			LogStdoutConsole: false,
 			LogStdoutLevel:   4,
@@ -103,4 +126,13 @@ func TestDbConf_DSN(t *testing.T) {
 	if dsn := db.DSN(); dsn != want {
 		t.Fatalf("DSN = %s, wants %s", dsn, want)
 	}
+
+	db = DbConf{
+		Driver: "sqlite3",
+		DBName: "/var/lib/wsnet2/wsnet2.db",
+	}
+	want = "file:/var/lib/wsnet2/wsnet2.db?_busy_timeout=5000&_journal_mode=WAL"
+	if dsn := db.DSN(); dsn != want {
+		t.Fatalf("DSN = %s, wants %s", dsn, want)
+	}
 }
@@ -0,0 +1,195 @@
+package game
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc/codes"
+
+	"wsnet2/binary"
+	"wsnet2/log"
+	"wsnet2/pb"
+)
+
+// ListRooms : 条件に合う部屋の一覧 (部屋ID順)
+func (repo *Repository) ListRooms(req *pb.ListRoomsReq) []*pb.RoomInfo {
+	repo.mu.RLock()
+	var rooms []*Room
+	if req.ClientId != "" {
+		for rid, c := range repo.clients[ClientID(req.ClientId)] {
+			if room, ok := repo.rooms[rid]; ok && c.isPlayer {
+				rooms = append(rooms, room)
+			}
+		}
+	} else {
+		rooms = make([]*Room, 0, len(repo.rooms))
+		for _, room := range repo.rooms {
+			rooms = append(rooms, room)
+		}
+	}
+	repo.mu.RUnlock()
+
+	infos := make([]*pb.RoomInfo, 0, len(rooms))
+	for _, room := range rooms {
+		ri := room.Info()
+		if req.SearchGroup != nil && ri.SearchGroup != *req.SearchGroup {
+			continue
+		}
+		if req.JoinableOnly && !ri.Joinable {
+			continue
+		}
+		if req.WatchableOnly && !ri.Watchable {
+			continue
+		}
+		infos = append(infos, ri)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+	if req.Limit > 0 && len(infos) > int(req.Limit) {
+		infos = infos[:req.Limit]
+	}
+	return infos
+}
+
+// MonitorRoom : 部屋のイベントを受け取るチャネルを登録する.
+// 部屋が終了するとチャネルは閉じられる. 不要になったら返り値の関数で外す.
+func (repo *Repository) MonitorRoom(ctx context.Context, roomId string) (<-chan *binary.RegularEvent, func(), ErrorWithCode) {
+	room, err := repo.GetRoom(roomId)
+	if err != nil {
+		return nil, nil, WithCode(xerrors.Errorf("MonitorRoom: %w", err), codes.NotFound)
+	}
+
+	ch := make(chan *binary.RegularEvent, MonitorChSize)
+	res := make(chan error, 1)
+	if ewc := repo.sendAdminMsg(ctx, room, &MsgAdminMonitor{Ch: ch, Res: res}, res); ewc != nil {
+		return nil, nil, WithCode(xerrors.Errorf("MonitorRoom: %w", ewc), ewc.Code())
+	}
+
+	unmonitor := func() {
+		room.SendMessage(&MsgAdminUnmonitor{Ch: ch})
+	}
+	return ch, unmonitor, nil
+}
+
+// AdminCloseRoom : 全員を退室させて部屋を終了する
+func (repo *Repository) AdminCloseRoom(ctx context.Context, roomId, reason string) ErrorWithCode {
+	room, err := repo.GetRoom(roomId)
+	if err != nil {
+		return WithCode(xerrors.Errorf("AdminCloseRoom: %w", err), codes.NotFound)
+	}
+	if reason == "" {
+		reason = "closed by admin"
+	}
+
+	res := make(chan error, 1)
+	if ewc := repo.sendAdminMsg(ctx, room, &MsgAdminClose{Reason: reason, Res: res}, res); ewc != nil {
+		return WithCode(xerrors.Errorf("AdminCloseRoom: %w", ewc), ewc.Code())
+	}
+	return nil
+}
+
+// AdminUpdateRoomProps : サーバから部屋の設定とpropsを更新する
+func (repo *Repository) AdminUpdateRoomProps(ctx context.Context, req *pb.UpdateRoomPropsReq) ErrorWithCode {
+	room, err := repo.GetRoom(req.RoomId)
+	if err != nil {
+		return WithCode(xerrors.Errorf("AdminUpdateRoomProps: %w", err), codes.NotFound)
+	}
+	pubProps, err := unmarshalAdminProps(req.PublicProps)
+	if err != nil {
+		return WithCode(xerrors.Errorf("AdminUpdateRoomProps: public props: %w", err), codes.InvalidArgument)
+	}
+	privProps, err := unmarshalAdminProps(req.PrivateProps)
+	if err != nil {
+		return WithCode(xerrors.Errorf("AdminUpdateRoomProps: private props: %w", err), codes.InvalidArgument)
+	}
+
+	res := make(chan error, 1)
+	msg := &MsgAdminRoomProp{
+		Visible:      req.Visible,
+		Joinable:     req.Joinable,
+		Watchable:    req.Watchable,
+		SearchGroup:  req.SearchGroup,
+		MaxPlayers:   req.MaxPlayers,
+		PublicProps:  pubProps,
+		PrivateProps: privProps,
+		Res:          res,
+	}
+	if ewc := repo.sendAdminMsg(ctx, room, msg, res); ewc != nil {
+		return WithCode(xerrors.Errorf("AdminUpdateRoomProps: %w", ewc), ewc.Code())
+	}
+	return nil
+}
+
+func unmarshalAdminProps(data []byte) (binary.Dict, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	d, _, err := binary.UnmarshalAs(data, binary.TypeDict, binary.TypeNull)
+	if err != nil {
+		return nil, err
+	}
+	props, _ := d.(binary.Dict)
+	return props, nil
+}
+
+// AdminBroadcast : 送信者が空のメッセージを全員に送る
+func (repo *Repository) AdminBroadcast(ctx context.Context, roomId string, data []byte) ErrorWithCode {
+	room, err := repo.GetRoom(roomId)
+	if err != nil {
+		return WithCode(xerrors.Errorf("AdminBroadcast: %w", err), codes.NotFound)
+	}
+
+	res := make(chan error, 1)
+	if ewc := repo.sendAdminMsg(ctx, room, &MsgAdminBroadcast{Data: data, Res: res}, res); ewc != nil {
+		return WithCode(xerrors.Errorf("AdminBroadcast: %w", ewc), ewc.Code())
+	}
+	return nil
+}
+
+// SetRoomLogLevel : 部屋のログレベルを変更する
+func (repo *Repository) SetRoomLogLevel(roomId string, level log.Level) ErrorWithCode {
+	if level < log.NOLOG || level > log.ALL {
+		return WithCode(xerrors.Errorf("SetRoomLogLevel: invalid log level: %v", level), codes.InvalidArgument)
+	}
+	room, err := repo.GetRoom(roomId)
+	if err != nil {
+		return WithCode(xerrors.Errorf("SetRoomLogLevel: %w", err), codes.NotFound)
+	}
+	room.SetLogLevel(level)
+	return nil
+}
+
+// sendAdminMsg : 管理用のMsgを部屋に送り、処理結果をresで受け取る
+func (repo *Repository) sendAdminMsg(ctx context.Context, room *Room, msg Msg, res <-chan error) ErrorWithCode {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+		return WithCode(
+			xerrors.Errorf("write msg timeout or context done: room=%q", room.Id),
+			codes.DeadlineExceeded)
+	case <-room.Done():
+		return WithCode(xerrors.Errorf("room closed: room=%q", room.Id), codes.NotFound)
+	case room.msgCh <- msg:
+	}
+
+	select {
+	case <-ctx.Done():
+		return WithCode(
+			xerrors.Errorf("response timeout or context done: room=%q", room.Id),
+			codes.DeadlineExceeded)
+	case <-room.Done():
+		// 応答してから部屋が終了することもある (MsgAdminClose)
+		select {
+		case err := <-res:
+			return WithCode(err, codes.Internal)
+		default:
+			return WithCode(xerrors.Errorf("room closed: room=%q", room.Id), codes.NotFound)
+		}
+	case err := <-res:
+		return WithCode(err, codes.Internal)
+	}
+}
@@ -0,0 +1,95 @@
+package game
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"wsnet2/log"
+	"wsnet2/storage"
+)
+
+// banWriter : 部屋のbanを順番にDBへ書き込む.
+//
+// 部屋のgoroutineを止めないように書き込みは別のgoroutineで行う.
+// 部屋の終了時にはCloseで書き込みを終えてからDeleteRoomBansするので、
+// 削除した後に部屋のbanが書き込まれて残ることはない.
+type banWriter struct {
+	store  storage.BanStorage
+	logger log.Logger
+
+	mu     sync.Mutex
+	queue  []*storage.Ban
+	closed bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+func newBanWriter(store storage.BanStorage, logger log.Logger) *banWriter {
+	w := &banWriter{
+		store:  store,
+		logger: logger,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Write : banの書き込みを予約する. 予約した順に書き込む
+func (w *banWriter) Write(ban *storage.Ban) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		w.logger.Errorf("banWriter: already closed. ban not written: %v", ban.UserID)
+		return
+	}
+	w.queue = append(w.queue, ban)
+	w.notify()
+}
+
+// Close : 予約済みのbanを書き込み終えるまで待つ
+func (w *banWriter) Close() {
+	w.mu.Lock()
+	w.closed = true
+	w.notify()
+	w.mu.Unlock()
+	<-w.done
+}
+
+func (w *banWriter) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *banWriter) run() {
+	defer close(w.done)
+	for {
+		w.mu.Lock()
+		bans, closed := w.queue, w.closed
+		w.queue = nil
+		w.mu.Unlock()
+
+		for _, ban := range bans {
+			w.write(ban)
+		}
+		if len(bans) == 0 {
+			if closed {
+				return
+			}
+			<-w.wake
+		}
+	}
+}
+
+func (w *banWriter) write(ban *storage.Ban) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.store.InsertBan(ctx, ban); err != nil {
+		// 部屋の中でのbanは有効なので続ける. lobbyからは入室を拒否できない
+		w.logger.Errorf("insert ban (%v): %+v", ban.UserID, err)
+	}
+}
@@ -0,0 +1,47 @@
+package game
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"wsnet2/config"
+	"wsnet2/log"
+	"wsnet2/pb"
+	"wsnet2/storage"
+)
+
+func TestBanWriter(t *testing.T) {
+	defer log.InitLogger(&config.LogConf{LogStdoutLevel: uint32(log.ERROR)})()
+	ctx := context.Background()
+	store := storage.NewMemory(&pb.App{Id: "app1", Key: "key1"})
+	w := newBanWriter(store, log.Get(log.ERROR))
+
+	// 同じuserのbanは後から予約したもので上書きされる
+	ban := func(reason string) *storage.Ban {
+		return &storage.Ban{AppID: "app1", UserID: "user1", RoomID: "room1", Reason: reason, BannedBy: "master", Created: time.Now()}
+	}
+	for _, reason := range []string{"first", "second", "third"} {
+		w.Write(ban(reason))
+	}
+
+	// Closeは予約済みのbanを書き込み終えてから戻る
+	w.Close()
+	bans, err := store.Bans(ctx, &storage.BanFilter{AppId: "app1", UserId: "user1"})
+	if err != nil {
+		t.Fatalf("Bans: %+v", err)
+	}
+	if len(bans) != 1 || bans[0].Reason != "third" {
+		t.Fatalf("bans = %v, wants the last one", bans)
+	}
+
+	// Close後の予約は書き込まない
+	w.Write(ban("closed"))
+	if err := store.DeleteRoomBans(ctx, "room1"); err != nil {
+		t.Fatalf("DeleteRoomBans: %+v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if bans, _ := store.Bans(ctx, &storage.BanFilter{AppId: "app1", UserId: "user1"}); len(bans) != 0 {
+		t.Fatalf("ban written after Close: %v", bans)
+	}
+}
@@ -1,8 +1,6 @@
 package game
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
 	"hash"
 	"sync"
 	"time"
@@ -26,6 +24,13 @@ type Client struct {
 	isPlayer  bool
 	nodeCount uint32
 
+	// 観戦者チャットの流量制限 (token bucket)
+	chatTokens float64
+	chatLast   time.Time
+
+	// 観戦者が購読しているトピック. nilなら全トピック
+	topics map[string]struct{}
+
 	props binary.Dict
 
 	removed     chan struct{}
@@ -41,24 +46,32 @@ type Client struct {
 	waitPeer     chan *Peer
 	renewPeer    chan struct{}
 	connectCount int
+	protoVer     int
 
-	authKey string
-	hmac    hash.Hash
+	authKey   string
+	hmac      hash.Hash
+	macScheme auth.MACScheme
 
 	logger log.Logger
 
 	evErr chan error
 }
 
-func NewPlayer(info *pb.ClientInfo, macKey string, room IRoom) (*Client, ErrorWithCode) {
-	return newClient(info, macKey, room, true)
+func NewPlayer(info *pb.ClientInfo, macKey string, macScheme auth.MACScheme, room IRoom) (*Client, ErrorWithCode) {
+	return newClient(info, macKey, macScheme, room, true)
 }
 
-func NewWatcher(info *pb.ClientInfo, macKey string, room IRoom) (*Client, ErrorWithCode) {
-	return newClient(info, macKey, room, false)
+func NewWatcher(info *pb.ClientInfo, macKey string, macScheme auth.MACScheme, room IRoom) (*Client, ErrorWithCode) {
+	return newClient(info, macKey, macScheme, room, false)
 }
 
-func newClient(info *pb.ClientInfo, macKey string, room IRoom, isPlayer bool) (*Client, ErrorWithCode) {
+func newClient(info *pb.ClientInfo, macKey string, macScheme auth.MACScheme, room IRoom, isPlayer bool) (*Client, ErrorWithCode) {
+	mac, err := auth.NewMsgHMAC(macScheme, macKey)
+	if err != nil {
+		return nil, WithCode(
+			xerrors.Errorf("NewMsgHMAC: %w", err),
+			codes.InvalidArgument)
+	}
 	props, iProps, err := common.InitProps(info.Props)
 	if err != nil {
 		return nil, WithCode(
@@ -83,8 +96,9 @@ func newClient(info *pb.ClientInfo, macKey string, room IRoom, isPlayer bool) (*
 		waitPeer:  make(chan *Peer, 1),
 		renewPeer: make(chan struct{}, 1),
 
-		authKey: RandomHex(room.ClientConf().AuthKeyLen),
-		hmac:    hmac.New(sha1.New, []byte(macKey)),
+		authKey:   RandomHex(room.ClientConf().AuthKeyLen),
+		hmac:      mac,
+		macScheme: macScheme,
 
 		logger: room.Logger().With(log.KeyClient, info.Id),
 
@@ -114,10 +128,72 @@ func (c *Client) AuthKey() string {
 	return c.authKey
 }
 
+// MACScheme : Msgのメッセージ認証方式
+func (c *Client) MACScheme() auth.MACScheme {
+	return c.macScheme
+}
+
 func (c *Client) NodeCount() uint32 {
 	return c.nodeCount
 }
 
+// SetNodeCount : 子hubから通知された観戦者数を設定する (多段hub用)
+// 呼び出し側のRoom/Hubのgoroutineからのみ呼ぶこと
+func (c *Client) SetNodeCount(count uint32) {
+	c.nodeCount = count
+}
+
+// AllowWatcherChat : 観戦者チャットの流量制限.
+// 呼び出し側のRoom/Hubのgoroutineからのみ呼ぶこと
+func (c *Client) AllowWatcherChat() bool {
+	conf := c.room.ClientConf()
+	if conf.WatcherChatRate <= 0 {
+		return true
+	}
+	burst := float64(conf.WatcherChatBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	if c.chatLast.IsZero() {
+		c.chatTokens = burst
+	} else {
+		c.chatTokens += now.Sub(c.chatLast).Seconds() * conf.WatcherChatRate
+		if c.chatTokens > burst {
+			c.chatTokens = burst
+		}
+	}
+	c.chatLast = now
+	if c.chatTokens < 1 {
+		return false
+	}
+	c.chatTokens--
+	return true
+}
+
+// SetTopics : 観戦者が購読するトピックを設定する. 空なら全トピックを購読する.
+// 呼び出し側のRoom/Hubのgoroutineからのみ呼ぶこと
+func (c *Client) SetTopics(topics []string) {
+	if len(topics) == 0 {
+		c.topics = nil
+		return
+	}
+	c.topics = make(map[string]struct{}, len(topics))
+	for _, t := range topics {
+		c.topics[t] = struct{}{}
+	}
+}
+
+// Subscribes : topicのBroadcastを受け取るか.
+// トピックの無いBroadcastは常に受け取る.
+func (c *Client) Subscribes(topic string) bool {
+	if topic == "" || c.topics == nil {
+		return true
+	}
+	_, ok := c.topics[topic]
+	return ok
+}
+
 func (c *Client) Logger() log.Logger {
 	return c.logger
 }
@@ -311,6 +387,15 @@ func (c *Client) AttachPeer(p *Peer, lastEvSeq int) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	// 未接続の間や前のpeerのバージョンで積んだEventのうち、このpeerが受信できないものは
+	// 変換するか取り除く. クライアントは未読分を受け取っていないので詰めても通番は連続する.
+	ver := p.ProtocolVersion()
+	if n := c.evbuf.Rewrite(lastEvSeq, func(ev *binary.RegularEvent) (*binary.RegularEvent, bool) {
+		return binary.DowngradeEvent(ev, ver)
+	}); n > 0 {
+		c.logger.Infof("attach peer: %v removed %v events for protocol version v%v", c.Id, n, ver)
+	}
+
 	// 未読Eventを再送. client終了後でも送信する.
 	if err := p.SendEvents(c.evbuf); err != nil {
 		return xerrors.Errorf("SendEvents: %w", err)
@@ -335,10 +420,26 @@ func (c *Client) AttachPeer(p *Peer, lastEvSeq int) error {
 		c.peer.Close("new peer attached")
 	}
 	c.peer = p
+	c.protoVer = p.ProtocolVersion()
 	c.sendRenewPeer()
 	return nil
 }
 
+// CanReceive : このイベントを受信できるプロトコルバージョンか.
+// まだ接続していない場合は受信できるものとしてバッファに積み、接続時にAttachPeerで取り除く.
+func (c *Client) CanReceive(t binary.EvType) bool {
+	v := c.ProtocolVersion()
+	return v == 0 || v >= t.ProtocolVersion()
+}
+
+// ProtocolVersion : 直近に接続したpeerのプロトコルバージョン.
+// 一度も接続していなければ0.
+func (c *Client) ProtocolVersion() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.protoVer
+}
+
 // DetachPeer : peerを切り離す.
 // Peer.MsgLoopで切断やエラーを検知したときに呼ばれる.
 // websocketの切断は呼び出し側で行う
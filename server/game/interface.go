@@ -4,8 +4,10 @@ package game
 import (
 	"sync"
 	"time"
+	"wsnet2/binary"
 	"wsnet2/config"
 	"wsnet2/log"
+	"wsnet2/pb"
 )
 
 type RoomID string
@@ -29,4 +31,12 @@ type IRoom interface {
 type IRepo interface {
 	RemoveClient(c *Client)
 	PlayerLog(c *Client, msg PlayerLogMsg)
+	PlayerEvent(c *Client, typ PlayerEventType, detail PlayerEventDetail)
 }
+
+// BroadcastHook : Broadcastの配信先をサーバ側で決める.
+// クライアントが指定したscope (Masterのみ限定できる) を受け取り、実際に配信するscopeを返す.
+// 例えばアプリ固有の形式のdataを見て、手札などの観戦者に見せない情報をBroadcastScopePlayersにする.
+// roomは部屋の状態の複製で、変更しても部屋には反映されない.
+// 部屋のgoroutineから呼ばれるので、ブロックしないこと.
+type BroadcastHook func(room *pb.RoomInfo, sender *pb.ClientInfo, scope binary.BroadcastScope, data []byte) binary.BroadcastScope
@@ -0,0 +1,290 @@
+package game
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"wsnet2/common"
+	"wsnet2/config"
+	"wsnet2/log"
+	"wsnet2/pb"
+	"wsnet2/storage"
+)
+
+// LobbySync : 部屋の状態の変化をlobbyに直接送る.
+//
+// lobby_serverテーブルに登録された有効なlobbyそれぞれにpb.Lobby/SyncRoomsのstreamを張り、
+// 接続直後にこのサーバの全ての部屋 (snapshot) を、以降は変化した部屋を送る.
+// streamが切れたlobbyや後から起動したlobbyには、次の確認時に接続し直してsnapshotから送る.
+type LobbySync struct {
+	store  storage.ServerStorage
+	conf   *config.GameConf
+	hostId uint32
+
+	grpcPool *common.GrpcPool
+
+	mu      sync.Mutex
+	rooms   map[string]*pb.RoomInfo
+	streams map[uint32]*lobbyStream
+}
+
+func NewLobbySync(store storage.ServerStorage, conf *config.GameConf, hostId uint32) *LobbySync {
+	return &LobbySync{
+		store:    store,
+		conf:     conf,
+		hostId:   hostId,
+		grpcPool: common.NewGrpcPool(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		rooms:    make(map[string]*pb.RoomInfo),
+		streams:  make(map[uint32]*lobbyStream),
+	}
+}
+
+// Add : 部屋の作成を送る
+func (s *LobbySync) Add(ri *pb.RoomInfo) {
+	if s == nil {
+		return
+	}
+	ri = publicRoomInfo(ri)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rooms[ri.Id] = ri
+	for _, ls := range s.streams {
+		ls.push(ri.Id, ri)
+	}
+}
+
+// Update : 部屋の更新を送る.
+// 削除済みの部屋の更新が遅れて届くことがあるので、Addされていない部屋は無視する
+func (s *LobbySync) Update(ri *pb.RoomInfo) {
+	if s == nil {
+		return
+	}
+	ri = publicRoomInfo(ri)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[ri.Id]; !ok {
+		return
+	}
+	s.rooms[ri.Id] = ri
+	for _, ls := range s.streams {
+		ls.push(ri.Id, ri)
+	}
+}
+
+// Delete : 部屋の削除を送る
+func (s *LobbySync) Delete(roomId string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rooms, roomId)
+	for _, ls := range s.streams {
+		ls.push(roomId, nil)
+	}
+}
+
+// publicRoomInfo : lobbyはprivate_propsを使わないので送らない (roomテーブルにも無い)
+func publicRoomInfo(ri *pb.RoomInfo) *pb.RoomInfo {
+	ri = ri.Clone()
+	ri.PrivateProps = nil
+	return ri
+}
+
+// Run : 有効なlobbyを定期的に確認し、streamを張り直す
+func (s *LobbySync) Run(ctx context.Context) {
+	t := time.NewTicker(time.Duration(s.conf.HeartBeatInterval))
+	defer t.Stop()
+	for {
+		if err := s.connectLobbies(ctx); err != nil {
+			log.Errorf("LobbySync: %+v", err)
+		}
+		select {
+		case <-ctx.Done():
+			s.closeAll()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *LobbySync) connectLobbies(ctx context.Context) error {
+	since := time.Now().Add(-time.Duration(s.conf.LobbyValidHeartBeat)).Unix()
+	lobbies, err := s.store.AliveLobbyServers(ctx, since)
+	if err != nil {
+		return xerrors.Errorf("alive lobby servers: %w", err)
+	}
+
+	alive := make(map[uint32]bool, len(lobbies))
+	for _, l := range lobbies {
+		alive[l.Id] = true
+		s.mu.Lock()
+		ls, ok := s.streams[l.Id]
+		s.mu.Unlock()
+		if ok && !ls.closed() {
+			continue
+		}
+		if err := s.connect(ctx, l); err != nil {
+			log.Infof("LobbySync: connect to lobby %v: %+v", l.Hostname, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, ls := range s.streams {
+		if !alive[id] || ls.closed() {
+			ls.close()
+			delete(s.streams, id)
+		}
+	}
+	return nil
+}
+
+func (s *LobbySync) connect(ctx context.Context, lobby *storage.Host) error {
+	grpcAddr := fmt.Sprintf("%s:%d", lobby.Hostname, lobby.GRPCPort)
+	conn, err := s.grpcPool.Get(grpcAddr)
+	if err != nil {
+		return xerrors.Errorf("get gRPC client(%s): %w", grpcAddr, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := pb.NewLobbyClient(conn).SyncRooms(ctx)
+	if err != nil {
+		cancel()
+		return xerrors.Errorf("gRPC SyncRooms(%s): %w", grpcAddr, err)
+	}
+
+	ls := &lobbyStream{
+		hostname: lobby.Hostname,
+		stream:   stream,
+		cancel:   cancel,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	// snapshotを作ってから登録するまでの間の変化を取りこぼさないようにロックしておく
+	s.mu.Lock()
+	snapshot := &pb.RoomSync{
+		HostId:   s.hostId,
+		Snapshot: true,
+		Rooms:    make([]*pb.RoomInfo, 0, len(s.rooms)),
+	}
+	for _, ri := range s.rooms {
+		snapshot.Rooms = append(snapshot.Rooms, ri)
+	}
+	if old, ok := s.streams[lobby.Id]; ok {
+		old.close()
+	}
+	s.streams[lobby.Id] = ls
+	s.mu.Unlock()
+
+	go ls.sender(s.hostId, snapshot)
+	go ls.watch()
+	log.Infof("LobbySync: connected to lobby %v (%v rooms)", lobby.Hostname, len(snapshot.Rooms))
+	return nil
+}
+
+func (s *LobbySync) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, ls := range s.streams {
+		ls.close()
+		delete(s.streams, id)
+	}
+}
+
+// lobbyStream : 1つのlobbyへのstream.
+// 送信待ちの変化は部屋ごとに最新のものだけを残す.
+type lobbyStream struct {
+	hostname string
+	stream   pb.Lobby_SyncRoomsClient
+	cancel   context.CancelFunc
+
+	mu      sync.Mutex
+	pending map[string]*pb.RoomInfo // nilは削除
+	notify  chan struct{}
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (ls *lobbyStream) push(roomId string, ri *pb.RoomInfo) {
+	ls.mu.Lock()
+	if ls.pending == nil {
+		ls.pending = make(map[string]*pb.RoomInfo)
+	}
+	ls.pending[roomId] = ri
+	ls.mu.Unlock()
+
+	select {
+	case ls.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (ls *lobbyStream) sender(hostId uint32, snapshot *pb.RoomSync) {
+	defer ls.close()
+
+	if err := ls.stream.Send(snapshot); err != nil {
+		log.Infof("LobbySync: send snapshot to %v: %v", ls.hostname, err)
+		return
+	}
+
+	for {
+		select {
+		case <-ls.done:
+			return
+		case <-ls.notify:
+		}
+
+		ls.mu.Lock()
+		pending := ls.pending
+		ls.pending = nil
+		ls.mu.Unlock()
+
+		msg := &pb.RoomSync{HostId: hostId}
+		for id, ri := range pending {
+			if ri == nil {
+				msg.Deleted = append(msg.Deleted, id)
+			} else {
+				msg.Rooms = append(msg.Rooms, ri)
+			}
+		}
+		if err := ls.stream.Send(msg); err != nil {
+			log.Infof("LobbySync: send to %v: %v", ls.hostname, err)
+			return
+		}
+	}
+}
+
+// watch : lobbyがstreamを終了したら閉じる.
+// lobbyは送信し終わるまで応答しないので、RecvMsgが返るのはstreamが切れたとき.
+func (ls *lobbyStream) watch() {
+	err := ls.stream.RecvMsg(&pb.Empty{})
+	if !ls.closed() {
+		log.Infof("LobbySync: stream to %v closed: %v", ls.hostname, err)
+	}
+	ls.close()
+}
+
+func (ls *lobbyStream) closed() bool {
+	select {
+	case <-ls.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ls *lobbyStream) close() {
+	ls.doneOnce.Do(func() {
+		close(ls.done)
+		ls.cancel()
+	})
+}
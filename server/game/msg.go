@@ -5,6 +5,7 @@ import (
 
 	"golang.org/x/xerrors"
 
+	"wsnet2/auth"
 	"wsnet2/binary"
 	"wsnet2/pb"
 )
@@ -25,6 +26,11 @@ var _ Msg = &MsgClientProp{}
 var _ Msg = &MsgBroadcast{}
 var _ Msg = &MsgSwitchMaster{}
 var _ Msg = &MsgKick{}
+var _ Msg = &MsgBan{}
+var _ Msg = &MsgRoomKey{}
+var _ Msg = &MsgWatcherChat{}
+var _ Msg = &MsgSubscribe{}
+var _ Msg = &MsgRoomState{}
 var _ Msg = &MsgClientError{}
 var _ Msg = &MsgClientTimeout{}
 
@@ -37,15 +43,17 @@ type JoinedInfo struct {
 	Client   *Client
 	MasterId ClientID
 	Deadline time.Duration
+	State    []byte
 }
 
 // MsgCreate : 部屋作成メッセージ
 // gRPCリクエストよりwsnet内で発生
 type MsgCreate struct {
-	Info   *pb.ClientInfo
-	MACKey string
-	Joined chan<- *JoinedInfo
-	Err    chan<- ErrorWithCode
+	Info      *pb.ClientInfo
+	MACKey    string
+	MACScheme auth.MACScheme
+	Joined    chan<- *JoinedInfo
+	Err       chan<- ErrorWithCode
 }
 
 func (*MsgCreate) msg() {}
@@ -57,10 +65,13 @@ func (m *MsgCreate) SenderID() ClientID {
 // MsgJoin : 入室メッセージ
 // gRPCリクエストよりwsnet内で発生
 type MsgJoin struct {
-	Info   *pb.ClientInfo
-	MACKey string
-	Joined chan<- *JoinedInfo
-	Err    chan<- ErrorWithCode
+	Info      *pb.ClientInfo
+	MACKey    string
+	MACScheme auth.MACScheme
+	Joined    chan<- *JoinedInfo
+	Err       chan<- ErrorWithCode
+	// Source : lobbyでの部屋の指定方法 (see: common.JoinSourceId)
+	Source string
 }
 
 func (*MsgJoin) msg() {}
@@ -72,10 +83,11 @@ func (m *MsgJoin) SenderID() ClientID {
 // MsgWatch : 観戦入室メッセージ
 // gRPCリクエストよりwsnet内で発生
 type MsgWatch struct {
-	Info   *pb.ClientInfo
-	MACKey string
-	Joined chan<- *JoinedInfo
-	Err    chan<- ErrorWithCode
+	Info      *pb.ClientInfo
+	MACKey    string
+	MACScheme auth.MACScheme
+	Joined    chan<- *JoinedInfo
+	Err       chan<- ErrorWithCode
 }
 
 func (*MsgWatch) msg() {}
@@ -154,6 +166,73 @@ func (m *MsgAdminKick) SenderID() ClientID {
 	return adminClientID
 }
 
+// MsgAdminMonitor : 部屋のイベントをChで受け取る.
+// 観戦者としては数えない. 部屋が終了するとChは閉じられる.
+// gRPCから実行される
+type MsgAdminMonitor struct {
+	Ch  chan *binary.RegularEvent
+	Res chan<- error
+}
+
+func (*MsgAdminMonitor) msg() {}
+func (m *MsgAdminMonitor) SenderID() ClientID {
+	return adminClientID
+}
+
+// MsgAdminUnmonitor : MsgAdminMonitorで登録したChを閉じて外す
+// gRPCから実行される
+type MsgAdminUnmonitor struct {
+	Ch chan *binary.RegularEvent
+}
+
+func (*MsgAdminUnmonitor) msg() {}
+func (m *MsgAdminUnmonitor) SenderID() ClientID {
+	return adminClientID
+}
+
+// MsgAdminClose : 全員を退室させて部屋を終了する
+// gRPCから実行される
+type MsgAdminClose struct {
+	Reason string
+	Res    chan<- error
+}
+
+func (*MsgAdminClose) msg() {}
+func (m *MsgAdminClose) SenderID() ClientID {
+	return adminClientID
+}
+
+// MsgAdminRoomProp : サーバから部屋の設定とpropsを更新する.
+// nilのフィールドは変更しない.
+// gRPCから実行される
+type MsgAdminRoomProp struct {
+	Visible      *bool
+	Joinable     *bool
+	Watchable    *bool
+	SearchGroup  *uint32
+	MaxPlayers   *uint32
+	PublicProps  binary.Dict
+	PrivateProps binary.Dict
+	Res          chan<- error
+}
+
+func (*MsgAdminRoomProp) msg() {}
+func (m *MsgAdminRoomProp) SenderID() ClientID {
+	return adminClientID
+}
+
+// MsgAdminBroadcast : 送信者が空のEvTypeMessageとして全員に送る
+// gRPCから実行される
+type MsgAdminBroadcast struct {
+	Data []byte
+	Res  chan<- error
+}
+
+func (*MsgAdminBroadcast) msg() {}
+func (m *MsgAdminBroadcast) SenderID() ClientID {
+	return adminClientID
+}
+
 // MsgLeave : 退室メッセージ
 // クライアントの自発的な退室リクエスト
 type MsgLeave struct {
@@ -284,6 +363,8 @@ type MsgBroadcast struct {
 	binary.RegularMsg
 	Sender *Client
 	Data   []byte
+	Scope  binary.BroadcastScope
+	Topic  string
 }
 
 func (*MsgBroadcast) msg() {}
@@ -300,6 +381,34 @@ func msgBroadcast(sender *Client, msg binary.RegularMsg) (Msg, error) {
 	}, nil
 }
 
+// msgScopedBroadcast : 配信先を限定したBroadcast
+func msgScopedBroadcast(sender *Client, msg binary.RegularMsg) (Msg, error) {
+	scope, data, err := binary.UnmarshalScopedBroadcastPayload(msg.Payload())
+	if err != nil {
+		return nil, err
+	}
+	return &MsgBroadcast{
+		RegularMsg: msg,
+		Sender:     sender,
+		Data:       data,
+		Scope:      scope,
+	}, nil
+}
+
+// msgTopicBroadcast : トピック付きのBroadcast
+func msgTopicBroadcast(sender *Client, msg binary.RegularMsg) (Msg, error) {
+	topic, data, err := binary.UnmarshalTopicBroadcastPayload(msg.Payload())
+	if err != nil {
+		return nil, err
+	}
+	return &MsgBroadcast{
+		RegularMsg: msg,
+		Sender:     sender,
+		Data:       data,
+		Topic:      topic,
+	}, nil
+}
+
 // MsgSwitchMaster : MasterClientの切替え
 // MasterClientからのみ受け付ける.
 type MsgSwitchMaster struct {
@@ -354,6 +463,138 @@ func msgKick(sender *Client, msg binary.RegularMsg) (Msg, error) {
 	}, nil
 }
 
+// MsgBan : ClientをKickし、部屋への入室を禁止する
+// MasterClientからのみ受け付ける.
+type MsgBan struct {
+	binary.RegularMsg
+	Sender   *Client
+	Target   ClientID
+	Duration time.Duration // 0なら部屋が終了するまで
+	Message  string
+}
+
+func (*MsgBan) msg() {}
+
+func (m *MsgBan) SenderID() ClientID {
+	return m.Sender.ID()
+}
+
+func msgBan(sender *Client, msg binary.RegularMsg) (Msg, error) {
+	target, duration, message, err := binary.UnmarshalBanPayload(msg.Payload())
+	if err != nil {
+		return nil, err
+	}
+	return &MsgBan{
+		RegularMsg: msg,
+		Sender:     sender,
+		Target:     ClientID(target),
+		Duration:   duration,
+		Message:    message,
+	}, nil
+}
+
+// MsgRoomKey : 暗号化された部屋鍵を特定プレイヤーに送る
+// 中身は復号せずにSystemEventとして中継する.
+type MsgRoomKey struct {
+	binary.RegularMsg
+	Sender *Client
+	Target ClientID
+	Sealed []byte
+}
+
+func (*MsgRoomKey) msg() {}
+
+func (m *MsgRoomKey) SenderID() ClientID {
+	return m.Sender.ID()
+}
+
+func msgRoomKey(sender *Client, msg binary.RegularMsg) (Msg, error) {
+	target, sealed, err := binary.UnmarshalRoomKeyPayload(msg.Payload())
+	if err != nil {
+		return nil, err
+	}
+	return &MsgRoomKey{
+		RegularMsg: msg,
+		Sender:     sender,
+		Target:     ClientID(target),
+		Sealed:     sealed,
+	}, nil
+}
+
+// MsgWatcherChat : 観戦者同士のチャット
+// gameのプレイヤーには届けない.
+type MsgWatcherChat struct {
+	binary.RegularMsg
+	Sender *Client
+	Data   []byte
+}
+
+func (*MsgWatcherChat) msg() {}
+
+func (m *MsgWatcherChat) SenderID() ClientID {
+	return m.Sender.ID()
+}
+
+func msgWatcherChat(sender *Client, msg binary.RegularMsg) (Msg, error) {
+	return &MsgWatcherChat{
+		RegularMsg: msg,
+		Sender:     sender,
+		Data:       msg.Payload(),
+	}, nil
+}
+
+// MsgSubscribe : 観戦者の購読トピックの設定
+// 観戦者からのみ受け付ける.
+type MsgSubscribe struct {
+	binary.RegularMsg
+	Sender *Client
+	Topics []string
+}
+
+func (*MsgSubscribe) msg() {}
+
+func (m *MsgSubscribe) SenderID() ClientID {
+	return m.Sender.ID()
+}
+
+func msgSubscribe(sender *Client, msg binary.RegularMsg) (Msg, error) {
+	topics, err := binary.UnmarshalSubscribePayload(msg.Payload())
+	if err != nil {
+		return nil, err
+	}
+	return &MsgSubscribe{
+		RegularMsg: msg,
+		Sender:     sender,
+		Topics:     topics,
+	}, nil
+}
+
+// MsgRoomState : room stateの更新
+// MasterClientからのみ受け付ける.
+type MsgRoomState struct {
+	binary.RegularMsg
+	Sender *Client
+	State  binary.Dict
+}
+
+func (*MsgRoomState) msg() {}
+
+func (m *MsgRoomState) SenderID() ClientID {
+	return m.Sender.ID()
+}
+
+func msgRoomState(sender *Client, msg binary.RegularMsg) (Msg, error) {
+	state, _, err := binary.UnmarshalNullDict(msg.Payload())
+	if err != nil {
+		return nil, xerrors.Errorf("state: %w", err)
+	}
+	return &MsgRoomState{
+		RegularMsg: msg,
+		Sender:     sender,
+		State:      state,
+	}, nil
+}
+
 // MsgClientError : Client内部エラー（内部で発生）
 type MsgClientError struct {
 	Sender *Client
@@ -395,10 +636,24 @@ func ConstructMsg(cli *Client, m binary.Msg) (msg Msg, err error) {
 		return msgToMaster(cli, m.(binary.RegularMsg))
 	case binary.MsgTypeBroadcast:
 		return msgBroadcast(cli, m.(binary.RegularMsg))
+	case binary.MsgTypeScopedBroadcast:
+		return msgScopedBroadcast(cli, m.(binary.RegularMsg))
+	case binary.MsgTypeTopicBroadcast:
+		return msgTopicBroadcast(cli, m.(binary.RegularMsg))
+	case binary.MsgTypeRoomState:
+		return msgRoomState(cli, m.(binary.RegularMsg))
+	case binary.MsgTypeWatcherChat:
+		return msgWatcherChat(cli, m.(binary.RegularMsg))
+	case binary.MsgTypeSubscribe:
+		return msgSubscribe(cli, m.(binary.RegularMsg))
 	case binary.MsgTypeSwitchMaster:
 		return msgSwitchMaster(cli, m.(binary.RegularMsg))
 	case binary.MsgTypeKick:
 		return msgKick(cli, m.(binary.RegularMsg))
+	case binary.MsgTypeBan:
+		return msgBan(cli, m.(binary.RegularMsg))
+	case binary.MsgTypeRoomKey:
+		return msgRoomKey(cli, m.(binary.RegularMsg))
 	}
 	return nil, xerrors.Errorf("unknown msg type: %T %v", m, m)
 }
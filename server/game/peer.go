@@ -2,14 +2,17 @@ package game
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shiguredo/websocket"
 	"golang.org/x/xerrors"
 
+	"wsnet2/auth"
 	"wsnet2/binary"
 	"wsnet2/common"
 	"wsnet2/metrics"
@@ -36,9 +39,25 @@ type Peer struct {
 	closed  bool
 
 	evSeqNum int
+
+	// compThreshold : このサイズ以上のメッセージを圧縮する. 0なら圧縮しない.
+	// permessage-deflateがネゴシエートされていない場合は常に非圧縮.
+	compThreshold int
+
+	// protoVer : ネゴシエートされたプロトコルバージョン
+	protoVer int
+
+	// macNonce : MsgのHMACに含める接続毎のnonce (auth.MACSchemeSHA256のみ)
+	macNonce []byte
+	// recvFrames : この接続で受信したフレーム数
+	recvFrames uint32
+
+	// sentBytes, recvBytes : この接続で送受信したメッセージのバイト数
+	sentBytes atomic.Int64
+	recvBytes atomic.Int64
 }
 
-func NewPeer(ctx context.Context, cli *Client, conn *websocket.Conn, lastEvSeq int) (*Peer, error) {
+func NewPeer(ctx context.Context, cli *Client, conn *websocket.Conn, lastEvSeq, compThreshold int) (*Peer, error) {
 	p := &Peer{
 		client: cli,
 		conn:   conn,
@@ -48,8 +67,30 @@ func NewPeer(ctx context.Context, cli *Client, conn *websocket.Conn, lastEvSeq i
 		detached: make(chan struct{}),
 
 		evSeqNum: lastEvSeq,
+
+		compThreshold: compThreshold,
+	}
+
+	ver, err := binary.ParseSubprotocol(conn.Subprotocol())
+	if err == nil && ver < cli.room.ClientConf().MinProtocolVersion {
+		err = xerrors.Errorf("protocol version too old: v%v (min: v%v)", ver, cli.room.ClientConf().MinProtocolVersion)
 	}
-	err := cli.AttachPeer(p, lastEvSeq)
+	if err != nil {
+		// クライアントは再接続しても受け入れられないので、理由を添えて切断する
+		p.closeWithMessage(websocket.ClosePolicyViolation, err.Error())
+		return nil, xerrors.Errorf("NewPeer (%v, peer=%p): %w", cli.Id, p, err)
+	}
+	p.protoVer = ver
+
+	if cli.MACScheme() == auth.MACSchemeSHA256 {
+		p.macNonce = make([]byte, binary.MsgMACBindingNonceSize)
+		if _, err := rand.Read(p.macNonce); err != nil {
+			p.closeWithMessage(websocket.CloseInternalServerErr, err.Error())
+			return nil, xerrors.Errorf("generate nonce (%v, peer=%p): %w", cli.Id, p, err)
+		}
+	}
+
+	err = cli.AttachPeer(p, lastEvSeq)
 	if err != nil {
 		p.closeWithMessage(websocket.CloseGoingAway, err.Error())
 		return nil, xerrors.Errorf("AttachPeer (%v, peer=%p): %w", cli.Id, p, err)
@@ -70,6 +111,21 @@ func (p *Peer) LastEventSeq() int {
 	return p.evSeqNum
 }
 
+// BytesSent : この接続で送信したメッセージのバイト数 (圧縮前)
+func (p *Peer) BytesSent() int64 {
+	return p.sentBytes.Load()
+}
+
+// BytesReceived : この接続で受信したメッセージのバイト数
+func (p *Peer) BytesReceived() int64 {
+	return p.recvBytes.Load()
+}
+
+// ProtocolVersion : ネゴシエートされたプロトコルバージョン
+func (p *Peer) ProtocolVersion() int {
+	return p.protoVer
+}
+
 // SendReady : EvPeerReadyを送信する.
 // websocketハンドラのgoroutineからcli.AttachPeer経由で呼ばれる.
 func (p *Peer) SendReady(lastMsgSeq int) error {
@@ -80,7 +136,10 @@ func (p *Peer) SendReady(lastMsgSeq int) error {
 	}
 	p.client.logger.Infof("peer ready (%v, peer=%p): lastMsg=%v", p.client.Id, p, lastMsgSeq)
 	ev := binary.NewEvPeerReady(lastMsgSeq)
-	return writeMessage(p.conn, websocket.BinaryMessage, ev.Marshal())
+	if p.macNonce != nil {
+		ev = binary.NewEvPeerReadyWithNonce(lastMsgSeq, p.macNonce)
+	}
+	return p.writeMessage(websocket.BinaryMessage, ev.Marshal())
 }
 
 // SendSystemEvent : SystemEventを送信する.
@@ -92,8 +151,13 @@ func (p *Peer) SendSystemEvent(ev *binary.SystemEvent) {
 	if p.closed {
 		return
 	}
+	if v := ev.Type().ProtocolVersion(); v > p.protoVer {
+		// 受信できないバージョンのクライアントには送らない
+		p.client.logger.Debugf("peer skip %v (%v, peer=%p): protocol version v%v < v%v", ev.Type(), p.client.Id, p, p.protoVer, v)
+		return
+	}
 	metrics.MessageSent.Add(1)
-	err := writeMessage(p.conn, websocket.BinaryMessage, ev.Marshal())
+	err := p.writeMessage(websocket.BinaryMessage, ev.Marshal())
 	if err != nil {
 		p.client.logger.Warnf("peer send %v (%v, peer=%p): %+v", ev.Type(), p.client.Id, p, err)
 		writeMessage(p.conn, websocket.CloseMessage,
@@ -129,7 +193,7 @@ func (p *Peer) SendEvents(evbuf *common.RingBuf[*binary.RegularEvent]) error {
 	for _, ev := range evs {
 		seqNum++
 		buf := ev.Marshal(seqNum)
-		err := writeMessage(p.conn, websocket.BinaryMessage, buf)
+		err := p.writeMessage(websocket.BinaryMessage, buf)
 		if err != nil {
 			// 新しいpeerで復帰できるかもしれない
 			p.client.logger.Warnf("peer send %v (%v, %p): %+v", ev.Type(), p.client.Id, p, err)
@@ -194,8 +258,9 @@ loop:
 			break loop
 		}
 		metrics.MessageRecv.Add(1)
+		p.recvBytes.Add(int64(len(data)))
 
-		msg, err := binary.UnmarshalMsg(p.client.hmac, data)
+		msg, err := p.unmarshalMsg(data)
 		if err != nil {
 			p.client.logger.Errorf("peer UnmarshalMsg (%v, %p): %+v", p.client.Id, p, err)
 			p.closeWithMessage(websocket.CloseInvalidFramePayloadData, err.Error())
@@ -218,6 +283,24 @@ loop:
 	close(p.done)
 }
 
+// unmarshalMsg : 受信したフレームのHMACを検証してMsgを取り出す.
+// MsgLoopのgoroutineから呼ばれる.
+func (p *Peer) unmarshalMsg(data []byte) (binary.Msg, error) {
+	if p.macNonce == nil {
+		return binary.UnmarshalMsg(p.client.hmac, data)
+	}
+	p.recvFrames++
+	return binary.UnmarshalMsgWithBinding(p.client.hmac, binary.MsgMACBinding(p.macNonce, p.recvFrames), data)
+}
+
+// writeMessage : サイズに応じて圧縮を切り替えて送信する.
+// muWriteのロックを取得してから呼び出す.
+func (p *Peer) writeMessage(messageType int, data []byte) error {
+	p.conn.EnableWriteCompression(p.compThreshold > 0 && len(data) >= p.compThreshold)
+	p.sentBytes.Add(int64(len(data)))
+	return writeMessage(p.conn, messageType, data)
+}
+
 func writeMessage(conn *websocket.Conn, messageType int, data []byte) error {
 	metrics.MessageSent.Add(1)
 	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
@@ -0,0 +1,137 @@
+package game
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/shiguredo/websocket"
+)
+
+// recordConn : 受信した生のバイト列を記録する
+type recordConn struct {
+	net.Conn
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.buf.Write(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+// frameRSV1 : サーバから受信したフレームのRSV1 (permessage-deflateで圧縮済み) を順に返す
+func frameRSV1(t *testing.T, raw []byte) []bool {
+	t.Helper()
+	i := bytes.Index(raw, []byte("\r\n\r\n"))
+	if i < 0 {
+		t.Fatalf("no handshake response")
+	}
+	raw = raw[i+4:]
+	var rsv1 []bool
+	for len(raw) >= 2 {
+		rsv1 = append(rsv1, raw[0]&0x40 != 0)
+		l, h := int(raw[1]&0x7f), 2
+		switch l {
+		case 126:
+			l, h = int(raw[2])<<8|int(raw[3]), 4
+		case 127:
+			t.Fatalf("too large frame")
+		}
+		raw = raw[h+l:]
+	}
+	return rsv1
+}
+
+// writeAndRecord : Peer.writeMessageで送信し、クライアントで受信したメッセージと各フレームの圧縮有無を返す
+func writeAndRecord(t *testing.T, threshold int, msgs [][]byte) ([][]byte, []bool) {
+	t.Helper()
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		p := &Peer{conn: conn, compThreshold: threshold}
+		for _, data := range msgs {
+			if err := p.writeMessage(websocket.BinaryMessage, data); err != nil {
+				t.Errorf("writeMessage: %v", err)
+			}
+		}
+		conn.ReadMessage() // クライアントが閉じるまで待つ
+	}))
+	defer srv.Close()
+
+	var rc *recordConn
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			rc = &recordConn{Conn: conn}
+			return rc, err
+		},
+	}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	var received [][]byte
+	for range msgs {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		received = append(received, data)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return received, frameRSV1(t, rc.buf.Bytes())
+}
+
+func TestPeerWriteMessageCompression(t *testing.T) {
+	const threshold = 100
+	small := []byte(strings.Repeat("a", threshold-1))
+	large := []byte(strings.Repeat("a", threshold))
+
+	tests := map[string]struct {
+		threshold int
+		msgs      [][]byte
+		compress  []bool
+	}{
+		"threshold":    {threshold, [][]byte{small, large}, []bool{false, true}},
+		"disabled":     {0, [][]byte{small, large}, []bool{false, false}},
+		"all-compress": {1, [][]byte{small, large}, []bool{true, true}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			received, rsv1 := writeAndRecord(t, test.threshold, test.msgs)
+			for i, data := range received {
+				if !bytes.Equal(data, test.msgs[i]) {
+					t.Errorf("message[%v] len=%v, wants len=%v", i, len(data), len(test.msgs[i]))
+				}
+			}
+			if len(rsv1) != len(test.compress) {
+				t.Fatalf("frames = %v, wants %v", rsv1, test.compress)
+			}
+			for i := range rsv1 {
+				if rsv1[i] != test.compress[i] {
+					t.Fatalf("compressed frames = %v, wants %v", rsv1, test.compress)
+				}
+			}
+		})
+	}
+}
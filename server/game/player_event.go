@@ -0,0 +1,159 @@
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"wsnet2/config"
+	"wsnet2/log"
+	"wsnet2/metrics"
+	"wsnet2/storage"
+)
+
+// PlayerEventType : player_eventに記録するイベントの種類
+type PlayerEventType string
+
+const (
+	// PlayerEventJoin : 入室. detail: source (create/id/number/random), rejoin
+	PlayerEventJoin PlayerEventType = "Join"
+	// PlayerEventLeave : 退室. detail: cause
+	PlayerEventLeave PlayerEventType = "Leave"
+	// PlayerEventConnect : websocketの接続. detail: remote_addr, forwarded_for, client_version, protocol_version
+	PlayerEventConnect PlayerEventType = "Connect"
+	// PlayerEventDisconnect : websocketの切断. detail: remote_addr, bytes_sent, bytes_received
+	PlayerEventDisconnect PlayerEventType = "Disconnect"
+	// PlayerEventKick : 部屋からのkick. detail: by (masterのID, admin), cause, ban (MsgBanによるもの)
+	PlayerEventKick PlayerEventType = "Kick"
+	// PlayerEventMasterSwitch : masterになった. detail: from, reason (switch/left)
+	PlayerEventMasterSwitch PlayerEventType = "MasterSwitch"
+	// PlayerEventClientError : MsgClientErrorによる退室. detail: error
+	PlayerEventClientError PlayerEventType = "ClientError"
+)
+
+// PlayerEventDetail : player_event.detail にJSONで記録する内容
+type PlayerEventDetail map[string]any
+
+// PlayerEventWriter : player_eventを非同期にまとめて書き込む.
+//
+// 書き込み待ちのバッファが溢れたときは、部屋のgoroutineを止めないように待たずに記録を捨てる.
+// 捨てた件数はmetrics.PlayerEventDroppedに数え、ログにはPlayerEventFlushIntervalごとに件数をまとめて出力する.
+// Runのctxが終了したら、残っているものを書き込んでからDoneをcloseする.
+type PlayerEventWriter struct {
+	store storage.RoomStorage
+	conf  *config.GameConf
+
+	ch   chan *storage.PlayerEvent
+	done chan struct{}
+
+	// dropped : 前回ログに出力してから捨てた件数
+	dropped atomic.Int64
+}
+
+func NewPlayerEventWriter(store storage.RoomStorage, conf *config.GameConf) *PlayerEventWriter {
+	return &PlayerEventWriter{
+		store: store,
+		conf:  conf,
+		ch:    make(chan *storage.PlayerEvent, conf.PlayerEventBufSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// WritePlayerEvent : player_eventの書き込みを予約する.
+// バッファが溢れているときは待たずに捨てる.
+func (w *PlayerEventWriter) WritePlayerEvent(ev *storage.PlayerEvent) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.ch <- ev:
+	default:
+		w.dropped.Add(1)
+		metrics.PlayerEventDropped.Add(1)
+	}
+}
+
+// Done : Runが書き込みを終えたらcloseされる
+func (w *PlayerEventWriter) Done() <-chan struct{} {
+	return w.done
+}
+
+func (w *PlayerEventWriter) Run(ctx context.Context) {
+	defer close(w.done)
+
+	t := time.NewTicker(time.Duration(w.conf.PlayerEventFlushInterval))
+	defer t.Stop()
+
+	batchSize := w.conf.PlayerEventBatchSize
+	var events []*storage.PlayerEvent
+	flush := func() {
+		w.flush(events)
+		events = nil
+	}
+	add := func(ev *storage.PlayerEvent) {
+		events = append(events, ev)
+		if len(events) >= batchSize {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case ev := <-w.ch:
+					add(ev)
+				default:
+					flush()
+					w.logDropped()
+					return
+				}
+			}
+		case ev := <-w.ch:
+			add(ev)
+		case <-t.C:
+			flush()
+			w.logDropped()
+		}
+	}
+}
+
+func (w *PlayerEventWriter) flush(events []*storage.PlayerEvent) {
+	if len(events) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.store.InsertPlayerEvents(ctx, events); err != nil {
+		log.Errorf("PlayerEventWriter: InsertPlayerEvents (%v records): %+v", len(events), err)
+	}
+}
+
+// logDropped : 前回から捨てた件数をまとめてログに出力する
+func (w *PlayerEventWriter) logDropped() {
+	if n := w.dropped.Swap(0); n > 0 {
+		log.Errorf("PlayerEventWriter: buffer full. dropped %v events (total %v)", n, metrics.PlayerEventDropped.Value())
+	}
+}
+
+func newPlayerEvent(appId string, c *Client, typ PlayerEventType, detail PlayerEventDetail) *storage.PlayerEvent {
+	d := []byte("{}")
+	if len(detail) > 0 {
+		var err error
+		d, err = json.Marshal(detail)
+		if err != nil {
+			c.logger.Errorf("player event detail (%v, %v): %+v", c.ID(), typ, err)
+			d = []byte("{}")
+		}
+	}
+	return &storage.PlayerEvent{
+		AppID:    appId,
+		RoomID:   string(c.RoomID()),
+		PlayerID: string(c.ID()),
+		Event:    string(typ),
+		Detail:   string(d),
+		Datetime: time.Now(),
+	}
+}
@@ -0,0 +1,85 @@
+package game
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"wsnet2/config"
+	"wsnet2/log"
+	"wsnet2/metrics"
+	"wsnet2/pb"
+	"wsnet2/storage"
+)
+
+func TestPlayerEventWriter(t *testing.T) {
+	defer log.InitLogger(&config.LogConf{LogStdoutLevel: uint32(log.ERROR)})()
+	store := storage.NewMemory(&pb.App{Id: "app1", Key: "key1"})
+	w := NewPlayerEventWriter(store, &config.GameConf{
+		PlayerEventBufSize:       4,
+		PlayerEventBatchSize:     2,
+		PlayerEventFlushInterval: config.Duration(time.Hour),
+	})
+
+	now := time.Now()
+	event := func(name string) *storage.PlayerEvent {
+		return &storage.PlayerEvent{AppID: "app1", RoomID: "room1", PlayerID: "p1", Event: name, Detail: "{}", Datetime: now}
+	}
+	for _, name := range []string{"Join", "Connect", "Disconnect", "Leave"} {
+		w.WritePlayerEvent(event(name))
+	}
+
+	// バッファが溢れたら待たずに捨てる
+	dropped := metrics.PlayerEventDropped.Value()
+	start := time.Now()
+	w.WritePlayerEvent(event("Dropped"))
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("WritePlayerEvent blocked %v", d)
+	}
+	if n := w.dropped.Load(); n != 1 {
+		t.Fatalf("dropped = %v, wants 1", n)
+	}
+	if n := metrics.PlayerEventDropped.Value() - dropped; n != 1 {
+		t.Fatalf("metrics.PlayerEventDropped increased %v, wants 1", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go w.Run(ctx)
+
+	// バッチサイズに達した分はflush間隔を待たずに書き込む
+	deadline := time.Now().Add(time.Second)
+	for {
+		evs, _ := store.PlayerEvents(ctx, &storage.PlayerEventFilter{PlayerId: "p1"})
+		if len(evs) >= 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("player events not written: %v", evs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 空いたら書き込める
+	w.WritePlayerEvent(event("Join"))
+	w.WritePlayerEvent(event("Leave"))
+
+	// 終了時に残りを書き込み、捨てた件数をログに出力する
+	cancel()
+	<-w.Done()
+	evs, _ := store.PlayerEvents(context.Background(), &storage.PlayerEventFilter{PlayerId: "p1"})
+	names := []string{}
+	for _, ev := range evs {
+		names = append(names, ev.Event)
+	}
+	if len(names) != 6 || names[0] != "Join" || names[3] != "Leave" || names[5] != "Leave" {
+		t.Fatalf("player events = %v", names)
+	}
+	if n := w.dropped.Load(); n != 0 {
+		t.Fatalf("dropped = %v after summary, wants 0", n)
+	}
+}
+
+func TestPlayerEventWriterNil(t *testing.T) {
+	var w *PlayerEventWriter
+	w.WritePlayerEvent(&storage.PlayerEvent{})
+}
@@ -5,22 +5,20 @@ import (
 	crand "crypto/rand"
 	"database/sql"
 	"encoding/hex"
-	"fmt"
 	"math"
 	"math/big"
 	"math/rand"
-	"reflect"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	"golang.org/x/xerrors"
 	"google.golang.org/grpc/codes"
 
+	"wsnet2/auth"
 	"wsnet2/config"
 	"wsnet2/log"
 	"wsnet2/pb"
+	"wsnet2/storage"
 )
 
 const (
@@ -29,53 +27,14 @@ const (
 )
 
 var (
-	roomInsertQuery        string
-	roomUpdateQuery        string
-	roomHistoryInsertQuery string
-
 	randsrc *rand.Rand
 )
 
 func init() {
-	initQueries()
 	seed, _ := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
 	randsrc = rand.New(rand.NewSource(seed.Int64()))
 }
 
-func dbCols(t reflect.Type) []string {
-	cols := make([]string, 0, t.NumField())
-	for i := 0; i < t.NumField(); i++ {
-		if c := t.Field(i).Tag.Get("db"); c != "" {
-			cols = append(cols, c)
-		}
-	}
-	return cols
-}
-
-func initQueries() {
-	// room_info queries
-	{
-		cols := dbCols(reflect.TypeOf(pb.RoomInfo{}))
-		roomInsertQuery = fmt.Sprintf("INSERT INTO room (%s) VALUES (:%s)",
-			strings.Join(cols, ","), strings.Join(cols, ",:"))
-
-		var sets []string
-		for _, c := range cols {
-			if c != "id" {
-				sets = append(sets, c+"=:"+c)
-			}
-		}
-		roomUpdateQuery = fmt.Sprintf("UPDATE room SET %s WHERE id=:id", strings.Join(sets, ","))
-	}
-
-	// room_history
-	{
-		cols := dbCols(reflect.TypeOf(roomHistory{}))
-		roomHistoryInsertQuery = fmt.Sprintf("INSERT INTO room_history (%s) VALUES (:%s)",
-			strings.Join(cols, ","), strings.Join(cols, ",:"))
-	}
-}
-
 func RandomHex(n int) string {
 	b := make([]byte, n)
 	_, _ = randsrc.Read(b) // (*rand.Rand).Read always success.
@@ -85,26 +44,27 @@ func RandomHex(n int) string {
 type Repository struct {
 	hostId uint32
 
-	app  *pb.App
-	conf *config.GameConf
-	db   *sqlx.DB
+	app   *pb.App
+	conf  *config.GameConf
+	store storage.Storage
+
+	lobbySync *LobbySync
+	roomInfos *RoomInfoWriter
+	events    *PlayerEventWriter
+
+	broadcastHook BroadcastHook
 
 	mu      sync.RWMutex
 	rooms   map[RoomID]*Room
 	clients map[ClientID]map[RoomID]*Client
 }
 
-func NewRepos(db *sqlx.DB, conf *config.GameConf, hostId uint32) (map[pb.AppId]*Repository, error) {
-	if _, err := db.Exec("INSERT INTO room_history (room_id, app_id, host_id, number, search_group, max_players, public_props, created, closed) "+
-		"SELECT id, app_id, host_id, number, search_group, max_players, props, created, now() FROM room WHERE host_id=?", hostId); err != nil {
-		return nil, xerrors.Errorf("room to history: %w", err)
+func NewRepos(store storage.Storage, conf *config.GameConf, hostId uint32, lobbySync *LobbySync, roomInfos *RoomInfoWriter, events *PlayerEventWriter) (map[pb.AppId]*Repository, error) {
+	ctx := context.Background()
+	if err := store.ArchiveRooms(ctx, hostId); err != nil {
+		return nil, xerrors.Errorf("archive rooms: %w", err)
 	}
-	if _, err := db.Exec("DELETE FROM `room` WHERE host_id=?", hostId); err != nil {
-		return nil, xerrors.Errorf("delete rooms: %w", err)
-	}
-	query := "SELECT id, `key` FROM app"
-	var apps []*pb.App
-	err := db.Select(&apps, query)
+	apps, err := store.Apps(ctx)
 	if err != nil {
 		return nil, xerrors.Errorf("select apps: %w", err)
 	}
@@ -115,7 +75,11 @@ func NewRepos(db *sqlx.DB, conf *config.GameConf, hostId uint32) (map[pb.AppId]*
 			hostId: hostId,
 			app:    app,
 			conf:   conf,
-			db:     db,
+			store:  store,
+
+			lobbySync: lobbySync,
+			roomInfos: roomInfos,
+			events:    events,
 
 			rooms:   make(map[RoomID]*Room),
 			clients: make(map[ClientID]map[RoomID]*Client),
@@ -124,7 +88,12 @@ func NewRepos(db *sqlx.DB, conf *config.GameConf, hostId uint32) (map[pb.AppId]*
 	return repos, nil
 }
 
-func (repo *Repository) CreateRoom(ctx context.Context, op *pb.RoomOption, master *pb.ClientInfo, macKey string) (*pb.JoinedRoomRes, ErrorWithCode) {
+// SetBroadcastHook : Broadcastの配信先を決めるhookを設定する. 部屋を作成する前に呼ぶこと
+func (repo *Repository) SetBroadcastHook(hook BroadcastHook) {
+	repo.broadcastHook = hook
+}
+
+func (repo *Repository) CreateRoom(ctx context.Context, op *pb.RoomOption, master *pb.ClientInfo, macKey string, macScheme auth.MACScheme) (*pb.JoinedRoomRes, ErrorWithCode) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
@@ -141,9 +110,9 @@ func (repo *Repository) CreateRoom(ctx context.Context, op *pb.RoomOption, maste
 			xerrors.Errorf("reached to the max_clients"), codes.ResourceExhausted)
 	}
 
-	tx, err := repo.db.Beginx()
+	tx, err := repo.store.BeginRoomTx(ctx)
 	if err != nil {
-		return nil, WithCode(xerrors.Errorf("db.Beginx: %w", err), codes.Internal)
+		return nil, WithCode(xerrors.Errorf("begin room tx: %w", err), codes.Internal)
 	}
 
 	info, ewc := repo.newRoomInfo(ctx, tx, op)
@@ -156,10 +125,11 @@ func (repo *Repository) CreateRoom(ctx context.Context, op *pb.RoomOption, maste
 	if op.LogLevel > 0 {
 		loglevel = log.Level(op.LogLevel)
 	}
-	logger := log.Get(loglevel).With(log.KeyApp, repo.app.Id, log.KeyRoom, info.Id)
+	logLevel := log.NewAtomicLevel(loglevel)
+	logger := log.GetAtomic(logLevel).With(log.KeyApp, repo.app.Id, log.KeyRoom, info.Id)
 	logger.Infof("new room: %v, num=%v, master=%v", info.Id, info.Number.Number, master.Id)
 
-	room, joined, ewc := NewRoom(ctx, repo, info, master, macKey, op.ClientDeadline, repo.conf, logger)
+	room, joined, ewc := NewRoom(ctx, repo, info, master, macKey, macScheme, op.ClientDeadline, repo.conf, logger, logLevel)
 	if ewc != nil {
 		tx.Rollback()
 		return nil, WithCode(xerrors.Errorf("NewRoom: %w", ewc), ewc.Code())
@@ -178,7 +148,7 @@ func (repo *Repository) CreateRoom(ctx context.Context, op *pb.RoomOption, maste
 	if len(repo.rooms) >= repo.conf.MaxRooms {
 		logger.Warnf("reached to the max_rooms. delete room: %v", room.Id)
 		// 履歴は残さずに部屋を削除
-		_, err := repo.db.Exec("DELETE FROM room WHERE id=?", room.Id)
+		err := repo.store.DeleteRoom(context.Background(), room.Id)
 		if err != nil {
 			logger.Errorf("delete room (%v): %+v", room.Id, err)
 		}
@@ -187,6 +157,7 @@ func (repo *Repository) CreateRoom(ctx context.Context, op *pb.RoomOption, maste
 	}
 
 	repo.rooms[room.ID()] = room
+	repo.lobbySync.Add(joined.Room)
 	if _, ok := repo.clients[cli.ID()]; !ok {
 		repo.clients[cli.ID()] = make(map[RoomID]*Client)
 	}
@@ -198,18 +169,23 @@ func (repo *Repository) CreateRoom(ctx context.Context, op *pb.RoomOption, maste
 		AuthKey:  cli.authKey,
 		MasterId: string(joined.MasterId),
 		Deadline: uint32(joined.Deadline / time.Second),
+
+		CompressionThreshold: repo.app.CompressionThreshold,
+		MacScheme:            uint32(cli.macScheme),
+		RoomState:            joined.State,
 	}, nil
 }
 
-func (repo *Repository) JoinRoom(ctx context.Context, id string, client *pb.ClientInfo, macKey string) (*pb.JoinedRoomRes, ErrorWithCode) {
-	return repo.joinRoom(ctx, id, client, macKey, true)
+// JoinRoom : sourceはplayer_eventに記録する部屋の指定方法 (see: common.JoinSourceId)
+func (repo *Repository) JoinRoom(ctx context.Context, id string, client *pb.ClientInfo, macKey string, macScheme auth.MACScheme, source string) (*pb.JoinedRoomRes, ErrorWithCode) {
+	return repo.joinRoom(ctx, id, client, macKey, macScheme, true, source)
 }
 
-func (repo *Repository) WatchRoom(ctx context.Context, id string, client *pb.ClientInfo, macKey string) (*pb.JoinedRoomRes, ErrorWithCode) {
-	return repo.joinRoom(ctx, id, client, macKey, false)
+func (repo *Repository) WatchRoom(ctx context.Context, id string, client *pb.ClientInfo, macKey string, macScheme auth.MACScheme) (*pb.JoinedRoomRes, ErrorWithCode) {
+	return repo.joinRoom(ctx, id, client, macKey, macScheme, false, "")
 }
 
-func (repo *Repository) joinRoom(ctx context.Context, id string, client *pb.ClientInfo, macKey string, isPlayer bool) (*pb.JoinedRoomRes, ErrorWithCode) {
+func (repo *Repository) joinRoom(ctx context.Context, id string, client *pb.ClientInfo, macKey string, macScheme auth.MACScheme, isPlayer bool, source string) (*pb.JoinedRoomRes, ErrorWithCode) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
@@ -230,9 +206,9 @@ func (repo *Repository) joinRoom(ctx context.Context, id string, client *pb.Clie
 	errch := make(chan ErrorWithCode, 1)
 	var msg Msg
 	if isPlayer {
-		msg = &MsgJoin{client, macKey, jch, errch}
+		msg = &MsgJoin{client, macKey, macScheme, jch, errch, source}
 	} else {
-		msg = &MsgWatch{client, macKey, jch, errch}
+		msg = &MsgWatch{client, macKey, macScheme, jch, errch}
 	}
 
 	select {
@@ -269,10 +245,14 @@ func (repo *Repository) joinRoom(ctx context.Context, id string, client *pb.Clie
 		AuthKey:  cli.authKey,
 		MasterId: string(joined.MasterId),
 		Deadline: uint32(joined.Deadline / time.Second),
+
+		CompressionThreshold: repo.app.CompressionThreshold,
+		MacScheme:            uint32(cli.macScheme),
+		RoomState:            joined.State,
 	}, nil
 }
 
-func (repo *Repository) newRoomInfo(ctx context.Context, tx *sqlx.Tx, op *pb.RoomOption) (*pb.RoomInfo, ErrorWithCode) {
+func (repo *Repository) newRoomInfo(ctx context.Context, tx storage.RoomTx, op *pb.RoomOption) (*pb.RoomInfo, ErrorWithCode) {
 	ri := &pb.RoomInfo{
 		AppId:        repo.app.Id,
 		HostId:       repo.hostId,
@@ -285,6 +265,9 @@ func (repo *Repository) newRoomInfo(ctx context.Context, tx *sqlx.Tx, op *pb.Roo
 		Players:      1,
 		PublicProps:  op.PublicProps,
 		PrivateProps: op.PrivateProps,
+		WatchDelay:   op.WatchDelay,
+
+		WatcherChatDisabled: op.DisableWatcherChat,
 	}
 	ri.SetCreated(time.Now())
 
@@ -303,7 +286,7 @@ func (repo *Repository) newRoomInfo(ctx context.Context, tx *sqlx.Tx, op *pb.Roo
 			ri.Number.Number = randsrc.Int31n(maxNumber) + 1 // [1..maxNumber]
 		}
 
-		_, err = tx.NamedExecContext(ctx, roomInsertQuery, ri)
+		err = tx.InsertRoom(ctx, ri)
 		if err == nil {
 			return ri, nil
 		}
@@ -312,35 +295,22 @@ func (repo *Repository) newRoomInfo(ctx context.Context, tx *sqlx.Tx, op *pb.Roo
 	return nil, WithCode(xerrors.Errorf("NewRoomInfo try %d times: %w", retryCount, err), codes.Internal)
 }
 
-func (repo *Repository) updateRoomInfo(ri *pb.RoomInfo, conn *sqlx.Conn, logger log.Logger) {
-	// DBへの反映は遅延して良い
-	q, args, err := sqlx.Named(roomUpdateQuery, ri)
-	if err != nil {
-		logger.Errorf("update roominfo query: q=%v, ri=%v, err=%+v", roomUpdateQuery, ri, err)
-		return
-	}
-
-	if _, err := conn.ExecContext(context.Background(), q, args...); err != nil {
-		logger.Errorf("update roominfo: %v %+v", ri.Id, err)
-	}
-}
+func (repo *Repository) updateRoomInfo(ri *pb.RoomInfo) {
+	repo.lobbySync.Update(ri)
 
-type roomHistory struct {
-	AppID        string        `db:"app_id"`
-	HostID       uint32        `db:"host_id"`
-	RoomID       string        `db:"room_id"`
-	Number       sql.NullInt32 `db:"number"`
-	SearchGroup  uint32        `db:"search_group"`
-	MaxPlayers   uint32        `db:"max_players"`
-	PublicProps  []byte        `db:"public_props"`
-	PrivateProps []byte        `db:"private_props"`
-	Created      time.Time     `db:"created"`
-	Closed       time.Time     `db:"closed"`
+	// DBはlobbyが同期できていない間の代わりなので、まとめて書き込む
+	repo.roomInfos.Update(ri)
 }
 
 func (repo *Repository) deleteRoom(room *Room) {
-	var err error
-	_, err = repo.db.Exec("DELETE FROM room WHERE id=?", room.Id)
+	repo.lobbySync.Delete(room.Id)
+	repo.roomInfos.Delete(room.Id)
+
+	// DeleteRoomBansより後に部屋のbanが書き込まれないように、予約済みのbanを書き込み終えておく
+	room.bans.Close()
+
+	ctx := context.Background()
+	err := repo.store.DeleteRoom(ctx, room.Id)
 	if err != nil {
 		room.logger.Errorf("delete room record (%v): %+v", room.Id, err)
 		return
@@ -353,7 +323,7 @@ func (repo *Repository) deleteRoom(room *Room) {
 		number = sql.NullInt32{Int32: room.Number.Number, Valid: true}
 	}
 
-	history := roomHistory{
+	history := &storage.RoomHistory{
 		AppID:        room.AppId,
 		HostID:       room.HostId,
 		RoomID:       room.Id,
@@ -366,10 +336,15 @@ func (repo *Repository) deleteRoom(room *Room) {
 		Closed:       time.Now(),
 	}
 
-	_, err = repo.db.NamedExec(roomHistoryInsertQuery, history)
+	err = repo.store.InsertRoomHistory(ctx, history)
 	if err != nil {
 		room.logger.Errorf("insert to room_history: %+v", err)
 	}
+
+	// 部屋のbanは部屋と共に不要になる
+	if err := repo.store.DeleteRoomBans(ctx, room.Id); err != nil {
+		room.logger.Errorf("delete room bans: %+v", err)
+	}
 }
 
 func (repo *Repository) RemoveRoom(room *Room) {
@@ -421,12 +396,39 @@ func (repo *Repository) GetClient(roomId, userId string) (*Client, error) {
 	return cli, nil
 }
 
+// CompressionThreshold : websocketメッセージを圧縮するサイズの閾値 (0は圧縮しない)
+func (repo *Repository) CompressionThreshold() int {
+	return int(repo.app.CompressionThreshold)
+}
+
 func (repo *Repository) GetRoomCount() int {
 	repo.mu.Lock()
 	defer repo.mu.Unlock()
 	return len(repo.rooms)
 }
 
+func (repo *Repository) GetClientCount() int {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	return len(repo.clients)
+}
+
+// Usage : max_rooms/max_clientsに対する使用率 (大きい方)
+func (repo *Repository) Usage() float64 {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	var usage float64
+	if repo.conf.MaxRooms > 0 {
+		usage = float64(len(repo.rooms)) / float64(repo.conf.MaxRooms)
+	}
+	if repo.conf.MaxClients > 0 {
+		if u := float64(len(repo.clients)) / float64(repo.conf.MaxClients); u > usage {
+			usage = u
+		}
+	}
+	return usage
+}
+
 func (repo *Repository) GetRoomInfo(ctx context.Context, id string) (*pb.GetRoomInfoRes, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
@@ -524,19 +526,40 @@ const (
 )
 
 func (repo *Repository) PlayerLog(c *Client, msg PlayerLogMsg) {
-	const q = "INSERT INTO player_log (`room_id`, `player_id`, `message`, `datetime`) VALUES (:room_id, :player_id, :message, :datetime)"
-
-	param := map[string]any{
-		"room_id":   c.RoomID(),
-		"player_id": c.ID(),
-		"message":   msg,
-		"datetime":  time.Now(),
+	plog := &storage.PlayerLog{
+		RoomID:   string(c.RoomID()),
+		PlayerID: string(c.ID()),
+		Message:  string(msg),
+		Datetime: time.Now(),
 	}
 
 	go func() {
-		_, err := repo.db.NamedExec(q, param)
+		err := repo.store.InsertPlayerLog(context.Background(), plog)
 		if err != nil {
 			c.logger.Errorf("Repository.PlayerLog(%v, %v, %v): %+v", c.RoomID(), c.ID(), msg, err)
 		}
 	}()
 }
+
+// Ban : 部屋からのbanをDBに記録する. lobbyはこれを見て入室を拒否する.
+// expiresがゼロ値なら部屋の終了まで (deleteRoomで削除する).
+// 部屋のgoroutineを止めないように、部屋ごとのbanWriterで順番に書き込む.
+func (repo *Repository) Ban(room *Room, userId, bannedBy, reason string, expires time.Time) {
+	room.bans.Write(&storage.Ban{
+		AppID:    room.AppId,
+		UserID:   userId,
+		RoomID:   room.Id,
+		Reason:   reason,
+		BannedBy: bannedBy,
+		Expires:  sql.NullTime{Time: expires, Valid: !expires.IsZero()},
+		Created:  time.Now(),
+	})
+}
+
+// PlayerEvent : playerのセッションの記録. watcherは記録しない
+func (repo *Repository) PlayerEvent(c *Client, typ PlayerEventType, detail PlayerEventDetail) {
+	if !c.isPlayer {
+		return
+	}
+	repo.events.WritePlayerEvent(newPlayerEvent(repo.app.Id, c, typ, detail))
+}
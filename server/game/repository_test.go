@@ -3,64 +3,107 @@ package game
 import (
 	"context"
 	"errors"
-	"regexp"
 	"testing"
 	"time"
 
-	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/jmoiron/sqlx"
-	"golang.org/x/xerrors"
+	"google.golang.org/protobuf/proto"
 
 	"wsnet2/config"
 	"wsnet2/pb"
+	"wsnet2/storage"
 )
 
+func newTestRepository(store storage.Storage, retryCount, maxNumber int) *Repository {
+	return &Repository{
+		app:    &pb.App{Id: "testing"},
+		hostId: 1,
+		conf: &config.GameConf{
+			RetryCount: retryCount,
+			MaxRoomNum: maxNumber,
+		},
+		store: store,
+	}
+}
+
 func TestQueries(t *testing.T) {
-	ok, err := regexp.MatchString(
-		`INSERT INTO room \((.+,|)id(,.+|)\) VALUES \((.+,|):id(,.+|)\)`,
-		roomInsertQuery)
+	// Repositoryが書き込んだroomの行を確認する
+	ctx := context.Background()
+	store := storage.NewMemory()
+	repo := newTestRepository(store, 1, 999)
+
+	op := &pb.RoomOption{
+		Visible:     true,
+		Joinable:    true,
+		WithNumber:  true,
+		SearchGroup: 3,
+		MaxPlayers:  4,
+		PublicProps: []byte{1, 2, 3},
+		WatchDelay:  5,
+	}
+	tx, err := store.BeginRoomTx(ctx)
 	if err != nil {
-		t.Fatalf("roomInsertQuery match error: %+v", err)
+		t.Fatalf("BeginRoomTx: %+v", err)
+	}
+	ri, ewc := repo.newRoomInfo(ctx, tx, op)
+	if ewc != nil {
+		t.Fatalf("newRoomInfo: %+v", ewc)
 	}
-	if !ok {
-		t.Fatalf("roomInsertQuery not match: %v, %v", ok, roomInsertQuery)
+
+	// Commitするまでは書き込まれない
+	if _, err := store.GetRoom(ctx, "testing", ri.Id); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetRoom before commit: %+v, wants %v", err, storage.ErrNotFound)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %+v", err)
 	}
 
-	ok, err = regexp.MatchString(
-		`UPDATE room SET (.+,|)app_id=:app_id(,.+|) WHERE id=:id`,
-		roomUpdateQuery)
+	got, err := store.GetRoom(ctx, "testing", ri.Id)
 	if err != nil {
-		t.Fatalf("roomUpdateQuery match error: %+v", err)
+		t.Fatalf("GetRoom: %+v", err)
 	}
-	if !ok {
-		t.Fatalf("roomUpdateQuery not match: %v, %v", ok, roomUpdateQuery)
+	want := &pb.RoomInfo{
+		Id:          ri.Id,
+		AppId:       "testing",
+		HostId:      1,
+		Visible:     true,
+		Joinable:    true,
+		Number:      &pb.RoomNumber{Number: ri.Number.Number},
+		SearchGroup: 3,
+		MaxPlayers:  4,
+		Players:     1,
+		PublicProps: []byte{1, 2, 3},
+		Created:     ri.Created,
+		WatchDelay:  5,
+	}
+	if !proto.Equal(got, want) {
+		t.Fatalf("inserted room:\n%v\nwants\n%v", got, want)
 	}
-}
 
-func newDbMock(t *testing.T) (*sqlx.DB, sqlmock.Sqlmock) {
-	db, mock, err := sqlmock.New()
+	// UpdateRoomで部屋の状態が更新される
+	upd := ri.Clone()
+	upd.Joinable = false
+	upd.Players = 3
+	upd.Watchers = 10
+	upd.PublicProps = []byte{4, 5}
+	if err := store.UpdateRoom(ctx, upd); err != nil {
+		t.Fatalf("UpdateRoom: %+v", err)
+	}
+	got, err = store.GetRoom(ctx, "testing", ri.Id)
 	if err != nil {
-		t.Fatalf("sqlmock error: %+v", err)
+		t.Fatalf("GetRoom: %+v", err)
+	}
+	if !proto.Equal(got, upd) {
+		t.Fatalf("updated room:\n%v\nwants\n%v", got, upd)
 	}
-	return sqlx.NewDb(db, "mysql"), mock
 }
 
 func TestNewRoomInfo(t *testing.T) {
 	ctx := context.Background()
-	db, mock := newDbMock(t)
+	store := storage.NewMemory()
 	retryCount := 3
 	maxNumber := 999
 
-	repo := &Repository{
-		app: &pb.App{Id: "testing"},
-		conf: &config.GameConf{
-			RetryCount: retryCount,
-			MaxRoomNum: maxNumber,
-		},
-		db: db,
-	}
-
-	dupErr := xerrors.Errorf("Duplicate entry")
+	repo := newTestRepository(store, retryCount, maxNumber)
 
 	op := &pb.RoomOption{
 		Visible:        true,
@@ -80,18 +123,25 @@ func TestNewRoomInfo(t *testing.T) {
 	num1 := randsrc.Int31n(int32(maxNumber)) + 1
 	id2 := RandomHex(lenId)
 	num2 := randsrc.Int31n(int32(maxNumber)) + 1
+	if num1 == num2 {
+		t.Skipf("same numbers are generated: seed=%v", seed)
+	}
 
-	insQuery := "INSERT INTO room "
-	mock.ExpectBegin()
-	mock.ExpectExec(insQuery).WillReturnError(dupErr)
-	mock.ExpectExec(insQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	// 1回目の部屋番号を使用済みにしておく
+	dup := &pb.RoomInfo{Id: "duproom", AppId: "testing", Number: &pb.RoomNumber{Number: num1}}
+	if err := store.InsertRoom(ctx, dup); err != nil {
+		t.Fatalf("InsertRoom: %+v", err)
+	}
 
 	randsrc.Seed(seed)
-	tx, _ := db.Beginx()
+	tx, _ := store.BeginRoomTx(ctx)
 	ri, err := repo.newRoomInfo(ctx, tx, op)
 	if err != nil {
 		t.Fatalf("NewRoomInfo fail: %v", err)
 	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %+v", err)
+	}
 
 	if ri.Id == id1 || ri.Id != id2 {
 		t.Fatalf("ri.Id = %v, wants %v", ri.Id, id2)
@@ -99,20 +149,26 @@ func TestNewRoomInfo(t *testing.T) {
 	if ri.Number.Number == num1 || ri.Number.Number != num2 {
 		t.Fatalf("ri.Number = %v, wants %v", ri.Number.Number, num2)
 	}
-
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expectations: %s", err)
+	if _, err := store.GetRoom(ctx, "testing", id1); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("room %v should not be inserted: %+v", id1, err)
+	}
+	if r, err := store.GetRoom(ctx, "testing", id2); err != nil || r.Number.Number != num2 {
+		t.Fatalf("room is not inserted: %v, %+v", r, err)
 	}
 
 	// リトライ回数オーバーでエラーになるはず
+	seed++
+	randsrc.Seed(seed)
 	for i := 0; i < retryCount; i++ {
-		mock.ExpectExec(insQuery).WillReturnError(dupErr)
+		id := "dup" + RandomHex(lenId)
+		num := randsrc.Int31n(int32(maxNumber)) + 1
+		store.InsertRoom(ctx, &pb.RoomInfo{Id: id, AppId: "testing", Number: &pb.RoomNumber{Number: num}})
 	}
+	randsrc.Seed(seed)
+	tx, _ = store.BeginRoomTx(ctx)
+	defer tx.Rollback()
 	_, err = repo.newRoomInfo(ctx, tx, op)
-	if !errors.Is(err, dupErr) {
-		t.Fatalf("NewRoomInfo error: %v wants %v", err, dupErr)
-	}
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expectations: %s", err)
+	if !errors.Is(err, storage.ErrDuplicate) {
+		t.Fatalf("NewRoomInfo error: %v wants %v", err, storage.ErrDuplicate)
 	}
 }
@@ -8,6 +8,7 @@ import (
 	"golang.org/x/xerrors"
 	"google.golang.org/grpc/codes"
 
+	"wsnet2/auth"
 	"wsnet2/binary"
 	"wsnet2/common"
 	"wsnet2/config"
@@ -19,6 +20,9 @@ import (
 const (
 	// RoomMsgChSize : Msgチャネルのバッファサイズ
 	RoomMsgChSize = 10
+
+	// MonitorChSize : 管理用にイベントを受け取るチャネルのバッファサイズ
+	MonitorChSize = 64
 )
 
 type Room struct {
@@ -32,6 +36,9 @@ type Room struct {
 	publicProps  binary.Dict
 	privateProps binary.Dict
 
+	// state : Masterが更新する部屋の状態 (see: binary.MsgTypeRoomState)
+	state binary.Dict
+
 	msgCh    chan Msg
 	done     chan struct{}
 	wgClient sync.WaitGroup
@@ -42,16 +49,25 @@ type Room struct {
 	masterOrder []ClientID
 	watchers    map[ClientID]*Client
 
+	// banned : MsgBanで入室を禁止したプレイヤーと期限 (ゼロ値なら部屋の終了まで). MsgLoopのgoroutineだけが触る
+	banned map[ClientID]time.Time
+	// bans : MsgBanのDBへの書き込みを順番に行う. 部屋の終了時にdeleteRoomでCloseする
+	bans *banWriter
+
 	lastMsg binary.Dict // map[clientID]unixtime_millisec
 
-	logger log.Logger
+	logger   log.Logger
+	logLevel log.AtomicLevel
+
+	// monitors : 管理用にイベントを受け取るチャネル. MsgLoopのgoroutineだけが触る
+	monitors map[chan *binary.RegularEvent]struct{}
 
 	chRoomInfo   chan struct{}
 	mRoomInfo    sync.Mutex // used by updateRoomInfo
 	lastRoomInfo *pb.RoomInfo
 }
 
-func NewRoom(ctx context.Context, repo *Repository, info *pb.RoomInfo, masterInfo *pb.ClientInfo, macKey string, deadlineSec uint32, conf *config.GameConf, logger log.Logger) (*Room, *JoinedInfo, ErrorWithCode) {
+func NewRoom(ctx context.Context, repo *Repository, info *pb.RoomInfo, masterInfo *pb.ClientInfo, macKey string, macScheme auth.MACScheme, deadlineSec uint32, conf *config.GameConf, logger log.Logger, logLevel log.AtomicLevel) (*Room, *JoinedInfo, ErrorWithCode) {
 	pubProps, iProps, err := common.InitProps(info.PublicProps)
 	if err != nil {
 		return nil, nil, WithCode(xerrors.Errorf("PublicProps unmarshal error: %w", err), codes.InvalidArgument)
@@ -71,6 +87,7 @@ func NewRoom(ctx context.Context, repo *Repository, info *pb.RoomInfo, masterInf
 
 		publicProps:  pubProps,
 		privateProps: privProps,
+		state:        make(binary.Dict),
 
 		msgCh: make(chan Msg, RoomMsgChSize),
 		done:  make(chan struct{}),
@@ -78,9 +95,14 @@ func NewRoom(ctx context.Context, repo *Repository, info *pb.RoomInfo, masterInf
 		players:     make(map[ClientID]*Client),
 		masterOrder: []ClientID{},
 		watchers:    make(map[ClientID]*Client),
+		banned:      make(map[ClientID]time.Time),
+		bans:        newBanWriter(repo.store, logger),
 		lastMsg:     make(binary.Dict),
 
-		logger: logger,
+		logger:   logger,
+		logLevel: logLevel,
+
+		monitors: make(map[chan *binary.RegularEvent]struct{}),
 
 		chRoomInfo:   make(chan struct{}, 1),
 		lastRoomInfo: info.Clone(),
@@ -97,7 +119,7 @@ func NewRoom(ctx context.Context, repo *Repository, info *pb.RoomInfo, masterInf
 		return nil, nil, WithCode(
 			xerrors.Errorf("write msg timeout or context done: room=%v client=%v", r.Id, masterInfo.Id),
 			codes.DeadlineExceeded)
-	case r.msgCh <- &MsgCreate{masterInfo, macKey, jch, ech}:
+	case r.msgCh <- &MsgCreate{masterInfo, macKey, macScheme, jch, ech}:
 	}
 
 	select {
@@ -136,6 +158,9 @@ Loop:
 			r.dispatch(msg)
 		}
 	}
+	for ch := range r.monitors {
+		close(ch)
+	}
 	r.repo.RemoveRoom(r)
 	r.drainMsg()
 }
@@ -210,6 +235,7 @@ func (r *Room) removePlayer(c *Client, cause string) {
 	}
 
 	r.repo.PlayerLog(c, PlayerLogLeave)
+	r.repo.PlayerEvent(c, PlayerEventLeave, PlayerEventDetail{"cause": cause})
 
 	c.logger.Infof("player left: %v: %v", cid, cause)
 	c.Removed(cause)
@@ -222,6 +248,7 @@ func (r *Room) removePlayer(c *Client, cause string) {
 	if r.master.ID() == cid {
 		r.master = r.players[r.masterOrder[0]]
 		r.logger.Infof("master switched: %v -> %v", cid, r.master.ID())
+		r.repo.PlayerEvent(r.master, PlayerEventMasterSwitch, PlayerEventDetail{"from": cid, "reason": "left"})
 	}
 
 	r.RoomInfo.Players = uint32(len(r.players))
@@ -232,36 +259,38 @@ func (r *Room) removePlayer(c *Client, cause string) {
 	r.removeLastMsg(cid)
 }
 
+// notifyMonitors : 管理用のチャネルにイベントを送る.
+// 受け取りが追いつかないチャネルは閉じて外す.
+func (r *Room) notifyMonitors(ev *binary.RegularEvent) {
+	for ch := range r.monitors {
+		select {
+		case ch <- ev:
+		default:
+			r.logger.Infof("monitor is too slow: drop the monitor")
+			delete(r.monitors, ch)
+			close(ch)
+		}
+	}
+}
+
 func (r *Room) roomInfoUpdater() {
 	for {
 		select {
 		case <-r.done:
 			return
 		case <-r.chRoomInfo:
-			for {
-				// mRoomInfo.Lock() はすぐにロック取れるので、先にDB接続を確保する
-				t1 := time.Now()
-				conn, err := r.repo.db.Connx(context.Background())
-				if err != nil {
-					r.logger.Errorf("roomInfoUpdater: conn: %+v", err)
-					time.Sleep(time.Second)
-					continue
-				}
-				if d := time.Since(t1); d > time.Second {
-					r.logger.Warnf("roomInfoUpdater: took %v to get a db conn", d)
-				}
-
-				r.mRoomInfo.Lock()
-				ri := r.lastRoomInfo
-				select {
-				case <-r.chRoomInfo:
-				default:
-				}
-				r.mRoomInfo.Unlock()
-
-				r.repo.updateRoomInfo(ri, conn, r.logger)
-				conn.Close()
-				break
+			r.mRoomInfo.Lock()
+			ri := r.lastRoomInfo
+			select {
+			case <-r.chRoomInfo:
+			default:
+			}
+			r.mRoomInfo.Unlock()
+
+			t1 := time.Now()
+			r.repo.updateRoomInfo(ri)
+			if d := time.Since(t1); d > time.Second {
+				r.logger.Warnf("roomInfoUpdater: took %v to update room info", d)
 			}
 		}
 	}
@@ -322,10 +351,30 @@ func (r *Room) dispatch(msg Msg) {
 		r.msgSwitchMaster(m)
 	case *MsgKick:
 		r.msgKick(m)
+	case *MsgBan:
+		r.msgBan(m)
+	case *MsgRoomKey:
+		r.msgRoomKey(m)
+	case *MsgWatcherChat:
+		r.msgWatcherChat(m)
+	case *MsgSubscribe:
+		r.msgSubscribe(m)
+	case *MsgRoomState:
+		r.msgRoomState(m)
 	case *MsgAdminKick:
 		r.msgAdminKick(m)
 	case *MsgGetRoomInfo:
 		r.msgGetRoomInfo(m)
+	case *MsgAdminMonitor:
+		r.msgAdminMonitor(m)
+	case *MsgAdminUnmonitor:
+		r.msgAdminUnmonitor(m)
+	case *MsgAdminClose:
+		r.msgAdminClose(m)
+	case *MsgAdminRoomProp:
+		r.msgAdminRoomProp(m)
+	case *MsgAdminBroadcast:
+		r.msgAdminBroadcast(m)
 	case *MsgClientError:
 		r.msgClientError(m)
 	case *MsgClientTimeout:
@@ -339,6 +388,10 @@ func (r *Room) dispatch(msg Msg) {
 // muClients のロックを取得してから呼び出す.
 // 送信できない場合続行不能なので退室させる.
 func (r *Room) sendTo(c *Client, ev *binary.RegularEvent) {
+	if !c.CanReceive(ev.Type()) {
+		c.logger.Debugf("sendTo %v: skip %v: protocol version v%v", c.Id, ev.Type(), c.ProtocolVersion())
+		return
+	}
 	err := c.Send(ev)
 	if err != nil {
 		c.logger.Infof("sendTo %v: %v", c.Id, err.Error())
@@ -354,11 +407,50 @@ func (r *Room) sendTo(c *Client, ev *binary.RegularEvent) {
 // broadcast : 全員に送信.
 // muClients のロックを取得してから呼び出すこと
 func (r *Room) broadcast(ev *binary.RegularEvent) {
-	for _, c := range r.players {
-		r.sendTo(c, ev)
+	r.broadcastScoped(ev, binary.BroadcastScopeAll)
+}
+
+// broadcastScoped : scopeで限定された相手に送信.
+// 観戦者のみの場合もhubには送り、hubから観戦者に配信される.
+func (r *Room) broadcastScoped(ev *binary.RegularEvent, scope binary.BroadcastScope) {
+	r.notifyMonitors(ev)
+	if scope.ToPlayers() {
+		for _, c := range r.players {
+			r.sendTo(c, ev)
+		}
 	}
-	for _, c := range r.watchers {
-		r.sendTo(c, ev)
+	if scope.ToWatchers() {
+		for _, c := range r.watchers {
+			r.sendTo(c, ev)
+		}
+	}
+}
+
+// broadcastTopic : トピック付きでscopeで限定された相手に送信.
+// 観戦者には購読しているトピックのものだけ送る.
+// hubは全トピックを購読しており、hubに接続している観戦者にはhubで振り分ける.
+func (r *Room) broadcastTopic(topic, sender string, data []byte, scope binary.BroadcastScope) {
+	ev := binary.NewEvTopicMessage(topic, sender, data)
+	fallback := binary.NewEvMessage(sender, data)
+	r.notifyMonitors(ev)
+	send := func(c *Client) {
+		if c.CanReceive(ev.Type()) {
+			r.sendTo(c, ev)
+		} else {
+			r.sendTo(c, fallback)
+		}
+	}
+	if scope.ToPlayers() {
+		for _, c := range r.players {
+			send(c)
+		}
+	}
+	if scope.ToWatchers() {
+		for _, c := range r.watchers {
+			if c.Subscribes(topic) {
+				send(c)
+			}
+		}
 	}
 }
 
@@ -366,7 +458,7 @@ func (r *Room) msgCreate(msg *MsgCreate) {
 	r.muClients.Lock()
 	defer r.muClients.Unlock()
 
-	master, err := NewPlayer(msg.Info, msg.MACKey, r)
+	master, err := NewPlayer(msg.Info, msg.MACKey, msg.MACScheme, r)
 	if err != nil {
 		err = WithCode(
 			xerrors.Errorf("NewPlayer(%v): %w", msg.Info.Id, err),
@@ -381,11 +473,12 @@ func (r *Room) msgCreate(msg *MsgCreate) {
 	r.players[master.ID()] = master
 	r.masterOrder = append(r.masterOrder, master.ID())
 	r.repo.PlayerLog(master, PlayerLogCreate)
+	r.repo.PlayerEvent(master, PlayerEventJoin, PlayerEventDetail{"source": common.JoinSourceCreate})
 
 	rinfo := r.RoomInfo.Clone()
 	cinfo := r.master.ClientInfo.Clone()
 	players := []*pb.ClientInfo{cinfo}
-	msg.Joined <- &JoinedInfo{rinfo, players, master, master.ID(), r.deadline}
+	msg.Joined <- &JoinedInfo{rinfo, players, master, master.ID(), r.deadline, binary.MarshalDict(r.state)}
 	r.broadcast(binary.NewEvJoined(cinfo))
 
 	r.writeLastMsg(master.ID())
@@ -399,6 +492,13 @@ func (r *Room) msgJoin(msg *MsgJoin) {
 		return
 	}
 
+	if r.isBanned(msg.SenderID()) {
+		err := xerrors.Errorf("Player is banned. room=%v, client=%v", r.ID(), msg.SenderID())
+		r.logger.Info(err.Error())
+		msg.Err <- WithCode(err, codes.PermissionDenied)
+		return
+	}
+
 	r.muClients.Lock()
 	defer r.muClients.Unlock()
 
@@ -419,7 +519,7 @@ func (r *Room) msgJoin(msg *MsgJoin) {
 		return
 	}
 
-	client, err := NewPlayer(msg.Info, msg.MACKey, r)
+	client, err := NewPlayer(msg.Info, msg.MACKey, msg.MACScheme, r)
 	if err != nil {
 		err = WithCode(
 			xerrors.Errorf("NewPlayer room=%v, client=%v: %w", r.ID(), msg.Info.Id, err),
@@ -435,10 +535,12 @@ func (r *Room) msgJoin(msg *MsgJoin) {
 			r.master = client
 		}
 		r.repo.PlayerLog(client, PlayerLogRejoin)
+		r.repo.PlayerEvent(client, PlayerEventJoin, PlayerEventDetail{"source": msg.Source, "rejoin": true})
 		client.logger.Infof("rejoin player: %v", client.Id)
 	} else {
 		r.masterOrder = append(r.masterOrder, client.ID())
 		r.repo.PlayerLog(client, PlayerLogJoin)
+		r.repo.PlayerEvent(client, PlayerEventJoin, PlayerEventDetail{"source": msg.Source})
 		r.RoomInfo.Players = uint32(len(r.players))
 		r.updateRoomInfo()
 		client.logger.Infof("new player: %v", client.Id)
@@ -450,7 +552,7 @@ func (r *Room) msgJoin(msg *MsgJoin) {
 	for _, c := range r.players {
 		players = append(players, c.ClientInfo.Clone())
 	}
-	msg.Joined <- &JoinedInfo{rinfo, players, client, r.master.ID(), r.deadline}
+	msg.Joined <- &JoinedInfo{rinfo, players, client, r.master.ID(), r.deadline, binary.MarshalDict(r.state)}
 	if rejoin {
 		r.broadcast(binary.NewEvRejoined(cinfo))
 	} else {
@@ -468,6 +570,13 @@ func (r *Room) msgWatch(msg *MsgWatch) {
 		return
 	}
 
+	if !msg.Info.IsHub && r.isBanned(msg.SenderID()) {
+		err := xerrors.Errorf("Watcher is banned. room=%v, client=%v", r.ID(), msg.SenderID())
+		r.logger.Info(err.Error())
+		msg.Err <- WithCode(err, codes.PermissionDenied)
+		return
+	}
+
 	r.muClients.Lock()
 	defer r.muClients.Unlock()
 
@@ -479,7 +588,7 @@ func (r *Room) msgWatch(msg *MsgWatch) {
 		return
 	}
 
-	client, err := NewWatcher(msg.Info, msg.MACKey, r)
+	client, err := NewWatcher(msg.Info, msg.MACKey, msg.MACScheme, r)
 	if err != nil {
 		err = WithCode(
 			xerrors.Errorf("NewWatcher error. room=%v, client=%v: %w", r.ID(), msg.Info.Id, err),
@@ -506,7 +615,7 @@ func (r *Room) msgWatch(msg *MsgWatch) {
 		players = append(players, c.ClientInfo.Clone())
 	}
 
-	msg.Joined <- &JoinedInfo{rinfo, players, client, r.master.ID(), r.deadline}
+	msg.Joined <- &JoinedInfo{rinfo, players, client, r.master.ID(), r.deadline, binary.MarshalDict(r.state)}
 }
 
 func (r *Room) msgPing(msg *MsgPing) {
@@ -559,23 +668,32 @@ func (r *Room) msgRoomProp(msg *MsgRoomProp) {
 		return
 	}
 
-	msg.Sender.logger.Debugf("update room props: v=%v j=%v w=%v group=%v maxp=%v deadline=%v public=%v private=%v",
-		msg.Visible, msg.Joinable, msg.Watchable, msg.SearchGroup, msg.MaxPlayer, msg.ClientDeadline, msg.PublicProps, msg.PrivateProps)
+	r.updateRoomProp(msg.MsgRoomPropPayload, msg.Sender.logger)
 
-	outputlog := r.RoomInfo.Visible != msg.Visible ||
-		r.RoomInfo.Joinable != msg.Joinable ||
-		r.RoomInfo.Watchable != msg.Watchable ||
-		r.RoomInfo.SearchGroup != msg.SearchGroup ||
-		r.RoomInfo.MaxPlayers != msg.MaxPlayer
-
-	r.RoomInfo.Visible = msg.Visible
-	r.RoomInfo.Joinable = msg.Joinable
-	r.RoomInfo.Watchable = msg.Watchable
-	r.RoomInfo.SearchGroup = msg.SearchGroup
-	r.RoomInfo.MaxPlayers = msg.MaxPlayer
+	r.sendTo(msg.Sender, binary.NewEvSucceeded(msg))
+	r.broadcast(binary.NewEvRoomProp(msg.Sender.Id, msg.MsgRoomPropPayload))
+}
 
-	if len(msg.PublicProps) > 0 {
-		for k, v := range msg.PublicProps {
+// updateRoomProp : 部屋の設定とpropsを更新する.
+// muClients のロックを取得してから呼び出す.
+func (r *Room) updateRoomProp(rpp *binary.MsgRoomPropPayload, logger log.Logger) {
+	logger.Debugf("update room props: v=%v j=%v w=%v group=%v maxp=%v deadline=%v public=%v private=%v",
+		rpp.Visible, rpp.Joinable, rpp.Watchable, rpp.SearchGroup, rpp.MaxPlayer, rpp.ClientDeadline, rpp.PublicProps, rpp.PrivateProps)
+
+	outputlog := r.RoomInfo.Visible != rpp.Visible ||
+		r.RoomInfo.Joinable != rpp.Joinable ||
+		r.RoomInfo.Watchable != rpp.Watchable ||
+		r.RoomInfo.SearchGroup != rpp.SearchGroup ||
+		r.RoomInfo.MaxPlayers != rpp.MaxPlayer
+
+	r.RoomInfo.Visible = rpp.Visible
+	r.RoomInfo.Joinable = rpp.Joinable
+	r.RoomInfo.Watchable = rpp.Watchable
+	r.RoomInfo.SearchGroup = rpp.SearchGroup
+	r.RoomInfo.MaxPlayers = rpp.MaxPlayer
+
+	if len(rpp.PublicProps) > 0 {
+		for k, v := range rpp.PublicProps {
 			if _, ok := r.publicProps[k]; ok && len(v) == 0 {
 				delete(r.publicProps, k)
 			} else {
@@ -585,8 +703,8 @@ func (r *Room) msgRoomProp(msg *MsgRoomProp) {
 		r.RoomInfo.PublicProps = binary.MarshalDict(r.publicProps)
 	}
 
-	if len(msg.PrivateProps) > 0 {
-		for k, v := range msg.PrivateProps {
+	if len(rpp.PrivateProps) > 0 {
+		for k, v := range rpp.PrivateProps {
 			if _, ok := r.privateProps[k]; ok && len(v) == 0 {
 				delete(r.privateProps, k)
 			} else {
@@ -598,8 +716,8 @@ func (r *Room) msgRoomProp(msg *MsgRoomProp) {
 
 	r.updateRoomInfo()
 
-	if msg.ClientDeadline != 0 {
-		deadline := time.Duration(msg.ClientDeadline) * time.Second
+	if rpp.ClientDeadline != 0 {
+		deadline := time.Duration(rpp.ClientDeadline) * time.Second
 		if deadline != r.deadline {
 			r.deadline = deadline
 			for _, c := range r.players {
@@ -610,12 +728,9 @@ func (r *Room) msgRoomProp(msg *MsgRoomProp) {
 	}
 
 	if outputlog {
-		msg.Sender.logger.Infof("room props: v=%v, j=%v, w=%v, group=%v, maxp=%v, deadline=%v",
+		logger.Infof("room props: v=%v, j=%v, w=%v, group=%v, maxp=%v, deadline=%v",
 			r.Visible, r.Joinable, r.Watchable, r.SearchGroup, r.MaxPlayers, r.deadline)
 	}
-
-	r.sendTo(msg.Sender, binary.NewEvSucceeded(msg))
-	r.broadcast(binary.NewEvRoomProp(msg.Sender.Id, msg.MsgRoomPropPayload))
 }
 
 func (r *Room) msgClientProp(msg *MsgClientProp) {
@@ -715,9 +830,26 @@ func (r *Room) msgBroadcast(msg *MsgBroadcast) {
 		}
 	}
 
-	msg.Sender.logger.Debugf("message to all: %v", msg.Data)
+	if msg.Scope != binary.BroadcastScopeAll && msg.Sender != r.master {
+		msg.Sender.logger.Warnf("scoped broadcast: sender %q is not master %q", msg.Sender.Id, r.master.Id)
+		r.sendTo(msg.Sender, binary.NewEvPermissionDenied(msg))
+		return
+	}
+
+	scope := msg.Scope
+	if hook := r.repo.broadcastHook; hook != nil {
+		scope = hook(r.RoomInfo.Clone(), msg.Sender.ClientInfo, scope, msg.Data)
+	}
+
+	if msg.Topic != "" {
+		msg.Sender.logger.Debugf("message to topic %q (%v): %v", msg.Topic, scope, msg.Data)
+		r.broadcastTopic(msg.Topic, msg.Sender.Id, msg.Data, scope)
+		return
+	}
+
+	msg.Sender.logger.Debugf("message to %v: %v", scope, msg.Data)
 
-	r.broadcast(binary.NewEvMessage(msg.Sender.Id, msg.Data))
+	r.broadcastScoped(binary.NewEvMessage(msg.Sender.Id, msg.Data), scope)
 }
 
 func (r *Room) msgSwitchMaster(msg *MsgSwitchMaster) {
@@ -739,11 +871,127 @@ func (r *Room) msgSwitchMaster(msg *MsgSwitchMaster) {
 	r.master = target
 
 	msg.Sender.logger.Infof("master switched: %v -> %v", msg.Sender.ID(), r.master.Id)
+	r.repo.PlayerEvent(target, PlayerEventMasterSwitch, PlayerEventDetail{"from": msg.Sender.Id, "reason": "switch"})
 
 	r.sendTo(msg.Sender, binary.NewEvSucceeded(msg))
 	r.broadcast(binary.NewEvMasterSwitched(msg.Sender.Id, r.master.Id))
 }
 
+// msgRoomKey : 部屋鍵をプレイヤー間で中継する.
+// 部屋鍵を持つのはプレイヤーだけなので、送信元はプレイヤーに限る.
+func (r *Room) msgRoomKey(msg *MsgRoomKey) {
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	if r.players[msg.SenderID()] != msg.Sender {
+		msg.Sender.logger.Warnf("sender %q is not a player", msg.Sender.Id)
+		r.sendTo(msg.Sender, binary.NewEvPermissionDenied(msg))
+		return
+	}
+
+	target, found := r.players[msg.Target]
+	if !found {
+		// hubに送るとhubの観戦者全員に配信されてしまうので除く
+		target, found = r.watchers[msg.Target]
+		found = found && !target.IsHub
+	}
+	if !found {
+		msg.Sender.logger.Infof("target %s is absent", msg.Target)
+		r.sendTo(msg.Sender, binary.NewEvTargetNotFound(msg, []string{string(msg.Target)}))
+		return
+	}
+
+	msg.Sender.logger.Debugf("room key to %v", msg.Target)
+	// 再接続中でも失われないようバッファして送る
+	r.sendTo(target, binary.NewEvRoomKey(msg.Sender.Id, msg.Sealed))
+}
+
+// msgWatcherChat : gameに直接接続している観戦者同士のチャット.
+// hubは各hub内で処理するので、hubには配信しない.
+func (r *Room) msgWatcherChat(msg *MsgWatcherChat) {
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	if r.watchers[msg.SenderID()] != msg.Sender || msg.Sender.IsHub {
+		msg.Sender.logger.Warnf("sender %q is not a watcher", msg.Sender.Id)
+		r.sendTo(msg.Sender, binary.NewEvPermissionDenied(msg))
+		return
+	}
+	if r.RoomInfo.WatcherChatDisabled {
+		msg.Sender.logger.Infof("watcher chat is disabled")
+		r.sendTo(msg.Sender, binary.NewEvPermissionDenied(msg))
+		return
+	}
+	if !msg.Sender.AllowWatcherChat() {
+		msg.Sender.logger.Infof("watcher chat rate limited")
+		r.sendTo(msg.Sender, binary.NewEvPermissionDenied(msg))
+		return
+	}
+
+	msg.Sender.logger.Debugf("watcher chat: %v", msg.Data)
+
+	ev := binary.NewEvWatcherMessage(msg.Sender.Id, msg.Data)
+	r.notifyMonitors(ev)
+	for _, c := range r.watchers {
+		if c.IsHub {
+			continue
+		}
+		r.sendTo(c, ev)
+	}
+}
+
+// msgSubscribe : gameに直接接続している観戦者の購読トピックを設定する.
+// hubは全トピックを受け取り、hubの観戦者の購読はhubで処理する.
+func (r *Room) msgSubscribe(msg *MsgSubscribe) {
+	r.muClients.Lock()
+	defer r.muClients.Unlock()
+
+	if r.watchers[msg.SenderID()] != msg.Sender || msg.Sender.IsHub {
+		msg.Sender.logger.Warnf("sender %q is not a watcher", msg.Sender.Id)
+		r.sendTo(msg.Sender, binary.NewEvPermissionDenied(msg))
+		return
+	}
+
+	msg.Sender.logger.Debugf("subscribe: %v", msg.Topics)
+	msg.Sender.SetTopics(msg.Topics)
+}
+
+// msgRoomState : room stateを更新して全員に通知する
+func (r *Room) msgRoomState(msg *MsgRoomState) {
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	if msg.Sender != r.master {
+		msg.Sender.logger.Warnf("msgRoomState: sender %q is not master %q", msg.Sender.Id, r.master.Id)
+		r.sendTo(msg.Sender, binary.NewEvPermissionDenied(msg))
+		return
+	}
+	if len(msg.State) == 0 {
+		return
+	}
+
+	state := make(binary.Dict, len(r.state)+len(msg.State))
+	for k, v := range r.state {
+		state[k] = v
+	}
+	for k, v := range msg.State {
+		if len(v) == 0 {
+			delete(state, k)
+		} else {
+			state[k] = v
+		}
+	}
+	if size := len(binary.MarshalDict(state)); r.conf.MaxRoomStateSize > 0 && size > r.conf.MaxRoomStateSize {
+		msg.Sender.logger.Warnf("msgRoomState: room state too large: %v > %v", size, r.conf.MaxRoomStateSize)
+		r.sendTo(msg.Sender, binary.NewEvPermissionDenied(msg))
+		return
+	}
+	r.state = state
+
+	msg.Sender.logger.Debugf("room state: %v", msg.State)
+	r.broadcast(binary.NewEvRoomState(msg.State))
+}
+
 func (r *Room) msgKick(msg *MsgKick) {
 	r.muClients.Lock()
 	defer r.muClients.Unlock()
@@ -763,10 +1011,56 @@ func (r *Room) msgKick(msg *MsgKick) {
 
 	r.logger.Infof("kick: %v", target.Id)
 	r.sendTo(msg.Sender, binary.NewEvSucceeded(msg))
+	r.repo.PlayerEvent(target, PlayerEventKick, PlayerEventDetail{"by": msg.Sender.Id, "cause": msg.Message})
 
 	r.removeClient(target, msg.Message)
 }
 
+func (r *Room) msgBan(msg *MsgBan) {
+	r.muClients.Lock()
+	defer r.muClients.Unlock()
+
+	if msg.Sender != r.master {
+		msg.Sender.logger.Warnf("sender %q is not master %q", msg.Sender.Id, r.master.Id)
+		r.sendTo(msg.Sender, binary.NewEvPermissionDenied(msg))
+		return
+	}
+	if msg.Target == msg.Sender.ID() {
+		msg.Sender.logger.Warnf("master %q cannot ban itself", msg.Sender.Id)
+		r.sendTo(msg.Sender, binary.NewEvPermissionDenied(msg))
+		return
+	}
+
+	var expires time.Time
+	if msg.Duration > 0 {
+		expires = time.Now().Add(msg.Duration)
+	}
+	r.banned[msg.Target] = expires
+	r.repo.Ban(r, string(msg.Target), msg.Sender.Id, msg.Message, expires)
+
+	r.logger.Infof("ban: %v (%v)", msg.Target, msg.Duration)
+	r.sendTo(msg.Sender, binary.NewEvSucceeded(msg))
+
+	// 退室済みのプレイヤーもbanできる
+	if target, found := r.players[msg.Target]; found {
+		r.repo.PlayerEvent(target, PlayerEventKick, PlayerEventDetail{"by": msg.Sender.Id, "cause": msg.Message, "ban": true})
+		r.removeClient(target, msg.Message)
+	}
+}
+
+// isBanned : MsgBanで入室を禁止されているか
+func (r *Room) isBanned(id ClientID) bool {
+	expires, ok := r.banned[id]
+	if !ok {
+		return false
+	}
+	if !expires.IsZero() && !time.Now().Before(expires) {
+		delete(r.banned, id)
+		return false
+	}
+	return true
+}
+
 func (r *Room) msgAdminKick(msg *MsgAdminKick) {
 	r.muClients.Lock()
 	defer r.muClients.Unlock()
@@ -776,6 +1070,7 @@ func (r *Room) msgAdminKick(msg *MsgAdminKick) {
 		return
 	}
 
+	r.repo.PlayerEvent(target, PlayerEventKick, PlayerEventDetail{"by": "admin", "cause": "kicked by admin"})
 	r.removeClient(target, "kicked by admin")
 	msg.Res <- nil
 }
@@ -806,9 +1101,87 @@ func (r *Room) msgGetRoomInfo(msg *MsgGetRoomInfo) {
 	}
 }
 
+func (r *Room) msgAdminMonitor(msg *MsgAdminMonitor) {
+	r.monitors[msg.Ch] = struct{}{}
+	r.logger.Infof("admin monitor added: monitors=%v", len(r.monitors))
+	msg.Res <- nil
+}
+
+func (r *Room) msgAdminUnmonitor(msg *MsgAdminUnmonitor) {
+	if _, ok := r.monitors[msg.Ch]; !ok {
+		return
+	}
+	delete(r.monitors, msg.Ch)
+	close(msg.Ch)
+	r.logger.Infof("admin monitor removed: monitors=%v", len(r.monitors))
+}
+
+// msgAdminClose : 観戦者、プレイヤーの順に退室させる.
+// 最後のプレイヤーが退室すると部屋が終了する.
+func (r *Room) msgAdminClose(msg *MsgAdminClose) {
+	r.muClients.Lock()
+	defer r.muClients.Unlock()
+
+	r.logger.Infof("close by admin: %v", msg.Reason)
+	// 部屋の終了 (done) より先に応答する
+	msg.Res <- nil
+	for _, c := range r.watchers {
+		r.removeClient(c, msg.Reason)
+	}
+	for _, id := range append([]ClientID{}, r.masterOrder...) {
+		r.removeClient(r.players[id], msg.Reason)
+	}
+}
+
+func (r *Room) msgAdminRoomProp(msg *MsgAdminRoomProp) {
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	visible, joinable, watchable := r.Visible, r.Joinable, r.Watchable
+	searchGroup, maxPlayers := r.SearchGroup, r.MaxPlayers
+	if msg.Visible != nil {
+		visible = *msg.Visible
+	}
+	if msg.Joinable != nil {
+		joinable = *msg.Joinable
+	}
+	if msg.Watchable != nil {
+		watchable = *msg.Watchable
+	}
+	if msg.SearchGroup != nil {
+		searchGroup = *msg.SearchGroup
+	}
+	if msg.MaxPlayers != nil {
+		maxPlayers = *msg.MaxPlayers
+	}
+
+	payload := binary.MarshalRoomPropPayload(
+		visible, joinable, watchable, searchGroup, maxPlayers, 0, msg.PublicProps, msg.PrivateProps)
+	rpp, err := binary.UnmarshalRoomPropPayload(payload)
+	if err != nil {
+		msg.Res <- xerrors.Errorf("room prop payload: %w", err)
+		return
+	}
+
+	r.logger.Infof("update room props by admin")
+	r.updateRoomProp(rpp, r.logger)
+	r.broadcast(binary.NewEvRoomProp(string(adminClientID), rpp))
+	msg.Res <- nil
+}
+
+func (r *Room) msgAdminBroadcast(msg *MsgAdminBroadcast) {
+	r.muClients.RLock()
+	defer r.muClients.RUnlock()
+
+	r.logger.Debugf("broadcast by admin: %v", msg.Data)
+	r.broadcast(binary.NewEvMessage(string(adminClientID), msg.Data))
+	msg.Res <- nil
+}
+
 func (r *Room) msgClientError(msg *MsgClientError) {
 	r.muClients.Lock()
 	defer r.muClients.Unlock()
+	r.repo.PlayerEvent(msg.Sender, PlayerEventClientError, PlayerEventDetail{"error": msg.ErrMsg})
 	r.removeClient(msg.Sender, msg.ErrMsg)
 }
 
@@ -842,3 +1215,16 @@ func (r *Room) SendMessage(msg Msg) {
 func (r *Room) Repo() IRepo {
 	return r.repo
 }
+
+// Info : 最後に更新された部屋情報
+func (r *Room) Info() *pb.RoomInfo {
+	r.mRoomInfo.Lock()
+	defer r.mRoomInfo.Unlock()
+	return r.lastRoomInfo
+}
+
+// SetLogLevel : 部屋のログレベルを変更する
+func (r *Room) SetLogLevel(l log.Level) {
+	r.logLevel.SetLevel(l)
+	r.logger.Infof("log level changed: %v", l)
+}
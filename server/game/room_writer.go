@@ -0,0 +1,94 @@
+package game
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"wsnet2/config"
+	"wsnet2/log"
+	"wsnet2/pb"
+	"wsnet2/storage"
+)
+
+// RoomInfoWriter : 部屋の更新をroomテーブルにまとめて書き込む.
+//
+// lobbyはLobbySyncで受け取った部屋の状態を使い、roomテーブルはlobbyが同期できていない間の代わりなので、
+// 更新の度には書き込まず、RoomUpdateIntervalごとに部屋ごとの最新の状態だけを書き込む.
+// Runのctxが終了したら、残っているものを書き込んでからDoneをcloseする.
+type RoomInfoWriter struct {
+	store storage.RoomStorage
+	conf  *config.GameConf
+
+	mu      sync.Mutex
+	pending map[string]*pb.RoomInfo
+
+	done chan struct{}
+}
+
+func NewRoomInfoWriter(store storage.RoomStorage, conf *config.GameConf) *RoomInfoWriter {
+	return &RoomInfoWriter{
+		store:   store,
+		conf:    conf,
+		pending: make(map[string]*pb.RoomInfo),
+		done:    make(chan struct{}),
+	}
+}
+
+// Update : 部屋の更新の書き込みを予約する. 書き込み前の更新は上書きする
+func (w *RoomInfoWriter) Update(ri *pb.RoomInfo) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[ri.Id] = ri
+}
+
+// Delete : 削除する部屋の書き込み待ちの更新を捨てる.
+// 書き込み中の更新がDeleteRoomの後になっても、UpdateRoomは存在しない部屋を作らない
+func (w *RoomInfoWriter) Delete(roomId string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.pending, roomId)
+}
+
+// Done : Runが書き込みを終えたらcloseされる
+func (w *RoomInfoWriter) Done() <-chan struct{} {
+	return w.done
+}
+
+func (w *RoomInfoWriter) Run(ctx context.Context) {
+	defer close(w.done)
+
+	t := time.NewTicker(time.Duration(w.conf.RoomUpdateInterval))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.flush()
+			return
+		case <-t.C:
+			w.flush()
+		}
+	}
+}
+
+func (w *RoomInfoWriter) flush() {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string]*pb.RoomInfo, len(pending))
+	w.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for id, ri := range pending {
+		if err := w.store.UpdateRoom(ctx, ri); err != nil {
+			log.Errorf("RoomInfoWriter: update room %v: %+v", id, err)
+		}
+	}
+}
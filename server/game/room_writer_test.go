@@ -0,0 +1,48 @@
+package game
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"wsnet2/config"
+	"wsnet2/log"
+	"wsnet2/pb"
+	"wsnet2/storage"
+)
+
+func TestRoomInfoWriter(t *testing.T) {
+	defer log.InitLogger(&config.LogConf{LogStdoutLevel: uint32(log.ERROR)})()
+	ctx := context.Background()
+	store := storage.NewMemory(&pb.App{Id: "app1", Key: "key1"})
+	for _, id := range []string{"room1", "room2"} {
+		if err := store.InsertRoom(ctx, &pb.RoomInfo{Id: id, AppId: "app1", MaxPlayers: 4, Players: 1}); err != nil {
+			t.Fatalf("InsertRoom: %v", err)
+		}
+	}
+	w := NewRoomInfoWriter(store, &config.GameConf{RoomUpdateInterval: config.Duration(time.Hour)})
+
+	// 書き込むまでの更新は最新のものだけが残る
+	w.Update(&pb.RoomInfo{Id: "room1", AppId: "app1", MaxPlayers: 4, Players: 2})
+	w.Update(&pb.RoomInfo{Id: "room1", AppId: "app1", MaxPlayers: 4, Players: 3})
+	w.Update(&pb.RoomInfo{Id: "room2", AppId: "app1", MaxPlayers: 4, Players: 2})
+	if n := len(w.pending); n != 2 {
+		t.Fatalf("pending = %v, wants 2", n)
+	}
+	w.Delete("room2")
+
+	// 終了時に残りを書き込む
+	wctx, cancel := context.WithCancel(ctx)
+	go w.Run(wctx)
+	cancel()
+	<-w.Done()
+
+	r1, err := store.GetRoom(ctx, "app1", "room1")
+	if err != nil || r1.Players != 3 {
+		t.Errorf("room1: %v, %v, wants players=3", r1, err)
+	}
+	r2, err := store.GetRoom(ctx, "app1", "room2")
+	if err != nil || r2.Players != 1 {
+		t.Errorf("room2: %v, %v, wants players=1", r2, err)
+	}
+}
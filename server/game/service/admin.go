@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"wsnet2/game"
+	"wsnet2/log"
+	"wsnet2/pb"
+)
+
+// pb.GameAdminServer実装
+
+func (sv *GameService) adminRepo(appId string, logger log.Logger) (*game.Repository, error) {
+	repo, ok := sv.repos[appId]
+	if !ok {
+		logger.Errorf("invalid app_id: %v", appId)
+		return nil, status.Errorf(codes.NotFound, "Invalid app_id: %v", appId)
+	}
+	return repo, nil
+}
+
+func (sv *GameService) ListRooms(ctx context.Context, in *pb.ListRoomsReq) (*pb.ListRoomsRes, error) {
+	logger := log.GetLoggerWith(
+		log.KeyHandler, "grpc:ListRooms",
+		log.KeyApp, in.AppId,
+		log.KeyRequestedAt, float64(time.Now().UnixMilli())/1000,
+	)
+	logger.Debugf("gRPC ListRooms: %v", in)
+
+	repos := sv.repos
+	if in.AppId != "" {
+		repo, err := sv.adminRepo(in.AppId, logger)
+		if err != nil {
+			return nil, err
+		}
+		repos = map[pb.AppId]*game.Repository{in.AppId: repo}
+	}
+
+	res := &pb.ListRoomsRes{}
+	for _, repo := range repos {
+		res.Rooms = append(res.Rooms, repo.ListRooms(in)...)
+		if in.Limit > 0 && len(res.Rooms) >= int(in.Limit) {
+			res.Rooms = res.Rooms[:in.Limit]
+			break
+		}
+	}
+
+	logger.Infof("gRPC ListRooms OK: %v rooms", len(res.Rooms))
+	return res, nil
+}
+
+// WatchRoom : 部屋が終了するかクライアントが切断するまでイベントを送り続ける
+func (sv *GameService) WatchRoom(in *pb.AdminRoomReq, stream pb.GameAdmin_WatchRoomServer) error {
+	logger := log.GetLoggerWith(
+		log.KeyHandler, "grpc:WatchRoom",
+		log.KeyApp, in.AppId,
+		log.KeyRoom, in.RoomId,
+		log.KeyRequestedAt, float64(time.Now().UnixMilli())/1000,
+	)
+	logger.Debugf("gRPC WatchRoom: %v", in.RoomId)
+	repo, err := sv.adminRepo(in.AppId, logger)
+	if err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	events, unmonitor, ewc := repo.MonitorRoom(ctx, in.RoomId)
+	if ewc != nil {
+		logger.Errorf("repo.MonitorRoom: %+v", ewc)
+		return status.Errorf(ewc.Code(), "WatchRoom failed: %s", ewc)
+	}
+	defer unmonitor()
+
+	// 監視を始めたことをクライアントに知らせる (イベントの取りこぼしなく待てるように)
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		logger.Infof("gRPC WatchRoom send header: %v", err)
+		return err
+	}
+	logger.Infof("gRPC WatchRoom start: room=%v", in.RoomId)
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Infof("gRPC WatchRoom end: %v", ctx.Err())
+			return nil
+		case ev, ok := <-events:
+			if !ok {
+				logger.Infof("gRPC WatchRoom end: room closed")
+				return nil
+			}
+			err := stream.Send(&pb.RoomEvent{
+				Type:    uint32(ev.Type()),
+				Payload: ev.Payload(),
+			})
+			if err != nil {
+				logger.Infof("gRPC WatchRoom send: %v", err)
+				return err
+			}
+		}
+	}
+}
+
+func (sv *GameService) CloseRoom(ctx context.Context, in *pb.CloseRoomReq) (*pb.Empty, error) {
+	logger := log.GetLoggerWith(
+		log.KeyHandler, "grpc:CloseRoom",
+		log.KeyApp, in.AppId,
+		log.KeyRoom, in.RoomId,
+		log.KeyRequestedAt, float64(time.Now().UnixMilli())/1000,
+	)
+	logger.Debugf("gRPC CloseRoom: %v %q", in.RoomId, in.Reason)
+	repo, err := sv.adminRepo(in.AppId, logger)
+	if err != nil {
+		return nil, err
+	}
+	if ewc := repo.AdminCloseRoom(ctx, in.RoomId, in.Reason); ewc != nil {
+		logger.Errorf("repo.AdminCloseRoom: %+v", ewc)
+		return nil, status.Errorf(ewc.Code(), "CloseRoom failed: %s", ewc)
+	}
+
+	logger.Infof("gRPC CloseRoom OK: room=%v reason=%q", in.RoomId, in.Reason)
+	return &pb.Empty{}, nil
+}
+
+func (sv *GameService) UpdateRoomProps(ctx context.Context, in *pb.UpdateRoomPropsReq) (*pb.Empty, error) {
+	logger := log.GetLoggerWith(
+		log.KeyHandler, "grpc:UpdateRoomProps",
+		log.KeyApp, in.AppId,
+		log.KeyRoom, in.RoomId,
+		log.KeyRequestedAt, float64(time.Now().UnixMilli())/1000,
+	)
+	logger.Debugf("gRPC UpdateRoomProps: %v", in)
+	repo, err := sv.adminRepo(in.AppId, logger)
+	if err != nil {
+		return nil, err
+	}
+	if ewc := repo.AdminUpdateRoomProps(ctx, in); ewc != nil {
+		logger.Errorf("repo.AdminUpdateRoomProps: %+v", ewc)
+		return nil, status.Errorf(ewc.Code(), "UpdateRoomProps failed: %s", ewc)
+	}
+
+	logger.Infof("gRPC UpdateRoomProps OK: room=%v", in.RoomId)
+	return &pb.Empty{}, nil
+}
+
+func (sv *GameService) Broadcast(ctx context.Context, in *pb.AdminBroadcastReq) (*pb.Empty, error) {
+	logger := log.GetLoggerWith(
+		log.KeyHandler, "grpc:Broadcast",
+		log.KeyApp, in.AppId,
+		log.KeyRoom, in.RoomId,
+		log.KeyRequestedAt, float64(time.Now().UnixMilli())/1000,
+	)
+	logger.Debugf("gRPC Broadcast: %v %v", in.RoomId, in.Data)
+	repo, err := sv.adminRepo(in.AppId, logger)
+	if err != nil {
+		return nil, err
+	}
+	if ewc := repo.AdminBroadcast(ctx, in.RoomId, in.Data); ewc != nil {
+		logger.Errorf("repo.AdminBroadcast: %+v", ewc)
+		return nil, status.Errorf(ewc.Code(), "Broadcast failed: %s", ewc)
+	}
+
+	logger.Infof("gRPC Broadcast OK: room=%v", in.RoomId)
+	return &pb.Empty{}, nil
+}
+
+func (sv *GameService) SetRoomLogLevel(ctx context.Context, in *pb.SetRoomLogLevelReq) (*pb.Empty, error) {
+	logger := log.GetLoggerWith(
+		log.KeyHandler, "grpc:SetRoomLogLevel",
+		log.KeyApp, in.AppId,
+		log.KeyRoom, in.RoomId,
+		log.KeyRequestedAt, float64(time.Now().UnixMilli())/1000,
+	)
+	logger.Debugf("gRPC SetRoomLogLevel: %v %v", in.RoomId, in.LogLevel)
+	repo, err := sv.adminRepo(in.AppId, logger)
+	if err != nil {
+		return nil, err
+	}
+	if ewc := repo.SetRoomLogLevel(in.RoomId, log.Level(in.LogLevel)); ewc != nil {
+		logger.Errorf("repo.SetRoomLogLevel: %+v", ewc)
+		return nil, status.Errorf(ewc.Code(), "SetRoomLogLevel failed: %s", ewc)
+	}
+
+	logger.Infof("gRPC SetRoomLogLevel OK: room=%v level=%v", in.RoomId, log.Level(in.LogLevel))
+	return &pb.Empty{}, nil
+}
+
+// Drain : シグナル (SIGTERM) を受けたときと同様に停止を始める.
+// 部屋が全て終了するまで待たずに応答する.
+func (sv *GameService) Drain(ctx context.Context, in *pb.Empty) (*pb.Empty, error) {
+	logger := log.GetLoggerWith(
+		log.KeyHandler, "grpc:Drain",
+		log.KeyRequestedAt, float64(time.Now().UnixMilli())/1000,
+	)
+	if sv.shutdownRequested() {
+		logger.Infof("gRPC Drain: already shutting down")
+		return &pb.Empty{}, nil
+	}
+
+	go sv.Shutdown(context.Background())
+
+	logger.Infof("gRPC Drain OK: %v rooms", sv.numRooms())
+	return &pb.Empty{}, nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package service
+
+import "time"
+
+// processCPUTime : CPU時間を取得できない環境では計測しない
+func processCPUTime() time.Duration {
+	return 0
+}
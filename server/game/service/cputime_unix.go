@@ -0,0 +1,17 @@
+//go:build unix
+
+package service
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime : プロセスが消費したCPU時間 (user+system)
+func processCPUTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -11,6 +11,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"wsnet2/auth"
 	"wsnet2/log"
 	"wsnet2/pb"
 )
@@ -31,6 +32,11 @@ func (sv *GameService) serveGRPC(ctx context.Context) <-chan error {
 
 		server := grpc.NewServer()
 		pb.RegisterGameServer(server, sv)
+		pb.RegisterGameAdminServer(server, sv)
+
+		sv.muGRPC.Lock()
+		sv.grpcServer = server
+		sv.muGRPC.Unlock()
 
 		c := make(chan error)
 		go func() {
@@ -42,6 +48,10 @@ func (sv *GameService) serveGRPC(ctx context.Context) <-chan error {
 			server.Stop()
 			log.Infof("gRPC server stop")
 		case err := <-c:
+			if err == nil {
+				// gracefulStopGRPCによる停止
+				return
+			}
 			errCh <- err
 			log.Infof("gRPC server error: %v", err)
 		}
@@ -50,6 +60,17 @@ func (sv *GameService) serveGRPC(ctx context.Context) <-chan error {
 	return errCh
 }
 
+// gracefulStopGRPC : 処理中のリクエスト (Drainなど) に応答してからgRPCサーバを停止する
+func (sv *GameService) gracefulStopGRPC() {
+	sv.muGRPC.Lock()
+	server := sv.grpcServer
+	sv.muGRPC.Unlock()
+	if server != nil {
+		server.GracefulStop()
+		log.Infof("gRPC server graceful stop")
+	}
+}
+
 func (sv *GameService) Create(ctx context.Context, in *pb.CreateRoomReq) (*pb.JoinedRoomRes, error) {
 	logger := log.GetLoggerWith(
 		log.KeyHandler, "grpc:Create",
@@ -66,7 +87,7 @@ func (sv *GameService) Create(ctx context.Context, in *pb.CreateRoomReq) (*pb.Jo
 		return nil, status.Errorf(codes.NotFound, "Invalid app_id: %v", in.AppId)
 	}
 
-	res, err := repo.CreateRoom(ctx, in.RoomOption, in.MasterInfo, in.MacKey)
+	res, err := repo.CreateRoom(ctx, in.RoomOption, in.MasterInfo, in.MacKey, auth.MACScheme(in.MacScheme))
 	if err != nil {
 		logger.Errorf("repo.CreateRoom: %+v", err)
 		return nil, status.Errorf(err.Code(), "CreateRoom failed: %s", err)
@@ -107,7 +128,7 @@ func (sv *GameService) Join(ctx context.Context, in *pb.JoinRoomReq) (*pb.Joined
 		return nil, status.Errorf(codes.Internal, "Invalid app_id: %v", in.AppId)
 	}
 
-	res, err := repo.JoinRoom(ctx, in.RoomId, in.ClientInfo, in.MacKey)
+	res, err := repo.JoinRoom(ctx, in.RoomId, in.ClientInfo, in.MacKey, auth.MACScheme(in.MacScheme), in.JoinSource)
 	if err != nil {
 		logger.Errorf("repo.JoinRoom: %+v", err)
 		return nil, status.Errorf(err.Code(), "JoinRoom failed: %s", err)
@@ -136,7 +157,7 @@ func (sv *GameService) Watch(ctx context.Context, in *pb.JoinRoomReq) (*pb.Joine
 		return nil, status.Errorf(codes.Internal, "Invalid app_id: %v", in.AppId)
 	}
 
-	res, err := repo.WatchRoom(ctx, in.RoomId, in.ClientInfo, in.MacKey)
+	res, err := repo.WatchRoom(ctx, in.RoomId, in.ClientInfo, in.MacKey, auth.MACScheme(in.MacScheme))
 	if err != nil {
 		logger.Errorf("repo.WatchRoom: %+v", err)
 		return nil, status.Errorf(err.Code(), "WatchRoom failed: %s", err)
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"wsnet2/storage"
+)
+
+// load : heartbeatで報告するサーバの負荷.
+// Lobbyは負荷の低いサーバを優先して部屋を作成する.
+func (s *GameService) load() *storage.GameLoad {
+	var rooms, clients int
+	var usage float64
+	for _, repo := range s.repos {
+		rooms += repo.GetRoomCount()
+		clients += repo.GetClientCount()
+		// max_rooms/max_clientsはappごとの上限なので、最も使用率の高いappの値を使う
+		if u := repo.Usage(); u > usage {
+			usage = u
+		}
+	}
+	return &storage.GameLoad{
+		Rooms:         rooms,
+		Clients:       clients,
+		CapacityUsage: usage,
+		CPUUsage:      s.cpu.usage(),
+	}
+}
+
+// cpuMeter : プロセスのCPU使用率を前回の計測からの差分で求める
+type cpuMeter struct {
+	mu      sync.Mutex
+	last    time.Time
+	lastCPU time.Duration
+}
+
+// usage : 前回の呼び出しからのCPU使用率 (0.0〜1.0, 全コアに対する割合)
+func (m *cpuMeter) usage() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	cpu := processCPUTime()
+	last, lastCPU := m.last, m.lastCPU
+	m.last, m.lastCPU = now, cpu
+
+	if last.IsZero() || cpu == 0 {
+		return 0
+	}
+	elapsed := now.Sub(last)
+	if elapsed <= 0 {
+		return 0
+	}
+	u := float64(cpu-lastCPU) / float64(elapsed) / float64(runtime.NumCPU())
+	if u > 1 {
+		u = 1
+	}
+	return u
+}
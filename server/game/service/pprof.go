@@ -8,7 +8,10 @@ import (
 	_ "net/http/pprof"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+
 	"wsnet2/log"
+	"wsnet2/storage"
 )
 
 func (sv *GameService) servePprof(ctx context.Context) <-chan error {
@@ -17,6 +20,26 @@ func (sv *GameService) servePprof(ctx context.Context) <-chan error {
 	}
 
 	// DB接続を擬似的に詰まった状態にする
+	if db, ok := sv.store.(storage.Database); ok {
+		sv.handleStopTheDB(db.DB())
+	}
+
+	errCh := make(chan error)
+
+	sv.preparation.Add(1)
+	go func() {
+		laddr := fmt.Sprintf(":%d", sv.conf.PprofPort)
+		log.Infof("game pprof: %#v", laddr)
+
+		sv.preparation.Done()
+		errCh <- http.ListenAndServe(laddr, nil)
+	}()
+
+	return errCh
+}
+
+// handleStopTheDB : /debug/stop-the-db を登録する (SQLのDBを使うときのみ)
+func (sv *GameService) handleStopTheDB(db *sqlx.DB) {
 	http.HandleFunc("/debug/stop-the-db", func(w http.ResponseWriter, r *http.Request) {
 		d := time.Second * 10
 		if p := r.URL.Query().Get("d"); p != "" {
@@ -31,7 +54,7 @@ func (sv *GameService) servePprof(ctx context.Context) <-chan error {
 
 		// SetMaxOpenConns(0) は無制限にDB接続することになる。
 		// 1本の接続を握って SetMaxOpenConns(1) することでDB接続が詰まった状況を作る。
-		conn, err := sv.db.Conn(context.Background())
+		conn, err := db.Conn(context.Background())
 		if err != nil {
 			log.Errorf("/debug/stop-the-db: failed to get db conn: %+v", err)
 
@@ -40,27 +63,14 @@ func (sv *GameService) servePprof(ctx context.Context) <-chan error {
 			return
 		}
 
-		sv.db.SetMaxOpenConns(1)
+		db.SetMaxOpenConns(1)
 		time.Sleep(d)
 
 		conn.Close()
 		cs := sv.conf.DbMaxConns
-		sv.db.SetMaxOpenConns(cs)
-		sv.db.SetMaxIdleConns(cs)
+		db.SetMaxOpenConns(cs)
+		db.SetMaxIdleConns(cs)
 
-		_, _ = w.Write([]byte(fmt.Sprintf("%+v\n", sv.db.Stats())))
+		_, _ = w.Write([]byte(fmt.Sprintf("%+v\n", db.Stats())))
 	})
-
-	errCh := make(chan error)
-
-	sv.preparation.Add(1)
-	go func() {
-		laddr := fmt.Sprintf(":%d", sv.conf.PprofPort)
-		log.Infof("game pprof: %#v", laddr)
-
-		sv.preparation.Done()
-		errCh <- http.ListenAndServe(laddr, nil)
-	}()
-
-	return errCh
 }
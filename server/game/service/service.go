@@ -5,46 +5,54 @@ import (
 	"sync"
 	"time"
 
-	"github.com/jmoiron/sqlx"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
 
 	"wsnet2/common"
 	"wsnet2/config"
 	"wsnet2/game"
 	"wsnet2/log"
 	"wsnet2/pb"
-)
-
-const (
-	registerQuery = "" +
-		"INSERT INTO `game_server` (`hostname`, `public_name`, `grpc_port`, `ws_port`, `status`) VALUES (:hostname, :public_name, :grpc_port, :ws_port, :status) " +
-		"ON DUPLICATE KEY UPDATE `public_name`=:public_name, `grpc_port`=:grpc_port, `ws_port`=:ws_port, `status`=:status, id=last_insert_id(id)"
-	heartbeatQuery = "" +
-		"UPDATE `game_server` SET `status`=:status, heartbeat=:now WHERE `id`=:hostid"
+	"wsnet2/storage"
 )
 
 type GameService struct {
 	pb.UnimplementedGameServer
+	pb.UnimplementedGameAdminServer
 
 	HostId int64
 
 	conf  *config.GameConf
 	repos map[pb.AppId]*game.Repository
 
-	db          *sqlx.DB
+	lobbySync    *game.LobbySync
+	roomInfos    *game.RoomInfoWriter
+	playerEvents *game.PlayerEventWriter
+
+	store       storage.Storage
 	preparation sync.WaitGroup
 
 	wsURLFormat string
 
+	cpu cpuMeter
+
+	muGRPC     sync.Mutex
+	grpcServer *grpc.Server
+
+	shutdownMu   sync.Mutex
 	shutdownChan chan struct{}
 	done         chan error
 }
 
-func New(db *sqlx.DB, conf *config.GameConf) (*GameService, error) {
-	hostId, err := registerHost(db, conf)
+func New(store storage.Storage, conf *config.GameConf) (*GameService, error) {
+	hostId, err := registerHost(store, conf)
 	if err != nil {
 		return nil, err
 	}
-	repos, err := game.NewRepos(db, conf, uint32(hostId))
+	lobbySync := game.NewLobbySync(store, conf, uint32(hostId))
+	roomInfos := game.NewRoomInfoWriter(store, conf)
+	playerEvents := game.NewPlayerEventWriter(store, conf)
+	repos, err := game.NewRepos(store, conf, uint32(hostId), lobbySync, roomInfos, playerEvents)
 	if err != nil {
 		return nil, err
 	}
@@ -52,17 +60,36 @@ func New(db *sqlx.DB, conf *config.GameConf) (*GameService, error) {
 		HostId: hostId,
 		conf:   conf,
 		repos:  repos,
-		db:     db,
+		store:  store,
+
+		lobbySync:    lobbySync,
+		roomInfos:    roomInfos,
+		playerEvents: playerEvents,
 
 		shutdownChan: make(chan struct{}),
 		done:         make(chan error),
 	}, nil
 }
 
+// SetBroadcastHook : appのBroadcastの配信先を決めるhookを設定する. Serveの前に呼ぶこと
+func (s *GameService) SetBroadcastHook(appId pb.AppId, hook game.BroadcastHook) error {
+	repo, ok := s.repos[appId]
+	if !ok {
+		return xerrors.Errorf("unknown app: %v", appId)
+	}
+	repo.SetBroadcastHook(hook)
+	return nil
+}
+
 func (s *GameService) Serve(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	go s.lobbySync.Run(ctx)
+
+	go s.roomInfos.Run(ctx)
+	go s.playerEvents.Run(ctx)
+
 	var err error
 	select {
 	case <-ctx.Done():
@@ -72,22 +99,27 @@ func (s *GameService) Serve(ctx context.Context) error {
 	case err = <-s.heartbeat(ctx):
 	case err = <-s.done:
 	}
+
+	// 書き込み待ちの部屋の更新やplayer_eventを書き込んでから終了する
+	cancel()
+	<-s.roomInfos.Done()
+	<-s.playerEvents.Done()
 	return err
 }
 
-func registerHost(db *sqlx.DB, conf *config.GameConf) (int64, error) {
-	bind := map[string]interface{}{
-		"hostname":    conf.Hostname,
-		"public_name": conf.PublicName,
-		"grpc_port":   conf.GRPCPort,
-		"ws_port":     conf.WebsocketPort,
-		"status":      common.HostStatusRunning,
-	}
-	res, err := sqlx.NamedExec(db, registerQuery, bind)
+func registerHost(store storage.Storage, conf *config.GameConf) (int64, error) {
+	id, err := store.RegisterGameServer(context.Background(), &storage.Host{
+		Hostname:      conf.Hostname,
+		PublicName:    conf.PublicName,
+		GRPCPort:      conf.GRPCPort,
+		WebSocketPort: conf.WebsocketPort,
+		Region:        conf.Region,
+		Status:        common.HostStatusRunning,
+	})
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	return int64(id), nil
 }
 
 func (s *GameService) shutdownRequested() bool {
@@ -117,10 +149,7 @@ func (s *GameService) heartbeat(ctx context.Context) <-chan error {
 
 		log.Debugf("heartbeat start")
 		t := time.NewTicker(time.Duration(s.conf.HeartBeatInterval))
-		bind := map[string]interface{}{
-			"hostid": s.HostId,
-			"status": common.HostStatusRunning,
-		}
+		var status int32 = common.HostStatusRunning
 		for {
 			select {
 			case <-ctx.Done():
@@ -128,14 +157,12 @@ func (s *GameService) heartbeat(ctx context.Context) <-chan error {
 			case <-t.C:
 			}
 
-			bind["now"] = time.Now().Unix()
-
 			if s.shutdownRequested() {
-				bind["status"] = common.HostStatusClosing
+				status = common.HostStatusClosing
 				log.Infof("the host is shutting down and waiting for %v rooms to be closed", s.numRooms())
 			}
 
-			if _, err := sqlx.NamedExec(s.db, heartbeatQuery, bind); err != nil {
+			if err := s.store.UpdateGameServer(ctx, uint32(s.HostId), status, time.Now().Unix(), s.load()); err != nil {
 				errCh <- err
 				return
 			}
@@ -149,19 +176,18 @@ func (s *GameService) heartbeat(ctx context.Context) <-chan error {
 func (s *GameService) Shutdown(ctx context.Context) {
 	log.Infof("GameService %v is gracefully shutting down", s.HostId)
 
+	// Drain (gRPC) とシグナルから同時に呼ばれることがある
+	s.shutdownMu.Lock()
 	if s.shutdownRequested() {
+		s.shutdownMu.Unlock()
 		return
 	}
 	close(s.shutdownChan)
+	s.shutdownMu.Unlock()
 	defer close(s.done)
 
 	// Immediately execute a heartbeat query in order not to miss the status update
-	bind := map[string]interface{}{
-		"now":    time.Now().Unix(),
-		"hostid": s.HostId,
-		"status": common.HostStatusClosing,
-	}
-	if _, err := sqlx.NamedExec(s.db, heartbeatQuery, bind); err != nil {
+	if err := s.store.UpdateGameServer(ctx, uint32(s.HostId), common.HostStatusClosing, time.Now().Unix(), s.load()); err != nil {
 		s.done <- err
 		return
 	}
@@ -172,6 +198,7 @@ func (s *GameService) Shutdown(ctx context.Context) {
 	for {
 		if s.numRooms() == 0 {
 			log.Infof("graceful shutdown completed")
+			s.gracefulStopGRPC()
 			s.done <- nil
 			return
 		}
@@ -15,6 +15,7 @@ import (
 	"github.com/shiguredo/websocket"
 	"golang.org/x/xerrors"
 
+	"wsnet2/binary"
 	"wsnet2/game"
 	"wsnet2/log"
 	"wsnet2/metrics"
@@ -26,10 +27,11 @@ const (
 
 var (
 	upgrader = websocket.Upgrader{
-		ReadBufferSize:  4000,
-		WriteBufferSize: 4000,
-		Subprotocols:    []string{"wsnet2"},
-		CheckOrigin:     func(r *http.Request) bool { return true },
+		ReadBufferSize:    4000,
+		WriteBufferSize:   4000,
+		Subprotocols:      binary.Subprotocols(binary.ProtocolVersion1),
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		EnableCompression: true,
 	}
 )
 
@@ -79,8 +81,15 @@ func (sv *GameService) serveWebSocket(ctx context.Context) <-chan error {
 			ReadTimeout:  WebsocketRWTimeout,
 			WriteTimeout: WebsocketRWTimeout,
 		}
+		go func() {
+			<-ctx.Done()
+			svr.Close()
+		}()
+
 		sv.preparation.Done()
-		errCh <- svr.Serve(listener)
+		if err := svr.Serve(listener); err != http.ErrServerClosed {
+			errCh <- err
+		}
 	}()
 
 	return errCh
@@ -141,11 +150,22 @@ func (s *WSHandler) HandleRoom(w http.ResponseWriter, r *http.Request) {
 	metrics.Conns.Add(1)
 	defer metrics.Conns.Add(-1)
 
-	peer, err := game.NewPeer(ctx, cli, conn, lastEvSeq)
+	peer, err := game.NewPeer(ctx, cli, conn, lastEvSeq, repo.CompressionThreshold())
 	if err != nil {
 		logger.Warnf("websocket: NewPeer: %+v", err)
 		return
 	}
+	repo.PlayerEvent(cli, game.PlayerEventConnect, game.PlayerEventDetail{
+		"remote_addr":      r.RemoteAddr,
+		"forwarded_for":    r.Header.Get("X-Forwarded-For"),
+		"client_version":   r.Header.Get("Wsnet2-ClientVersion"),
+		"protocol_version": peer.ProtocolVersion(),
+	})
 	<-peer.Done()
+	repo.PlayerEvent(cli, game.PlayerEventDisconnect, game.PlayerEventDetail{
+		"remote_addr":    r.RemoteAddr,
+		"bytes_sent":     peer.BytesSent(),
+		"bytes_received": peer.BytesReceived(),
+	})
 	logger.Debugf("websocket: finish: room=%v client=%v peer=%p", roomId, clientId, peer)
 }
@@ -0,0 +1,111 @@
+package hub
+
+import (
+	"time"
+
+	"wsnet2/binary"
+	"wsnet2/client"
+)
+
+// delayedEvent : 観戦者への配信を待っているgameからのイベント
+// snapshotは観戦し直した時点の部屋の状態で、配信時にroomを置き換える.
+type delayedEvent struct {
+	due      time.Time
+	ev       binary.Event
+	snapshot *client.Room
+}
+
+// watchDelay : 観戦配信の遅延時間
+// RoomOptionのwatch_delayを優先し、未指定ならpublic propsのWatchDelayPropを使う
+func watchDelay(room *client.Room, max time.Duration) time.Duration {
+	sec := int64(room.WatchDelay)
+	if sec == 0 {
+		if v, ok := room.PublicProps[client.WatchDelayProp]; ok {
+			d, _, err := binary.Unmarshal(v)
+			if err == nil {
+				switch n := d.(type) {
+				case int:
+					sec = int64(n)
+				case int64:
+					sec = n
+				case uint64:
+					sec = int64(n)
+				}
+			}
+		}
+	}
+	if sec <= 0 {
+		return 0
+	}
+	delay := time.Duration(sec) * time.Second
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// enqueueEvent : イベントを遅延キューに積む.
+// キューが空だった場合はタイマーを開始して、そのチャネルを返す.
+func (h *Hub) enqueueEvent(ev binary.Event, timerC <-chan time.Time) <-chan time.Time {
+	return h.enqueue(delayedEvent{ev: ev}, timerC)
+}
+
+func (h *Hub) enqueue(d delayedEvent, timerC <-chan time.Time) <-chan time.Time {
+	d.due = time.Now().Add(h.delay)
+	h.delayed = append(h.delayed, d)
+	if timerC != nil {
+		return timerC
+	}
+	if h.delayTimer == nil {
+		h.delayTimer = time.NewTimer(h.delay)
+	} else {
+		h.delayTimer.Reset(h.delay)
+	}
+	return h.delayTimer.C
+}
+
+// flushDelayed : 期限の来たイベントを観戦者に配信する.
+// キューが残っていれば次の期限でタイマーを再開して、そのチャネルを返す.
+func (h *Hub) flushDelayed() <-chan time.Time {
+	now := time.Now()
+	n := 0
+	for ; n < len(h.delayed); n++ {
+		if h.delayed[n].due.After(now) {
+			break
+		}
+		if s := h.delayed[n].snapshot; s != nil {
+			h.room = s
+			h.notifyGap()
+		} else {
+			h.processEvent(h.delayed[n].ev)
+		}
+		h.delayed[n] = delayedEvent{}
+	}
+	h.delayed = h.delayed[n:]
+
+	if len(h.delayed) == 0 {
+		h.delayed = nil
+		return nil
+	}
+	h.delayTimer.Reset(h.delayed[0].due.Sub(now))
+	return h.delayTimer.C
+}
+
+// delayedLastMsgTimes : 遅延分だけ最終メッセージ時刻をずらす
+// 観戦者から見た時刻が配信済みのイベントと矛盾しないようにする
+func (h *Hub) delayedLastMsgTimes() binary.Dict {
+	if h.delay == 0 || h.room.LastMsgTimes == nil {
+		return h.room.LastMsgTimes
+	}
+	ms := uint64(h.delay.Milliseconds())
+	times := make(binary.Dict, len(h.room.LastMsgTimes))
+	for id, v := range h.room.LastMsgTimes {
+		t, _, err := binary.UnmarshalAs(v, binary.TypeULong)
+		if err != nil {
+			times[id] = v
+			continue
+		}
+		times[id] = binary.MarshalULong(t.(uint64) + ms)
+	}
+	return times
+}
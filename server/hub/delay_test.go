@@ -0,0 +1,119 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"wsnet2/binary"
+	"wsnet2/client"
+	"wsnet2/pb"
+)
+
+func TestWatchDelay(t *testing.T) {
+	tests := map[string]struct {
+		watchDelay uint32
+		prop       []byte
+		max        time.Duration
+		exp        time.Duration
+	}{
+		"none":        {exp: 0},
+		"option":      {watchDelay: 5, exp: 5 * time.Second},
+		"option>prop": {watchDelay: 5, prop: binary.MarshalInt(10), exp: 5 * time.Second},
+		"prop int":    {prop: binary.MarshalInt(10), exp: 10 * time.Second},
+		"prop long":   {prop: binary.MarshalLong(20), exp: 20 * time.Second},
+		"prop ulong":  {prop: binary.MarshalULong(30), exp: 30 * time.Second},
+		"prop minus":  {prop: binary.MarshalInt(-1), exp: 0},
+		"prop str":    {prop: binary.MarshalStr8("10"), exp: 0},
+		"max":         {watchDelay: 600, max: time.Minute, exp: time.Minute},
+		"no max":      {watchDelay: 600, exp: 10 * time.Minute},
+	}
+
+	for k, test := range tests {
+		room := newTestRoom(test.watchDelay)
+		if test.prop != nil {
+			room.PublicProps = binary.Dict{client.WatchDelayProp: test.prop}
+		}
+		if d := watchDelay(room, test.max); d != test.exp {
+			t.Errorf("%s: watchDelay = %v, wants %v", k, d, test.exp)
+		}
+	}
+}
+
+func TestDelayedEvents(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	h := newTestHub(t, nil, time.Minute)
+	h.delay = delay
+	h.live = newTestRoom(0)
+	h.room = h.live.Clone()
+	h.room.Players = make(map[string]*client.Player)
+
+	joined := func(id string) binary.Event {
+		return binary.NewEvJoined(&pb.ClientInfo{Id: id, Props: binary.MarshalNull()})
+	}
+
+	// 最初のイベントでタイマーを開始し、以降は同じタイマーを使う
+	timerC := h.enqueueEvent(joined("p1"), nil)
+	if timerC == nil {
+		t.Fatalf("timer must be started")
+	}
+	if c := h.enqueueEvent(joined("p2"), timerC); c != timerC {
+		t.Fatalf("timer must be reused")
+	}
+	snapshot := newTestRoom(0)
+	h.enqueue(delayedEvent{snapshot: snapshot}, timerC)
+	if len(h.delayed) != 3 {
+		t.Fatalf("delayed = %v, wants 3", len(h.delayed))
+	}
+
+	// 期限前は配信しない
+	if c := h.flushDelayed(); c == nil {
+		t.Fatalf("timer must be restarted while events remain")
+	}
+	if len(h.delayed) != 3 || len(h.room.Players) != 0 {
+		t.Fatalf("events delivered before due: delayed=%v players=%v", len(h.delayed), h.room.Players)
+	}
+
+	// 期限が来たら積んだ順に配信し、snapshotで観戦し直した部屋の状態に置き換える
+	start := time.Now()
+	<-timerC
+	if d := time.Since(start); d > delay*2 {
+		t.Fatalf("timer fired after %v, wants %v", d, delay)
+	}
+	if c := h.flushDelayed(); c != nil {
+		t.Fatalf("timer must stop when the queue is empty")
+	}
+	if h.delayed != nil {
+		t.Fatalf("delayed = %v, wants empty", h.delayed)
+	}
+	if h.room != snapshot {
+		t.Fatalf("room must be replaced with the snapshot")
+	}
+}
+
+func TestDelayedLastMsgTimes(t *testing.T) {
+	h := newTestHub(t, nil, time.Minute)
+	h.room = newTestRoom(0)
+	h.room.LastMsgTimes = binary.Dict{
+		"p1":  binary.MarshalULong(1000),
+		"bad": binary.MarshalStr8("x"),
+	}
+
+	// 遅延しなければそのまま
+	if times := h.delayedLastMsgTimes(); times["p1"][0] != h.room.LastMsgTimes["p1"][0] || len(times) != 2 {
+		t.Fatalf("times without delay = %v", times)
+	}
+
+	h.delay = 2 * time.Second
+	times := h.delayedLastMsgTimes()
+	v, _, err := binary.UnmarshalAs(times["p1"], binary.TypeULong)
+	if err != nil || v.(uint64) != 3000 {
+		t.Fatalf("p1 = %v (%v), wants 3000", v, err)
+	}
+	if string(times["bad"]) != string(h.room.LastMsgTimes["bad"]) {
+		t.Fatalf("undecodable value must be kept: %v", times["bad"])
+	}
+	// 元の値は変えない
+	if v, _, _ := binary.UnmarshalAs(h.room.LastMsgTimes["p1"], binary.TypeULong); v.(uint64) != 1000 {
+		t.Fatalf("original p1 = %v, wants 1000", v)
+	}
+}
@@ -7,9 +7,7 @@ import (
 	"sync/atomic"
 	"time"
 
-	"go.uber.org/zap"
 	"golang.org/x/xerrors"
-	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 
 	"wsnet2/binary"
@@ -27,77 +25,119 @@ type Hub struct {
 	appId    AppID
 	clientId string
 
+	// 上流 (gameまたは親hub) の接続先
+	grpcHost string
+	wsHost   string
+	parent   *ParentHub
+
+	// live : gameから受け取った最新の部屋の状態
+	// room : 観戦者に配信済みの部屋の状態. 遅延なしの場合はliveと同じ
+	live *client.Room
 	room *client.Room
-	conn *client.Connection
+	conn atomic.Pointer[client.Connection]
+
+	// 上流に観戦し直している間に観戦者から受け取ったメッセージ
+	reconnecting bool
+	pending      []binary.RegularMsg
+
+	// resuming : 上流との接続の続きから再開して、EvPeerReadyを待っている
+	// resumeSeq : 直近に再開したときの受信済みEventの通番
+	resuming  bool
+	resumeSeq int
+
+	// 観戦者への配信遅延
+	delay      time.Duration
+	delayed    []delayedEvent
+	delayTimer *time.Timer
 
 	msgCh chan game.Msg
-	done  <-chan struct{}
+	done  chan struct{}
+
+	// hubの停止 (see: Shutdown)
+	shutdownCh chan time.Duration
+	closing    bool
+	left       bool
 
 	watchers map[ClientID]*game.Client
 	wgClient sync.WaitGroup
 
-	// game に通知した直近の nodeCount
-	lastNodeCount    uint32
-	nodeCount        atomic.Uint32
-	nodeCountUpdated chan struct{}
+	// game (または親hub) に通知した直近の nodeCount と通知した接続
+	lastNodeCount     uint32
+	lastNodeCountConn *client.Connection
+	nodeCount         atomic.Uint32
+	nodeCountUpdated  chan struct{}
+
+	// DBに記録した直近の直接接続している観戦者数
+	lastWatcherCount uint32
+	watcherCount     atomic.Uint32
 
 	logger log.Logger
 }
 
 var _ game.IRoom = &Hub{}
 
-func NewHub(repo *Repository, pk int64, appid AppID, roomid RoomID, grpc *grpc.ClientConn, wsHost string, logger log.Logger) (*Hub, error) {
+func NewHub(repo *Repository, pk int64, appid AppID, roomid RoomID, grpcHost, wsHost string, parent *ParentHub, logger log.Logger) (*Hub, error) {
 	// hub->game 接続に使うclientId. このhubを作成するトリガーになったclientIdは使わない
 	// roomIdもhostIdもユニークなので hostId:roomId はユニークになるはず。
 	clientid := fmt.Sprintf("hub:%d:%s", repo.hostId, roomid)
-	clinfo := &pb.ClientInfo{
-		Id:    clientid,
-		IsHub: true,
-	}
-
-	ctx := context.Background() // hubの寿命はリクエストなどに紐付かない
-
-	lg := logger.WithOptions(zap.AddCallerSkip(1))
-	room, conn, err := client.WatchDirect(
-		ctx, grpc, wsHost, appid, string(roomid), clinfo,
-		func(err error) { lg.Warnf("%v: %v", clientid, err) })
-	if err != nil {
-		return nil, xerrors.Errorf("client.WatchDirect: %w", err)
-	}
-
-	done := make(chan struct{})
-	go func() {
-		msg, err := conn.Wait(ctx)
-		close(done)
-		if err != nil {
-			logger.Errorf("connection closed with error: room=%v %v, %+v", roomid, msg, err)
-		} else {
-			logger.Infof("connection closed: room=%v %v", roomid, msg)
-		}
-	}()
 
 	hub := &Hub{
 		repo:     repo,
 		hubPK:    pk,
 		roomId:   roomid,
+		appId:    appid,
 		clientId: clientid,
-		room:     room,
-		conn:     conn,
+		grpcHost: grpcHost,
+		wsHost:   wsHost,
+		parent:   parent,
 		msgCh:    make(chan game.Msg, game.RoomMsgChSize),
-		done:     done,
+		done:     make(chan struct{}),
 		watchers: make(map[ClientID]*game.Client),
 
+		shutdownCh: make(chan time.Duration, 1),
+
 		nodeCountUpdated: make(chan struct{}, 1),
 
 		logger: logger,
 	}
 
+	// hubの寿命はリクエストなどに紐付かない
+	room, conn, err := hub.connect(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	hub.conn.Store(conn)
+	hub.initRoom(room)
+
 	go hub.ProcessLoop()
 	go hub.nodeCountUpdater()
 
 	return hub, nil
 }
 
+// initRoom : 上流から受け取った部屋の状態と配信遅延を設定する.
+// 多段hubでは親hubが遅延させたイベントを受け取るので、遅延はgameに接続するhubでのみ行う
+func (h *Hub) initRoom(room *client.Room) {
+	h.live = room
+	h.room = room
+	if h.parent == nil {
+		h.delay = watchDelay(room, time.Duration(h.repo.conf.MaxWatchDelay))
+	}
+	if h.delay > 0 {
+		h.room = room.Clone()
+		h.logger.Infof("watch delay: room=%v %v", h.roomId, h.delay)
+	}
+}
+
+// watchDelaySec : 観戦者に通知する配信遅延 (秒).
+// 子hubは遅延させないので、親hubから通知された遅延をそのまま伝える
+func (h *Hub) watchDelaySec() uint32 {
+	if h.parent != nil {
+		return h.live.WatchDelay
+	}
+	return uint32(h.delay / time.Second)
+}
+
 func (h *Hub) ID() RoomID {
 	return h.roomId
 }
@@ -111,7 +151,7 @@ func (h *Hub) Repo() game.IRepo {
 }
 
 func (h *Hub) Deadline() time.Duration {
-	return time.Duration(h.room.ClientDeadline) * time.Second
+	return time.Duration(h.live.ClientDeadline) * time.Second
 }
 
 func (h *Hub) WaitGroup() *sync.WaitGroup {
@@ -133,6 +173,44 @@ func (h *Hub) SendMessage(msg game.Msg) {
 	}
 }
 
+// Shutdown : 観戦者にEvTypeRewatchを送り、grace経過後または観戦者がいなくなったらgameから退室する
+func (h *Hub) Shutdown(grace time.Duration) {
+	select {
+	case h.shutdownCh <- grace:
+	default:
+	}
+}
+
+func (h *Hub) startShutdown(grace time.Duration) <-chan time.Time {
+	if h.closing {
+		return nil
+	}
+	h.closing = true
+	h.logger.Infof("hub shutting down: room=%v grace=%v", h.roomId, grace)
+
+	ev := binary.NewEvRewatch(grace)
+	for _, c := range h.watchers {
+		c.SendSystemEvent(ev)
+	}
+	if len(h.watchers) == 0 {
+		h.leave("hub shutdown")
+		return nil
+	}
+	return time.After(grace)
+}
+
+// leave : gameから退室する. 接続が閉じるとProcessLoopが終了する
+func (h *Hub) leave(cause string) {
+	if h.left {
+		return
+	}
+	h.left = true
+	h.logger.Infof("hub leave: room=%v %v", h.roomId, cause)
+	if err := h.upstream().Send(binary.MsgTypeLeave, binary.MarshalLeavePayload(cause)); err != nil {
+		h.logger.Errorf("send leave: %+v", err)
+	}
+}
+
 func (h *Hub) removeWatcher(cid game.ClientID, cause string) {
 	c, ok := h.watchers[cid]
 	if !ok {
@@ -142,9 +220,14 @@ func (h *Hub) removeWatcher(cid game.ClientID, cause string) {
 
 	h.logger.Infof("Watcher removed: client=%v %v", cid, cause)
 	delete(h.watchers, cid)
+	h.watcherCount.Store(uint32(len(h.watchers)))
 	h.storeNodeCount()
 
 	c.Removed(cause)
+
+	if h.closing && len(h.watchers) == 0 {
+		h.leave("hub shutdown: all watchers left")
+	}
 }
 
 func (h *Hub) storeNodeCount() {
@@ -169,13 +252,20 @@ func (h *Hub) nodeCountUpdater() {
 		case <-h.nodeCountUpdated:
 		}
 
+		if watchers := h.watcherCount.Load(); watchers != h.lastWatcherCount {
+			// hub_max_watchersとの比較に使うので、子hubの観戦者は含めず直接の接続数を記録する
+			h.repo.updateHubWatchers(h, int(watchers))
+			h.lastWatcherCount = watchers
+		}
+
+		// 観戦し直した場合は新しい接続で通知し直す
+		conn := h.upstream()
 		count := h.nodeCount.Load()
-		if count == h.lastNodeCount {
+		if count == h.lastNodeCount && conn == h.lastNodeCountConn {
 			continue
 		}
 
-		h.repo.updateHubWatchers(h, int(count))
-		if err := h.conn.SendSystemMsg(binary.NewMsgNodeCount(count)); err != nil {
+		if err := conn.SendSystemMsg(binary.NewMsgNodeCount(count)); err != nil {
 			h.logger.Errorf("send nodecount: %+v", err)
 
 			// retry after interval
@@ -185,6 +275,7 @@ func (h *Hub) nodeCountUpdater() {
 			}
 		} else {
 			h.lastNodeCount = count
+			h.lastNodeCountConn = conn
 		}
 
 		select {
@@ -196,26 +287,86 @@ func (h *Hub) nodeCountUpdater() {
 }
 
 // ProcessLoop goroutine dispatch messages and events.
+// gameとの接続が切れても、観戦し直している間や遅延中のイベントを配信し終えるまでは終了しない.
 func (h *Hub) ProcessLoop() {
-Loop:
-	for {
+	events := h.upstream().Events()
+	var timerC, graceC <-chan time.Time
+	var reconnCh chan *reconnected
+	for events != nil || reconnCh != nil || len(h.delayed) > 0 {
 		select {
 		case msg := <-h.msgCh:
 			h.dispatchMsg(msg)
-		case ev, ok := <-h.conn.Events():
+		case ev, ok := <-events:
 			if !ok {
 				h.logger.Debugf("connection events closed")
-				break Loop
+				events = nil
+				if h.resuming {
+					// 続きのEventを受け取れなかったので、観戦し直す
+					h.resuming = false
+					if h.resumeFailed() {
+						reconnCh = make(chan *reconnected, 1)
+						go h.reconnect(reconnCh)
+					} else {
+						h.reconnecting = false
+						h.pending = nil
+					}
+					continue
+				}
+				if h.upstreamClosed() {
+					// 観戦者は切断せずに上流との接続を再開する
+					h.reconnecting = true
+					if h.shouldResume(h.upstream().LastEventSeq()) {
+						events = h.resume()
+						continue
+					}
+					reconnCh = make(chan *reconnected, 1)
+					go h.reconnect(reconnCh)
+				}
+				continue
+			}
+			if h.resuming && ev.Type() == binary.EvTypePeerReady {
+				h.resumed()
+			}
+			if ev.Type() == binary.EvTypeRewatch {
+				// 親hubが停止するので、このhubも観戦者に観戦し直してもらう
+				grace, err := binary.UnmarshalEvRewatchPayload(ev.Payload())
+				if err != nil {
+					h.logger.Errorf("rewatch event: %+v", err)
+				}
+				graceC = h.startShutdown(grace)
+				continue
 			}
-			if err := h.room.Update(ev); err != nil {
-				h.logger.Errorf("room update: %+v", err)
+			if h.delay == 0 {
+				h.processEvent(ev)
+				continue
 			}
-			if binary.IsRegularEvent(ev) {
-				h.logger.Debugf("broadcast: %v", ev.Type())
-				h.broadcast(ev.(*binary.RegularEvent))
+			if err := h.live.Update(ev); err != nil {
+				h.logger.Errorf("live room update: %+v", err)
 			}
+			timerC = h.enqueueEvent(ev, timerC)
+		case r := <-reconnCh:
+			reconnCh = nil
+			h.reconnecting = false
+			if r == nil {
+				h.logger.Errorf("give up reconnecting upstream: room=%v", h.roomId)
+				h.pending = nil
+				continue
+			}
+			h.resync(r)
+			events = r.conn.Events()
+			if h.delay > 0 {
+				timerC = h.enqueue(delayedEvent{snapshot: r.room.Clone()}, timerC)
+			}
+		case <-timerC:
+			timerC = h.flushDelayed()
+		case grace := <-h.shutdownCh:
+			graceC = h.startShutdown(grace)
+		case <-graceC:
+			graceC = nil
+			h.leave("hub shutdown: grace period expired")
 		}
 	}
+	close(h.done)
 	h.drainMsg()
 	h.logger.Debug("Hub.ProcessLoop() finish")
 }
@@ -239,6 +390,17 @@ func (h *Hub) drainMsg() {
 	}
 }
 
+// processEvent : 観戦者から見える部屋の状態を更新して配信する
+func (h *Hub) processEvent(ev binary.Event) {
+	if err := h.room.Update(ev); err != nil {
+		h.logger.Errorf("room update: %+v", err)
+	}
+	if binary.IsRegularEvent(ev) {
+		h.logger.Debugf("broadcast: %v", ev.Type())
+		h.broadcast(ev.(*binary.RegularEvent))
+	}
+}
+
 func (h *Hub) dispatchMsg(msg game.Msg) {
 	switch m := msg.(type) {
 	case *game.MsgWatch:
@@ -247,6 +409,8 @@ func (h *Hub) dispatchMsg(msg game.Msg) {
 		h.msgLeave(m)
 	case *game.MsgPing:
 		h.msgPing(m)
+	case *game.MsgNodeCount:
+		h.msgNodeCount(m)
 	case *game.MsgClientError:
 		h.msgClientError(m)
 	case *game.MsgClientTimeout:
@@ -260,8 +424,26 @@ func (h *Hub) dispatchMsg(msg game.Msg) {
 		m.Sender.Logger().Debugf("message to master: %v", m.Data)
 		h.proxyMessage(m.RegularMsg)
 	case *game.MsgBroadcast:
+		if m.Scope != binary.BroadcastScopeAll {
+			// 配信先の限定はMasterのみ可能なので観戦者からは受け付けない
+			m.Sender.Logger().Warnf("scoped broadcast from watcher is not allowed")
+			if err := m.Sender.Send(binary.NewEvPermissionDenied(m)); err != nil {
+				h.removeWatcher(m.Sender.ID(), err.Error())
+			}
+			break
+		}
 		m.Sender.Logger().Debugf("message to all: %v", m.Data)
 		h.proxyMessage(m.RegularMsg)
+	case *game.MsgWatcherChat:
+		h.msgWatcherChat(m)
+	case *game.MsgSubscribe:
+		h.msgSubscribe(m)
+	case *game.MsgRoomKey:
+		// 部屋鍵はプレイヤー間でのみ受け渡す
+		m.Sender.Logger().Warnf("room key from watcher is not allowed")
+		if err := m.Sender.Send(binary.NewEvPermissionDenied(m)); err != nil {
+			h.removeWatcher(m.Sender.ID(), err.Error())
+		}
 
 	default:
 		h.logger.Errorf("unknown msg type: %T %v", m, m)
@@ -269,10 +451,35 @@ func (h *Hub) dispatchMsg(msg game.Msg) {
 }
 
 // broadcast : 全員に送信.
+// プレイヤーのみに限定されたイベント (binary.BroadcastScopePlayers) はgameからhubに届かないので
+// 届いたイベントは全て観戦者に配信してよい.
 func (h *Hub) broadcast(ev *binary.RegularEvent) {
+	// トピック付きのBroadcastは購読している観戦者にだけ送る
+	var topic string
+	var fallback *binary.RegularEvent
+	if ev.Type() == binary.EvTypeTopicMessage {
+		t, msg, err := binary.UnmarshalEvTopicMessage(ev.Payload())
+		if err != nil {
+			h.logger.Errorf("topic message: %+v", err)
+			return
+		}
+		topic = t
+		fallback = binary.NewRegularEvent(binary.EvTypeMessage, msg)
+	}
+
 	errs := map[game.ClientID]string{}
 	for _, c := range h.watchers {
-		err := c.Send(ev)
+		if !c.Subscribes(topic) {
+			continue
+		}
+		e := ev
+		if !c.CanReceive(e.Type()) {
+			if fallback == nil {
+				continue
+			}
+			e = fallback
+		}
+		err := c.Send(e)
 		if err != nil {
 			errs[c.ID()] = err.Error()
 		}
@@ -283,7 +490,13 @@ func (h *Hub) broadcast(ev *binary.RegularEvent) {
 }
 
 func (h *Hub) msgWatch(msg *game.MsgWatch) {
-	if !h.room.Watchable {
+	if h.closing {
+		err := xerrors.Errorf("Hub is shutting down. room=%v, client=%v", h.ID(), msg.Info.Id)
+		h.logger.Info(err.Error())
+		msg.Err <- game.WithCode(err, codes.Unavailable)
+		return
+	}
+	if !h.live.Watchable {
 		err := xerrors.Errorf("Room is not watchable. room=%v, client=%v", h.ID(), msg.Info.Id)
 		h.logger.Info(err.Error())
 		msg.Err <- game.WithCode(err, codes.FailedPrecondition)
@@ -291,14 +504,14 @@ func (h *Hub) msgWatch(msg *game.MsgWatch) {
 	}
 
 	// Playerとして参加中の観戦は不許可
-	if _, ok := h.room.Players[string(msg.SenderID())]; ok {
+	if _, ok := h.live.Players[string(msg.SenderID())]; ok {
 		err := xerrors.Errorf("Watcher already exists as a player. room=%v, client=%v", h.ID(), msg.SenderID())
 		h.logger.Warn(err.Error())
 		msg.Err <- game.WithCode(err, codes.AlreadyExists)
 		return
 	}
 
-	client, err := game.NewWatcher(msg.Info, msg.MACKey, h)
+	client, err := game.NewWatcher(msg.Info, msg.MACKey, msg.MACScheme, h)
 	if err != nil {
 		err = game.WithCode(
 			xerrors.Errorf("NewWatcher error. room=%v, client=%v: %w", h.ID(), msg.Info.Id, err),
@@ -309,6 +522,7 @@ func (h *Hub) msgWatch(msg *game.MsgWatch) {
 	}
 	oldc, rejoin := h.watchers[client.ID()]
 	h.watchers[client.ID()] = client
+	h.watcherCount.Store(uint32(len(h.watchers)))
 	if rejoin {
 		oldc.Removed("client rejoined as a new client")
 		client.Logger().Infof("rejoin watcher: %v", client.Id)
@@ -331,6 +545,9 @@ func (h *Hub) msgWatch(msg *game.MsgWatch) {
 		Watchers:     h.room.Watchers,
 		PublicProps:  binary.MarshalDict(h.room.PublicProps),
 		PrivateProps: binary.MarshalDict(h.room.PrivateProps),
+		WatchDelay:   h.watchDelaySec(),
+
+		WatcherChatDisabled: !h.room.WatcherChat,
 	}
 	rinfo.SetCreated(h.room.Created)
 
@@ -348,6 +565,8 @@ func (h *Hub) msgWatch(msg *game.MsgWatch) {
 		Client:   client,
 		MasterId: game.ClientID(h.room.Master.Id),
 		Deadline: h.Deadline(),
+		// 観戦者に配信済みの時点のroom stateを渡すので、gameへの問い合わせは不要
+		State: binary.MarshalDict(h.room.State),
 	}
 }
 
@@ -360,10 +579,79 @@ func (h *Hub) msgPing(msg *game.MsgPing) {
 		return
 	}
 	msg.Sender.Logger().Debugf("ping %v: %v", msg.Sender.Id, msg.Timestamp)
-	ev := binary.NewEvPong(msg.Timestamp, h.room.Watchers, h.room.LastMsgTimes)
+	ev := binary.NewEvPong(msg.Timestamp, h.room.Watchers, h.delayedLastMsgTimes())
 	msg.Sender.SendSystemEvent(ev)
 }
 
+// msgNodeCount : 子hubの観戦者数を集計して上流に伝える
+func (h *Hub) msgNodeCount(msg *game.MsgNodeCount) {
+	c := msg.Sender
+	if h.watchers[c.ID()] != c || !c.IsHub {
+		return
+	}
+	if c.NodeCount() == msg.Count {
+		return
+	}
+	c.Logger().Debugf("nodeCount %v: %v -> %v", c.Id, c.NodeCount(), msg.Count)
+	c.SetNodeCount(msg.Count)
+	h.storeNodeCount()
+}
+
+// msgWatcherChat : 観戦者同士のチャット. gameには転送せずhub内で配信する.
+func (h *Hub) msgWatcherChat(msg *game.MsgWatcherChat) {
+	if h.watchers[msg.SenderID()] != msg.Sender {
+		return
+	}
+	if !h.live.WatcherChat {
+		msg.Sender.Logger().Infof("watcher chat is disabled")
+		if err := msg.Sender.Send(binary.NewEvPermissionDenied(msg)); err != nil {
+			h.removeWatcher(msg.Sender.ID(), err.Error())
+		}
+		return
+	}
+	if !msg.Sender.AllowWatcherChat() {
+		msg.Sender.Logger().Infof("watcher chat rate limited")
+		if err := msg.Sender.Send(binary.NewEvPermissionDenied(msg)); err != nil {
+			h.removeWatcher(msg.Sender.ID(), err.Error())
+		}
+		return
+	}
+
+	msg.Sender.Logger().Debugf("watcher chat: %v", msg.Data)
+
+	ev := binary.NewEvWatcherMessage(msg.Sender.Id, msg.Data)
+	errs := map[game.ClientID]string{}
+	for _, c := range h.watchers {
+		if c.IsHub || !c.CanReceive(ev.Type()) {
+			continue
+		}
+		if err := c.Send(ev); err != nil {
+			errs[c.ID()] = err.Error()
+		}
+	}
+	for id, msg := range errs {
+		h.removeWatcher(id, msg)
+	}
+}
+
+// msgSubscribe : 観戦者の購読トピックの設定. gameには転送せずhub内で振り分ける.
+func (h *Hub) msgSubscribe(msg *game.MsgSubscribe) {
+	if h.watchers[msg.SenderID()] != msg.Sender {
+		return
+	}
+	if msg.Sender.IsHub {
+		// 子hubは全トピックを受け取って振り分ける
+		msg.Sender.Logger().Warnf("subscribe from hub is not allowed")
+		if err := msg.Sender.Send(binary.NewEvPermissionDenied(msg)); err != nil {
+			h.removeWatcher(msg.Sender.ID(), err.Error())
+		}
+		return
+	}
+
+	msg.Sender.Logger().Debugf("subscribe: %v", msg.Topics)
+	msg.Sender.SetTopics(msg.Topics)
+}
+
 func (h *Hub) msgClientError(msg *game.MsgClientError) {
 	h.removeWatcher(msg.Sender.ID(), msg.ErrMsg)
 }
@@ -374,7 +662,15 @@ func (h *Hub) msgClientTimeout(msg *game.MsgClientTimeout) {
 
 // clientから受け取った RegularMsg を gameサーバーに転送する
 func (h *Hub) proxyMessage(msg binary.RegularMsg) {
-	err := h.conn.Send(msg.Type(), msg.Payload())
+	if h.reconnecting {
+		if len(h.pending) >= h.repo.conf.EventBufSize {
+			h.logger.Warnf("pending message buffer is full: discard %v", msg.Type())
+			return
+		}
+		h.pending = append(h.pending, msg)
+		return
+	}
+	err := h.upstream().Send(msg.Type(), msg.Payload())
 	if err != nil {
 		h.logger.Errorf("send message: %+v", err)
 	}
@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"wsnet2/client"
+	"wsnet2/config"
+	"wsnet2/game"
+	"wsnet2/log"
+)
+
+func newTestHub(t *testing.T, parent *ParentHub, maxDelay time.Duration) *Hub {
+	t.Cleanup(log.InitLogger(&config.LogConf{LogStdoutLevel: uint32(log.ERROR)}))
+	return &Hub{
+		repo:             &Repository{conf: &config.HubConf{MaxWatchDelay: config.Duration(maxDelay)}},
+		roomId:           "room1",
+		appId:            "app1",
+		parent:           parent,
+		watchers:         make(map[ClientID]*game.Client),
+		nodeCountUpdated: make(chan struct{}, 1),
+		logger:           log.Get(log.ERROR),
+	}
+}
+
+func newTestRoom(watchDelay uint32) *client.Room {
+	return &client.Room{
+		Id:         "room1",
+		WatchDelay: watchDelay,
+		Players:    make(map[string]*client.Player),
+	}
+}
+
+func TestInitRoomDelayOnlyAtRoot(t *testing.T) {
+	// gameに接続するhubが遅延させる
+	root := newTestHub(t, nil, time.Minute)
+	room := newTestRoom(3)
+	root.initRoom(room)
+	if root.delay != 3*time.Second {
+		t.Fatalf("root delay = %v, wants 3s", root.delay)
+	}
+	if root.live != room || root.room == room {
+		t.Fatalf("root must keep the delivered room apart from the live room")
+	}
+	if d := root.watchDelaySec(); d != 3 {
+		t.Fatalf("root watchDelaySec = %v, wants 3", d)
+	}
+
+	// 子hubは親hubが遅延させたイベントをそのまま配信する
+	child := newTestHub(t, &ParentHub{GRPCHost: "parent:19000", WSHost: "parent:8000"}, time.Minute)
+	room = newTestRoom(3)
+	child.initRoom(room)
+	if child.delay != 0 {
+		t.Fatalf("child delay = %v, wants 0", child.delay)
+	}
+	if child.live != room || child.room != room {
+		t.Fatalf("child must deliver the live room")
+	}
+	// 観戦者には親hubから通知された遅延を伝える
+	if d := child.watchDelaySec(); d != 3 {
+		t.Fatalf("child watchDelaySec = %v, wants 3", d)
+	}
+}
@@ -5,18 +5,19 @@ import (
 	"sync"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	"golang.org/x/xerrors"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
 
+	"wsnet2/auth"
 	"wsnet2/common"
 	"wsnet2/config"
 	"wsnet2/game"
 	"wsnet2/log"
 	"wsnet2/metrics"
 	"wsnet2/pb"
+	"wsnet2/storage"
 )
 
 type AppID = pb.AppId
@@ -27,26 +28,27 @@ type Repository struct {
 	hostId uint32
 
 	conf     *config.HubConf
-	db       *sqlx.DB
+	store    storage.Storage
 	grpcPool *common.GrpcPool
 
-	muhubs sync.RWMutex
-	hubs   map[RoomID]*Hub
+	muhubs  sync.RWMutex
+	hubs    map[RoomID]*Hub
+	closing bool
 
 	muclients sync.RWMutex
 	clients   map[ClientID]map[RoomID]*game.Client
 }
 
-func NewRepository(db *sqlx.DB, conf *config.HubConf, hostId uint32) (*Repository, error) {
+func NewRepository(store storage.Storage, conf *config.HubConf, hostId uint32) (*Repository, error) {
 	// レコードが残っていると再起動したとき元いた部屋に入れないので削除しておく
-	if _, err := db.Exec("DELETE FROM hub WHERE `host_id` = ?", hostId); err != nil {
+	if err := store.DeleteHostHubs(context.Background(), hostId); err != nil {
 		return nil, xerrors.Errorf("delete rooms: %w", err)
 	}
 
 	repo := &Repository{
 		hostId:   hostId,
 		conf:     conf,
-		db:       db,
+		store:    store,
 		grpcPool: common.NewGrpcPool(grpc.WithTransportCredentials(insecure.NewCredentials())),
 
 		hubs:    make(map[RoomID]*Hub),
@@ -55,64 +57,45 @@ func NewRepository(db *sqlx.DB, conf *config.HubConf, hostId uint32) (*Repositor
 	return repo, nil
 }
 
-func (r *Repository) insertHub(ctx context.Context, tx sqlx.ExecerContext, roomId RoomID) (int64, error) {
-	res, err := tx.ExecContext(ctx,
-		"INSERT INTO `hub` (`host_id`, `room_id`, `watchers`, `created`) VALUES (?,?,?,?)",
-		r.hostId, string(roomId), 0, time.Now().UTC())
-	if err != nil {
-		return 0, err
-	}
-	return res.LastInsertId()
-}
-
 func (r *Repository) deleteHub(hub *Hub) {
-	_, err := r.db.Exec("DELETE FROM `hub` WHERE `id` = ?", hub.hubPK)
+	err := r.store.DeleteHub(context.Background(), hub.hubPK)
 	if err != nil {
 		hub.logger.Errorf("delete from db: %v", err)
 	}
 }
 
 func (r *Repository) updateHubWatchers(hub *Hub, watchers int) {
-	_, err := r.db.Exec("UPDATE `hub` SET `watchers`= ? WHERE `id` = ?", watchers, hub.hubPK)
+	err := r.store.UpdateHubWatchers(context.Background(), hub.hubPK, watchers)
 	if err != nil {
 		hub.logger.Errorf("update hub.watchers: %v", err)
 	}
 }
 
-func (r *Repository) getOrCreateHub(ctx context.Context, appId AppID, roomId RoomID, grpcHost, wsHost string) (_ *Hub, err error) {
+func (r *Repository) getOrCreateHub(ctx context.Context, appId AppID, roomId RoomID, grpcHost, wsHost string, parent *ParentHub) (_ *Hub, err error) {
 	r.muhubs.Lock()
 	defer r.muhubs.Unlock()
 	hub, ok := r.hubs[roomId]
 	if !ok {
+		if r.closing {
+			return nil, xerrors.Errorf("hub server is shutting down")
+		}
+
 		logger := log.Get(log.CurrentLevel()).With(log.KeyApp, appId, log.KeyRoom, roomId)
 		logger.Infof("create new hub: app=%v room=%v", appId, roomId)
 
-		grpc, err := r.grpcPool.Get(grpcHost)
-		if err != nil {
-			return nil, xerrors.Errorf("grpcPool get: %w", err)
-		}
-
-		tx, err := r.db.Begin()
-		if err != nil {
-			return nil, xerrors.Errorf("db.Begin: %w", err)
-		}
-		pk, err := r.insertHub(ctx, tx, roomId)
+		pk, err := r.store.InsertHub(ctx, r.hostId, string(roomId))
 		if err != nil {
-			tx.Rollback()
 			return nil, xerrors.Errorf("insert into hub: %w", err)
 		}
 
-		hub, err = NewHub(r, pk, appId, roomId, grpc, wsHost, logger)
+		hub, err = NewHub(r, pk, appId, roomId, grpcHost, wsHost, parent, logger)
 		if err != nil {
-			tx.Rollback()
+			if err := r.store.DeleteHub(context.Background(), pk); err != nil {
+				logger.Errorf("delete from db: %v", err)
+			}
 			return nil, xerrors.Errorf("new hub: %w", err)
 		}
 
-		err = tx.Commit()
-		if err != nil {
-			return nil, xerrors.Errorf("commit: %w", err)
-		}
-
 		r.hubs[roomId] = hub
 		metrics.Hubs.Add(1)
 
@@ -128,10 +111,37 @@ func (r *Repository) getOrCreateHub(ctx context.Context, appId AppID, roomId Roo
 	return hub, nil
 }
 
-func (r *Repository) WatchRoom(ctx context.Context, appId AppID, roomId RoomID, client *pb.ClientInfo, grpcHost, wsHost, macKey string) (*pb.JoinedRoomRes, game.ErrorWithCode) {
+// checkBan : app全体かroomIdの部屋からbanされているuserの観戦を拒否する.
+// hubはlobbyのbanのキャッシュを持たないので、観戦の度にDBを確認する.
+func (r *Repository) checkBan(ctx context.Context, appId AppID, roomId RoomID, userId string) game.ErrorWithCode {
+	now := time.Now()
+	bans, err := r.store.Bans(ctx, &storage.BanFilter{AppId: string(appId), UserId: userId, ActiveAt: &now})
+	if err != nil {
+		return game.WithCode(xerrors.Errorf("get bans: %w", err), codes.Internal)
+	}
+	for _, b := range bans {
+		if b.RoomID == "" || b.RoomID == string(roomId) {
+			return game.WithCode(
+				xerrors.Errorf("user %v is banned from room %v: %v", userId, roomId, b.Reason),
+				codes.PermissionDenied)
+		}
+	}
+	return nil
+}
+
+// WatchRoom : 観戦する. parentが指定された場合、新しく作るhubはgameではなく親hubに接続する.
+func (r *Repository) WatchRoom(ctx context.Context, appId AppID, roomId RoomID, client *pb.ClientInfo, grpcHost, wsHost string, parent *ParentHub, macKey string, macScheme auth.MACScheme) (*pb.JoinedRoomRes, game.ErrorWithCode) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
+	r.muhubs.RLock()
+	closing := r.closing
+	r.muhubs.RUnlock()
+	if closing {
+		return nil, game.WithCode(
+			xerrors.Errorf("hub server is shutting down"), codes.Unavailable)
+	}
+
 	r.muclients.RLock()
 	clients := len(r.clients)
 	r.muclients.RUnlock()
@@ -140,7 +150,13 @@ func (r *Repository) WatchRoom(ctx context.Context, appId AppID, roomId RoomID,
 			xerrors.Errorf("reached to the max_clients"), codes.ResourceExhausted)
 	}
 
-	hub, err := r.getOrCreateHub(ctx, appId, roomId, grpcHost, wsHost)
+	if !client.IsHub {
+		if err := r.checkBan(ctx, appId, roomId, client.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	hub, err := r.getOrCreateHub(ctx, appId, roomId, grpcHost, wsHost, parent)
 	if err != nil {
 		return nil, game.WithCode(xerrors.Errorf("getOrCreateHub: %w", err), codes.NotFound)
 	}
@@ -148,10 +164,11 @@ func (r *Repository) WatchRoom(ctx context.Context, appId AppID, roomId RoomID,
 	jch := make(chan *game.JoinedInfo, 1)
 	errch := make(chan game.ErrorWithCode, 1)
 	msg := &game.MsgWatch{
-		Info:   client,
-		MACKey: macKey,
-		Joined: jch,
-		Err:    errch,
+		Info:      client,
+		MACKey:    macKey,
+		MACScheme: macScheme,
+		Joined:    jch,
+		Err:       errch,
 	}
 	select {
 	case <-hub.Done():
@@ -195,6 +212,10 @@ func (r *Repository) WatchRoom(ctx context.Context, appId AppID, roomId RoomID,
 		AuthKey:  cli.AuthKey(),
 		MasterId: string(joined.MasterId),
 		Deadline: uint32(joined.Deadline / time.Second),
+
+		CompressionThreshold: uint32(hub.upstream().CompressionThreshold()),
+		MacScheme:            uint32(cli.MACScheme()),
+		RoomState:            joined.State,
 	}, nil
 }
 
@@ -227,6 +248,27 @@ func (r *Repository) GetClient(roomId, userId string) (*game.Client, error) {
 	return cli, nil
 }
 
+// CompressionThreshold : Hubの接続先gameと同じ閾値を返す
+func (r *Repository) CompressionThreshold(roomId string) int {
+	r.muhubs.RLock()
+	defer r.muhubs.RUnlock()
+	hub, ok := r.hubs[RoomID(roomId)]
+	if !ok {
+		return 0
+	}
+	return hub.upstream().CompressionThreshold()
+}
+
+// Shutdown : 新しい観戦を受け付けないようにして、全てのhubを停止する
+func (r *Repository) Shutdown(grace time.Duration) {
+	r.muhubs.Lock()
+	defer r.muhubs.Unlock()
+	r.closing = true
+	for _, hub := range r.hubs {
+		hub.Shutdown(grace)
+	}
+}
+
 func (r *Repository) GetHubCount() int {
 	r.muhubs.RLock()
 	defer r.muhubs.RUnlock()
@@ -234,3 +276,6 @@ func (r *Repository) GetHubCount() int {
 }
 
 func (r *Repository) PlayerLog(c *game.Client, msg game.PlayerLogMsg) {}
+
+func (r *Repository) PlayerEvent(c *game.Client, typ game.PlayerEventType, detail game.PlayerEventDetail) {
+}
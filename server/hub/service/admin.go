@@ -0,0 +1,29 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"wsnet2/log"
+	"wsnet2/pb"
+)
+
+// pb.GameAdminServer実装 (Drainのみ)
+
+// Drain : シグナル (SIGTERM) を受けたときと同様に停止を始める.
+// 観戦が全て終了するまで待たずに応答する.
+func (sv *HubService) Drain(ctx context.Context, in *pb.Empty) (*pb.Empty, error) {
+	logger := log.GetLoggerWith(
+		log.KeyHandler, "grpc:Drain",
+		log.KeyRequestedAt, float64(time.Now().UnixMilli())/1000,
+	)
+	if sv.shutdownRequested() {
+		logger.Infof("gRPC Drain: already shutting down")
+		return &pb.Empty{}, nil
+	}
+
+	go sv.Shutdown(context.Background())
+
+	logger.Infof("gRPC Drain OK: %v hubs", sv.repo.GetHubCount())
+	return &pb.Empty{}, nil
+}
@@ -10,6 +10,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/status"
 
+	"wsnet2/auth"
 	"wsnet2/hub"
 	"wsnet2/log"
 	"wsnet2/pb"
@@ -31,6 +32,11 @@ func (sv *HubService) serveGRPC(ctx context.Context) <-chan error {
 
 		server := grpc.NewServer()
 		pb.RegisterGameServer(server, sv)
+		pb.RegisterGameAdminServer(server, sv)
+
+		sv.muGRPC.Lock()
+		sv.grpcServer = server
+		sv.muGRPC.Unlock()
 
 		c := make(chan error)
 		go func() {
@@ -42,6 +48,10 @@ func (sv *HubService) serveGRPC(ctx context.Context) <-chan error {
 			server.Stop()
 			log.Infof("gRPC server stop")
 		case err := <-c:
+			if err == nil {
+				// gracefulStopGRPCによる停止
+				return
+			}
 			errCh <- err
 			log.Infof("gRPC server error: %v", err)
 		}
@@ -50,6 +60,17 @@ func (sv *HubService) serveGRPC(ctx context.Context) <-chan error {
 	return errCh
 }
 
+// gracefulStopGRPC : 処理中のリクエスト (Drainなど) に応答してからgRPCサーバを停止する
+func (sv *HubService) gracefulStopGRPC() {
+	sv.muGRPC.Lock()
+	server := sv.grpcServer
+	sv.muGRPC.Unlock()
+	if server != nil {
+		server.GracefulStop()
+		log.Infof("gRPC server graceful stop")
+	}
+}
+
 func (sv *HubService) Watch(ctx context.Context, in *pb.JoinRoomReq) (*pb.JoinedRoomRes, error) {
 	logger := log.GetLoggerWith(
 		log.KeyHandler, "grpc:Watch",
@@ -60,7 +81,15 @@ func (sv *HubService) Watch(ctx context.Context, in *pb.JoinRoomReq) (*pb.Joined
 	)
 	logger.Debugf("gRPC Watch: %v %v", in.RoomId, in.ClientInfo)
 
-	res, err := sv.repo.WatchRoom(ctx, in.AppId, hub.RoomID(in.RoomId), in.ClientInfo, in.GrpcHost, in.WsHost, in.MacKey)
+	var parent *hub.ParentHub
+	if in.ParentGrpcHost != "" {
+		parent = &hub.ParentHub{
+			GRPCHost: in.ParentGrpcHost,
+			WSHost:   in.ParentWsHost,
+		}
+	}
+
+	res, err := sv.repo.WatchRoom(ctx, in.AppId, hub.RoomID(in.RoomId), in.ClientInfo, in.GrpcHost, in.WsHost, parent, in.MacKey, auth.MACScheme(in.MacScheme))
 	if err != nil {
 		logger.Errorf("repo.WatchRoom: %+v", err)
 		return nil, status.Errorf(err.Code(), "WatchRoom failed: %s", err)
@@ -5,47 +5,45 @@ import (
 	"sync"
 	"time"
 
-	"github.com/jmoiron/sqlx"
+	"google.golang.org/grpc"
 
 	"wsnet2/common"
 	"wsnet2/config"
 	"wsnet2/hub"
 	"wsnet2/log"
 	"wsnet2/pb"
-)
-
-const (
-	registerQuery = "" +
-		"INSERT INTO `hub_server` (`hostname`, `public_name`, `grpc_port`, `ws_port`, `status`) VALUES (:hostname, :public_name, :grpc_port, :ws_port, :status) " +
-		"ON DUPLICATE KEY UPDATE `public_name`=:public_name, `grpc_port`=:grpc_port, `ws_port`=:ws_port, `status`=:status, id=last_insert_id(id)"
-	heartbeatQuery = "" +
-		"UPDATE `hub_server` SET `status`=:status, heartbeat=:now WHERE `id`=:hostid"
+	"wsnet2/storage"
 )
 
 type HubService struct {
-	pb.UnimplementedGameServer // Create, Join の空実装
+	pb.UnimplementedGameServer      // Create, Join の空実装
+	pb.UnimplementedGameAdminServer // Drain 以外の空実装
 
 	HostId int64
 
 	conf *config.HubConf
 	repo *hub.Repository
 
-	db          *sqlx.DB
+	store       storage.Storage
 	preparation sync.WaitGroup
 
 	wsURLFormat string
 
+	muGRPC     sync.Mutex
+	grpcServer *grpc.Server
+
+	shutdownMu   sync.Mutex
 	shutdownChan chan struct{}
 	done         chan error
 }
 
-func New(db *sqlx.DB, conf *config.HubConf) (*HubService, error) {
-	hostId, err := registerHost(db, conf)
+func New(store storage.Storage, conf *config.HubConf) (*HubService, error) {
+	hostId, err := registerHost(store, conf)
 	if err != nil {
 		return nil, err
 	}
 
-	repo, err := hub.NewRepository(db, conf, uint32(hostId))
+	repo, err := hub.NewRepository(store, conf, uint32(hostId))
 	if err != nil {
 		return nil, err
 	}
@@ -54,26 +52,26 @@ func New(db *sqlx.DB, conf *config.HubConf) (*HubService, error) {
 		HostId:       hostId,
 		conf:         conf,
 		repo:         repo,
-		db:           db,
+		store:        store,
 		preparation:  sync.WaitGroup{},
 		shutdownChan: make(chan struct{}),
 		done:         make(chan error),
 	}, nil
 }
 
-func registerHost(db *sqlx.DB, conf *config.HubConf) (int64, error) {
-	bind := map[string]interface{}{
-		"hostname":    conf.Hostname,
-		"public_name": conf.PublicName,
-		"grpc_port":   conf.GRPCPort,
-		"ws_port":     conf.WebsocketPort,
-		"status":      common.HostStatusRunning,
-	}
-	res, err := sqlx.NamedExec(db, registerQuery, bind)
+func registerHost(store storage.Storage, conf *config.HubConf) (int64, error) {
+	id, err := store.RegisterHubServer(context.Background(), &storage.Host{
+		Hostname:      conf.Hostname,
+		PublicName:    conf.PublicName,
+		GRPCPort:      conf.GRPCPort,
+		WebSocketPort: conf.WebsocketPort,
+		Region:        conf.Region,
+		Status:        common.HostStatusRunning,
+	})
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	return int64(id), nil
 }
 
 func (s *HubService) shutdownRequested() bool {
@@ -92,10 +90,10 @@ func (s *HubService) Serve(ctx context.Context) error {
 	var err error
 	select {
 	case <-ctx.Done():
-	case err = <-s.heartbeat(ctx):
 	case err = <-s.servePprof(ctx):
 	case err = <-s.serveGRPC(ctx):
 	case err = <-s.serveWebSocket(ctx):
+	case err = <-s.heartbeat(ctx): // preparationを待つので最後に評価する
 	case err = <-s.done:
 	}
 	return err
@@ -119,10 +117,7 @@ func (s *HubService) heartbeat(ctx context.Context) <-chan error {
 
 		log.Debugf("heartbeat start")
 		t := time.NewTicker(time.Duration(s.conf.HeartBeatInterval))
-		bind := map[string]interface{}{
-			"hostid": s.HostId,
-			"status": common.HostStatusRunning,
-		}
+		var status int32 = common.HostStatusRunning
 		for {
 			select {
 			case <-ctx.Done():
@@ -130,11 +125,10 @@ func (s *HubService) heartbeat(ctx context.Context) <-chan error {
 			case <-t.C:
 			}
 
-			bind["now"] = time.Now().Unix()
 			if s.shutdownRequested() {
-				bind["status"] = common.HostStatusClosing
+				status = common.HostStatusClosing
 			}
-			if _, err := sqlx.NamedExec(s.db, heartbeatQuery, bind); err != nil {
+			if err := s.store.UpdateHubServer(ctx, uint32(s.HostId), status, time.Now().Unix()); err != nil {
 				errCh <- err
 				return
 			}
@@ -148,29 +142,32 @@ func (s *HubService) heartbeat(ctx context.Context) <-chan error {
 func (s *HubService) Shutdown(ctx context.Context) {
 	log.Infof("HubService %v is gracefully shutting down", s.HostId)
 
+	// Drain (gRPC) とシグナルから同時に呼ばれることがある
+	s.shutdownMu.Lock()
 	if s.shutdownRequested() {
+		s.shutdownMu.Unlock()
 		return
 	}
 	close(s.shutdownChan)
+	s.shutdownMu.Unlock()
 	defer close(s.done)
 
 	// Immediately execute a heartbeat query in order not to miss the status update
-	bind := map[string]interface{}{
-		"now":    time.Now().Unix(),
-		"hostid": s.HostId,
-		"status": common.HostStatusClosing,
-	}
-	if _, err := sqlx.NamedExec(s.db, heartbeatQuery, bind); err != nil {
+	if err := s.store.UpdateHubServer(ctx, uint32(s.HostId), common.HostStatusClosing, time.Now().Unix()); err != nil {
 		s.done <- err
 		return
 	}
 
+	// Ask the watchers to re-watch through the lobby, and close the hubs after the grace period
+	s.repo.Shutdown(time.Duration(s.conf.ShutdownGracePeriod))
+
 	// Wait for all the hubs to be closed
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 	for {
 		if s.repo.GetHubCount() == 0 {
 			log.Infof("graceful shutdown completed")
+			s.gracefulStopGRPC()
 			s.done <- nil
 			return
 		}
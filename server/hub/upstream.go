@@ -0,0 +1,190 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"wsnet2/binary"
+	"wsnet2/client"
+	"wsnet2/pb"
+)
+
+// upstreamRetryInterval : 上流への観戦し直しの間隔
+const upstreamRetryInterval = 3 * time.Second
+
+// ParentHub : 多段hubでgameの代わりに接続する親hub
+type ParentHub struct {
+	GRPCHost string
+	WSHost   string
+}
+
+// reconnected : 観戦し直した上流との接続
+type reconnected struct {
+	room *client.Room
+	conn *client.Connection
+}
+
+// connWarn : 上流との接続で再接続を試みたエラーを記録する
+func (h *Hub) connWarn() func(error) {
+	lg := h.logger.WithOptions(zap.AddCallerSkip(1))
+	return func(err error) { lg.Warnf("%v: %v", h.clientId, err) }
+}
+
+// connect : 上流 (gameまたは親hub) に観戦者として接続する
+func (h *Hub) connect(ctx context.Context) (*client.Room, *client.Connection, error) {
+	clinfo := &pb.ClientInfo{
+		Id:    h.clientId,
+		IsHub: true,
+	}
+	warn := h.connWarn()
+
+	if h.parent == nil {
+		grpc, err := h.repo.grpcPool.Get(h.grpcHost)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("grpcPool get: %w", err)
+		}
+		room, conn, err := client.WatchDirect(ctx, grpc, h.wsHost, h.appId, string(h.roomId), clinfo, warn)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("client.WatchDirect: %w", err)
+		}
+		return room, conn, nil
+	}
+
+	grpc, err := h.repo.grpcPool.Get(h.parent.GRPCHost)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("grpcPool get: %w", err)
+	}
+	room, conn, err := client.WatchParentHub(ctx, grpc, h.parent.WSHost, h.appId, string(h.roomId), clinfo, h.grpcHost, h.wsHost, warn)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("client.WatchParentHub(%v): %w", h.parent.GRPCHost, err)
+	}
+	h.logger.Infof("watch via parent hub: room=%v parent=%v", h.roomId, h.parent.GRPCHost)
+	return room, conn, nil
+}
+
+// upstream : 現在の上流との接続
+func (h *Hub) upstream() *client.Connection {
+	return h.conn.Load()
+}
+
+// upstreamClosed : 上流との接続が切れた理由を確認し、観戦し直すべきか判定する.
+// 部屋の終了やhubの停止による切断では観戦し直さない.
+func (h *Hub) upstreamClosed() bool {
+	msg, err := h.upstream().Wait(context.Background())
+	if err == nil {
+		h.logger.Infof("connection closed: room=%v %v", h.roomId, msg)
+		return false
+	}
+	h.logger.Errorf("connection closed with error: room=%v %v, %+v", h.roomId, msg, err)
+	return !h.left && !h.closing
+}
+
+// resume : 切れた上流との接続を、受信済みの最後のEventの通番 (Wsnet2-LastEventSeq) の続きから再開する.
+// 上流のクライアントの再送バッファから続きのEventを受け取れれば、観戦者には欠落を通知しない.
+// EvPeerReadyを受け取るまでは観戦者からのメッセージを溜めておく (see: resumed).
+func (h *Hub) resume() <-chan binary.Event {
+	h.startResume(h.upstream().LastEventSeq())
+	conn := h.upstream().Resume(context.Background(), h.connWarn())
+	h.conn.Store(conn)
+	return conn.Events()
+}
+
+// shouldResume : 切れた上流との接続を続きから再開するか判定する. lastSeqは受信済みの最後のEventの通番.
+// 再開してから何も受け取れずに切れたときは続きからの再開を繰り返さず、観戦し直す.
+func (h *Hub) shouldResume(lastSeq int) bool {
+	return lastSeq != h.resumeSeq
+}
+
+// startResume : lastSeqの続きからの再開を始め、EvPeerReadyを待つ状態にする
+func (h *Hub) startResume(lastSeq int) {
+	h.resumeSeq = lastSeq
+	h.resuming = true
+	h.logger.Infof("resume upstream: room=%v lastEventSeq=%v", h.roomId, lastSeq)
+}
+
+// resumed : 上流との接続を再開できたので、再接続中に溜めたメッセージを送る
+func (h *Hub) resumed() {
+	h.logger.Infof("upstream resumed: room=%v", h.roomId)
+	h.resuming = false
+	h.reconnecting = false
+	h.sendPending(h.upstream())
+	h.storeNodeCount()
+}
+
+// resumeFailed : 続きから再開できなかった上流との接続の終了理由を記録し、観戦し直すべきか判定する.
+// 上流にクライアントが残っていない、または続きのEventが再送バッファに無かった場合はEvPeerReadyの前に終了する.
+func (h *Hub) resumeFailed() bool {
+	msg, err := h.upstream().Wait(context.Background())
+	h.logger.Warnf("upstream resume failed: room=%v %v, %v", h.roomId, msg, err)
+	return !h.left && !h.closing
+}
+
+// reconnect goroutine: UpstreamRetryTimeoutの間、上流に観戦し直す.
+// 観戦し直せなければnilを送る.
+func (h *Hub) reconnect(ch chan<- *reconnected) {
+	ctx := context.Background()
+	deadline := time.Now().Add(time.Duration(h.repo.conf.UpstreamRetryTimeout))
+	for {
+		room, conn, err := h.connect(ctx)
+		if err == nil {
+			h.logger.Infof("upstream reconnected: room=%v", h.roomId)
+			ch <- &reconnected{room, conn}
+			return
+		}
+		h.logger.Warnf("upstream reconnect: room=%v %+v", h.roomId, err)
+
+		var se interface{ GRPCStatus() *status.Status }
+		if errors.As(err, &se) {
+			switch se.GRPCStatus().Code() {
+			case codes.NotFound, codes.FailedPrecondition:
+				// 部屋が終了した, 観戦不可になった
+				ch <- nil
+				return
+			}
+		}
+		if time.Now().Add(upstreamRetryInterval).After(deadline) {
+			ch <- nil
+			return
+		}
+		time.Sleep(upstreamRetryInterval)
+	}
+}
+
+// resync : 観戦し直した上流の部屋の状態に切り替え、再接続中に溜めたメッセージを送る.
+// 遅延配信中なら切り替えは遅延キューで行う (see: flushDelayed)
+func (h *Hub) resync(r *reconnected) {
+	h.conn.Store(r.conn)
+	h.resumeSeq = 0
+	h.live = r.room
+	if h.delay == 0 {
+		h.room = r.room
+		h.notifyGap()
+	}
+
+	h.sendPending(r.conn)
+	h.storeNodeCount()
+}
+
+// sendPending : 再接続中に溜めたメッセージを上流に送る
+func (h *Hub) sendPending(conn *client.Connection) {
+	for _, m := range h.pending {
+		if err := conn.Send(m.Type(), m.Payload()); err != nil {
+			h.logger.Errorf("send pending message: %+v", err)
+		}
+	}
+	h.pending = nil
+}
+
+// notifyGap : 観戦者にイベントの欠落を通知する
+func (h *Hub) notifyGap() {
+	ev := binary.NewEvEventGap()
+	for _, c := range h.watchers {
+		c.SendSystemEvent(ev)
+	}
+}
@@ -0,0 +1,56 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"wsnet2/client"
+)
+
+func TestResumeSeq(t *testing.T) {
+	h := newTestHub(t, nil, time.Minute)
+	h.initRoom(newTestRoom(0))
+	h.conn.Store(&client.Connection{})
+
+	// 何も受け取らずに切れた接続は続きから再開せず、観戦し直す
+	if h.shouldResume(0) {
+		t.Fatalf("must not resume without events")
+	}
+
+	// 受け取ったEventの続きから再開する
+	if !h.shouldResume(10) {
+		t.Fatalf("must resume from seq 10")
+	}
+	h.reconnecting = true
+	h.startResume(10)
+	if !h.resuming || h.resumeSeq != 10 {
+		t.Fatalf("resuming=%v resumeSeq=%v, wants true, 10", h.resuming, h.resumeSeq)
+	}
+
+	// 再開した接続で何も受け取れずに切れたら、続きからの再開を繰り返さない
+	if h.shouldResume(10) {
+		t.Fatalf("must not resume again from the same seq")
+	}
+
+	// EvPeerReadyを受け取ったら再開完了. その後に受け取っていれば再び続きから再開できる
+	h.resumed()
+	if h.resuming || h.reconnecting {
+		t.Fatalf("resuming=%v reconnecting=%v after resumed", h.resuming, h.reconnecting)
+	}
+	if !h.shouldResume(15) {
+		t.Fatalf("must resume from seq 15")
+	}
+
+	// 観戦し直した接続の通番は0から始まるので、resumeSeqもリセットする
+	h.startResume(15)
+	h.resync(&reconnected{room: newTestRoom(0), conn: &client.Connection{}})
+	if h.resumeSeq != 0 {
+		t.Fatalf("resumeSeq = %v after resync, wants 0", h.resumeSeq)
+	}
+	if h.shouldResume(0) {
+		t.Fatalf("must not resume the new connection without events")
+	}
+	if !h.shouldResume(3) {
+		t.Fatalf("must resume the new connection from seq 3")
+	}
+}
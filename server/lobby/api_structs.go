@@ -54,6 +54,7 @@ const (
 	ResponseTypeRoomLimit
 	ResponseTypeNoRoomFound
 	ResponseTypeRoomFull
+	ResponseTypeBanned
 )
 
 func (r ResponseType) String() string {
@@ -66,6 +67,8 @@ func (r ResponseType) String() string {
 		return "NoRoomFound"
 	case ResponseTypeRoomFull:
 		return "RoomFull"
+	case ResponseTypeBanned:
+		return "Banned"
 	default:
 		return fmt.Sprintf("UnknownType(%v)", byte(r))
 	}
@@ -0,0 +1,69 @@
+package lobby
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"wsnet2/log"
+	"wsnet2/storage"
+)
+
+type banKey struct {
+	appId  string
+	userId string
+}
+
+// banCache : 有効なbanをapp, userごとに保持する.
+// expireごとにDBから読み直すので、DBでの追加・削除はexpire以内に反映される.
+// DBから読めなかったときは古い内容を使い続ける.
+type banCache struct {
+	sync.Mutex
+	store  storage.BanStorage
+	expire time.Duration
+
+	bans        map[banKey][]*storage.Ban
+	lastUpdated time.Time
+}
+
+func newBanCache(store storage.BanStorage, expire time.Duration) *banCache {
+	return &banCache{
+		store:  store,
+		expire: expire,
+		bans:   make(map[banKey][]*storage.Ban),
+	}
+}
+
+func (c *banCache) update() {
+	if time.Since(c.lastUpdated) <= c.expire {
+		return
+	}
+	c.lastUpdated = time.Now()
+
+	bans, err := c.store.ActiveBans(context.Background(), c.lastUpdated)
+	if err != nil {
+		log.Errorf("banCache: select bans: %+v", err)
+		return
+	}
+	c.bans = make(map[banKey][]*storage.Ban)
+	for _, b := range bans {
+		k := banKey{b.AppID, b.UserID}
+		c.bans[k] = append(c.bans[k], b)
+	}
+}
+
+// Find : userの有効なbanを返す. 無ければnil.
+// app全体のbanに加えて、roomIdが空でなければその部屋のbanも対象にする.
+func (c *banCache) Find(appId, userId, roomId string) *storage.Ban {
+	c.Lock()
+	defer c.Unlock()
+	c.update()
+
+	now := time.Now()
+	for _, b := range c.bans[banKey{appId, userId}] {
+		if (b.RoomID == "" || b.RoomID == roomId) && b.Active(now) {
+			return b
+		}
+	}
+	return nil
+}
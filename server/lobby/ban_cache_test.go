@@ -0,0 +1,65 @@
+package lobby
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"wsnet2/config"
+	"wsnet2/log"
+	"wsnet2/storage"
+)
+
+func TestBanCache(t *testing.T) {
+	defer log.InitLogger(&config.LogConf{LogStdoutLevel: uint32(log.ERROR)})()
+	ctx := context.Background()
+	store := storage.NewMemory()
+	now := time.Now()
+	for _, b := range []*storage.Ban{
+		{AppID: "app1", UserID: "u1", Created: now},
+		{AppID: "app1", UserID: "u2", RoomID: "room1", Created: now},
+		{AppID: "app1", UserID: "u3", Expires: sql.NullTime{Time: now.Add(-time.Second), Valid: true}, Created: now},
+		{AppID: "app1", UserID: "u4", Expires: sql.NullTime{Time: now.Add(200 * time.Millisecond), Valid: true}, Created: now},
+	} {
+		if err := store.InsertBan(ctx, b); err != nil {
+			t.Fatalf("InsertBan: %+v", err)
+		}
+	}
+
+	c := newBanCache(store, time.Hour)
+	tests := []struct {
+		app, user, room string
+		banned          bool
+	}{
+		{"app1", "u1", "", true},
+		{"app1", "u1", "room1", true},
+		{"app2", "u1", "", false},
+		{"app1", "u2", "", false},
+		{"app1", "u2", "room1", true},
+		{"app1", "u2", "room2", false},
+		{"app1", "u3", "", false},
+		{"app1", "u4", "", true},
+		{"app1", "u5", "", false},
+	}
+	for _, test := range tests {
+		if b := c.Find(test.app, test.user, test.room); (b != nil) != test.banned {
+			t.Errorf("Find(%v, %v, %v) = %+v, wants banned=%v", test.app, test.user, test.room, b, test.banned)
+		}
+	}
+
+	// expireまではDBの変更は反映されないが、期限切れは反映する
+	store.InsertBan(ctx, &storage.Ban{AppID: "app1", UserID: "u5", Created: now})
+	time.Sleep(200 * time.Millisecond)
+	if b := c.Find("app1", "u5", ""); b != nil {
+		t.Errorf("Find(u5) before expire = %+v", b)
+	}
+	if b := c.Find("app1", "u4", ""); b != nil {
+		t.Errorf("Find(u4) after expires = %+v", b)
+	}
+
+	c.expire = 0
+	if b := c.Find("app1", "u5", ""); b == nil {
+		t.Errorf("Find(u5) after expire = nil")
+	}
+}
@@ -15,6 +15,7 @@ const (
 	ErrRoomFull
 	ErrAlreadyJoined
 	ErrNoWatchableRoom
+	ErrBanned
 )
 
 // ErrorWithErrType : ErrTypeとerrorの組
@@ -54,6 +55,8 @@ func (e *errorWithType) Message() string {
 		return "Already exists"
 	case ErrNoWatchableRoom:
 		return "No watchable room found"
+	case ErrBanned:
+		return "Banned"
 	}
 	return ""
 }
@@ -1,68 +1,105 @@
 package lobby
 
 import (
+	"context"
 	"math/rand"
 	"sync"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	"golang.org/x/xerrors"
 
 	"wsnet2/common"
 	"wsnet2/log"
+	"wsnet2/storage"
 )
 
 type hostInfo struct {
 	Id            uint32
 	Hostname      string
-	PublicName    string `db:"public_name"`
-	GRPCPort      int    `db:"grpc_port"`
-	WebSocketPort int    `db:"ws_port"`
+	PublicName    string
+	GRPCPort      int
+	WebSocketPort int
+	Region        string
+}
+
+func newHostInfo(h *storage.Host) hostInfo {
+	return hostInfo{
+		Id:            h.Id,
+		Hostname:      h.Hostname,
+		PublicName:    h.PublicName,
+		GRPCPort:      h.GRPCPort,
+		WebSocketPort: h.WebSocketPort,
+		Region:        h.Region,
+	}
 }
 
 type gameServer struct {
 	hostInfo
 	Status int32
+
+	// heartbeatで報告された負荷
+	Rooms         int
+	Clients       int
+	CapacityUsage float64
+	CPUUsage      float64
 }
 
+// usage : 部屋数・クライアント数の上限とCPUに対する使用率のうち大きい方
+func (s *gameServer) usage() float64 {
+	if s.CPUUsage > s.CapacityUsage {
+		return s.CPUUsage
+	}
+	return s.CapacityUsage
+}
+
+// errGameServerBusy : 全てのgameサーバが上限付近で部屋を作成できない
+var errGameServerBusy = xerrors.New("all game servers are busy")
+
 type gameCache struct {
 	sync.Mutex
-	db     *sqlx.DB
+	store  storage.ServerStorage
 	expire time.Duration
 	valid  time.Duration
 
+	// maxUsage : 使用率がこれ以上のサーバは部屋の作成に使わない (0なら制限しない)
+	maxUsage float64
+
 	servers     map[uint32]*gameServer
 	order       []uint32
 	lastUpdated time.Time
 }
 
-func newGameCache(db *sqlx.DB, expire time.Duration, valid time.Duration) *gameCache {
+func newGameCache(store storage.ServerStorage, expire time.Duration, valid time.Duration, maxUsage float64) *gameCache {
 	return &gameCache{
-		db:      db,
-		expire:  expire,
-		valid:   valid,
-		servers: make(map[uint32]*gameServer),
-		order:   []uint32{},
+		store:    store,
+		expire:   expire,
+		valid:    valid,
+		maxUsage: maxUsage,
+		servers:  make(map[uint32]*gameServer),
+		order:    []uint32{},
 	}
 }
 
 func (c *gameCache) updateInner() error {
 	// 再入室のために、graceful shutdown中のサーバー(status == closing == 2)の情報も取得する.
-	query := ("SELECT id, hostname, public_name, grpc_port, ws_port, status\n" +
-		"FROM game_server WHERE status IN (1, 2) AND heartbeat >= ?")
-
-	var servers []gameServer
-	err := c.db.Select(&servers, query, time.Now().Add(-c.valid).Unix())
+	alives, err := c.store.AliveGameServers(context.Background(), time.Now().Add(-c.valid).Unix())
 	if err != nil {
 		return xerrors.Errorf("selecting game servers: %w", err)
 	}
 
-	log.Debugf("Now alive game servers: %+v", servers)
-
-	c.servers = make(map[uint32]*gameServer, len(servers))
-	c.order = make([]uint32, 0, len(servers))
-	for i := range servers {
-		s := &servers[i]
+	log.Debugf("Now alive game servers: %+v", alives)
+
+	c.servers = make(map[uint32]*gameServer, len(alives))
+	c.order = make([]uint32, 0, len(alives))
+	for _, gs := range alives {
+		s := &gameServer{
+			hostInfo:      newHostInfo(&gs.Host),
+			Status:        gs.Status,
+			Rooms:         gs.Rooms,
+			Clients:       gs.Clients,
+			CapacityUsage: gs.CapacityUsage,
+			CPUUsage:      gs.CPUUsage,
+		}
 		c.servers[s.Id] = s
 		// Rand() がgraceful shutdown中のサーバーを返さないために、
 		// status=running のサーバーのみ order に追加する.
@@ -98,7 +135,10 @@ func (c *gameCache) Get(id uint32) (*gameServer, error) {
 	return game, nil
 }
 
-func (c *gameCache) Rand() (*gameServer, error) {
+// Rand : 部屋を作成するgameサーバを選ぶ.
+// 使用率がmaxUsageに達したサーバを除き、regionのサーバがあればその中から、
+// 無ければ全てのサーバから、使用率の低いサーバほど選ばれやすい重み付きランダムで選ぶ.
+func (c *gameCache) Rand(region string) (*gameServer, error) {
 	c.Lock()
 	defer c.Unlock()
 	if err := c.update(); err != nil {
@@ -108,8 +148,40 @@ func (c *gameCache) Rand() (*gameServer, error) {
 	if len(c.order) == 0 {
 		return nil, xerrors.New("no available game server")
 	}
-	id := c.order[rand.Intn(len(c.order))]
-	return c.servers[id], nil
+	ids := make([]uint32, 0, len(c.order))
+	for _, id := range c.order {
+		if c.maxUsage <= 0 || c.servers[id].usage() < c.maxUsage {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errGameServerBusy
+	}
+	ids = preferRegion(ids, region, func(id uint32) string { return c.servers[id].Region })
+	return c.servers[weightedRand(ids, c.servers)], nil
+}
+
+// weightedRand : 空き (1-usage) を重みとしてidsから選ぶ
+func weightedRand(ids []uint32, servers map[uint32]*gameServer) uint32 {
+	const minWeight = 0.01
+	weights := make([]float64, len(ids))
+	var total float64
+	for i, id := range ids {
+		w := 1 - servers[id].usage()
+		if w < minWeight {
+			w = minWeight
+		}
+		weights[i] = w
+		total += w
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return ids[i]
+		}
+		r -= w
+	}
+	return ids[len(ids)-1]
 }
 
 func (c *gameCache) All() ([]*gameServer, error) {
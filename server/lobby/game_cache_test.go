@@ -1,8 +1,14 @@
 package lobby
 
 import (
+	"context"
+	"fmt"
 	"testing"
 	"time"
+
+	"golang.org/x/xerrors"
+
+	"wsnet2/storage"
 )
 
 func TestGameCache(t *testing.T) {
@@ -19,19 +25,24 @@ func TestGameCache(t *testing.T) {
 			"  `public_name` VARCHAR(191) NOT NULL,\n" +
 			"  `grpc_port`   INTEGER NOT NULL,\n" +
 			"  `ws_port`     INTEGER NOT NULL,\n" +
+			"  `region`      VARCHAR(64) NOT NULL DEFAULT '',\n" +
 			"  `status`      TINYINT NOT NULL,\n" +
 			"  `heartbeat`   BIGINT,\n" +
+			"  `rooms`       INTEGER NOT NULL DEFAULT 0,\n" +
+			"  `clients`     INTEGER NOT NULL DEFAULT 0,\n" +
+			"  `capacity_usage` FLOAT NOT NULL DEFAULT 0,\n" +
+			"  `cpu_usage`   FLOAT NOT NULL DEFAULT 0,\n" +
 			"  UNIQUE KEY `idx_hostname` (`hostname`)\n" +
 			") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
 
 	now := time.Now()
 	nowUnix := now.Unix()
 	lobbyDB.MustExec(
-		`INSERT INTO game_server (id, hostname, public_name, grpc_port, ws_port, status, heartbeat) VALUES
-		(1, "host1", "global1", 1001, 1002, 0, ?),
-		(2, "host2", "global2", 2001, 2002, 1, ?),
-		(3, "host3", "global3", 3001, 3002, 2, ?),
-		(4, "host4", "global4", 4001, 4002, 1, ?)`,
+		`INSERT INTO game_server (id, hostname, public_name, grpc_port, ws_port, region, status, heartbeat) VALUES
+		(1, "host1", "global1", 1001, 1002, "tokyo", 0, ?),
+		(2, "host2", "global2", 2001, 2002, "osaka", 1, ?),
+		(3, "host3", "global3", 3001, 3002, "tokyo", 2, ?),
+		(4, "host4", "global4", 4001, 4002, "tokyo", 1, ?)`,
 		nowUnix, nowUnix, nowUnix, nowUnix-100)
 	// host1 - not ready
 	// host2 - ready
@@ -40,7 +51,46 @@ func TestGameCache(t *testing.T) {
 	// randではhost2のみが選択される
 	// Getではhost3も取得可能
 
-	hc := newGameCache(lobbyDB, time.Second, time.Second*10)
+	testGameCache(t, storage.NewMySQL(lobbyDB), now)
+}
+
+func TestGameCacheMemory(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	now := time.Now()
+	nowUnix := now.Unix()
+	for i, h := range []struct {
+		region    string
+		status    int32
+		heartbeat int64
+	}{
+		{"tokyo", 0, nowUnix},
+		{"osaka", 1, nowUnix},
+		{"tokyo", 2, nowUnix},
+		{"tokyo", 1, nowUnix - 100},
+	} {
+		n := i + 1
+		id, err := store.RegisterGameServer(ctx, &storage.Host{
+			Hostname:      fmt.Sprintf("host%d", n),
+			PublicName:    fmt.Sprintf("global%d", n),
+			GRPCPort:      n*1000 + 1,
+			WebSocketPort: n*1000 + 2,
+			Region:        h.region,
+		})
+		if err != nil {
+			t.Fatalf("RegisterGameServer: %+v", err)
+		}
+		if err := store.UpdateGameServer(ctx, id, h.status, h.heartbeat, &storage.GameLoad{}); err != nil {
+			t.Fatalf("UpdateGameServer: %+v", err)
+		}
+	}
+	// MySQLと同じ構成
+	testGameCache(t, store, now)
+}
+
+func testGameCache(t *testing.T, store storage.Storage, now time.Time) {
+	t.Helper()
+	hc := newGameCache(store, time.Second, time.Second*10, 0.9)
 	err := hc.update()
 	if err != nil {
 		t.Fatal(err)
@@ -54,7 +104,7 @@ func TestGameCache(t *testing.T) {
 	if len(hc.order) != 1 {
 		t.Errorf("len(order) is not 1: %v", hc.order)
 	}
-	host, err := hc.Rand()
+	host, err := hc.Rand("")
 	if err != nil {
 		t.Fatalf("hc.Rand(): %v", err)
 	}
@@ -72,6 +122,15 @@ func TestGameCache(t *testing.T) {
 		t.Errorf("host != host2: %+v != %+v", host, host2)
 	}
 
+	// tokyoに選択可能なサーバが無いのでosakaのhost2が選ばれる
+	host, err = hc.Rand("tokyo")
+	if err != nil {
+		t.Fatalf("hc.Rand(tokyo): %v", err)
+	}
+	if host.Id != 2 || host.Region != "osaka" {
+		t.Errorf("hc.Rand(tokyo) = %+v, wants host2 in osaka", host)
+	}
+
 	host3, err := hc.Get(3)
 	if err != nil {
 		t.Fatalf("hc.Get(3): %v", err)
@@ -80,3 +139,31 @@ func TestGameCache(t *testing.T) {
 		t.Fatalf("host3 is nil")
 	}
 }
+
+func TestGameCacheRandUsage(t *testing.T) {
+	servers := map[uint32]*gameServer{
+		1: {hostInfo: hostInfo{Id: 1, Region: "tokyo"}, CapacityUsage: 0.95},
+		2: {hostInfo: hostInfo{Id: 2, Region: "tokyo"}, CPUUsage: 0.92},
+		3: {hostInfo: hostInfo{Id: 3, Region: "osaka"}, CapacityUsage: 0.2},
+	}
+	hc := newGameCache(nil, time.Hour, time.Hour, 0.9)
+	hc.servers = servers
+	hc.order = []uint32{1, 2, 3}
+	hc.lastUpdated = time.Now()
+
+	// tokyoのサーバは上限付近なのでosakaのhost3が選ばれる
+	for i := 0; i < 10; i++ {
+		host, err := hc.Rand("tokyo")
+		if err != nil {
+			t.Fatalf("hc.Rand(tokyo): %v", err)
+		}
+		if host.Id != 3 {
+			t.Fatalf("hc.Rand(tokyo) = %v, wants 3", host.Id)
+		}
+	}
+
+	servers[3].CPUUsage = 0.9
+	if host, err := hc.Rand(""); !xerrors.Is(err, errGameServerBusy) {
+		t.Fatalf("hc.Rand() = (%+v, %v), wants errGameServerBusy", host, err)
+	}
+}
@@ -1,21 +1,22 @@
 package lobby
 
 import (
+	"context"
 	"math/rand"
 	"sync"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	"golang.org/x/xerrors"
 
 	"wsnet2/log"
+	"wsnet2/storage"
 )
 
 type hubServer hostInfo
 
 type hubCache struct {
 	sync.Mutex
-	db     *sqlx.DB
+	store  storage.ServerStorage
 	expire time.Duration
 	valid  time.Duration
 
@@ -24,9 +25,9 @@ type hubCache struct {
 	lastUpdated time.Time
 }
 
-func newHubCache(db *sqlx.DB, expire time.Duration, valid time.Duration) *hubCache {
+func newHubCache(store storage.ServerStorage, expire time.Duration, valid time.Duration) *hubCache {
 	return &hubCache{
-		db:      db,
+		store:   store,
 		expire:  expire,
 		valid:   valid,
 		servers: make(map[uint32]*hubServer),
@@ -35,20 +36,18 @@ func newHubCache(db *sqlx.DB, expire time.Duration, valid time.Duration) *hubCac
 }
 
 func (c *hubCache) updateInner() error {
-	query := "SELECT id, hostname, public_name, grpc_port, ws_port FROM hub_server WHERE status=1 AND heartbeat >= ?"
-
-	var servers []hubServer
-	err := c.db.Select(&servers, query, time.Now().Add(-c.valid).Unix())
+	alives, err := c.store.AliveHubServers(context.Background(), time.Now().Add(-c.valid).Unix())
 	if err != nil {
 		return xerrors.Errorf("selecting hub servers: %w", err)
 	}
 
-	log.Debugf("Now alive hub servers: %+v", servers)
+	log.Debugf("Now alive hub servers: %+v", alives)
 
-	c.servers = make(map[uint32]*hubServer, len(servers))
-	c.order = make([]uint32, len(servers))
-	for i, s := range servers {
-		c.servers[s.Id] = &servers[i]
+	c.servers = make(map[uint32]*hubServer, len(alives))
+	c.order = make([]uint32, len(alives))
+	for i, h := range alives {
+		s := hubServer(newHostInfo(h))
+		c.servers[s.Id] = &s
 		c.order[i] = s.Id
 	}
 	c.lastUpdated = time.Now()
@@ -79,16 +78,39 @@ func (c *hubCache) Get(id uint32) (*hubServer, error) {
 	return hub, nil
 }
 
-func (c *hubCache) Rand() (*hubServer, error) {
+// Rand : hubサーバをランダムに選ぶ.
+// regionのサーバがあればその中から、無ければ全てのサーバから選ぶ.
+func (c *hubCache) Rand(region string) (*hubServer, error) {
+	return c.RandExcept(region, nil)
+}
+
+// RandExcept : excludeに含まれないhubサーバからランダムに選ぶ.
+// regionのサーバがあればその中から選ぶ.
+func (c *hubCache) RandExcept(region string, exclude []uint32) (*hubServer, error) {
 	c.Lock()
 	defer c.Unlock()
 	if err := c.update(); err != nil {
 		return nil, err
 	}
 
-	if len(c.order) == 0 {
+	ids := c.order
+	if len(exclude) > 0 {
+		ids = make([]uint32, 0, len(c.order))
+	Loop:
+		for _, id := range c.order {
+			for _, ex := range exclude {
+				if id == ex {
+					continue Loop
+				}
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	ids = preferRegion(ids, region, func(id uint32) string { return c.servers[id].Region })
+	if len(ids) == 0 {
 		return nil, xerrors.New("no available hub server")
 	}
-	id := c.order[rand.Intn(len(c.order))]
+	id := ids[rand.Intn(len(ids))]
 	return c.servers[id], nil
 }
@@ -1,8 +1,12 @@
 package lobby
 
 import (
+	"context"
+	"fmt"
 	"testing"
 	"time"
+
+	"wsnet2/storage"
 )
 
 func TestHubCache(t *testing.T) {
@@ -19,6 +23,7 @@ func TestHubCache(t *testing.T) {
 			"  `public_name` VARCHAR(191) NOT NULL,\n" +
 			"  `grpc_port`   INTEGER NOT NULL,\n" +
 			"  `ws_port`     INTEGER NOT NULL,\n" +
+			"  `region`      VARCHAR(64) NOT NULL DEFAULT '',\n" +
 			"  `status`      TINYINT NOT NULL,\n" +
 			"  `heartbeat`   BIGINT,\n" +
 			"  UNIQUE KEY `idx_hostname` (`hostname`)\n" +
@@ -39,7 +44,44 @@ func TestHubCache(t *testing.T) {
 	// host4 - expired
 	// host2のみが選択される
 
-	hc := newHubCache(lobbyDB, time.Second, time.Second*10)
+	testHubCache(t, storage.NewMySQL(lobbyDB), now)
+}
+
+func TestHubCacheMemory(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	now := time.Now()
+	nowUnix := now.Unix()
+	for i, h := range []struct {
+		status    int32
+		heartbeat int64
+	}{
+		{0, nowUnix},
+		{1, nowUnix},
+		{2, nowUnix},
+		{1, nowUnix - 100},
+	} {
+		n := i + 1
+		id, err := store.RegisterHubServer(ctx, &storage.Host{
+			Hostname:      fmt.Sprintf("host%d", n),
+			PublicName:    fmt.Sprintf("global%d", n),
+			GRPCPort:      n*1000 + 1,
+			WebSocketPort: n*1000 + 2,
+		})
+		if err != nil {
+			t.Fatalf("RegisterHubServer: %+v", err)
+		}
+		if err := store.UpdateHubServer(ctx, id, h.status, h.heartbeat); err != nil {
+			t.Fatalf("UpdateHubServer: %+v", err)
+		}
+	}
+	// MySQLと同じ構成
+	testHubCache(t, store, now)
+}
+
+func testHubCache(t *testing.T, store storage.Storage, now time.Time) {
+	t.Helper()
+	hc := newHubCache(store, time.Second, time.Second*10)
 	err := hc.update()
 	if err != nil {
 		t.Fatal(err)
@@ -53,7 +95,7 @@ func TestHubCache(t *testing.T) {
 	if len(hc.order) != 1 {
 		t.Errorf("len(order) is not 1: %v", hc.order)
 	}
-	host, err := hc.Rand()
+	host, err := hc.Rand("")
 	if err != nil {
 		t.Fatalf("hc.Rand(): %v", err)
 	}
@@ -70,4 +112,7 @@ func TestHubCache(t *testing.T) {
 	if host != host2 {
 		t.Errorf("host != host2: %+v != %+v", host, host2)
 	}
+	if h, err := hc.RandExcept("", []uint32{2}); err == nil {
+		t.Errorf("hc.RandExcept(2) must be error: %+v", h)
+	}
 }
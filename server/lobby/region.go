@@ -0,0 +1,19 @@
+package lobby
+
+// preferRegion : idsのうちregionに配置されたサーバだけを返す.
+// regionが空か、regionのサーバが無ければidsをそのまま返す (リージョンをまたいだフォールバック).
+func preferRegion(ids []uint32, region string, regionOf func(id uint32) string) []uint32 {
+	if region == "" {
+		return ids
+	}
+	var in []uint32
+	for _, id := range ids {
+		if regionOf(id) == region {
+			in = append(in, id)
+		}
+	}
+	if len(in) == 0 {
+		return ids
+	}
+	return in
+}
@@ -0,0 +1,25 @@
+package lobby
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPreferRegion(t *testing.T) {
+	regions := map[uint32]string{1: "tokyo", 2: "osaka", 3: "tokyo", 4: ""}
+	regionOf := func(id uint32) string { return regions[id] }
+	ids := []uint32{1, 2, 3, 4}
+
+	tests := map[string][]uint32{
+		"tokyo":     {1, 3},
+		"osaka":     {2},
+		"singapore": ids,
+		"":          ids,
+	}
+	for region, wants := range tests {
+		got := preferRegion(ids, region, regionOf)
+		if !reflect.DeepEqual(got, wants) {
+			t.Errorf("preferRegion(%q) = %v, wants %v", region, got, wants)
+		}
+	}
+}
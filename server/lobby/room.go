@@ -6,22 +6,23 @@ import (
 	"math/rand"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	"golang.org/x/xerrors"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
 
+	"wsnet2/auth"
 	"wsnet2/binary"
 	"wsnet2/common"
 	"wsnet2/config"
 	"wsnet2/log"
 	"wsnet2/pb"
+	"wsnet2/storage"
 )
 
 type RoomService struct {
-	db       *sqlx.DB
+	store    storage.Storage
 	conf     *config.LobbyConf
 	apps     map[string]*pb.App
 	grpcPool *common.GrpcPool
@@ -29,30 +30,110 @@ type RoomService struct {
 	roomCache *RoomCache
 	gameCache *gameCache
 	hubCache  *hubCache
+	banCache  *banCache
+
+	// registry : gameサーバから送られた部屋の状態. nilなら常にDBを使う
+	registry *roomRegistry
 }
 
-func NewRoomService(db *sqlx.DB, conf *config.LobbyConf) (*RoomService, error) {
-	query := "SELECT id, `key` FROM app"
-	var apps []*pb.App
-	err := db.Select(&apps, query)
+func NewRoomService(store storage.Storage, conf *config.LobbyConf) (*RoomService, error) {
+	apps, err := store.Apps(context.Background())
 	if err != nil {
 		return nil, xerrors.Errorf("select apps: %w", err)
 	}
 	rs := &RoomService{
-		db:        db,
+		store:     store,
 		conf:      conf,
 		apps:      make(map[string]*pb.App),
 		grpcPool:  common.NewGrpcPool(grpc.WithTransportCredentials(insecure.NewCredentials())),
-		roomCache: NewRoomCache(db, time.Millisecond*10),
-		gameCache: newGameCache(db, time.Second*1, time.Duration(conf.ValidHeartBeat)),
-		hubCache:  newHubCache(db, time.Second*1, time.Duration(conf.ValidHeartBeat)),
+		roomCache: NewRoomCache(store, time.Millisecond*10),
+		gameCache: newGameCache(store, time.Second*1, time.Duration(conf.ValidHeartBeat), conf.GameMaxUsage),
+		hubCache:  newHubCache(store, time.Second*1, time.Duration(conf.ValidHeartBeat)),
+		banCache:  newBanCache(store, time.Duration(conf.BanCacheExpire)),
 	}
 	for i, app := range apps {
 		rs.apps[app.Id] = apps[i]
 	}
+	if conf.GRPCPort != 0 {
+		rs.registry = newRoomRegistry()
+	}
 	return rs, nil
 }
 
+// SyncRooms : gameサーバから送られる部屋の状態をregistryに反映する
+func (rs *RoomService) SyncRooms(stream pb.Lobby_SyncRoomsServer) error {
+	if rs.registry == nil {
+		return status.Errorf(codes.Unavailable, "room registry is disabled")
+	}
+
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if !msg.Snapshot {
+		return status.Errorf(codes.InvalidArgument, "first message must be a snapshot: host=%v", msg.HostId)
+	}
+	hostId := msg.HostId
+	sid := rs.registry.open(hostId)
+	defer rs.registry.close(hostId, sid)
+	log.Infof("SyncRooms: game server %v connected (%v rooms)", hostId, len(msg.Rooms))
+
+	for {
+		if msg.HostId != hostId {
+			return status.Errorf(codes.InvalidArgument, "host id changed: %v -> %v", hostId, msg.HostId)
+		}
+		if err := rs.registry.apply(sid, msg); err != nil {
+			log.Infof("SyncRooms: %v", err)
+			return status.Errorf(codes.Aborted, "%v", err)
+		}
+
+		msg, err = stream.Recv()
+		if err != nil {
+			log.Infof("SyncRooms: game server %v disconnected: %v", hostId, err)
+			return err
+		}
+	}
+}
+
+// registryReady : 全ての有効なgameサーバの部屋がregistryに揃っているか.
+// 揃っていなければDBから部屋を取得する.
+func (rs *RoomService) registryReady() bool {
+	if rs.registry == nil {
+		return false
+	}
+	games, err := rs.gameCache.All()
+	if err != nil {
+		return false
+	}
+	ids := make([]uint32, len(games))
+	for i, g := range games {
+		ids[i] = g.Id
+	}
+	return rs.registry.ready(ids)
+}
+
+func (rs *RoomService) getRoom(ctx context.Context, appId, roomId string) (*pb.RoomInfo, error) {
+	if rs.registryReady() {
+		return rs.registry.get(appId, roomId)
+	}
+	return rs.store.GetRoom(ctx, appId, roomId)
+}
+
+func (rs *RoomService) getRoomByNumber(ctx context.Context, appId string, number int32) (*pb.RoomInfo, error) {
+	if rs.registryReady() {
+		return rs.registry.getByNumber(appId, number)
+	}
+	return rs.store.GetRoomByNumber(ctx, appId, number)
+}
+
+func (rs *RoomService) getRooms(ctx context.Context, appId string, searchGroup uint32) ([]*pb.RoomInfo, []binary.Dict, error) {
+	if rs.registryReady() {
+		rooms, props := rs.registry.search(appId, searchGroup, searchLimit)
+		return rooms, props, nil
+	}
+	return rs.roomCache.GetRooms(ctx, appId, searchGroup)
+}
+
 func (rs *RoomService) GetAppKey(appId string) (string, bool) {
 	app, found := rs.apps[appId]
 	if !found {
@@ -61,14 +142,52 @@ func (rs *RoomService) GetAppKey(appId string) (string, bool) {
 	return app.Key, true
 }
 
-func (rs *RoomService) Create(ctx context.Context, appId string, roomOption *pb.RoomOption, clientInfo *pb.ClientInfo, macKey string) (*pb.JoinedRoomRes, error) {
+// ValidMACScheme : クライアントの要求したMACSchemeがAppで許可されているか
+func (rs *RoomService) ValidMACScheme(appId string, scheme auth.MACScheme) error {
+	app, found := rs.apps[appId]
+	if !found {
+		return xerrors.Errorf("Unknown appId: %v", appId)
+	}
+	if scheme < auth.MACScheme(app.MacScheme) {
+		return xerrors.Errorf("mac scheme %v is not allowed (min: %v)", scheme, auth.MACScheme(app.MacScheme))
+	}
+	return nil
+}
+
+// CheckBan : userがapp全体からbanされていたらErrBanned
+func (rs *RoomService) CheckBan(appId, userId string) error {
+	if b := rs.banCache.Find(appId, userId, ""); b != nil {
+		return withType(
+			xerrors.Errorf("user %v is banned: %v (expires=%v)", userId, b.Reason, b.Expires.Time),
+			ErrBanned)
+	}
+	return nil
+}
+
+// checkRoomBan : userがapp全体かroomIdの部屋からbanされていたらErrBanned
+func (rs *RoomService) checkRoomBan(appId, userId, roomId string) error {
+	if b := rs.banCache.Find(appId, userId, roomId); b != nil {
+		return withType(
+			xerrors.Errorf("user %v is banned from room %v: %v (expires=%v)", userId, b.RoomID, b.Reason, b.Expires.Time),
+			ErrBanned)
+	}
+	return nil
+}
+
+// Create : 部屋を作成する.
+// regionに配置されたgameサーバを優先して使う.
+func (rs *RoomService) Create(ctx context.Context, appId, region string, roomOption *pb.RoomOption, clientInfo *pb.ClientInfo, macKey string, macScheme auth.MACScheme) (*pb.JoinedRoomRes, error) {
 	if _, found := rs.apps[appId]; !found {
 		return nil, xerrors.Errorf("Unknown appId: %v", appId)
 	}
 
-	game, err := rs.gameCache.Rand()
+	game, err := rs.gameCache.Rand(region)
 	if err != nil {
-		return nil, xerrors.Errorf("get game server: %w", err)
+		err = xerrors.Errorf("get game server: %w", err)
+		if xerrors.Is(err, errGameServerBusy) {
+			err = withType(err, ErrRoomLimit)
+		}
+		return nil, err
 	}
 
 	grpcAddr := fmt.Sprintf("%s:%d", game.Hostname, game.GRPCPort)
@@ -84,6 +203,7 @@ func (rs *RoomService) Create(ctx context.Context, appId string, roomOption *pb.
 		RoomOption: roomOption,
 		MasterInfo: clientInfo,
 		MacKey:     macKey,
+		MacScheme:  uint32(macScheme),
 	}
 
 	res, err := client.Create(ctx, req)
@@ -136,7 +256,7 @@ func filter(rooms []*pb.RoomInfo, props []binary.Dict, queries []PropQueries, li
 	return filtered
 }
 
-func (rs *RoomService) join(ctx context.Context, appId, roomId string, clientInfo *pb.ClientInfo, macKey string, hostId uint32) (*pb.JoinedRoomRes, error) {
+func (rs *RoomService) join(ctx context.Context, appId, roomId string, clientInfo *pb.ClientInfo, macKey string, macScheme auth.MACScheme, hostId uint32, source string) (*pb.JoinedRoomRes, error) {
 	game, err := rs.gameCache.Get(hostId)
 	if err != nil {
 		return nil, xerrors.Errorf("get game server(%v): %w", hostId, err)
@@ -155,6 +275,8 @@ func (rs *RoomService) join(ctx context.Context, appId, roomId string, clientInf
 		RoomId:     roomId,
 		ClientInfo: clientInfo,
 		MacKey:     macKey,
+		MacScheme:  uint32(macScheme),
+		JoinSource: source,
 	}
 
 	res, err := client.Join(ctx, req)
@@ -171,6 +293,8 @@ func (rs *RoomService) join(ctx context.Context, appId, roomId string, clientInf
 				err = withType(err, ErrRoomFull)
 			case codes.AlreadyExists: // 既に入室している
 				err = withType(err, ErrAlreadyJoined)
+			case codes.PermissionDenied: // Masterにbanされた
+				err = withType(err, ErrBanned)
 			case codes.InvalidArgument:
 				err = withType(err, ErrArgument)
 			}
@@ -181,64 +305,74 @@ func (rs *RoomService) join(ctx context.Context, appId, roomId string, clientInf
 	return res, nil
 }
 
-func (rs *RoomService) JoinById(ctx context.Context, appId, roomId string, queries []PropQueries, clientInfo *pb.ClientInfo, macKey string, logger log.Logger) (*pb.JoinedRoomRes, error) {
+func (rs *RoomService) JoinById(ctx context.Context, appId, roomId string, queries []PropQueries, clientInfo *pb.ClientInfo, macKey string, macScheme auth.MACScheme, logger log.Logger) (*pb.JoinedRoomRes, error) {
 	if _, found := rs.apps[appId]; !found {
 		return nil, xerrors.Errorf("Unknown appId: %v", appId)
 	}
 
-	var room pb.RoomInfo
-	err := rs.db.Get(&room, "SELECT * FROM room WHERE app_id = ? AND id = ? AND joinable = 1", appId, roomId)
+	room, err := rs.getRoom(ctx, appId, roomId)
+	if err == nil && !room.Joinable {
+		err = xerrors.Errorf("room is not joinable")
+	}
 	if err != nil {
 		return nil, withType(
 			xerrors.Errorf("select room (id=%v): %w", roomId, err),
 			ErrNoJoinableRoom)
 	}
+	if err := rs.checkRoomBan(appId, clientInfo.Id, room.Id); err != nil {
+		return nil, err
+	}
 
 	props, err := unmarshalProps(room.PublicProps)
 	if err != nil {
 		return nil, xerrors.Errorf("unmarshalProps: %w", err)
 	}
 
-	filtered := filter([]*pb.RoomInfo{&room}, []binary.Dict{props}, queries, 1, true, false, logger)
+	filtered := filter([]*pb.RoomInfo{room}, []binary.Dict{props}, queries, 1, true, false, logger)
 	if len(filtered) == 0 {
 		return nil, withType(
 			xerrors.Errorf("filter result is empty: room=%v", roomId),
 			ErrNoJoinableRoom)
 	}
 
-	return rs.join(ctx, appId, filtered[0].Id, clientInfo, macKey, filtered[0].HostId)
+	return rs.join(ctx, appId, filtered[0].Id, clientInfo, macKey, macScheme, filtered[0].HostId, common.JoinSourceId)
 }
 
-func (rs *RoomService) JoinByNumber(ctx context.Context, appId string, roomNumber int32, queries []PropQueries, clientInfo *pb.ClientInfo, macKey string, logger log.Logger) (*pb.JoinedRoomRes, error) {
+func (rs *RoomService) JoinByNumber(ctx context.Context, appId string, roomNumber int32, queries []PropQueries, clientInfo *pb.ClientInfo, macKey string, macScheme auth.MACScheme, logger log.Logger) (*pb.JoinedRoomRes, error) {
 	if _, found := rs.apps[appId]; !found {
 		return nil, xerrors.Errorf("Unknown appId: %v", appId)
 	}
 
-	var room pb.RoomInfo
-	err := rs.db.Get(&room, "SELECT * FROM room WHERE app_id = ? AND number = ? AND joinable = 1", appId, roomNumber)
+	room, err := rs.getRoomByNumber(ctx, appId, roomNumber)
+	if err == nil && !room.Joinable {
+		err = xerrors.Errorf("room is not joinable")
+	}
 	if err != nil {
 		return nil, withType(
 			xerrors.Errorf("select room (num=%v): %w", roomNumber, err),
 			ErrNoJoinableRoom)
 	}
+	if err := rs.checkRoomBan(appId, clientInfo.Id, room.Id); err != nil {
+		return nil, err
+	}
 
 	props, err := unmarshalProps(room.PublicProps)
 	if err != nil {
 		return nil, xerrors.Errorf("unmarshalProps: %w", err)
 	}
 
-	filtered := filter([]*pb.RoomInfo{&room}, []binary.Dict{props}, queries, 1, true, false, logger)
+	filtered := filter([]*pb.RoomInfo{room}, []binary.Dict{props}, queries, 1, true, false, logger)
 	if len(filtered) == 0 {
 		return nil, withType(
 			xerrors.Errorf("filter result is empty: number=%v: %w", roomNumber, err),
 			ErrNoJoinableRoom)
 	}
 
-	return rs.join(ctx, appId, filtered[0].Id, clientInfo, macKey, filtered[0].HostId)
+	return rs.join(ctx, appId, filtered[0].Id, clientInfo, macKey, macScheme, filtered[0].HostId, common.JoinSourceNumber)
 }
 
-func (rs *RoomService) JoinAtRandom(ctx context.Context, appId string, searchGroup uint32, queries []PropQueries, clientInfo *pb.ClientInfo, macKey string, logger log.Logger) (*pb.JoinedRoomRes, error) {
-	rooms, props, err := rs.roomCache.GetRooms(ctx, appId, searchGroup)
+func (rs *RoomService) JoinAtRandom(ctx context.Context, appId string, searchGroup uint32, queries []PropQueries, clientInfo *pb.ClientInfo, macKey string, macScheme auth.MACScheme, logger log.Logger) (*pb.JoinedRoomRes, error) {
+	rooms, props, err := rs.getRooms(ctx, appId, searchGroup)
 	if err != nil {
 		return nil, xerrors.Errorf("get rooms (group=%v): %w", searchGroup, err)
 	}
@@ -253,7 +387,12 @@ func (rs *RoomService) JoinAtRandom(ctx context.Context, appId string, searchGro
 		default:
 		}
 
-		res, err := rs.join(ctx, appId, room.Id, clientInfo, macKey, room.HostId)
+		if err := rs.checkRoomBan(appId, clientInfo.Id, room.Id); err != nil {
+			logger.Debugf("skip %v: %v", room.Id, err)
+			continue
+		}
+
+		res, err := rs.join(ctx, appId, room.Id, clientInfo, macKey, macScheme, room.HostId, common.JoinSourceRandom)
 		if err == nil {
 			return res, nil
 		}
@@ -273,7 +412,7 @@ func (rs *RoomService) JoinAtRandom(ctx context.Context, appId string, searchGro
 }
 
 func (rs *RoomService) Search(ctx context.Context, appId string, searchGroup uint32, queries []PropQueries, limit int, joinable, watchable bool, logger log.Logger) ([]*pb.RoomInfo, error) {
-	rooms, props, err := rs.roomCache.GetRooms(ctx, appId, searchGroup)
+	rooms, props, err := rs.getRooms(ctx, appId, searchGroup)
 	if err != nil {
 		return nil, xerrors.Errorf("get rooms (group=%v): %w", searchGroup, err)
 	}
@@ -286,12 +425,16 @@ func (rs *RoomService) SearchByIds(ctx context.Context, appId string, roomIds []
 		return []*pb.RoomInfo{}, nil
 	}
 
-	sql, params, err := sqlx.In("SELECT * FROM room WHERE app_id = ? AND id IN (?)", appId, roomIds)
+	if rs.registryReady() {
+		return rs.filterRooms(rs.registry.getByIds(appId, roomIds), queries, logger)
+	}
+
+	rooms, err := rs.store.GetRoomsByIds(ctx, appId, roomIds)
 	if err != nil {
-		return nil, xerrors.Errorf("sqlx.In: %w", err)
+		return nil, xerrors.Errorf("GetRoomsByIds: %w", err)
 	}
 
-	return rs.searchBySQL(ctx, sql, params, queries, logger)
+	return rs.filterRooms(rooms, queries, logger)
 }
 
 func (rs *RoomService) SearchByNumbers(ctx context.Context, appId string, roomNumbers []int32, queries []PropQueries, logger log.Logger) ([]*pb.RoomInfo, error) {
@@ -299,21 +442,20 @@ func (rs *RoomService) SearchByNumbers(ctx context.Context, appId string, roomNu
 		return []*pb.RoomInfo{}, nil
 	}
 
-	sql, params, err := sqlx.In("SELECT * FROM room WHERE app_id = ? AND number IN (?)", appId, roomNumbers)
-	if err != nil {
-		return nil, xerrors.Errorf("sqlx.In: %w", err)
+	if rs.registryReady() {
+		return rs.filterRooms(rs.registry.getByNumbers(appId, roomNumbers), queries, logger)
 	}
 
-	return rs.searchBySQL(ctx, sql, params, queries, logger)
-}
-
-func (rs *RoomService) searchBySQL(ctx context.Context, sql string, params []any, queries []PropQueries, logger log.Logger) ([]*pb.RoomInfo, error) {
-	var rooms []*pb.RoomInfo
-	err := rs.db.SelectContext(ctx, &rooms, sql, params...)
+	rooms, err := rs.store.GetRoomsByNumbers(ctx, appId, roomNumbers)
 	if err != nil {
-		return nil, xerrors.Errorf("Select: %w", err)
+		return nil, xerrors.Errorf("GetRoomsByNumbers: %w", err)
 	}
 
+	return rs.filterRooms(rooms, queries, logger)
+}
+
+func (rs *RoomService) filterRooms(rooms []*pb.RoomInfo, queries []PropQueries, logger log.Logger) ([]*pb.RoomInfo, error) {
+	var err error
 	props := make([]binary.Dict, len(rooms))
 	for i, r := range rooms {
 		props[i], err = unmarshalProps(r.PublicProps)
@@ -324,20 +466,81 @@ func (rs *RoomService) searchBySQL(ctx context.Context, sql string, params []any
 	return filter(rooms, props, queries, len(rooms), false, false, logger), nil
 }
 
-func (rs *RoomService) watch(ctx context.Context, room *pb.RoomInfo, clientInfo *pb.ClientInfo, macKey string) (*pb.JoinedRoomRes, error) {
-	var hubIDs []uint32
-	err := rs.db.Select(&hubIDs, "SELECT `host_id` FROM `hub` WHERE `room_id`=? AND `watchers`<?", room.Id, rs.conf.HubMaxWatchers)
+// selectHub : 観戦に使うhubサーバを選ぶ.
+// regionに配置されたhubを優先し、無ければ他のリージョンのhubを使う.
+// 部屋のhubが全てhub_max_watchersに達していたら、別のhubサーバに
+// 既存のhubのいずれかを親とする子hubを作らせる (gameへの接続数を増やさない).
+// regionに部屋のhubが無いときも、regionのhubサーバに子hubを作らせる.
+func (rs *RoomService) selectHub(roomId, region string) (hub, parent *hubServer, err error) {
+	hubs, err := rs.store.GetRoomHubs(context.Background(), roomId)
 	if err != nil {
-		return nil, xerrors.Errorf("select hub: %w", err)
+		return nil, nil, xerrors.Errorf("select hub: %w", err)
 	}
 
-	var hub *hubServer
+	var hubIDs, fullIDs []uint32
+	regions := make(map[uint32]string, len(hubs))
+	for _, h := range hubs {
+		s, err := rs.hubCache.Get(h.HostId)
+		if err != nil {
+			// 停止中 (HostStatusClosing) のhubサーバには新しい観戦者を割り当てない
+			continue
+		}
+		regions[h.HostId] = s.Region
+		if h.Watchers < rs.conf.HubMaxWatchers {
+			hubIDs = append(hubIDs, h.HostId)
+		} else {
+			fullIDs = append(fullIDs, h.HostId)
+		}
+	}
+	regionOf := func(id uint32) string { return regions[id] }
+
+	if ids := preferRegion(hubIDs, region, regionOf); len(ids) > 0 && (region == "" || regionOf(ids[0]) == region) {
+		hub, err = rs.hubCache.Get(ids[rand.Intn(len(ids))])
+		return hub, nil, err
+	}
+	if len(hubIDs) == 0 && len(fullIDs) == 0 {
+		hub, err = rs.hubCache.Rand(region)
+		return hub, nil, err
+	}
+
+	existing := append(append([]uint32{}, hubIDs...), fullIDs...)
+	if region != "" {
+		// regionに部屋のhubが無ければ、regionのhubサーバに既存のhubを親とする子hubを作らせる
+		h, err := rs.hubCache.RandExcept(region, existing)
+		if err == nil && h.Region == region {
+			parents := hubIDs
+			if len(parents) == 0 {
+				parents = fullIDs
+			}
+			parent, err = rs.hubCache.Get(parents[rand.Intn(len(parents))])
+			if err == nil {
+				return h, parent, nil
+			}
+		}
+	}
 	if len(hubIDs) > 0 {
-		n := rand.Intn(len(hubIDs))
-		hub, err = rs.hubCache.Get(hubIDs[n])
-	} else {
-		hub, err = rs.hubCache.Rand()
+		hub, err = rs.hubCache.Get(hubIDs[rand.Intn(len(hubIDs))])
+		return hub, nil, err
+	}
+
+	parent, err = rs.hubCache.Get(fullIDs[rand.Intn(len(fullIDs))])
+	if err != nil {
+		// 親hubのサーバが停止中ならgameに接続させる
+		parent = nil
 	}
+	hub, err = rs.hubCache.RandExcept(region, fullIDs)
+	if err != nil {
+		if parent == nil {
+			return nil, nil, err
+		}
+		// 他に使えるhubサーバが無ければ上限を超えて既存のhubを使う
+		return parent, nil, nil
+	}
+	return hub, parent, nil
+}
+
+func (rs *RoomService) watch(ctx context.Context, room *pb.RoomInfo, region string, clientInfo *pb.ClientInfo, macKey string, macScheme auth.MACScheme) (*pb.JoinedRoomRes, error) {
+	hub, parent, err := rs.selectHub(room.Id, region)
 	if err != nil {
 		return nil, xerrors.Errorf("get hub server: %w", err)
 	}
@@ -360,9 +563,14 @@ func (rs *RoomService) watch(ctx context.Context, room *pb.RoomInfo, clientInfo
 		RoomId:     room.Id,
 		ClientInfo: clientInfo,
 		MacKey:     macKey,
+		MacScheme:  uint32(macScheme),
 		GrpcHost:   fmt.Sprintf("%s:%d", game.Hostname, game.GRPCPort),
 		WsHost:     fmt.Sprintf("%s:%d", game.Hostname, game.WebSocketPort),
 	}
+	if parent != nil {
+		req.ParentGrpcHost = fmt.Sprintf("%s:%d", parent.Hostname, parent.GRPCPort)
+		req.ParentWsHost = fmt.Sprintf("%s:%d", parent.Hostname, parent.WebSocketPort)
+	}
 
 	res, err := client.Watch(ctx, req)
 	if err != nil {
@@ -386,60 +594,70 @@ func (rs *RoomService) watch(ctx context.Context, room *pb.RoomInfo, clientInfo
 	return res, nil
 }
 
-func (rs *RoomService) WatchById(ctx context.Context, appId, roomId string, queries []PropQueries, clientInfo *pb.ClientInfo, macKey string, logger log.Logger) (*pb.JoinedRoomRes, error) {
+func (rs *RoomService) WatchById(ctx context.Context, appId, region, roomId string, queries []PropQueries, clientInfo *pb.ClientInfo, macKey string, macScheme auth.MACScheme, logger log.Logger) (*pb.JoinedRoomRes, error) {
 	if _, found := rs.apps[appId]; !found {
 		return nil, xerrors.Errorf("Unknown appId: %v", appId)
 	}
 
-	var room pb.RoomInfo
-	err := rs.db.Get(&room, "SELECT * FROM room WHERE app_id = ? AND id = ? AND watchable = 1", appId, roomId)
+	room, err := rs.getRoom(ctx, appId, roomId)
+	if err == nil && !room.Watchable {
+		err = xerrors.Errorf("room is not watchable")
+	}
 	if err != nil {
 		return nil, withType(
 			xerrors.Errorf("select room (id=%v): %w", roomId, err),
 			ErrNoWatchableRoom)
 	}
+	if err := rs.checkRoomBan(appId, clientInfo.Id, room.Id); err != nil {
+		return nil, err
+	}
 
 	props, err := unmarshalProps(room.PublicProps)
 	if err != nil {
 		return nil, xerrors.Errorf("unmarshalProps: %w", err)
 	}
 
-	filtered := filter([]*pb.RoomInfo{&room}, []binary.Dict{props}, queries, 1, false, true, logger)
+	filtered := filter([]*pb.RoomInfo{room}, []binary.Dict{props}, queries, 1, false, true, logger)
 	if len(filtered) == 0 {
 		return nil, withType(
 			xerrors.Errorf("filter result is empty: room=%v", roomId),
 			ErrNoWatchableRoom)
 	}
 
-	return rs.watch(ctx, filtered[0], clientInfo, macKey)
+	return rs.watch(ctx, filtered[0], region, clientInfo, macKey, macScheme)
 }
 
-func (rs *RoomService) WatchByNumber(ctx context.Context, appId string, roomNumber int32, queries []PropQueries, clientInfo *pb.ClientInfo, macKey string, logger log.Logger) (*pb.JoinedRoomRes, error) {
+func (rs *RoomService) WatchByNumber(ctx context.Context, appId, region string, roomNumber int32, queries []PropQueries, clientInfo *pb.ClientInfo, macKey string, macScheme auth.MACScheme, logger log.Logger) (*pb.JoinedRoomRes, error) {
 	if _, found := rs.apps[appId]; !found {
 		return nil, xerrors.Errorf("Unknown appId: %v", appId)
 	}
 
-	var room pb.RoomInfo
-	err := rs.db.Get(&room, "SELECT * FROM room WHERE app_id = ? AND number = ? AND watchable = 1", appId, roomNumber)
+	room, err := rs.getRoomByNumber(ctx, appId, roomNumber)
+	if err == nil && !room.Watchable {
+		err = xerrors.Errorf("room is not watchable")
+	}
 	if err != nil {
 		return nil, withType(
 			xerrors.Errorf("select room (num=%v): %w", roomNumber, err),
 			ErrNoWatchableRoom)
 	}
+	if err := rs.checkRoomBan(appId, clientInfo.Id, room.Id); err != nil {
+		return nil, err
+	}
 
 	props, err := unmarshalProps(room.PublicProps)
 	if err != nil {
 		return nil, xerrors.Errorf("unmarshalProps: %w", err)
 	}
 
-	filtered := filter([]*pb.RoomInfo{&room}, []binary.Dict{props}, queries, 1, false, true, logger)
+	filtered := filter([]*pb.RoomInfo{room}, []binary.Dict{props}, queries, 1, false, true, logger)
 	if len(filtered) == 0 {
 		return nil, withType(
 			xerrors.Errorf("filter result is empty: number=%v", roomNumber),
 			ErrNoWatchableRoom)
 	}
 
-	return rs.watch(ctx, filtered[0], clientInfo, macKey)
+	return rs.watch(ctx, filtered[0], region, clientInfo, macKey, macScheme)
 }
 
 func (rs *RoomService) AdminKick(ctx context.Context, appId, targetID string, logger log.Logger) error {
@@ -5,19 +5,21 @@ import (
 	"sync"
 	"time"
 
-	"github.com/jmoiron/sqlx"
-
 	"wsnet2/binary"
 	"wsnet2/log"
 	"wsnet2/pb"
+	"wsnet2/storage"
 )
 
+// searchLimit : 1つのsearch_groupから検索する部屋の上限
+const searchLimit = 1000
+
 type roomCacheQuery struct {
 	sync.Mutex
-	db     *sqlx.DB
-	expire time.Duration
-	query  string
-	args   []interface{}
+	store       storage.RoomStorage
+	expire      time.Duration
+	appId       string
+	searchGroup uint32
 
 	lastUpdated time.Time
 	result      []*pb.RoomInfo
@@ -25,12 +27,12 @@ type roomCacheQuery struct {
 	lastError   error
 }
 
-func newRoomCacheQuery(db *sqlx.DB, expire time.Duration, sql string, args ...interface{}) *roomCacheQuery {
+func newRoomCacheQuery(store storage.RoomStorage, expire time.Duration, appId string, searchGroup uint32) *roomCacheQuery {
 	return &roomCacheQuery{
-		db:     db,
-		expire: expire,
-		query:  sql,
-		args:   args,
+		store:       store,
+		expire:      expire,
+		appId:       appId,
+		searchGroup: searchGroup,
 	}
 }
 
@@ -44,8 +46,7 @@ func (q *roomCacheQuery) do(ctx context.Context) ([]*pb.RoomInfo, []binary.Dict,
 		return q.result, q.props, q.lastError
 	}
 
-	rooms := []*pb.RoomInfo{}
-	err := q.db.SelectContext(ctx, &rooms, q.query, q.args...)
+	rooms, err := q.store.SearchRooms(ctx, q.appId, q.searchGroup, searchLimit)
 	if err != nil {
 		q.result = nil
 		q.lastError = err
@@ -73,14 +74,14 @@ func (q *roomCacheQuery) do(ctx context.Context) ([]*pb.RoomInfo, []binary.Dict,
 
 type RoomCache struct {
 	sync.Mutex
-	db      *sqlx.DB
+	store   storage.RoomStorage
 	expire  time.Duration
 	queries map[string]map[uint32]*roomCacheQuery
 }
 
-func NewRoomCache(db *sqlx.DB, expire time.Duration) *RoomCache {
+func NewRoomCache(store storage.RoomStorage, expire time.Duration) *RoomCache {
 	return &RoomCache{
-		db:      db,
+		store:   store,
 		expire:  expire,
 		queries: make(map[string]map[uint32]*roomCacheQuery),
 	}
@@ -93,7 +94,7 @@ func (c *RoomCache) GetRooms(ctx context.Context, appId string, searchGroup uint
 		if c.queries[appId] == nil {
 			c.queries[appId] = make(map[uint32]*roomCacheQuery)
 		}
-		q = newRoomCacheQuery(c.db, c.expire, "SELECT * FROM room WHERE app_id = ? AND search_group = ? AND visible = 1 LIMIT 1000", appId, searchGroup)
+		q = newRoomCacheQuery(c.store, c.expire, appId, searchGroup)
 		c.queries[appId][searchGroup] = q
 	}
 	c.Unlock()
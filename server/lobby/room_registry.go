@@ -0,0 +1,225 @@
+package lobby
+
+import (
+	"sort"
+	"sync"
+
+	"golang.org/x/xerrors"
+
+	"wsnet2/binary"
+	"wsnet2/log"
+	"wsnet2/pb"
+	"wsnet2/storage"
+)
+
+type registryRoom struct {
+	info  *pb.RoomInfo
+	props binary.Dict
+}
+
+// numberKey : 部屋番号はappごとにユニーク
+type numberKey struct {
+	appId  string
+	number int32
+}
+
+// registryHost : 1つのgameサーバから受け取った部屋.
+// streamが繋がっている間だけsyncedになる.
+type registryHost struct {
+	rooms  map[string]*registryRoom
+	stream uint64
+	synced bool
+}
+
+// roomRegistry : gameサーバからpb.Lobby/SyncRoomsで送られた部屋の状態.
+//
+// 全ての有効なgameサーバとstreamが繋がっているとき (ready) だけ、DBの代わりに部屋の検索に使う.
+// gameサーバが再起動したときや後から接続したときは、最初に送られるsnapshotでそのサーバの部屋を置き換える.
+type roomRegistry struct {
+	mu         sync.RWMutex
+	hosts      map[uint32]*registryHost
+	rooms      map[string]*registryRoom
+	numbers    map[numberKey]*registryRoom
+	lastStream uint64
+}
+
+func newRoomRegistry() *roomRegistry {
+	return &roomRegistry{
+		hosts:   make(map[uint32]*registryHost),
+		rooms:   make(map[string]*registryRoom),
+		numbers: make(map[numberKey]*registryRoom),
+	}
+}
+
+// put : 部屋を登録し、部屋番号の索引を更新する. r.muをLockして呼ぶ
+func (r *roomRegistry) put(h *registryHost, room *registryRoom) {
+	r.remove(h, room.info.Id)
+	h.rooms[room.info.Id] = room
+	r.rooms[room.info.Id] = room
+	if n := room.info.Number.GetNumber(); n != 0 {
+		r.numbers[numberKey{room.info.AppId, n}] = room
+	}
+}
+
+// remove : 部屋を削除し、部屋番号の索引からも除く. r.muをLockして呼ぶ.
+// 同じ番号で別のサーバに作られた部屋が先に登録されていれば、その索引は残す.
+func (r *roomRegistry) remove(h *registryHost, roomId string) {
+	room, ok := h.rooms[roomId]
+	if !ok {
+		return
+	}
+	delete(h.rooms, roomId)
+	if r.rooms[roomId] == room {
+		delete(r.rooms, roomId)
+	}
+	key := numberKey{room.info.AppId, room.info.Number.GetNumber()}
+	if r.numbers[key] == room {
+		delete(r.numbers, key)
+	}
+}
+
+// open : gameサーバからのstreamを登録する.
+// 同じサーバからの古いstreamが残っていても新しいstreamを優先する.
+func (r *roomRegistry) open(hostId uint32) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastStream++
+	h := r.hosts[hostId]
+	if h == nil {
+		h = &registryHost{rooms: make(map[string]*registryRoom)}
+		r.hosts[hostId] = h
+	}
+	h.stream = r.lastStream
+	h.synced = false
+	return h.stream
+}
+
+// close : streamが切れたらそのサーバの部屋を捨てる
+func (r *roomRegistry) close(hostId uint32, stream uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.hosts[hostId]
+	if h == nil || h.stream != stream {
+		return
+	}
+	for id := range h.rooms {
+		r.remove(h, id)
+	}
+	delete(r.hosts, hostId)
+}
+
+func (r *roomRegistry) apply(stream uint64, msg *pb.RoomSync) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.hosts[msg.HostId]
+	if h == nil || h.stream != stream {
+		return xerrors.Errorf("stream is replaced: host=%v", msg.HostId)
+	}
+	if !msg.Snapshot && !h.synced {
+		return xerrors.Errorf("snapshot is not received: host=%v", msg.HostId)
+	}
+
+	if msg.Snapshot {
+		for id := range h.rooms {
+			r.remove(h, id)
+		}
+		h.synced = true
+	}
+	for _, ri := range msg.Rooms {
+		props, err := unmarshalProps(ri.PublicProps)
+		if err != nil {
+			log.Errorf("props unmarshal error: room=%v: %+v", ri.Id, err)
+			props = binary.Dict{}
+		}
+		r.put(h, &registryRoom{info: ri, props: props})
+	}
+	for _, id := range msg.Deleted {
+		r.remove(h, id)
+	}
+	return nil
+}
+
+// ready : hostIdsの全てのサーバと同期できている
+func (r *roomRegistry) ready(hostIds []uint32) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, id := range hostIds {
+		if h := r.hosts[id]; h == nil || !h.synced {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *roomRegistry) get(appId, roomId string) (*pb.RoomInfo, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	room, ok := r.rooms[roomId]
+	if !ok || room.info.AppId != appId {
+		return nil, storage.ErrNotFound
+	}
+	return room.info, nil
+}
+
+func (r *roomRegistry) getByNumber(appId string, number int32) (*pb.RoomInfo, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	room, ok := r.numbers[numberKey{appId, number}]
+	if !ok || number == 0 {
+		return nil, storage.ErrNotFound
+	}
+	return room.info, nil
+}
+
+func (r *roomRegistry) getByIds(appId string, roomIds []string) []*pb.RoomInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rooms := []*pb.RoomInfo{}
+	for _, id := range roomIds {
+		if room, ok := r.rooms[id]; ok && room.info.AppId == appId {
+			rooms = append(rooms, room.info)
+		}
+	}
+	return rooms
+}
+
+func (r *roomRegistry) getByNumbers(appId string, numbers []int32) []*pb.RoomInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen := make(map[int32]bool, len(numbers))
+	rooms := []*pb.RoomInfo{}
+	for _, n := range numbers {
+		if n == 0 || seen[n] {
+			continue
+		}
+		seen[n] = true
+		if room, ok := r.numbers[numberKey{appId, n}]; ok {
+			rooms = append(rooms, room.info)
+		}
+	}
+	return rooms
+}
+
+// search : search_groupのvisibleな部屋を最大limit件. DBと同様に部屋ID順
+func (r *roomRegistry) search(appId string, searchGroup uint32, limit int) ([]*pb.RoomInfo, []binary.Dict) {
+	r.mu.RLock()
+	found := []*registryRoom{}
+	for _, room := range r.rooms {
+		if room.info.AppId == appId && room.info.SearchGroup == searchGroup && room.info.Visible {
+			found = append(found, room)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(found, func(i, j int) bool { return found[i].info.Id < found[j].info.Id })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	rooms := make([]*pb.RoomInfo, len(found))
+	props := make([]binary.Dict, len(found))
+	for i, room := range found {
+		rooms[i] = room.info
+		props[i] = room.props
+	}
+	return rooms, props
+}
@@ -0,0 +1,199 @@
+package lobby
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/xerrors"
+
+	"wsnet2/binary"
+	"wsnet2/pb"
+	"wsnet2/storage"
+)
+
+func registryRoomInfo(id string, hostId uint32, group uint32, number int32) *pb.RoomInfo {
+	return &pb.RoomInfo{
+		Id:          id,
+		AppId:       "testapp",
+		HostId:      hostId,
+		Visible:     true,
+		Joinable:    true,
+		Number:      &pb.RoomNumber{Number: number},
+		SearchGroup: group,
+		PublicProps: binary.MarshalDict(binary.Dict{"key": binary.MarshalInt(int(number))}),
+	}
+}
+
+func roomIds(rooms []*pb.RoomInfo) []string {
+	ids := make([]string, len(rooms))
+	for i, r := range rooms {
+		ids[i] = r.Id
+	}
+	return ids
+}
+
+func TestRoomRegistry(t *testing.T) {
+	r := newRoomRegistry()
+
+	if r.ready([]uint32{1}) {
+		t.Fatalf("ready before sync")
+	}
+
+	sid1 := r.open(1)
+	if err := r.apply(sid1, &pb.RoomSync{HostId: 1, Rooms: []*pb.RoomInfo{registryRoomInfo("r1", 1, 1, 1)}}); err == nil {
+		t.Fatalf("apply without snapshot must fail")
+	}
+	err := r.apply(sid1, &pb.RoomSync{
+		HostId:   1,
+		Snapshot: true,
+		Rooms: []*pb.RoomInfo{
+			registryRoomInfo("r2", 1, 1, 2),
+			registryRoomInfo("r1", 1, 1, 1),
+			registryRoomInfo("r3", 1, 2, 3),
+		},
+	})
+	if err != nil {
+		t.Fatalf("apply snapshot: %+v", err)
+	}
+	sid2 := r.open(2)
+	if err := r.apply(sid2, &pb.RoomSync{HostId: 2, Snapshot: true, Rooms: []*pb.RoomInfo{registryRoomInfo("r4", 2, 1, 4)}}); err != nil {
+		t.Fatalf("apply snapshot: %+v", err)
+	}
+
+	if !r.ready([]uint32{1, 2}) {
+		t.Fatalf("not ready after sync")
+	}
+	if r.ready([]uint32{1, 2, 3}) {
+		t.Fatalf("ready without host 3")
+	}
+
+	rooms, props := r.search("testapp", 1, 10)
+	if diff := cmp.Diff(roomIds(rooms), []string{"r1", "r2", "r4"}); diff != "" {
+		t.Fatalf("search (-got +want)\n%s", diff)
+	}
+	if diff := cmp.Diff(props[1], binary.Dict{"key": binary.MarshalInt(2)}); diff != "" {
+		t.Fatalf("props[1] (-got +want)\n%s", diff)
+	}
+	if rooms, _ := r.search("testapp", 1, 2); len(rooms) != 2 {
+		t.Fatalf("search limit: %v", roomIds(rooms))
+	}
+
+	// 更新と削除
+	upd := registryRoomInfo("r1", 1, 1, 1)
+	upd.Visible = false
+	if err := r.apply(sid1, &pb.RoomSync{HostId: 1, Rooms: []*pb.RoomInfo{upd}, Deleted: []string{"r2"}}); err != nil {
+		t.Fatalf("apply: %+v", err)
+	}
+	rooms, _ = r.search("testapp", 1, 10)
+	if diff := cmp.Diff(roomIds(rooms), []string{"r4"}); diff != "" {
+		t.Fatalf("search after update (-got +want)\n%s", diff)
+	}
+	if _, err := r.get("testapp", "r2"); !xerrors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("get deleted room: %v", err)
+	}
+	if room, err := r.getByNumber("testapp", 3); err != nil || room.Id != "r3" {
+		t.Fatalf("getByNumber: %v, %v", room, err)
+	}
+	if diff := cmp.Diff(roomIds(r.getByIds("testapp", []string{"r1", "r2", "r4"})), []string{"r1", "r4"}); diff != "" {
+		t.Fatalf("getByIds (-got +want)\n%s", diff)
+	}
+	if _, err := r.get("otherapp", "r1"); err == nil {
+		t.Fatalf("get room of other app")
+	}
+
+	// gameサーバの再起動: 新しいstreamのsnapshotで置き換え、古いstreamは無視する
+	sid3 := r.open(1)
+	if r.ready([]uint32{1}) {
+		t.Fatalf("ready before snapshot of new stream")
+	}
+	if err := r.apply(sid3, &pb.RoomSync{HostId: 1, Snapshot: true, Rooms: []*pb.RoomInfo{registryRoomInfo("r5", 1, 1, 5)}}); err != nil {
+		t.Fatalf("apply snapshot: %+v", err)
+	}
+	if err := r.apply(sid1, &pb.RoomSync{HostId: 1, Deleted: []string{"r5"}}); err == nil {
+		t.Fatalf("apply to replaced stream must fail")
+	}
+	r.close(1, sid1)
+	rooms, _ = r.search("testapp", 1, 10)
+	if diff := cmp.Diff(roomIds(rooms), []string{"r4", "r5"}); diff != "" {
+		t.Fatalf("search after restart (-got +want)\n%s", diff)
+	}
+	if _, err := r.get("testapp", "r3"); err == nil {
+		t.Fatalf("room of previous snapshot remains")
+	}
+
+	// streamが切れたらそのサーバの部屋を捨てる
+	r.close(2, sid2)
+	if r.ready([]uint32{1, 2}) {
+		t.Fatalf("ready after disconnected")
+	}
+	rooms, _ = r.search("testapp", 1, 10)
+	if diff := cmp.Diff(roomIds(rooms), []string{"r5"}); diff != "" {
+		t.Fatalf("search after disconnected (-got +want)\n%s", diff)
+	}
+}
+
+func TestRoomRegistryNumberIndex(t *testing.T) {
+	r := newRoomRegistry()
+	sid1 := r.open(1)
+	sid2 := r.open(2)
+	err := r.apply(sid1, &pb.RoomSync{
+		HostId:   1,
+		Snapshot: true,
+		Rooms:    []*pb.RoomInfo{registryRoomInfo("r1", 1, 1, 1), registryRoomInfo("r2", 1, 1, 2)},
+	})
+	if err != nil {
+		t.Fatalf("apply snapshot: %+v", err)
+	}
+	if err := r.apply(sid2, &pb.RoomSync{HostId: 2, Snapshot: true}); err != nil {
+		t.Fatalf("apply snapshot: %+v", err)
+	}
+
+	if room, err := r.getByNumber("testapp", 2); err != nil || room.Id != "r2" {
+		t.Fatalf("getByNumber(2): %v, %v", room, err)
+	}
+	if _, err := r.getByNumber("otherapp", 2); !xerrors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("getByNumber of other app: %v", err)
+	}
+	if _, err := r.getByNumber("testapp", 0); !xerrors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("getByNumber(0): %v", err)
+	}
+
+	// 更新された部屋の状態を返す
+	upd := registryRoomInfo("r1", 1, 1, 1)
+	upd.Joinable = false
+	if err := r.apply(sid1, &pb.RoomSync{HostId: 1, Rooms: []*pb.RoomInfo{upd}}); err != nil {
+		t.Fatalf("apply: %+v", err)
+	}
+	if room, err := r.getByNumber("testapp", 1); err != nil || room.Joinable {
+		t.Fatalf("getByNumber(1) after update: %v, %v", room, err)
+	}
+
+	// 削除済みの部屋の番号が別のサーバで再利用されても、古い部屋の削除で索引を消さない
+	if err := r.apply(sid2, &pb.RoomSync{HostId: 2, Rooms: []*pb.RoomInfo{registryRoomInfo("r3", 2, 1, 2)}}); err != nil {
+		t.Fatalf("apply: %+v", err)
+	}
+	if err := r.apply(sid1, &pb.RoomSync{HostId: 1, Deleted: []string{"r2"}}); err != nil {
+		t.Fatalf("apply: %+v", err)
+	}
+	if room, err := r.getByNumber("testapp", 2); err != nil || room.Id != "r3" {
+		t.Fatalf("getByNumber(2) after reuse: %v, %v", room, err)
+	}
+	if diff := cmp.Diff(roomIds(r.getByNumbers("testapp", []int32{2, 0, 1, 9, 2})), []string{"r3", "r1"}); diff != "" {
+		t.Fatalf("getByNumbers (-got +want)\n%s", diff)
+	}
+
+	// snapshotやstreamの切断で部屋を捨てたら索引からも除く
+	if err := r.apply(sid1, &pb.RoomSync{HostId: 1, Snapshot: true}); err != nil {
+		t.Fatalf("apply snapshot: %+v", err)
+	}
+	if _, err := r.getByNumber("testapp", 1); !xerrors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("getByNumber(1) after snapshot: %v", err)
+	}
+	r.close(2, sid2)
+	if _, err := r.getByNumber("testapp", 2); !xerrors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("getByNumber(2) after close: %v", err)
+	}
+	if n := len(r.numbers); n != 0 {
+		t.Fatalf("numbers = %v, wants empty", r.numbers)
+	}
+}
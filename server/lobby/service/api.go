@@ -64,7 +64,15 @@ func (sv *LobbyService) serveAPI(ctx context.Context) <-chan error {
 		r := chi.NewMux()
 		sv.registerRoutes(r)
 
-		errCh <- http.Serve(listener, r)
+		svr := &http.Server{Handler: r}
+		go func() {
+			<-ctx.Done()
+			svr.Close()
+		}()
+
+		if err := svr.Serve(listener); err != http.ErrServerClosed {
+			errCh <- err
+		}
 	}()
 
 	return errCh
@@ -95,11 +103,17 @@ type header struct {
 	appId    string
 	userId   string
 	authData string
+	region   string
 }
 
 func parseSpecificHeader(r *http.Request) (hdr header) {
 	hdr.appId = r.Header.Get("Wsnet2-App")
 	hdr.userId = r.Header.Get("Wsnet2-User")
+	// 優先するgame/hubサーバのリージョン. クエリパラメータでも指定できる
+	hdr.region = r.Header.Get("Wsnet2-Region")
+	if hdr.region == "" {
+		hdr.region = r.URL.Query().Get("region")
+	}
 
 	bearer := r.Header.Get("Authorization")
 	if strings.HasPrefix(bearer, "Bearer ") {
@@ -187,6 +201,10 @@ func renderErrorResponse(w http.ResponseWriter, msg string, status int, err erro
 			logger.Infof("Failed with status OK: %+v", err)
 			renderResponse(w, &lobby.Response{Msg: msg, Type: lobby.ResponseTypeNoRoomFound}, logger)
 			return
+		case lobby.ErrBanned:
+			logger.Infof("Failed with status OK: %+v", err)
+			renderResponse(w, &lobby.Response{Msg: msg, Type: lobby.ResponseTypeBanned}, logger)
+			return
 		}
 	}
 	logger.Errorf("ErrorResponse: %d %s: %+v", status, logmsg, err)
@@ -202,9 +220,24 @@ func (sv *LobbyService) authUser(h header) (string, error) {
 	if err := auth.ValidAuthData(h.authData, appKey, h.userId, expired); err != nil {
 		return "", xerrors.Errorf("invalid authdata: %w", err)
 	}
+	if err := sv.roomService.CheckBan(h.appId, h.userId); err != nil {
+		return "", err
+	}
 	return appKey, nil
 }
 
+// decryptMACKey : MACKeyを復号し、要求されたMACSchemeがAppで許可されているか確認する
+func (sv *LobbyService) decryptMACKey(appId, appKey, encMACKey string) (string, auth.MACScheme, error) {
+	macKey, scheme, err := auth.DecryptMACKeyWithScheme(appKey, encMACKey)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := sv.roomService.ValidMACScheme(appId, scheme); err != nil {
+		return "", 0, err
+	}
+	return macKey, scheme, nil
+}
+
 // 部屋を作成する
 // Method: POST
 // Path: /rooms
@@ -229,13 +262,13 @@ func (sv *LobbyService) handleCreateRoom(w http.ResponseWriter, r *http.Request)
 		renderErrorResponse(w, "Failed to read request body", http.StatusBadRequest, err, logger)
 		return
 	}
-	macKey, err := auth.DecryptMACKey(appKey, param.EncMACKey)
+	macKey, macScheme, err := sv.decryptMACKey(h.appId, appKey, param.EncMACKey)
 	if err != nil {
 		renderErrorResponse(w, "Failed to read MAC Key", http.StatusBadRequest, err, logger)
 		return
 	}
 
-	room, err := sv.roomService.Create(ctx, h.appId, param.RoomOption, param.ClientInfo, macKey)
+	room, err := sv.roomService.Create(ctx, h.appId, h.region, param.RoomOption, param.ClientInfo, macKey, macScheme)
 	if err != nil {
 		renderErrorResponse(w, "Failed to create room", http.StatusInternalServerError, err, logger)
 		return
@@ -298,7 +331,7 @@ func (sv *LobbyService) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	macKey, err := auth.DecryptMACKey(appKey, param.EncMACKey)
+	macKey, macScheme, err := sv.decryptMACKey(h.appId, appKey, param.EncMACKey)
 	if err != nil {
 		renderErrorResponse(w, "Failed to read MAC Key", http.StatusBadRequest, err, logger)
 		return
@@ -313,7 +346,7 @@ func (sv *LobbyService) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 	}
 	logger = logger.With(log.KeyRoom, roomId)
 
-	room, err := sv.roomService.JoinById(ctx, h.appId, roomId, param.Queries, param.ClientInfo, macKey, logger)
+	room, err := sv.roomService.JoinById(ctx, h.appId, roomId, param.Queries, param.ClientInfo, macKey, macScheme, logger)
 	if err != nil {
 		renderErrorResponse(w, "Failed to join room", http.StatusInternalServerError, err, logger)
 		return
@@ -343,7 +376,7 @@ func (sv *LobbyService) handleJoinRoomByNumber(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	macKey, err := auth.DecryptMACKey(appKey, param.EncMACKey)
+	macKey, macScheme, err := sv.decryptMACKey(h.appId, appKey, param.EncMACKey)
 	if err != nil {
 		renderErrorResponse(w, "Failed to read MAC Key", http.StatusBadRequest, err, logger)
 		return
@@ -358,7 +391,7 @@ func (sv *LobbyService) handleJoinRoomByNumber(w http.ResponseWriter, r *http.Re
 	}
 	logger = logger.With(log.KeyRoomNumber, roomNumber)
 
-	room, err := sv.roomService.JoinByNumber(ctx, h.appId, roomNumber, param.Queries, param.ClientInfo, macKey, logger)
+	room, err := sv.roomService.JoinByNumber(ctx, h.appId, roomNumber, param.Queries, param.ClientInfo, macKey, macScheme, logger)
 	if err != nil {
 		renderErrorResponse(w, "Failed to join room", http.StatusInternalServerError, err, logger)
 		return
@@ -388,7 +421,7 @@ func (sv *LobbyService) handleJoinRoomAtRandom(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	macKey, err := auth.DecryptMACKey(appKey, param.EncMACKey)
+	macKey, macScheme, err := sv.decryptMACKey(h.appId, appKey, param.EncMACKey)
 	if err != nil {
 		renderErrorResponse(w, "Failed to read MAC Key", http.StatusBadRequest, err, logger)
 		return
@@ -398,7 +431,7 @@ func (sv *LobbyService) handleJoinRoomAtRandom(w http.ResponseWriter, r *http.Re
 	searchGroup := vars.searchGroup()
 	logger = logger.With(log.KeySearchGroup, searchGroup)
 
-	room, err := sv.roomService.JoinAtRandom(ctx, h.appId, searchGroup, param.Queries, param.ClientInfo, macKey, logger)
+	room, err := sv.roomService.JoinAtRandom(ctx, h.appId, searchGroup, param.Queries, param.ClientInfo, macKey, macScheme, logger)
 	if err != nil {
 		renderErrorResponse(w, "Failed to join room", http.StatusInternalServerError, err, logger)
 		return
@@ -516,7 +549,7 @@ func (sv *LobbyService) handleWatchRoom(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	macKey, err := auth.DecryptMACKey(appKey, param.EncMACKey)
+	macKey, macScheme, err := sv.decryptMACKey(h.appId, appKey, param.EncMACKey)
 	if err != nil {
 		renderErrorResponse(w, "Failed to read MAC Key", http.StatusBadRequest, err, logger)
 		return
@@ -531,7 +564,7 @@ func (sv *LobbyService) handleWatchRoom(w http.ResponseWriter, r *http.Request)
 	}
 	logger = logger.With(log.KeyRoom, roomId)
 
-	room, err := sv.roomService.WatchById(ctx, h.appId, roomId, param.Queries, param.ClientInfo, macKey, logger)
+	room, err := sv.roomService.WatchById(ctx, h.appId, h.region, roomId, param.Queries, param.ClientInfo, macKey, macScheme, logger)
 	if err != nil {
 		renderErrorResponse(w, "Failed to watch room", http.StatusInternalServerError, err, logger)
 		return
@@ -561,7 +594,7 @@ func (sv *LobbyService) handleWatchRoomByNumber(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	macKey, err := auth.DecryptMACKey(appKey, param.EncMACKey)
+	macKey, macScheme, err := sv.decryptMACKey(h.appId, appKey, param.EncMACKey)
 	if err != nil {
 		renderErrorResponse(w, "Failed to read MAC Key", http.StatusBadRequest, err, logger)
 		return
@@ -576,7 +609,7 @@ func (sv *LobbyService) handleWatchRoomByNumber(w http.ResponseWriter, r *http.R
 	}
 	logger = logger.With(log.KeyRoomNumber, roomNumber)
 
-	room, err := sv.roomService.WatchByNumber(ctx, h.appId, roomNumber, param.Queries, param.ClientInfo, macKey, logger)
+	room, err := sv.roomService.WatchByNumber(ctx, h.appId, h.region, roomNumber, param.Queries, param.ClientInfo, macKey, macScheme, logger)
 	if err != nil {
 		renderErrorResponse(w, "Failed to watch room", http.StatusInternalServerError, err, logger)
 		return
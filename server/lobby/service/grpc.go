@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
+
+	"wsnet2/log"
+	"wsnet2/pb"
+)
+
+func (sv *LobbyService) serveGRPC(ctx context.Context) <-chan error {
+	if sv.conf.GRPCPort == 0 {
+		return nil
+	}
+
+	errCh := make(chan error)
+
+	sv.preparation.Add(1)
+	go func() {
+		laddr := fmt.Sprintf(":%d", sv.conf.GRPCPort)
+		log.Infof("lobby grpc: %#v", laddr)
+
+		listenPort, err := net.Listen("tcp", laddr)
+		if err != nil {
+			errCh <- xerrors.Errorf("listen error: %w", err)
+			return
+		}
+
+		server := grpc.NewServer()
+		pb.RegisterLobbyServer(server, sv)
+
+		c := make(chan error)
+		go func() {
+			c <- server.Serve(listenPort)
+		}()
+		sv.preparation.Done()
+		select {
+		case <-ctx.Done():
+			server.Stop()
+			log.Infof("gRPC server stop")
+		case err := <-c:
+			errCh <- err
+			log.Infof("gRPC server error: %v", err)
+		}
+	}()
+
+	return errCh
+}
+
+func (sv *LobbyService) SyncRooms(stream pb.Lobby_SyncRoomsServer) error {
+	return sv.roomService.SyncRooms(stream)
+}
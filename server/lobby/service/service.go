@@ -2,30 +2,65 @@ package service
 
 import (
 	"context"
+	"sync"
+	"time"
 
-	"github.com/jmoiron/sqlx"
 	"golang.org/x/xerrors"
 
+	"wsnet2/common"
 	"wsnet2/config"
 	"wsnet2/lobby"
+	"wsnet2/log"
+	"wsnet2/pb"
+	"wsnet2/storage"
 )
 
 type LobbyService struct {
+	pb.UnimplementedLobbyServer
+
+	// HostId : lobby_serverテーブルのID. GRPCPortが0なら登録しない
+	HostId int64
+
 	conf        *config.LobbyConf
+	store       storage.Storage
 	roomService *lobby.RoomService
+	preparation sync.WaitGroup
 }
 
-func New(db *sqlx.DB, conf *config.LobbyConf) (*LobbyService, error) {
-	roomService, err := lobby.NewRoomService(db, conf)
+func New(store storage.Storage, conf *config.LobbyConf) (*LobbyService, error) {
+	roomService, err := lobby.NewRoomService(store, conf)
 	if err != nil {
 		return nil, xerrors.Errorf("NewRoomService: %w", err)
 	}
+	var hostId int64
+	if conf.GRPCPort != 0 {
+		hostId, err = registerHost(store, conf)
+		if err != nil {
+			return nil, xerrors.Errorf("registerHost: %w", err)
+		}
+	}
 	return &LobbyService{
+		HostId:      hostId,
 		conf:        conf,
+		store:       store,
 		roomService: roomService,
 	}, nil
 }
 
+func registerHost(store storage.Storage, conf *config.LobbyConf) (int64, error) {
+	id, err := store.RegisterLobbyServer(context.Background(), &storage.Host{
+		Hostname:      conf.GRPCHost,
+		PublicName:    conf.Hostname,
+		GRPCPort:      conf.GRPCPort,
+		WebSocketPort: conf.Port,
+		Status:        common.HostStatusRunning,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(id), nil
+}
+
 func (s *LobbyService) Serve(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -35,6 +70,48 @@ func (s *LobbyService) Serve(ctx context.Context) error {
 	case <-ctx.Done():
 	case err = <-s.serveAPI(ctx):
 	case err = <-s.servePprof(ctx):
+	case err = <-s.serveGRPC(ctx):
+	case err = <-s.heartbeat(ctx): // preparationを待つので最後に評価する
 	}
 	return err
 }
+
+// heartbeat : gameサーバが部屋の状態を送れるように、gRPCの待受けを始めたらlobby_serverテーブルを更新し続ける
+func (s *LobbyService) heartbeat(ctx context.Context) <-chan error {
+	if s.conf.GRPCPort == 0 {
+		return nil
+	}
+
+	wait := make(chan struct{})
+	go func() {
+		s.preparation.Wait()
+		close(wait)
+	}()
+
+	errCh := make(chan error)
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-wait:
+		}
+
+		log.Debugf("heartbeat start")
+		t := time.NewTicker(time.Duration(s.conf.HeartBeatInterval))
+		defer t.Stop()
+		for {
+			if err := s.store.UpdateLobbyServer(ctx, uint32(s.HostId), common.HostStatusRunning, time.Now().Unix()); err != nil {
+				errCh <- err
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	return errCh
+}
@@ -77,6 +77,26 @@ func Get(l Level) Logger {
 	return rootLogger.WithOptions(zap.IncreaseLevel(toZapLevel(l))).Sugar()
 }
 
+// AtomicLevel is a log level which can be changed at runtime.
+type AtomicLevel struct {
+	zl zap.AtomicLevel
+}
+
+// NewAtomicLevel returns AtomicLevel initialized with l.
+func NewAtomicLevel(l Level) AtomicLevel {
+	return AtomicLevel{zap.NewAtomicLevelAt(toZapLevel(l))}
+}
+
+// SetLevel changes the level of the loggers created by GetAtomic.
+func (l AtomicLevel) SetLevel(lv Level) {
+	l.zl.SetLevel(toZapLevel(lv))
+}
+
+// GetAtomic Logger whose log level can be changed by l.SetLevel.
+func GetAtomic(l AtomicLevel) Logger {
+	return rootLogger.WithOptions(zap.IncreaseLevel(l.zl)).Sugar()
+}
+
 // CurrentLevel returns global log level
 func CurrentLevel() Level {
 	return level
@@ -3,6 +3,9 @@ package log_test
 import (
 	"testing"
 
+	"go.uber.org/zap/zapcore"
+
+	"wsnet2/config"
 	"wsnet2/log"
 )
 
@@ -17,6 +20,24 @@ func TestLevel(t *testing.T) {
 	}
 }
 
+func TestAtomicLevel(t *testing.T) {
+	defer log.InitLogger(&config.LogConf{LogStdoutLevel: uint32(log.DEBUG)})()
+
+	lv := log.NewAtomicLevel(log.INFO)
+	logger := log.GetAtomic(lv).With(log.KeyRoom, "room1")
+	if logger.Desugar().Core().Enabled(zapcore.DebugLevel) {
+		t.Fatalf("debug log is enabled at INFO")
+	}
+	lv.SetLevel(log.DEBUG)
+	if !logger.Desugar().Core().Enabled(zapcore.DebugLevel) {
+		t.Fatalf("debug log is not enabled after SetLevel(DEBUG)")
+	}
+	lv.SetLevel(log.ERROR)
+	if logger.Desugar().Core().Enabled(zapcore.InfoLevel) {
+		t.Fatalf("info log is enabled after SetLevel(ERROR)")
+	}
+}
+
 func TestStringer(t *testing.T) {
 	if s, w := log.ALL.String(), "ALL"; s != w {
 		t.Fatalf("string \"%v\" wants \"%v\"", s, w)
@@ -11,6 +11,8 @@ var (
 	Hubs        = new(expvar.Int)
 	MessageSent = new(expvar.Int)
 	MessageRecv = new(expvar.Int)
+
+	PlayerEventDropped = new(expvar.Int)
 )
 
 func init() {
@@ -19,4 +21,5 @@ func init() {
 	expmap.Set("hubs", Hubs)
 	expmap.Set("message_sent", MessageSent)
 	expmap.Set("message_recv", MessageRecv)
+	expmap.Set("player_event_dropped", PlayerEventDropped)
 }
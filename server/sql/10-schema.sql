@@ -6,8 +6,13 @@ CREATE TABLE `game_server` (
   `public_name` VARCHAR(191) NOT NULL,
   `grpc_port`   INTEGER NOT NULL,
   `ws_port`     INTEGER NOT NULL,
+  `region`      VARCHAR(64) NOT NULL DEFAULT '',
   `status`      TINYINT NOT NULL,
   `heartbeat`   BIGINT,
+  `rooms`       INTEGER NOT NULL DEFAULT 0,
+  `clients`     INTEGER NOT NULL DEFAULT 0,
+  `capacity_usage` FLOAT NOT NULL DEFAULT 0,
+  `cpu_usage`   FLOAT NOT NULL DEFAULT 0,
   UNIQUE KEY `idx_hostname` (`hostname`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
@@ -18,6 +23,21 @@ CREATE TABLE `hub_server` (
   `public_name` VARCHAR(191) NOT NULL,
   `grpc_port`   INTEGER NOT NULL,
   `ws_port`     INTEGER NOT NULL,
+  `region`      VARCHAR(64) NOT NULL DEFAULT '',
+  `status`      TINYINT NOT NULL,
+  `heartbeat`   BIGINT,
+  UNIQUE KEY `idx_hostname` (`hostname`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- gameサーバが部屋の状態を送る先のlobby. ws_portはlobbyのAPIのポート
+DROP TABLE IF EXISTS `lobby_server`;
+CREATE TABLE `lobby_server` (
+  `id`          INTEGER UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,
+  `hostname`    VARCHAR(191) NOT NULL,
+  `public_name` VARCHAR(191) NOT NULL,
+  `grpc_port`   INTEGER NOT NULL,
+  `ws_port`     INTEGER NOT NULL,
+  `region`      VARCHAR(64) NOT NULL DEFAULT '',
   `status`      TINYINT NOT NULL,
   `heartbeat`   BIGINT,
   UNIQUE KEY `idx_hostname` (`hostname`)
@@ -27,7 +47,9 @@ DROP TABLE IF EXISTS `app`;
 CREATE TABLE app (
   `id`   VARCHAR(32) COLLATE ascii_bin PRIMARY KEY,
   `name` VARCHAR(191) COLLATE utf8mb4_bin,
-  `key`  VARCHAR(191) COLLATE ascii_bin
+  `key`  VARCHAR(191) COLLATE ascii_bin,
+  `compression_threshold` INTEGER UNSIGNED NOT NULL DEFAULT 0,
+  `mac_scheme` TINYINT UNSIGNED NOT NULL DEFAULT 0
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 DROP TABLE IF EXISTS `room`;
@@ -45,6 +67,8 @@ CREATE TABLE room (
   `watchers` INTEGER UNSIGNED NOT NULL,
   `props` BLOB,
   `created` DATETIME,
+  `watch_delay` INTEGER UNSIGNED NOT NULL DEFAULT 0,
+  `watcher_chat_disabled` TINYINT(1) NOT NULL DEFAULT 0,
   UNIQUE KEY `idx_number` (`number`),
   KEY `idx_search_group` (`app_id`, `search_group`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -77,6 +101,35 @@ CREATE TABLE player_log (
   KEY `player_id` (`player_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+DROP TABLE IF EXISTS `player_event`;
+CREATE TABLE player_event (
+  `id`        BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+  `app_id`    VARCHAR(32) NOT NULL,
+  `room_id`   VARCHAR(32) NOT NULL,
+  `player_id` VARCHAR(32) NOT NULL,
+  `event`     VARCHAR(32) NOT NULL,
+  `detail`    TEXT NOT NULL,
+  `datetime`  DATETIME,
+  KEY `player_id_datetime` (`player_id`, `datetime`),
+  KEY `room_id` (`room_id`),
+  KEY `datetime` (`datetime`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- room_idが空ならapp全体のban. expiresがNULLなら無期限
+DROP TABLE IF EXISTS `ban`;
+CREATE TABLE ban (
+  `id`        BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+  `app_id`    VARCHAR(32) NOT NULL,
+  `user_id`   VARCHAR(32) NOT NULL,
+  `room_id`   VARCHAR(32) NOT NULL DEFAULT '',
+  `reason`    VARCHAR(255) NOT NULL DEFAULT '',
+  `banned_by` VARCHAR(32) NOT NULL DEFAULT '',
+  `expires`   DATETIME,
+  `created`   DATETIME NOT NULL,
+  UNIQUE KEY `app_user_room` (`app_id`, `user_id`, `room_id`),
+  KEY `expires` (`expires`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
 DROP TABLE IF EXISTS `hub`;
 CREATE TABLE hub (
   `id`      BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
@@ -0,0 +1,787 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"wsnet2/common"
+	"wsnet2/pb"
+)
+
+type memHost struct {
+	GameServer
+	heartbeat int64
+}
+
+// Memory : プロセス内のメモリに保持するStorage.
+// lobby/game/hubを同じプロセスで動かすテスト用で、永続化はしない.
+type Memory struct {
+	mu sync.Mutex
+
+	apps []*pb.App
+
+	gameServers  map[uint32]*memHost
+	hubServers   map[uint32]*memHost
+	lobbyServers map[uint32]*memHost
+	lastHostId   uint32
+
+	rooms       map[string]*pb.RoomInfo
+	roomNumbers map[int32]string
+
+	roomHistories []*RoomHistory
+	playerLogs    []*PlayerLog
+	playerEvents  []*PlayerEvent
+
+	hubs      map[int64]*Hub
+	lastHubId int64
+
+	bans []*Ban
+}
+
+var (
+	_ Storage      = (*Memory)(nil)
+	_ AdminStorage = (*Memory)(nil)
+)
+
+func NewMemory(apps ...*pb.App) *Memory {
+	return &Memory{
+		apps:         apps,
+		gameServers:  make(map[uint32]*memHost),
+		hubServers:   make(map[uint32]*memHost),
+		lobbyServers: make(map[uint32]*memHost),
+		rooms:        make(map[string]*pb.RoomInfo),
+		roomNumbers:  make(map[int32]string),
+		hubs:         make(map[int64]*Hub),
+	}
+}
+
+// AddApp : appを登録する. 登録済みのIDなら上書きする
+func (s *Memory) AddApp(app *pb.App) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, a := range s.apps {
+		if a.Id == app.Id {
+			s.apps[i] = app
+			return
+		}
+	}
+	s.apps = append(s.apps, app)
+}
+
+func (s *Memory) Apps(ctx context.Context) ([]*pb.App, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	apps := make([]*pb.App, len(s.apps))
+	for i, a := range s.apps {
+		apps[i] = &pb.App{
+			Id:                   a.Id,
+			Key:                  a.Key,
+			CompressionThreshold: a.CompressionThreshold,
+			MacScheme:            a.MacScheme,
+		}
+	}
+	return apps, nil
+}
+
+func (s *Memory) registerHost(hosts map[uint32]*memHost, host *Host) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, h := range hosts {
+		if h.Hostname == host.Hostname {
+			h.Host = *host
+			h.Id = id
+			return id
+		}
+	}
+	s.lastHostId++
+	h := &memHost{GameServer: GameServer{Host: *host}}
+	h.Id = s.lastHostId
+	hosts[h.Id] = h
+	return h.Id
+}
+
+func (s *Memory) updateHost(hosts map[uint32]*memHost, id uint32, status int32, heartbeat int64, load *GameLoad) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := hosts[id]
+	if !ok {
+		return
+	}
+	h.Status = status
+	h.heartbeat = heartbeat
+	if load != nil {
+		h.GameLoad = *load
+	}
+}
+
+func (s *Memory) RegisterGameServer(ctx context.Context, host *Host) (uint32, error) {
+	return s.registerHost(s.gameServers, host), nil
+}
+
+func (s *Memory) UpdateGameServer(ctx context.Context, id uint32, status int32, heartbeat int64, load *GameLoad) error {
+	s.updateHost(s.gameServers, id, status, heartbeat, load)
+	return nil
+}
+
+func (s *Memory) AliveGameServers(ctx context.Context, since int64) ([]*GameServer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	servers := []*GameServer{}
+	for _, h := range s.gameServers {
+		if h.heartbeat < since {
+			continue
+		}
+		if h.Status == common.HostStatusRunning || h.Status == common.HostStatusClosing {
+			gs := h.GameServer
+			servers = append(servers, &gs)
+		}
+	}
+	return servers, nil
+}
+
+func (s *Memory) RegisterHubServer(ctx context.Context, host *Host) (uint32, error) {
+	return s.registerHost(s.hubServers, host), nil
+}
+
+func (s *Memory) UpdateHubServer(ctx context.Context, id uint32, status int32, heartbeat int64) error {
+	s.updateHost(s.hubServers, id, status, heartbeat, nil)
+	return nil
+}
+
+func (s *Memory) aliveHosts(hosts map[uint32]*memHost, since int64) []*Host {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	servers := []*Host{}
+	for _, h := range hosts {
+		if h.heartbeat >= since && h.Status == common.HostStatusRunning {
+			host := h.Host
+			servers = append(servers, &host)
+		}
+	}
+	return servers
+}
+
+func (s *Memory) AliveHubServers(ctx context.Context, since int64) ([]*Host, error) {
+	return s.aliveHosts(s.hubServers, since), nil
+}
+
+func (s *Memory) RegisterLobbyServer(ctx context.Context, host *Host) (uint32, error) {
+	return s.registerHost(s.lobbyServers, host), nil
+}
+
+func (s *Memory) UpdateLobbyServer(ctx context.Context, id uint32, status int32, heartbeat int64) error {
+	s.updateHost(s.lobbyServers, id, status, heartbeat, nil)
+	return nil
+}
+
+func (s *Memory) AliveLobbyServers(ctx context.Context, since int64) ([]*Host, error) {
+	return s.aliveHosts(s.lobbyServers, since), nil
+}
+
+func roomNumber(room *pb.RoomInfo) int32 {
+	if room.Number == nil {
+		return 0
+	}
+	return room.Number.Number
+}
+
+func (s *Memory) InsertRoom(ctx context.Context, room *pb.RoomInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkRoomDup(room); err != nil {
+		return err
+	}
+	s.insertRoom(room)
+	return nil
+}
+
+func (s *Memory) checkRoomDup(room *pb.RoomInfo) error {
+	if _, ok := s.rooms[room.Id]; ok {
+		return ErrDuplicate
+	}
+	if num := roomNumber(room); num != 0 {
+		if _, ok := s.roomNumbers[num]; ok {
+			return ErrDuplicate
+		}
+	}
+	return nil
+}
+
+func (s *Memory) insertRoom(room *pb.RoomInfo) {
+	if num := roomNumber(room); num != 0 {
+		s.roomNumbers[num] = room.Id
+	}
+	s.rooms[room.Id] = room.Clone()
+}
+
+func (s *Memory) BeginRoomTx(ctx context.Context) (RoomTx, error) {
+	return &memoryRoomTx{s: s}, nil
+}
+
+// memoryRoomTx : 作成した部屋をCommitまで保持する
+type memoryRoomTx struct {
+	s     *Memory
+	rooms []*pb.RoomInfo
+	done  bool
+}
+
+func (t *memoryRoomTx) InsertRoom(ctx context.Context, room *pb.RoomInfo) error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	if err := t.s.checkRoomDup(room); err != nil {
+		return err
+	}
+	for _, r := range t.rooms {
+		if r.Id == room.Id || (roomNumber(r) != 0 && roomNumber(r) == roomNumber(room)) {
+			return ErrDuplicate
+		}
+	}
+	t.rooms = append(t.rooms, room.Clone())
+	return nil
+}
+
+func (t *memoryRoomTx) Commit() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	for _, room := range t.rooms {
+		if err := t.s.checkRoomDup(room); err != nil {
+			return err
+		}
+	}
+	for _, room := range t.rooms {
+		t.s.insertRoom(room)
+	}
+	return nil
+}
+
+func (t *memoryRoomTx) Rollback() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	return nil
+}
+
+func (s *Memory) UpdateRoom(ctx context.Context, room *pb.RoomInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.rooms[room.Id]
+	if !ok {
+		return nil
+	}
+	if n, num := roomNumber(old), roomNumber(room); n != num {
+		if id, ok := s.roomNumbers[num]; num != 0 && ok && id != room.Id {
+			return ErrDuplicate
+		}
+		delete(s.roomNumbers, n)
+		if num != 0 {
+			s.roomNumbers[num] = room.Id
+		}
+	}
+	s.rooms[room.Id] = room.Clone()
+	return nil
+}
+
+func (s *Memory) deleteRoom(roomId string) {
+	if room, ok := s.rooms[roomId]; ok {
+		delete(s.roomNumbers, roomNumber(room))
+		delete(s.rooms, roomId)
+	}
+}
+
+func (s *Memory) DeleteRoom(ctx context.Context, roomId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteRoom(roomId)
+	return nil
+}
+
+func (s *Memory) ArchiveRooms(ctx context.Context, hostId uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	archived := make(map[string]bool)
+	for id, room := range s.rooms {
+		if room.HostId != hostId {
+			continue
+		}
+		archived[id] = true
+		num := roomNumber(room)
+		s.roomHistories = append(s.roomHistories, &RoomHistory{
+			AppID:       room.AppId,
+			HostID:      room.HostId,
+			RoomID:      room.Id,
+			Number:      sql.NullInt32{Int32: num, Valid: num != 0},
+			SearchGroup: room.SearchGroup,
+			MaxPlayers:  room.MaxPlayers,
+			PublicProps: room.PublicProps,
+			Created:     room.Created.Time(),
+			Closed:      now,
+		})
+		s.deleteRoom(id)
+	}
+	bans := s.bans[:0]
+	for _, b := range s.bans {
+		if !archived[b.RoomID] {
+			bans = append(bans, b)
+		}
+	}
+	s.bans = bans
+	return nil
+}
+
+func (s *Memory) GetRoom(ctx context.Context, appId, roomId string) (*pb.RoomInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.rooms[roomId]
+	if !ok || room.AppId != appId {
+		return nil, ErrNotFound
+	}
+	return room.Clone(), nil
+}
+
+func (s *Memory) GetRoomByNumber(ctx context.Context, appId string, number int32) (*pb.RoomInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.rooms[s.roomNumbers[number]]
+	if number == 0 || !ok || room.AppId != appId {
+		return nil, ErrNotFound
+	}
+	return room.Clone(), nil
+}
+
+func (s *Memory) GetRoomsByIds(ctx context.Context, appId string, roomIds []string) ([]*pb.RoomInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rooms := []*pb.RoomInfo{}
+	for _, id := range roomIds {
+		if room, ok := s.rooms[id]; ok && room.AppId == appId {
+			rooms = append(rooms, room.Clone())
+		}
+	}
+	return rooms, nil
+}
+
+func (s *Memory) GetRoomsByNumbers(ctx context.Context, appId string, numbers []int32) ([]*pb.RoomInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rooms := []*pb.RoomInfo{}
+	for _, num := range numbers {
+		if room, ok := s.rooms[s.roomNumbers[num]]; num != 0 && ok && room.AppId == appId {
+			rooms = append(rooms, room.Clone())
+		}
+	}
+	return rooms, nil
+}
+
+func (s *Memory) SearchRooms(ctx context.Context, appId string, searchGroup uint32, limit int) ([]*pb.RoomInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rooms := []*pb.RoomInfo{}
+	for _, room := range s.rooms {
+		if room.AppId == appId && room.SearchGroup == searchGroup && room.Visible {
+			rooms = append(rooms, room.Clone())
+		}
+	}
+	// MySQLと同様に主キー順で返す
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Id < rooms[j].Id })
+	if len(rooms) > limit {
+		rooms = rooms[:limit]
+	}
+	return rooms, nil
+}
+
+func (s *Memory) InsertRoomHistory(ctx context.Context, history *RoomHistory) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := *history
+	s.roomHistories = append(s.roomHistories, &h)
+	return nil
+}
+
+func (s *Memory) InsertPlayerLog(ctx context.Context, plog *PlayerLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := *plog
+	s.playerLogs = append(s.playerLogs, &l)
+	return nil
+}
+
+func (s *Memory) InsertPlayerEvents(ctx context.Context, events []*PlayerEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, event := range events {
+		ev := *event
+		s.playerEvents = append(s.playerEvents, &ev)
+	}
+	return nil
+}
+
+func (s *Memory) InsertHub(ctx context.Context, hostId uint32, roomId string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range s.hubs {
+		if h.HostId == hostId && h.RoomId == roomId {
+			return 0, ErrDuplicate
+		}
+	}
+	s.lastHubId++
+	s.hubs[s.lastHubId] = &Hub{
+		Id:      s.lastHubId,
+		HostId:  hostId,
+		RoomId:  roomId,
+		Created: time.Now().UTC(),
+	}
+	return s.lastHubId, nil
+}
+
+func (s *Memory) UpdateHubWatchers(ctx context.Context, id int64, watchers int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.hubs[id]; ok {
+		h.Watchers = watchers
+	}
+	return nil
+}
+
+func (s *Memory) DeleteHub(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.hubs, id)
+	return nil
+}
+
+func (s *Memory) DeleteHostHubs(ctx context.Context, hostId uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, h := range s.hubs {
+		if h.HostId == hostId {
+			delete(s.hubs, id)
+		}
+	}
+	return nil
+}
+
+func (s *Memory) GetRoomHubs(ctx context.Context, roomId string) ([]*Hub, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hubs := []*Hub{}
+	for _, h := range s.hubs {
+		if h.RoomId == roomId {
+			hub := *h
+			hubs = append(hubs, &hub)
+		}
+	}
+	return hubs, nil
+}
+
+func (s *Memory) InsertBan(ctx context.Context, ban *Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := *ban
+	for i, old := range s.bans {
+		if old.AppID == b.AppID && old.UserID == b.UserID && old.RoomID == b.RoomID {
+			s.bans[i] = &b
+			return nil
+		}
+	}
+	s.bans = append(s.bans, &b)
+	return nil
+}
+
+func (s *Memory) DeleteBan(ctx context.Context, appId, userId, roomId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, b := range s.bans {
+		if b.AppID == appId && b.UserID == userId && b.RoomID == roomId {
+			s.bans = append(s.bans[:i], s.bans[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *Memory) DeleteRoomBans(ctx context.Context, roomId string) error {
+	if roomId == "" {
+		return xerrors.Errorf("empty room id")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bans := s.bans[:0]
+	for _, b := range s.bans {
+		if b.RoomID != roomId {
+			bans = append(bans, b)
+		}
+	}
+	s.bans = bans
+	return nil
+}
+
+func (s *Memory) ActiveBans(ctx context.Context, at time.Time) ([]*Ban, error) {
+	return s.Bans(ctx, &BanFilter{ActiveAt: &at})
+}
+
+func (s *Memory) AppList(ctx context.Context) ([]*AppInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	apps := make([]*AppInfo, len(s.apps))
+	for i, a := range s.apps {
+		apps[i] = &AppInfo{Id: a.Id, Key: a.Key}
+	}
+	return apps, nil
+}
+
+func (s *Memory) servers(hosts map[uint32]*memHost) []*ServerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	servers := make([]*ServerInfo, 0, len(hosts))
+	for _, h := range hosts {
+		servers = append(servers, &ServerInfo{GameServer: h.GameServer, Heartbeat: h.heartbeat})
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Id < servers[j].Id })
+	return servers
+}
+
+func (s *Memory) GameServers(ctx context.Context) ([]*ServerInfo, error) {
+	return s.servers(s.gameServers), nil
+}
+
+func (s *Memory) HubServers(ctx context.Context) ([]*ServerInfo, error) {
+	return s.servers(s.hubServers), nil
+}
+
+func (s *Memory) LobbyServers(ctx context.Context) ([]*ServerInfo, error) {
+	return s.servers(s.lobbyServers), nil
+}
+
+func (s *Memory) Rooms(ctx context.Context, roomIds []string) ([]*pb.RoomInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rooms := []*pb.RoomInfo{}
+	if roomIds == nil {
+		for _, room := range s.rooms {
+			rooms = append(rooms, room.Clone())
+		}
+		sort.Slice(rooms, func(i, j int) bool { return rooms[i].Id < rooms[j].Id })
+		return rooms, nil
+	}
+	for _, id := range roomIds {
+		if room, ok := s.rooms[id]; ok {
+			rooms = append(rooms, room.Clone())
+		}
+	}
+	return rooms, nil
+}
+
+func (s *Memory) RoomHistories(ctx context.Context, filter *RoomHistoryFilter) ([]*RoomHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids map[string]bool
+	if filter.RoomIds != nil {
+		ids = make(map[string]bool, len(filter.RoomIds))
+		for _, id := range filter.RoomIds {
+			ids[id] = true
+		}
+	}
+	histories := []*RoomHistory{}
+	for _, h := range s.roomHistories {
+		if filter.AppId != "" && h.AppID != filter.AppId {
+			continue
+		}
+		if ids != nil && !ids[h.RoomID] {
+			continue
+		}
+		if filter.CreatedBefore != nil && h.Created.After(*filter.CreatedBefore) {
+			continue
+		}
+		if filter.CreatedAfter != nil && h.Created.Before(*filter.CreatedAfter) {
+			continue
+		}
+		if filter.ClosedAfter != nil && h.Closed.Before(*filter.ClosedAfter) {
+			continue
+		}
+		if filter.At != nil && (h.Created.After(*filter.At) || h.Closed.Before(*filter.At)) {
+			continue
+		}
+		history := *h
+		histories = append(histories, &history)
+	}
+	sort.SliceStable(histories, func(i, j int) bool { return histories[i].Created.After(histories[j].Created) })
+	if filter.Limit > 0 && len(histories) > filter.Limit {
+		histories = histories[:filter.Limit]
+	}
+	return histories, nil
+}
+
+func (s *Memory) PlayerLogs(ctx context.Context, roomIds []string) ([]*PlayerLog, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make(map[string]bool, len(roomIds))
+	for _, id := range roomIds {
+		ids[id] = true
+	}
+	plogs := []*PlayerLog{}
+	for _, l := range s.playerLogs {
+		if ids[l.RoomID] {
+			plog := *l
+			plogs = append(plogs, &plog)
+		}
+	}
+	return plogs, nil
+}
+
+func (s *Memory) PlayerEvents(ctx context.Context, filter *PlayerEventFilter) ([]*PlayerEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := []*PlayerEvent{}
+	for _, ev := range s.playerEvents {
+		if filter.AppId != "" && ev.AppID != filter.AppId {
+			continue
+		}
+		if filter.PlayerId != "" && ev.PlayerID != filter.PlayerId {
+			continue
+		}
+		if filter.RoomId != "" && ev.RoomID != filter.RoomId {
+			continue
+		}
+		if filter.Since != nil && ev.Datetime.Before(*filter.Since) {
+			continue
+		}
+		if filter.Until != nil && !ev.Datetime.Before(*filter.Until) {
+			continue
+		}
+		e := *ev
+		events = append(events, &e)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Datetime.Before(events[j].Datetime) })
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+func (s *Memory) Bans(ctx context.Context, filter *BanFilter) ([]*Ban, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bans := []*Ban{}
+	// 作成日時が同じなら後から登録したものを先にする
+	for i := len(s.bans) - 1; i >= 0; i-- {
+		b := s.bans[i]
+		if filter.AppId != "" && b.AppID != filter.AppId {
+			continue
+		}
+		if filter.UserId != "" && b.UserID != filter.UserId {
+			continue
+		}
+		if filter.ActiveAt != nil && !b.Active(*filter.ActiveAt) {
+			continue
+		}
+		ban := *b
+		bans = append(bans, &ban)
+	}
+	sort.SliceStable(bans, func(i, j int) bool { return bans[i].Created.After(bans[j].Created) })
+	if filter.Limit > 0 && len(bans) > filter.Limit {
+		bans = bans[:filter.Limit]
+	}
+	return bans, nil
+}
+
+func (s *Memory) PurgeRoomHistories(ctx context.Context, before time.Time, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	histories := s.roomHistories[:0]
+	for _, h := range s.roomHistories {
+		if n < limit && h.Created.Before(before) {
+			n++
+			continue
+		}
+		histories = append(histories, h)
+	}
+	s.roomHistories = histories
+	return n, nil
+}
+
+func (s *Memory) PurgePlayerLogs(ctx context.Context, before time.Time, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	plogs := s.playerLogs[:0]
+	for _, l := range s.playerLogs {
+		if n < limit && l.Datetime.Before(before) {
+			n++
+			continue
+		}
+		plogs = append(plogs, l)
+	}
+	s.playerLogs = plogs
+	return n, nil
+}
+
+func (s *Memory) ArchiveRoomHistories(ctx context.Context, before time.Time, limit int, archive func([]*RoomHistory) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	targets := make(map[*RoomHistory]bool)
+	histories := []*RoomHistory{}
+	for _, h := range s.roomHistories {
+		if len(histories) < limit && h.Created.Before(before) {
+			targets[h] = true
+			c := *h
+			histories = append(histories, &c)
+		}
+	}
+	if len(histories) == 0 {
+		return 0, nil
+	}
+	if err := archive(histories); err != nil {
+		return 0, xerrors.Errorf("archive room_history: %w", err)
+	}
+	remains := s.roomHistories[:0]
+	for _, h := range s.roomHistories {
+		if !targets[h] {
+			remains = append(remains, h)
+		}
+	}
+	s.roomHistories = remains
+	return len(histories), nil
+}
+
+func (s *Memory) ArchivePlayerLogs(ctx context.Context, before time.Time, limit int, archive func([]*PlayerLog) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	targets := make(map[*PlayerLog]bool)
+	plogs := []*PlayerLog{}
+	for _, l := range s.playerLogs {
+		if len(plogs) < limit && l.Datetime.Before(before) {
+			targets[l] = true
+			c := *l
+			plogs = append(plogs, &c)
+		}
+	}
+	if len(plogs) == 0 {
+		return 0, nil
+	}
+	if err := archive(plogs); err != nil {
+		return 0, xerrors.Errorf("archive player_log: %w", err)
+	}
+	remains := s.playerLogs[:0]
+	for _, l := range s.playerLogs {
+		if !targets[l] {
+			remains = append(remains, l)
+		}
+	}
+	s.playerLogs = remains
+	return len(plogs), nil
+}
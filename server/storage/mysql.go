@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+var mysqlDialect = dialect{
+	serverRegisterQuery: func(table string) string {
+		return "" +
+			"INSERT INTO `" + table + "` (`hostname`, `public_name`, `grpc_port`, `ws_port`, `region`, `status`) VALUES (:hostname, :public_name, :grpc_port, :ws_port, :region, :status) " +
+			"ON DUPLICATE KEY UPDATE `public_name`=:public_name, `grpc_port`=:grpc_port, `ws_port`=:ws_port, `region`=:region, `status`=:status, id=last_insert_id(id)"
+	},
+	banUpsertQuery: "" +
+		"INSERT INTO `ban` (`app_id`, `user_id`, `room_id`, `reason`, `banned_by`, `expires`, `created`) VALUES (:app_id, :user_id, :room_id, :reason, :banned_by, :expires, :created) " +
+		"ON DUPLICATE KEY UPDATE `reason`=:reason, `banned_by`=:banned_by, `expires`=:expires, `created`=:created",
+}
+
+// MySQL : MySQLを使うStorage
+type MySQL struct {
+	sqlDB
+}
+
+var _ Database = (*MySQL)(nil)
+
+func NewMySQL(db *sqlx.DB) *MySQL {
+	return &MySQL{sqlDB{db: db, dialect: mysqlDialect}}
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/xerrors"
+
+	"wsnet2/config"
+)
+
+// Open : conf.Driverに応じたDatabaseを開く.
+// SQLiteの場合は存在しないテーブルを作成する.
+func Open(conf *config.DbConf) (Database, error) {
+	switch conf.Driver {
+	case "", "mysql":
+		db, err := sqlx.Open("mysql", conf.DSN())
+		if err != nil {
+			return nil, xerrors.Errorf("open mysql: %w", err)
+		}
+		db.SetConnMaxLifetime(time.Duration(conf.ConnMaxLifetime))
+		return NewMySQL(db), nil
+
+	case "sqlite3":
+		if sqliteDriver == "" {
+			return nil, xerrors.Errorf("sqlite3 is not available: built without cgo")
+		}
+		db, err := sqlx.Open(sqliteDriver, conf.DSN())
+		if err != nil {
+			return nil, xerrors.Errorf("open sqlite3: %w", err)
+		}
+		s := NewSQLite(db)
+		if err := s.CreateTables(context.Background()); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, xerrors.Errorf("unsupported database driver: %q", conf.Driver)
+}
@@ -0,0 +1,713 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/xerrors"
+
+	"wsnet2/pb"
+)
+
+var (
+	roomInsertQuery        string
+	roomUpdateQuery        string
+	roomHistoryInsertQuery string
+)
+
+const (
+	gameServerHeartbeatQuery = "" +
+		"UPDATE `game_server` SET `status`=:status, heartbeat=:now, " +
+		"`rooms`=:rooms, `clients`=:clients, `capacity_usage`=:capacity_usage, `cpu_usage`=:cpu_usage WHERE `id`=:hostid"
+
+	hubServerHeartbeatQuery = "" +
+		"UPDATE `hub_server` SET `status`=:status, heartbeat=:now WHERE `id`=:hostid"
+
+	lobbyServerHeartbeatQuery = "" +
+		"UPDATE `lobby_server` SET `status`=:status, heartbeat=:now WHERE `id`=:hostid"
+
+	roomHistoryColumns = "app_id, host_id, room_id, number, search_group, max_players, public_props, private_props, created, closed"
+)
+
+func init() {
+	initQueries()
+}
+
+func dbCols(t reflect.Type) []string {
+	cols := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if c := t.Field(i).Tag.Get("db"); c != "" {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+func initQueries() {
+	// room
+	{
+		cols := dbCols(reflect.TypeOf(pb.RoomInfo{}))
+		roomInsertQuery = fmt.Sprintf("INSERT INTO room (%s) VALUES (:%s)",
+			strings.Join(cols, ","), strings.Join(cols, ",:"))
+
+		var sets []string
+		for _, c := range cols {
+			if c != "id" {
+				sets = append(sets, c+"=:"+c)
+			}
+		}
+		roomUpdateQuery = fmt.Sprintf("UPDATE room SET %s WHERE id=:id", strings.Join(sets, ","))
+	}
+
+	// room_history
+	{
+		cols := dbCols(reflect.TypeOf(RoomHistory{}))
+		roomHistoryInsertQuery = fmt.Sprintf("INSERT INTO room_history (%s) VALUES (:%s)",
+			strings.Join(cols, ","), strings.Join(cols, ",:"))
+	}
+}
+
+// dialect : DBごとに異なるクエリ
+type dialect struct {
+	// serverRegisterQuery : game_server, hub_server, lobby_serverへの登録. hostnameが重複していたら上書きする
+	serverRegisterQuery func(table string) string
+
+	// registerReturning : 登録クエリが RETURNING id でIDを返す.
+	// falseならLastInsertIdを使う
+	registerReturning bool
+
+	// banUpsertQuery : banの登録. app_id, user_id, room_idが重複していたら上書きする
+	banUpsertQuery string
+}
+
+// sqlDB : MySQL, SQLiteで共通の実装
+type sqlDB struct {
+	db *sqlx.DB
+	dialect
+}
+
+// DB : 接続プールの調整など、DB固有の操作のため
+func (s *sqlDB) DB() *sqlx.DB {
+	return s.db
+}
+
+func (s *sqlDB) Apps(ctx context.Context) ([]*pb.App, error) {
+	var apps []*pb.App
+	err := s.db.SelectContext(ctx, &apps, "SELECT id, `key`, compression_threshold, mac_scheme FROM app")
+	if err != nil {
+		return nil, xerrors.Errorf("select apps: %w", err)
+	}
+	return apps, nil
+}
+
+func (s *sqlDB) registerHost(ctx context.Context, table string, host *Host) (uint32, error) {
+	query := s.serverRegisterQuery(table)
+	bind := map[string]interface{}{
+		"hostname":    host.Hostname,
+		"public_name": host.PublicName,
+		"grpc_port":   host.GRPCPort,
+		"ws_port":     host.WebSocketPort,
+		"region":      host.Region,
+		"status":      host.Status,
+	}
+	if s.registerReturning {
+		rows, err := s.db.NamedQueryContext(ctx, query, bind)
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+		var id uint32
+		if !rows.Next() {
+			return 0, xerrors.Errorf("no id returned: %w", rows.Err())
+		}
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		return id, nil
+	}
+	res, err := s.db.NamedExecContext(ctx, query, bind)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(id), nil
+}
+
+func (s *sqlDB) RegisterGameServer(ctx context.Context, host *Host) (uint32, error) {
+	return s.registerHost(ctx, "game_server", host)
+}
+
+func (s *sqlDB) UpdateGameServer(ctx context.Context, id uint32, status int32, heartbeat int64, load *GameLoad) error {
+	bind := map[string]interface{}{
+		"hostid":         id,
+		"status":         status,
+		"now":            heartbeat,
+		"rooms":          load.Rooms,
+		"clients":        load.Clients,
+		"capacity_usage": load.CapacityUsage,
+		"cpu_usage":      load.CPUUsage,
+	}
+	_, err := s.db.NamedExecContext(ctx, gameServerHeartbeatQuery, bind)
+	return err
+}
+
+func (s *sqlDB) AliveGameServers(ctx context.Context, since int64) ([]*GameServer, error) {
+	query := ("SELECT id, hostname, public_name, grpc_port, ws_port, region, status,\n" +
+		"  rooms, clients, capacity_usage, cpu_usage\n" +
+		"FROM game_server WHERE status IN (1, 2) AND heartbeat >= ?")
+
+	var servers []*GameServer
+	err := s.db.SelectContext(ctx, &servers, query, since)
+	if err != nil {
+		return nil, xerrors.Errorf("select game servers: %w", err)
+	}
+	return servers, nil
+}
+
+func (s *sqlDB) RegisterHubServer(ctx context.Context, host *Host) (uint32, error) {
+	return s.registerHost(ctx, "hub_server", host)
+}
+
+func (s *sqlDB) UpdateHubServer(ctx context.Context, id uint32, status int32, heartbeat int64) error {
+	bind := map[string]interface{}{
+		"hostid": id,
+		"status": status,
+		"now":    heartbeat,
+	}
+	_, err := s.db.NamedExecContext(ctx, hubServerHeartbeatQuery, bind)
+	return err
+}
+
+func (s *sqlDB) AliveHubServers(ctx context.Context, since int64) ([]*Host, error) {
+	query := "SELECT id, hostname, public_name, grpc_port, ws_port, region, status FROM hub_server WHERE status=1 AND heartbeat >= ?"
+
+	var servers []*Host
+	err := s.db.SelectContext(ctx, &servers, query, since)
+	if err != nil {
+		return nil, xerrors.Errorf("select hub servers: %w", err)
+	}
+	return servers, nil
+}
+
+func (s *sqlDB) RegisterLobbyServer(ctx context.Context, host *Host) (uint32, error) {
+	return s.registerHost(ctx, "lobby_server", host)
+}
+
+func (s *sqlDB) UpdateLobbyServer(ctx context.Context, id uint32, status int32, heartbeat int64) error {
+	bind := map[string]interface{}{
+		"hostid": id,
+		"status": status,
+		"now":    heartbeat,
+	}
+	_, err := s.db.NamedExecContext(ctx, lobbyServerHeartbeatQuery, bind)
+	return err
+}
+
+func (s *sqlDB) AliveLobbyServers(ctx context.Context, since int64) ([]*Host, error) {
+	query := "SELECT id, hostname, public_name, grpc_port, ws_port, region, status FROM lobby_server WHERE status=1 AND heartbeat >= ?"
+
+	var servers []*Host
+	err := s.db.SelectContext(ctx, &servers, query, since)
+	if err != nil {
+		return nil, xerrors.Errorf("select lobby servers: %w", err)
+	}
+	return servers, nil
+}
+
+func (s *sqlDB) InsertRoom(ctx context.Context, room *pb.RoomInfo) error {
+	_, err := s.db.NamedExecContext(ctx, roomInsertQuery, room)
+	return err
+}
+
+func (s *sqlDB) BeginRoomTx(ctx context.Context) (RoomTx, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlRoomTx{tx}, nil
+}
+
+type sqlRoomTx struct {
+	tx *sqlx.Tx
+}
+
+func (t *sqlRoomTx) InsertRoom(ctx context.Context, room *pb.RoomInfo) error {
+	_, err := t.tx.NamedExecContext(ctx, roomInsertQuery, room)
+	return err
+}
+
+func (t *sqlRoomTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *sqlRoomTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+func (s *sqlDB) UpdateRoom(ctx context.Context, room *pb.RoomInfo) error {
+	_, err := s.db.NamedExecContext(ctx, roomUpdateQuery, room)
+	return err
+}
+
+func (s *sqlDB) DeleteRoom(ctx context.Context, roomId string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM room WHERE id=?", roomId)
+	return err
+}
+
+func (s *sqlDB) ArchiveRooms(ctx context.Context, hostId uint32) error {
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO room_history (room_id, app_id, host_id, number, search_group, max_players, public_props, created, closed) "+
+		"SELECT id, app_id, host_id, number, search_group, max_players, props, created, ? FROM room WHERE host_id=?", time.Now().UTC(), hostId); err != nil {
+		return xerrors.Errorf("room to history: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM `ban` WHERE `room_id` IN (SELECT id FROM `room` WHERE host_id=?)", hostId); err != nil {
+		return xerrors.Errorf("delete room bans: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM `room` WHERE host_id=?", hostId); err != nil {
+		return xerrors.Errorf("delete rooms: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlDB) getRoom(ctx context.Context, query string, args ...any) (*pb.RoomInfo, error) {
+	var room pb.RoomInfo
+	err := s.db.GetContext(ctx, &room, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+func (s *sqlDB) GetRoom(ctx context.Context, appId, roomId string) (*pb.RoomInfo, error) {
+	return s.getRoom(ctx, "SELECT * FROM room WHERE app_id = ? AND id = ?", appId, roomId)
+}
+
+func (s *sqlDB) GetRoomByNumber(ctx context.Context, appId string, number int32) (*pb.RoomInfo, error) {
+	return s.getRoom(ctx, "SELECT * FROM room WHERE app_id = ? AND number = ?", appId, number)
+}
+
+func (s *sqlDB) selectRooms(ctx context.Context, query string, args ...any) ([]*pb.RoomInfo, error) {
+	query, params, err := sqlx.In(query, args...)
+	if err != nil {
+		return nil, xerrors.Errorf("sqlx.In: %w", err)
+	}
+	rooms := []*pb.RoomInfo{}
+	err = s.db.SelectContext(ctx, &rooms, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	return rooms, nil
+}
+
+func (s *sqlDB) GetRoomsByIds(ctx context.Context, appId string, roomIds []string) ([]*pb.RoomInfo, error) {
+	if len(roomIds) == 0 {
+		return []*pb.RoomInfo{}, nil
+	}
+	return s.selectRooms(ctx, "SELECT * FROM room WHERE app_id = ? AND id IN (?)", appId, roomIds)
+}
+
+func (s *sqlDB) GetRoomsByNumbers(ctx context.Context, appId string, numbers []int32) ([]*pb.RoomInfo, error) {
+	if len(numbers) == 0 {
+		return []*pb.RoomInfo{}, nil
+	}
+	return s.selectRooms(ctx, "SELECT * FROM room WHERE app_id = ? AND number IN (?)", appId, numbers)
+}
+
+func (s *sqlDB) SearchRooms(ctx context.Context, appId string, searchGroup uint32, limit int) ([]*pb.RoomInfo, error) {
+	return s.selectRooms(ctx, "SELECT * FROM room WHERE app_id = ? AND search_group = ? AND visible = 1 LIMIT ?", appId, searchGroup, limit)
+}
+
+func (s *sqlDB) InsertRoomHistory(ctx context.Context, history *RoomHistory) error {
+	// SQLiteは日時を文字列で比較するのでUTCに揃える
+	h := *history
+	h.Created = h.Created.UTC()
+	h.Closed = h.Closed.UTC()
+	_, err := s.db.NamedExecContext(ctx, roomHistoryInsertQuery, &h)
+	return err
+}
+
+func (s *sqlDB) InsertPlayerLog(ctx context.Context, plog *PlayerLog) error {
+	const q = "INSERT INTO player_log (`room_id`, `player_id`, `message`, `datetime`) VALUES (:room_id, :player_id, :message, :datetime)"
+	l := *plog
+	l.Datetime = l.Datetime.UTC()
+	_, err := s.db.NamedExecContext(ctx, q, &l)
+	return err
+}
+
+func (s *sqlDB) InsertPlayerEvents(ctx context.Context, events []*PlayerEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	const q = "INSERT INTO player_event (`app_id`, `room_id`, `player_id`, `event`, `detail`, `datetime`) VALUES (:app_id, :room_id, :player_id, :event, :detail, :datetime)"
+	evs := make([]*PlayerEvent, len(events))
+	for i, event := range events {
+		ev := *event
+		ev.Datetime = ev.Datetime.UTC()
+		evs[i] = &ev
+	}
+	_, err := s.db.NamedExecContext(ctx, q, evs)
+	return err
+}
+
+func (s *sqlDB) InsertHub(ctx context.Context, hostId uint32, roomId string) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		"INSERT INTO `hub` (`host_id`, `room_id`, `watchers`, `created`) VALUES (?,?,?,?)",
+		hostId, roomId, 0, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *sqlDB) UpdateHubWatchers(ctx context.Context, id int64, watchers int) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE `hub` SET `watchers`= ? WHERE `id` = ?", watchers, id)
+	return err
+}
+
+func (s *sqlDB) DeleteHub(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM `hub` WHERE `id` = ?", id)
+	return err
+}
+
+func (s *sqlDB) DeleteHostHubs(ctx context.Context, hostId uint32) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM hub WHERE `host_id` = ?", hostId)
+	return err
+}
+
+func (s *sqlDB) GetRoomHubs(ctx context.Context, roomId string) ([]*Hub, error) {
+	var hubs []*Hub
+	err := s.db.SelectContext(ctx, &hubs, "SELECT `id`, `host_id`, `room_id`, `watchers`, `created` FROM `hub` WHERE `room_id`=?", roomId)
+	if err != nil {
+		return nil, err
+	}
+	return hubs, nil
+}
+
+func (s *sqlDB) InsertBan(ctx context.Context, ban *Ban) error {
+	b := *ban
+	b.Created = b.Created.UTC()
+	if b.Expires.Valid {
+		b.Expires.Time = b.Expires.Time.UTC()
+	}
+	_, err := s.db.NamedExecContext(ctx, s.banUpsertQuery, &b)
+	return err
+}
+
+func (s *sqlDB) DeleteBan(ctx context.Context, appId, userId, roomId string) error {
+	res, err := s.db.ExecContext(ctx,
+		"DELETE FROM `ban` WHERE `app_id`=? AND `user_id`=? AND `room_id`=?", appId, userId, roomId)
+	if err != nil {
+		return xerrors.Errorf("delete ban: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return xerrors.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlDB) DeleteRoomBans(ctx context.Context, roomId string) error {
+	if roomId == "" {
+		return xerrors.Errorf("empty room id")
+	}
+	_, err := s.db.ExecContext(ctx, "DELETE FROM `ban` WHERE `room_id`=?", roomId)
+	return err
+}
+
+func (s *sqlDB) ActiveBans(ctx context.Context, at time.Time) ([]*Ban, error) {
+	return s.Bans(ctx, &BanFilter{ActiveAt: &at})
+}
+
+func (s *sqlDB) AppList(ctx context.Context) ([]*AppInfo, error) {
+	var apps []*AppInfo
+	err := s.db.SelectContext(ctx, &apps, "SELECT `id`, `key`, COALESCE(`name`, '') AS `name` FROM `app`")
+	if err != nil {
+		return nil, xerrors.Errorf("select apps: %w", err)
+	}
+	return apps, nil
+}
+
+func (s *sqlDB) GameServers(ctx context.Context) ([]*ServerInfo, error) {
+	query := ("SELECT id, hostname, public_name, grpc_port, ws_port, region, status, COALESCE(heartbeat, 0) AS heartbeat,\n" +
+		"  rooms, clients, capacity_usage, cpu_usage\n" +
+		"FROM game_server")
+
+	var servers []*ServerInfo
+	err := s.db.SelectContext(ctx, &servers, query)
+	if err != nil {
+		return nil, xerrors.Errorf("select game servers: %w", err)
+	}
+	return servers, nil
+}
+
+func (s *sqlDB) HubServers(ctx context.Context) ([]*ServerInfo, error) {
+	query := "SELECT id, hostname, public_name, grpc_port, ws_port, region, status, COALESCE(heartbeat, 0) AS heartbeat FROM hub_server"
+
+	var servers []*ServerInfo
+	err := s.db.SelectContext(ctx, &servers, query)
+	if err != nil {
+		return nil, xerrors.Errorf("select hub servers: %w", err)
+	}
+	return servers, nil
+}
+
+func (s *sqlDB) LobbyServers(ctx context.Context) ([]*ServerInfo, error) {
+	query := "SELECT id, hostname, public_name, grpc_port, ws_port, region, status, COALESCE(heartbeat, 0) AS heartbeat FROM lobby_server"
+
+	var servers []*ServerInfo
+	err := s.db.SelectContext(ctx, &servers, query)
+	if err != nil {
+		return nil, xerrors.Errorf("select lobby servers: %w", err)
+	}
+	return servers, nil
+}
+
+func (s *sqlDB) Rooms(ctx context.Context, roomIds []string) ([]*pb.RoomInfo, error) {
+	if roomIds == nil {
+		return s.selectRooms(ctx, "SELECT * FROM room")
+	}
+	if len(roomIds) == 0 {
+		return []*pb.RoomInfo{}, nil
+	}
+	return s.selectRooms(ctx, "SELECT * FROM room WHERE id IN (?)", roomIds)
+}
+
+func (s *sqlDB) RoomHistories(ctx context.Context, filter *RoomHistoryFilter) ([]*RoomHistory, error) {
+	q := "SELECT " + roomHistoryColumns + " FROM room_history"
+	p := []any{}
+	var where []string
+	if filter.AppId != "" {
+		where = append(where, "app_id = ?")
+		p = append(p, filter.AppId)
+	}
+	if filter.RoomIds != nil {
+		if len(filter.RoomIds) == 0 {
+			return []*RoomHistory{}, nil
+		}
+		where = append(where, "room_id IN (?)")
+		p = append(p, filter.RoomIds)
+	}
+	if filter.CreatedBefore != nil {
+		where = append(where, "created <= ?")
+		p = append(p, filter.CreatedBefore.UTC())
+	}
+	if filter.CreatedAfter != nil {
+		where = append(where, "created >= ?")
+		p = append(p, filter.CreatedAfter.UTC())
+	}
+	if filter.ClosedAfter != nil {
+		where = append(where, "closed >= ?")
+		p = append(p, filter.ClosedAfter.UTC())
+	}
+	if filter.At != nil {
+		where = append(where, "created <= ?", "closed >= ?")
+		p = append(p, filter.At.UTC(), filter.At.UTC())
+	}
+	if where != nil {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY created DESC"
+	if filter.Limit > 0 {
+		q += " LIMIT ?"
+		p = append(p, filter.Limit)
+	}
+
+	q, p, err := sqlx.In(q, p...)
+	if err != nil {
+		return nil, xerrors.Errorf("sqlx.In: %w", err)
+	}
+	histories := []*RoomHistory{}
+	err = s.db.SelectContext(ctx, &histories, q, p...)
+	if err != nil {
+		return nil, xerrors.Errorf("select room_history: %w", err)
+	}
+	return histories, nil
+}
+
+func (s *sqlDB) PlayerLogs(ctx context.Context, roomIds []string) ([]*PlayerLog, error) {
+	if len(roomIds) == 0 {
+		return []*PlayerLog{}, nil
+	}
+	q, p, err := sqlx.In("SELECT room_id, player_id, message, datetime FROM player_log WHERE room_id IN (?) ORDER BY id", roomIds)
+	if err != nil {
+		return nil, xerrors.Errorf("sqlx.In: %w", err)
+	}
+	plogs := []*PlayerLog{}
+	err = s.db.SelectContext(ctx, &plogs, q, p...)
+	if err != nil {
+		return nil, xerrors.Errorf("select player_log: %w", err)
+	}
+	return plogs, nil
+}
+
+func (s *sqlDB) PlayerEvents(ctx context.Context, filter *PlayerEventFilter) ([]*PlayerEvent, error) {
+	q := "SELECT app_id, room_id, player_id, event, detail, datetime FROM player_event"
+	p := []any{}
+	var where []string
+	if filter.AppId != "" {
+		where = append(where, "app_id = ?")
+		p = append(p, filter.AppId)
+	}
+	if filter.PlayerId != "" {
+		where = append(where, "player_id = ?")
+		p = append(p, filter.PlayerId)
+	}
+	if filter.RoomId != "" {
+		where = append(where, "room_id = ?")
+		p = append(p, filter.RoomId)
+	}
+	if filter.Since != nil {
+		where = append(where, "datetime >= ?")
+		p = append(p, filter.Since.UTC())
+	}
+	if filter.Until != nil {
+		where = append(where, "datetime < ?")
+		p = append(p, filter.Until.UTC())
+	}
+	if where != nil {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY datetime, id"
+	if filter.Limit > 0 {
+		q += " LIMIT ?"
+		p = append(p, filter.Limit)
+	}
+
+	events := []*PlayerEvent{}
+	if err := s.db.SelectContext(ctx, &events, q, p...); err != nil {
+		return nil, xerrors.Errorf("select player_event: %w", err)
+	}
+	return events, nil
+}
+
+func (s *sqlDB) Bans(ctx context.Context, filter *BanFilter) ([]*Ban, error) {
+	q := "SELECT app_id, user_id, room_id, reason, banned_by, expires, created FROM ban"
+	p := []any{}
+	var where []string
+	if filter.AppId != "" {
+		where = append(where, "app_id = ?")
+		p = append(p, filter.AppId)
+	}
+	if filter.UserId != "" {
+		where = append(where, "user_id = ?")
+		p = append(p, filter.UserId)
+	}
+	if filter.ActiveAt != nil {
+		where = append(where, "(expires IS NULL OR expires > ?)")
+		p = append(p, filter.ActiveAt.UTC())
+	}
+	if where != nil {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY created DESC, id DESC"
+	if filter.Limit > 0 {
+		q += " LIMIT ?"
+		p = append(p, filter.Limit)
+	}
+
+	bans := []*Ban{}
+	if err := s.db.SelectContext(ctx, &bans, q, p...); err != nil {
+		return nil, xerrors.Errorf("select ban: %w", err)
+	}
+	return bans, nil
+}
+
+func (s *sqlDB) PurgeRoomHistories(ctx context.Context, before time.Time, limit int) (int, error) {
+	return s.purge(ctx, "room_history", "created", before, limit)
+}
+
+func (s *sqlDB) PurgePlayerLogs(ctx context.Context, before time.Time, limit int) (int, error) {
+	return s.purge(ctx, "player_log", "datetime", before, limit)
+}
+
+// ArchiveRoomHistories : 削除する行をarchiveに渡し、成功したらidを指定して削除する
+func (s *sqlDB) ArchiveRoomHistories(ctx context.Context, before time.Time, limit int, archive func([]*RoomHistory) error) (int, error) {
+	rows := []*struct {
+		Id int64 `db:"id"`
+		RoomHistory
+	}{}
+	q := "SELECT id, " + roomHistoryColumns + " FROM room_history WHERE created < ? ORDER BY id LIMIT ?"
+	if err := s.db.SelectContext(ctx, &rows, q, before.UTC(), limit); err != nil {
+		return 0, xerrors.Errorf("select room_history: %w", err)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	ids := make([]int64, len(rows))
+	histories := make([]*RoomHistory, len(rows))
+	for i, r := range rows {
+		ids[i] = r.Id
+		histories[i] = &r.RoomHistory
+	}
+	if err := archive(histories); err != nil {
+		return 0, xerrors.Errorf("archive room_history: %w", err)
+	}
+	return s.deleteIds(ctx, "room_history", ids)
+}
+
+func (s *sqlDB) ArchivePlayerLogs(ctx context.Context, before time.Time, limit int, archive func([]*PlayerLog) error) (int, error) {
+	rows := []*struct {
+		Id int64 `db:"id"`
+		PlayerLog
+	}{}
+	const q = "SELECT id, room_id, player_id, message, datetime FROM player_log WHERE datetime < ? ORDER BY id LIMIT ?"
+	if err := s.db.SelectContext(ctx, &rows, q, before.UTC(), limit); err != nil {
+		return 0, xerrors.Errorf("select player_log: %w", err)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	ids := make([]int64, len(rows))
+	plogs := make([]*PlayerLog, len(rows))
+	for i, r := range rows {
+		ids[i] = r.Id
+		plogs[i] = &r.PlayerLog
+	}
+	if err := archive(plogs); err != nil {
+		return 0, xerrors.Errorf("archive player_log: %w", err)
+	}
+	return s.deleteIds(ctx, "player_log", ids)
+}
+
+// purge : 削除対象のidを先に選ぶ (MySQLはIN句のサブクエリにLIMITを使えない)
+func (s *sqlDB) purge(ctx context.Context, table, column string, before time.Time, limit int) (int, error) {
+	ids := []int64{}
+	q := fmt.Sprintf("SELECT id FROM %s WHERE %s < ? ORDER BY id LIMIT ?", table, column)
+	if err := s.db.SelectContext(ctx, &ids, q, before.UTC(), limit); err != nil {
+		return 0, xerrors.Errorf("select %s: %w", table, err)
+	}
+	return s.deleteIds(ctx, table, ids)
+}
+
+func (s *sqlDB) deleteIds(ctx context.Context, table string, ids []int64) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	q, p, err := sqlx.In(fmt.Sprintf("DELETE FROM %s WHERE id IN (?)", table), ids)
+	if err != nil {
+		return 0, xerrors.Errorf("sqlx.In: %w", err)
+	}
+	res, err := s.db.ExecContext(ctx, q, p...)
+	if err != nil {
+		return 0, xerrors.Errorf("delete %s: %w", table, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, xerrors.Errorf("rows affected: %w", err)
+	}
+	return int(n), nil
+}
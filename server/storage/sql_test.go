@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestQueries(t *testing.T) {
+	ok, err := regexp.MatchString(
+		`INSERT INTO room \((.+,|)id(,.+|)\) VALUES \((.+,|):id(,.+|)\)`,
+		roomInsertQuery)
+	if err != nil {
+		t.Fatalf("roomInsertQuery match error: %+v", err)
+	}
+	if !ok {
+		t.Fatalf("roomInsertQuery not match: %v, %v", ok, roomInsertQuery)
+	}
+
+	ok, err = regexp.MatchString(
+		`UPDATE room SET (.+,|)app_id=:app_id(,.+|) WHERE id=:id`,
+		roomUpdateQuery)
+	if err != nil {
+		t.Fatalf("roomUpdateQuery match error: %+v", err)
+	}
+	if !ok {
+		t.Fatalf("roomUpdateQuery not match: %v, %v", ok, roomUpdateQuery)
+	}
+}
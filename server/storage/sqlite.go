@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	_ "embed"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/xerrors"
+)
+
+//go:embed sqlite_schema.sql
+var sqliteSchema string
+
+var sqliteDialect = dialect{
+	serverRegisterQuery: func(table string) string {
+		return "" +
+			"INSERT INTO `" + table + "` (`hostname`, `public_name`, `grpc_port`, `ws_port`, `region`, `status`) VALUES (:hostname, :public_name, :grpc_port, :ws_port, :region, :status) " +
+			"ON CONFLICT (`hostname`) DO UPDATE SET `public_name`=excluded.public_name, `grpc_port`=excluded.grpc_port, `ws_port`=excluded.ws_port, `region`=excluded.region, `status`=excluded.status " +
+			"RETURNING `id`"
+	},
+	registerReturning: true,
+	banUpsertQuery: "" +
+		"INSERT INTO `ban` (`app_id`, `user_id`, `room_id`, `reason`, `banned_by`, `expires`, `created`) VALUES (:app_id, :user_id, :room_id, :reason, :banned_by, :expires, :created) " +
+		"ON CONFLICT (`app_id`, `user_id`, `room_id`) DO UPDATE SET `reason`=excluded.reason, `banned_by`=excluded.banned_by, `expires`=excluded.expires, `created`=excluded.created",
+}
+
+// SQLite : SQLiteを使うStorage.
+// 1台のホストでlobby/game/hubを動かす小規模な環境向け.
+type SQLite struct {
+	sqlDB
+}
+
+var _ Database = (*SQLite)(nil)
+
+// NewSQLite : dbは "sqlite3" ドライバで開いたもの
+func NewSQLite(db *sqlx.DB) *SQLite {
+	return &SQLite{sqlDB{db: db, dialect: sqliteDialect}}
+}
+
+// CreateTables : 存在しないテーブルを作成する
+func (s *SQLite) CreateTables(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, sqliteSchema); err != nil {
+		return xerrors.Errorf("create tables: %w", err)
+	}
+	return nil
+}
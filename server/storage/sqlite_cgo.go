@@ -0,0 +1,8 @@
+//go:build cgo
+
+package storage
+
+import _ "github.com/mattn/go-sqlite3"
+
+// sqliteDriver : SQLiteのdatabase/sqlドライバ名
+const sqliteDriver = "sqlite3"
@@ -0,0 +1,6 @@
+//go:build !cgo
+
+package storage
+
+// sqliteDriver : go-sqlite3はcgoが必要なため、cgo無効のビルドではSQLiteを使えない
+const sqliteDriver = ""
@@ -0,0 +1,126 @@
+-- sql/10-schema.sql のSQLite版
+CREATE TABLE IF NOT EXISTS `game_server` (
+  `id`          INTEGER PRIMARY KEY AUTOINCREMENT,
+  `hostname`    VARCHAR(191) NOT NULL UNIQUE,
+  `public_name` VARCHAR(191) NOT NULL,
+  `grpc_port`   INTEGER NOT NULL,
+  `ws_port`     INTEGER NOT NULL,
+  `region`      VARCHAR(64) NOT NULL DEFAULT '',
+  `status`      TINYINT NOT NULL,
+  `heartbeat`   BIGINT,
+  `rooms`       INTEGER NOT NULL DEFAULT 0,
+  `clients`     INTEGER NOT NULL DEFAULT 0,
+  `capacity_usage` FLOAT NOT NULL DEFAULT 0,
+  `cpu_usage`   FLOAT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS `hub_server` (
+  `id`          INTEGER PRIMARY KEY AUTOINCREMENT,
+  `hostname`    VARCHAR(191) NOT NULL UNIQUE,
+  `public_name` VARCHAR(191) NOT NULL,
+  `grpc_port`   INTEGER NOT NULL,
+  `ws_port`     INTEGER NOT NULL,
+  `region`      VARCHAR(64) NOT NULL DEFAULT '',
+  `status`      TINYINT NOT NULL,
+  `heartbeat`   BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS `app` (
+  `id`   VARCHAR(32) PRIMARY KEY,
+  `name` VARCHAR(191),
+  `key`  VARCHAR(191),
+  `compression_threshold` INTEGER NOT NULL DEFAULT 0,
+  `mac_scheme` TINYINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS `room` (
+  `id`     VARCHAR(32) PRIMARY KEY,
+  `app_id` VARCHAR(32) NOT NULL,
+  `host_id` INTEGER NOT NULL,
+  `visible` TINYINT NOT NULL,
+  `joinable` TINYINT NOT NULL,
+  `watchable` TINYINT NOT NULL,
+  `number` INTEGER UNIQUE,
+  `search_group` INTEGER NOT NULL,
+  `max_players` INTEGER NOT NULL,
+  `players` INTEGER NOT NULL,
+  `watchers` INTEGER NOT NULL,
+  `props` BLOB,
+  `created` DATETIME,
+  `watch_delay` INTEGER NOT NULL DEFAULT 0,
+  `watcher_chat_disabled` TINYINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS `room_search_group` ON `room` (`app_id`, `search_group`);
+
+CREATE TABLE IF NOT EXISTS `room_history` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `app_id` VARCHAR(32) NOT NULL,
+  `host_id` INTEGER NOT NULL,
+  `room_id` VARCHAR(32) NOT NULL,
+  `number` INTEGER,
+  `search_group` INTEGER NOT NULL,
+  `max_players` INTEGER NOT NULL,
+  `public_props` BLOB,
+  `private_props` BLOB,
+  `created` DATETIME,
+  `closed` DATETIME
+);
+CREATE INDEX IF NOT EXISTS `room_history_room_id` ON `room_history` (`room_id`);
+CREATE INDEX IF NOT EXISTS `room_history_created` ON `room_history` (`created`);
+
+CREATE TABLE IF NOT EXISTS `player_log` (
+  `id`        INTEGER PRIMARY KEY AUTOINCREMENT,
+  `room_id`   VARCHAR(32) NOT NULL,
+  `player_id` VARCHAR(32) NOT NULL,
+  `message`   VARCHAR(32) NOT NULL,
+  `datetime`  DATETIME
+);
+CREATE INDEX IF NOT EXISTS `player_log_room_id` ON `player_log` (`room_id`);
+CREATE INDEX IF NOT EXISTS `player_log_player_id` ON `player_log` (`player_id`);
+
+CREATE TABLE IF NOT EXISTS `player_event` (
+  `id`        INTEGER PRIMARY KEY AUTOINCREMENT,
+  `app_id`    VARCHAR(32) NOT NULL,
+  `room_id`   VARCHAR(32) NOT NULL,
+  `player_id` VARCHAR(32) NOT NULL,
+  `event`     VARCHAR(32) NOT NULL,
+  `detail`    TEXT NOT NULL,
+  `datetime`  DATETIME
+);
+CREATE INDEX IF NOT EXISTS `player_event_player_id_datetime` ON `player_event` (`player_id`, `datetime`);
+CREATE INDEX IF NOT EXISTS `player_event_room_id` ON `player_event` (`room_id`);
+CREATE INDEX IF NOT EXISTS `player_event_datetime` ON `player_event` (`datetime`);
+
+CREATE TABLE IF NOT EXISTS `ban` (
+  `id`        INTEGER PRIMARY KEY AUTOINCREMENT,
+  `app_id`    VARCHAR(32) NOT NULL,
+  `user_id`   VARCHAR(32) NOT NULL,
+  `room_id`   VARCHAR(32) NOT NULL DEFAULT '',
+  `reason`    VARCHAR(255) NOT NULL DEFAULT '',
+  `banned_by` VARCHAR(32) NOT NULL DEFAULT '',
+  `expires`   DATETIME,
+  `created`   DATETIME NOT NULL,
+  UNIQUE (`app_id`, `user_id`, `room_id`)
+);
+CREATE INDEX IF NOT EXISTS `ban_expires` ON `ban` (`expires`);
+
+CREATE TABLE IF NOT EXISTS `hub` (
+  `id`      INTEGER PRIMARY KEY AUTOINCREMENT,
+  `host_id` INTEGER NOT NULL,
+  `room_id` VARCHAR(32) NOT NULL,
+  `watchers` INTEGER NOT NULL,
+  `created` DATETIME NOT NULL,
+  UNIQUE (`room_id`, `host_id`)
+);
+
+-- ws_portはlobbyのAPIのポート
+CREATE TABLE IF NOT EXISTS `lobby_server` (
+  `id`          INTEGER PRIMARY KEY AUTOINCREMENT,
+  `hostname`    VARCHAR(191) NOT NULL UNIQUE,
+  `public_name` VARCHAR(191) NOT NULL,
+  `grpc_port`   INTEGER NOT NULL,
+  `ws_port`     INTEGER NOT NULL,
+  `region`      VARCHAR(64) NOT NULL DEFAULT '',
+  `status`      TINYINT NOT NULL,
+  `heartbeat`   BIGINT
+);
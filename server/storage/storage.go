@@ -0,0 +1,292 @@
+// Package storage : lobby/game/hubが共有する永続化層.
+//
+// 本番ではMySQL (NewMySQL) を使う. 1台のホストで動かす場合はSQLite (NewSQLite) も使える (cgoが有効なビルドのみ).
+// どちらを使うかは設定の Database.driver で選び、Open で開く.
+// Memory (NewMemory) は1プロセス内で全てのサーバを動かすテスト用の実装.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/xerrors"
+
+	"wsnet2/pb"
+)
+
+var (
+	// ErrNotFound : 対象のレコードが存在しない
+	ErrNotFound = xerrors.New("record not found")
+	// ErrDuplicate : 一意キーが重複している
+	ErrDuplicate = xerrors.New("duplicate entry")
+)
+
+// Storage : lobby/game/hubが使う全ての操作
+type Storage interface {
+	AppStorage
+	ServerStorage
+	RoomStorage
+	HubStorage
+	BanStorage
+}
+
+// Database : SQLのDBを使うStorage
+type Database interface {
+	Storage
+	AdminStorage
+
+	DB() *sqlx.DB
+}
+
+// AdminStorage : wsnet2-toolなど管理用の参照
+type AdminStorage interface {
+	// AppList : 名前を含むappの一覧
+	AppList(ctx context.Context) ([]*AppInfo, error)
+
+	// GameServers : heartbeatが途絶えたものも含む全てのgameサーバ
+	GameServers(ctx context.Context) ([]*ServerInfo, error)
+	// HubServers : heartbeatが途絶えたものも含む全てのhubサーバ
+	HubServers(ctx context.Context) ([]*ServerInfo, error)
+	// LobbyServers : heartbeatが途絶えたものも含む全てのlobbyサーバ
+	LobbyServers(ctx context.Context) ([]*ServerInfo, error)
+
+	// Rooms : appを問わず部屋を取得する. roomIdsがnilなら全ての部屋
+	Rooms(ctx context.Context, roomIds []string) ([]*pb.RoomInfo, error)
+
+	// RoomHistories : 終了した部屋を作成日時の新しい順に
+	RoomHistories(ctx context.Context, filter *RoomHistoryFilter) ([]*RoomHistory, error)
+	// PlayerLogs : 部屋の入退室を記録した順に
+	PlayerLogs(ctx context.Context, roomIds []string) ([]*PlayerLog, error)
+	// PlayerEvents : プレイヤーの記録を部屋を問わず日時の古い順に
+	PlayerEvents(ctx context.Context, filter *PlayerEventFilter) ([]*PlayerEvent, error)
+	// PurgeRoomHistories : createdがbeforeより前のroom_historyを古いものから最大limit件削除し、削除した件数を返す
+	PurgeRoomHistories(ctx context.Context, before time.Time, limit int) (int, error)
+	// PurgePlayerLogs : datetimeがbeforeより前のplayer_logを古いものから最大limit件削除し、削除した件数を返す
+	PurgePlayerLogs(ctx context.Context, before time.Time, limit int) (int, error)
+
+	// ArchiveRoomHistories : createdがbeforeより前のroom_historyを古いものから最大limit件archiveに渡し、
+	// archiveが成功したら削除して件数を返す
+	ArchiveRoomHistories(ctx context.Context, before time.Time, limit int, archive func([]*RoomHistory) error) (int, error)
+	// ArchivePlayerLogs : datetimeがbeforeより前のplayer_logを古いものから最大limit件archiveに渡し、
+	// archiveが成功したら削除して件数を返す
+	ArchivePlayerLogs(ctx context.Context, before time.Time, limit int, archive func([]*PlayerLog) error) (int, error)
+}
+
+// AppStorage : appテーブル
+type AppStorage interface {
+	Apps(ctx context.Context) ([]*pb.App, error)
+}
+
+// ServerStorage : game_server, hub_server, lobby_server テーブル (サーバの登録とheartbeat)
+type ServerStorage interface {
+	// RegisterGameServer : hostnameが同じサーバがあれば上書きしてそのIDを返す
+	RegisterGameServer(ctx context.Context, host *Host) (uint32, error)
+	UpdateGameServer(ctx context.Context, id uint32, status int32, heartbeat int64, load *GameLoad) error
+	// AliveGameServers : heartbeatがsince以降の、running/closingのgameサーバ
+	AliveGameServers(ctx context.Context, since int64) ([]*GameServer, error)
+
+	// RegisterHubServer : hostnameが同じサーバがあれば上書きしてそのIDを返す
+	RegisterHubServer(ctx context.Context, host *Host) (uint32, error)
+	UpdateHubServer(ctx context.Context, id uint32, status int32, heartbeat int64) error
+	// AliveHubServers : heartbeatがsince以降の、runningのhubサーバ
+	AliveHubServers(ctx context.Context, since int64) ([]*Host, error)
+
+	// RegisterLobbyServer : hostnameが同じサーバがあれば上書きしてそのIDを返す
+	RegisterLobbyServer(ctx context.Context, host *Host) (uint32, error)
+	UpdateLobbyServer(ctx context.Context, id uint32, status int32, heartbeat int64) error
+	// AliveLobbyServers : heartbeatがsince以降の、runningのlobbyサーバ
+	AliveLobbyServers(ctx context.Context, since int64) ([]*Host, error)
+}
+
+// RoomStorage : room, room_history, player_log, player_event テーブル
+type RoomStorage interface {
+	// InsertRoom : IDか部屋番号が重複していたらエラー
+	InsertRoom(ctx context.Context, room *pb.RoomInfo) error
+	// BeginRoomTx : 部屋を作成するトランザクションを開始する
+	BeginRoomTx(ctx context.Context) (RoomTx, error)
+	UpdateRoom(ctx context.Context, room *pb.RoomInfo) error
+	DeleteRoom(ctx context.Context, roomId string) error
+	// ArchiveRooms : gameサーバに残っている部屋を履歴に移して、部屋単位のbanと共に削除する (再起動時)
+	ArchiveRooms(ctx context.Context, hostId uint32) error
+
+	GetRoom(ctx context.Context, appId, roomId string) (*pb.RoomInfo, error)
+	GetRoomByNumber(ctx context.Context, appId string, number int32) (*pb.RoomInfo, error)
+	GetRoomsByIds(ctx context.Context, appId string, roomIds []string) ([]*pb.RoomInfo, error)
+	GetRoomsByNumbers(ctx context.Context, appId string, numbers []int32) ([]*pb.RoomInfo, error)
+	// SearchRooms : search_groupのvisibleな部屋を最大limit件
+	SearchRooms(ctx context.Context, appId string, searchGroup uint32, limit int) ([]*pb.RoomInfo, error)
+
+	InsertRoomHistory(ctx context.Context, history *RoomHistory) error
+	InsertPlayerLog(ctx context.Context, plog *PlayerLog) error
+	// InsertPlayerEvents : まとめて書き込む
+	InsertPlayerEvents(ctx context.Context, events []*PlayerEvent) error
+}
+
+// RoomTx : 部屋を作成するトランザクション.
+// 作成した部屋はCommitするまで他からは見えず、Rollbackで取り消す
+type RoomTx interface {
+	// InsertRoom : IDか部屋番号が重複していたらエラー
+	InsertRoom(ctx context.Context, room *pb.RoomInfo) error
+	Commit() error
+	Rollback() error
+}
+
+// HubStorage : hub テーブル
+type HubStorage interface {
+	InsertHub(ctx context.Context, hostId uint32, roomId string) (int64, error)
+	UpdateHubWatchers(ctx context.Context, id int64, watchers int) error
+	DeleteHub(ctx context.Context, id int64) error
+	// DeleteHostHubs : hubサーバに残っているhubを削除する (再起動時)
+	DeleteHostHubs(ctx context.Context, hostId uint32) error
+	GetRoomHubs(ctx context.Context, roomId string) ([]*Hub, error)
+}
+
+// BanStorage : ban テーブル
+type BanStorage interface {
+	// InsertBan : 同じapp, user, roomのbanがあれば上書きする
+	InsertBan(ctx context.Context, ban *Ban) error
+	// DeleteBan : banが無ければErrNotFound
+	DeleteBan(ctx context.Context, appId, userId, roomId string) error
+	// DeleteRoomBans : 終了した部屋のbanを削除する
+	DeleteRoomBans(ctx context.Context, roomId string) error
+	// ActiveBans : atの時点で有効な全てのban
+	ActiveBans(ctx context.Context, at time.Time) ([]*Ban, error)
+	// Bans : 期限切れのものも含むbanを作成日時の新しい順に
+	Bans(ctx context.Context, filter *BanFilter) ([]*Ban, error)
+}
+
+// Host : game/hubサーバの登録情報
+type Host struct {
+	Id            uint32
+	Hostname      string
+	PublicName    string `db:"public_name"`
+	GRPCPort      int    `db:"grpc_port"`
+	WebSocketPort int    `db:"ws_port"`
+	Region        string `db:"region"`
+	Status        int32
+}
+
+// GameLoad : gameサーバがheartbeatで報告する負荷
+type GameLoad struct {
+	Rooms         int
+	Clients       int
+	CapacityUsage float64 `db:"capacity_usage"`
+	CPUUsage      float64 `db:"cpu_usage"`
+}
+
+type GameServer struct {
+	Host
+	GameLoad
+}
+
+// ServerInfo : 管理用のgame/hub/lobbyサーバの情報. hub/lobbyサーバはGameLoadが常にゼロ値
+type ServerInfo struct {
+	GameServer
+	Heartbeat int64
+}
+
+// AppInfo : 管理用のappの情報
+type AppInfo struct {
+	Id   string `db:"id"`
+	Name string `db:"name"`
+	Key  string `db:"key"`
+}
+
+// RoomHistoryFilter : RoomHistoriesの条件. ゼロ値の項目は条件にしない
+type RoomHistoryFilter struct {
+	AppId   string
+	RoomIds []string
+
+	CreatedBefore *time.Time
+	CreatedAfter  *time.Time
+	ClosedAfter   *time.Time
+	// At : この時刻に存在していた部屋
+	At *time.Time
+
+	Limit int
+}
+
+// RoomHistory : 終了した部屋の記録
+type RoomHistory struct {
+	AppID        string        `db:"app_id" json:"app_id"`
+	HostID       uint32        `db:"host_id" json:"host_id"`
+	RoomID       string        `db:"room_id" json:"room_id"`
+	Number       sql.NullInt32 `db:"number" json:"number"`
+	SearchGroup  uint32        `db:"search_group" json:"search_group"`
+	MaxPlayers   uint32        `db:"max_players" json:"max_players"`
+	PublicProps  []byte        `db:"public_props" json:"public_props"`
+	PrivateProps []byte        `db:"private_props" json:"private_props"`
+	Created      time.Time     `db:"created" json:"created"`
+	Closed       time.Time     `db:"closed" json:"closed"`
+}
+
+// PlayerLog : プレイヤーの入退室の記録
+type PlayerLog struct {
+	RoomID   string    `db:"room_id" json:"room_id"`
+	PlayerID string    `db:"player_id" json:"player_id"`
+	Message  string    `db:"message" json:"message"`
+	Datetime time.Time `db:"datetime" json:"datetime"`
+}
+
+// PlayerEvent : プレイヤーのセッションの記録.
+// Detailはイベントごとの内容のJSON
+type PlayerEvent struct {
+	AppID    string    `db:"app_id" json:"app_id"`
+	RoomID   string    `db:"room_id" json:"room_id"`
+	PlayerID string    `db:"player_id" json:"player_id"`
+	Event    string    `db:"event" json:"event"`
+	Detail   string    `db:"detail" json:"detail"`
+	Datetime time.Time `db:"datetime" json:"datetime"`
+}
+
+// PlayerEventFilter : PlayerEventsの条件. ゼロ値の項目は条件にしない
+type PlayerEventFilter struct {
+	AppId    string
+	PlayerId string
+	RoomId   string
+
+	Since *time.Time
+	Until *time.Time
+
+	Limit int
+}
+
+// Ban : ユーザの入室禁止.
+// RoomIDが空ならapp全体、ExpiresがNULLなら無期限.
+// 部屋単位のbanは部屋と共に削除する (see: DeleteRoomBans, ArchiveRooms) ので、ExpiresがNULLなら部屋の終了まで
+type Ban struct {
+	AppID    string       `db:"app_id" json:"app_id"`
+	UserID   string       `db:"user_id" json:"user_id"`
+	RoomID   string       `db:"room_id" json:"room_id"`
+	Reason   string       `db:"reason" json:"reason"`
+	BannedBy string       `db:"banned_by" json:"banned_by"`
+	Expires  sql.NullTime `db:"expires" json:"expires"`
+	Created  time.Time    `db:"created" json:"created"`
+}
+
+// Active : atの時点で有効か
+func (b *Ban) Active(at time.Time) bool {
+	return !b.Expires.Valid || b.Expires.Time.After(at)
+}
+
+// BanFilter : Bansの条件. ゼロ値の項目は条件にしない
+type BanFilter struct {
+	AppId  string
+	UserId string
+
+	// ActiveAt : この時刻に有効なban
+	ActiveAt *time.Time
+
+	Limit int
+}
+
+// Hub : hubサーバが中継している部屋
+type Hub struct {
+	Id       int64     `db:"id"`
+	HostId   uint32    `db:"host_id"`
+	RoomId   string    `db:"room_id"`
+	Watchers int       `db:"watchers"`
+	Created  time.Time `db:"created"`
+}
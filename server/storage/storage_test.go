@@ -0,0 +1,784 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"wsnet2/common"
+	"wsnet2/pb"
+)
+
+type testStorage interface {
+	Storage
+	AdminStorage
+}
+
+func newTestSQLite(t *testing.T) *SQLite {
+	t.Helper()
+	if sqliteDriver == "" {
+		t.Skip("sqlite3 is not available: built without cgo")
+	}
+	db, err := sqlx.Open(sqliteDriver, ":memory:")
+	if err != nil {
+		t.Fatalf("open sqlite3: %+v", err)
+	}
+	// :memory: は接続ごとに別のDBになる
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	s := NewSQLite(db)
+	if err := s.CreateTables(context.Background()); err != nil {
+		t.Fatalf("CreateTables: %+v", err)
+	}
+	return s
+}
+
+// forEachStorage : Memory, SQLite それぞれでテストする
+func forEachStorage(t *testing.T, test func(t *testing.T, s testStorage)) {
+	t.Run("Memory", func(t *testing.T) {
+		test(t, NewMemory(&pb.App{Id: "app1", Key: "key1"}))
+	})
+	t.Run("SQLite", func(t *testing.T) {
+		s := newTestSQLite(t)
+		s.DB().MustExec("INSERT INTO app (id, `key`) VALUES ('app1', 'key1')")
+		test(t, s)
+	})
+}
+
+func TestApps(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+		apps, err := s.Apps(ctx)
+		if err != nil {
+			t.Fatalf("Apps: %+v", err)
+		}
+		if len(apps) != 1 || apps[0].Id != "app1" || apps[0].Key != "key1" {
+			t.Fatalf("Apps = %v", apps)
+		}
+
+		list, err := s.AppList(ctx)
+		if err != nil {
+			t.Fatalf("AppList: %+v", err)
+		}
+		if len(list) != 1 || list[0].Id != "app1" || list[0].Key != "key1" {
+			t.Fatalf("AppList = %v", list)
+		}
+	})
+}
+
+func TestGameServer(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+		now := time.Now().Unix()
+
+		host1 := &Host{Hostname: "host1", PublicName: "public1", GRPCPort: 1001, WebSocketPort: 1002, Region: "tokyo", Status: common.HostStatusStarting}
+		id1, err := s.RegisterGameServer(ctx, host1)
+		if err != nil {
+			t.Fatalf("RegisterGameServer: %+v", err)
+		}
+		id2, err := s.RegisterGameServer(ctx, &Host{Hostname: "host2", PublicName: "public2", Status: common.HostStatusStarting})
+		if err != nil {
+			t.Fatalf("RegisterGameServer: %+v", err)
+		}
+		if id1 == id2 {
+			t.Fatalf("same id for different hosts: %v", id1)
+		}
+
+		// 同じhostnameなら上書きして同じID
+		host1.GRPCPort = 2001
+		id, err := s.RegisterGameServer(ctx, host1)
+		if err != nil {
+			t.Fatalf("RegisterGameServer: %+v", err)
+		}
+		if id != id1 {
+			t.Fatalf("re-registered id = %v, wants %v", id, id1)
+		}
+
+		load := &GameLoad{Rooms: 3, Clients: 10, CapacityUsage: 0.5, CPUUsage: 0.25}
+		if err := s.UpdateGameServer(ctx, id1, common.HostStatusRunning, now, load); err != nil {
+			t.Fatalf("UpdateGameServer: %+v", err)
+		}
+		if err := s.UpdateGameServer(ctx, id2, common.HostStatusRunning, now-100, &GameLoad{}); err != nil {
+			t.Fatalf("UpdateGameServer: %+v", err)
+		}
+
+		alive, err := s.AliveGameServers(ctx, now-10)
+		if err != nil {
+			t.Fatalf("AliveGameServers: %+v", err)
+		}
+		if len(alive) != 1 {
+			t.Fatalf("AliveGameServers = %v, wants only host1", alive)
+		}
+		want := GameServer{
+			Host:     Host{Id: id1, Hostname: "host1", PublicName: "public1", GRPCPort: 2001, WebSocketPort: 1002, Region: "tokyo", Status: common.HostStatusRunning},
+			GameLoad: *load,
+		}
+		if *alive[0] != want {
+			t.Fatalf("AliveGameServers[0] = %+v, wants %+v", *alive[0], want)
+		}
+
+		all, err := s.GameServers(ctx)
+		if err != nil {
+			t.Fatalf("GameServers: %+v", err)
+		}
+		if len(all) != 2 {
+			t.Fatalf("GameServers = %v, wants 2 servers", all)
+		}
+		for _, sv := range all {
+			if sv.Id == id2 && sv.Heartbeat != now-100 {
+				t.Errorf("heartbeat of host2 = %v, wants %v", sv.Heartbeat, now-100)
+			}
+		}
+	})
+}
+
+func TestHubServer(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+		now := time.Now().Unix()
+
+		id1, err := s.RegisterHubServer(ctx, &Host{Hostname: "hub1", PublicName: "public1", Status: common.HostStatusStarting})
+		if err != nil {
+			t.Fatalf("RegisterHubServer: %+v", err)
+		}
+		id2, err := s.RegisterHubServer(ctx, &Host{Hostname: "hub2", PublicName: "public2", Status: common.HostStatusStarting})
+		if err != nil {
+			t.Fatalf("RegisterHubServer: %+v", err)
+		}
+		if err := s.UpdateHubServer(ctx, id1, common.HostStatusRunning, now); err != nil {
+			t.Fatalf("UpdateHubServer: %+v", err)
+		}
+		// closingのhubは選ばれない
+		if err := s.UpdateHubServer(ctx, id2, common.HostStatusClosing, now); err != nil {
+			t.Fatalf("UpdateHubServer: %+v", err)
+		}
+
+		alive, err := s.AliveHubServers(ctx, now-10)
+		if err != nil {
+			t.Fatalf("AliveHubServers: %+v", err)
+		}
+		if len(alive) != 1 || alive[0].Id != id1 || alive[0].Hostname != "hub1" {
+			t.Fatalf("AliveHubServers = %v, wants only hub1", alive)
+		}
+
+		all, err := s.HubServers(ctx)
+		if err != nil {
+			t.Fatalf("HubServers: %+v", err)
+		}
+		if len(all) != 2 {
+			t.Fatalf("HubServers = %v, wants 2 servers", all)
+		}
+	})
+}
+
+func TestLobbyServer(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+		now := time.Now().Unix()
+
+		id1, err := s.RegisterLobbyServer(ctx, &Host{Hostname: "lobby1", GRPCPort: 19080, Status: common.HostStatusRunning})
+		if err != nil {
+			t.Fatalf("RegisterLobbyServer: %+v", err)
+		}
+		id2, err := s.RegisterLobbyServer(ctx, &Host{Hostname: "lobby2", GRPCPort: 19080, Status: common.HostStatusRunning})
+		if err != nil {
+			t.Fatalf("RegisterLobbyServer: %+v", err)
+		}
+		// 同じhostnameなら同じID
+		id3, err := s.RegisterLobbyServer(ctx, &Host{Hostname: "lobby1", GRPCPort: 19081, Status: common.HostStatusRunning})
+		if err != nil {
+			t.Fatalf("RegisterLobbyServer: %+v", err)
+		}
+		if id3 != id1 {
+			t.Fatalf("RegisterLobbyServer(lobby1) = %v, wants %v", id3, id1)
+		}
+		if err := s.UpdateLobbyServer(ctx, id1, common.HostStatusRunning, now); err != nil {
+			t.Fatalf("UpdateLobbyServer: %+v", err)
+		}
+		// heartbeatが途絶えたlobbyは選ばれない
+		if err := s.UpdateLobbyServer(ctx, id2, common.HostStatusRunning, now-100); err != nil {
+			t.Fatalf("UpdateLobbyServer: %+v", err)
+		}
+
+		alive, err := s.AliveLobbyServers(ctx, now-10)
+		if err != nil {
+			t.Fatalf("AliveLobbyServers: %+v", err)
+		}
+		if len(alive) != 1 || alive[0].Id != id1 || alive[0].GRPCPort != 19081 {
+			t.Fatalf("AliveLobbyServers = %v, wants only lobby1", alive)
+		}
+
+		all, err := s.LobbyServers(ctx)
+		if err != nil {
+			t.Fatalf("LobbyServers: %+v", err)
+		}
+		if len(all) != 2 {
+			t.Fatalf("LobbyServers = %v, wants 2 servers", all)
+		}
+	})
+}
+
+func newTestRoom(id string, number int32, visible bool) *pb.RoomInfo {
+	r := &pb.RoomInfo{
+		Id:          id,
+		AppId:       "app1",
+		HostId:      1,
+		Visible:     visible,
+		Joinable:    true,
+		Number:      &pb.RoomNumber{Number: number},
+		SearchGroup: 1,
+		MaxPlayers:  4,
+		Players:     1,
+		PublicProps: []byte{1, 2, 3},
+	}
+	r.SetCreated(time.Now())
+	return r
+}
+
+func roomIds(rooms []*pb.RoomInfo) []string {
+	ids := make([]string, len(rooms))
+	for i, r := range rooms {
+		ids[i] = r.Id
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func equalIds(ids []string, wants ...string) bool {
+	if len(ids) != len(wants) {
+		return false
+	}
+	for i := range ids {
+		if ids[i] != wants[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRoom(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+
+		for _, r := range []*pb.RoomInfo{
+			newTestRoom("room1", 10, true),
+			newTestRoom("room2", 0, true),
+			newTestRoom("room3", 30, false),
+		} {
+			if err := s.InsertRoom(ctx, r); err != nil {
+				t.Fatalf("InsertRoom(%v): %+v", r.Id, err)
+			}
+		}
+		if err := s.InsertRoom(ctx, newTestRoom("room1", 0, true)); err == nil {
+			t.Fatalf("InsertRoom must fail with duplicate id")
+		}
+		if err := s.InsertRoom(ctx, newTestRoom("room4", 10, true)); err == nil {
+			t.Fatalf("InsertRoom must fail with duplicate number")
+		}
+
+		room, err := s.GetRoom(ctx, "app1", "room1")
+		if err != nil {
+			t.Fatalf("GetRoom: %+v", err)
+		}
+		if room.Id != "room1" || room.Number.Number != 10 || !room.Visible || string(room.PublicProps) != "\x01\x02\x03" {
+			t.Fatalf("GetRoom = %v", room)
+		}
+		if _, err := s.GetRoom(ctx, "app2", "room1"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("GetRoom(app2) error = %v, wants ErrNotFound", err)
+		}
+		room, err = s.GetRoomByNumber(ctx, "app1", 30)
+		if err != nil || room.Id != "room3" {
+			t.Fatalf("GetRoomByNumber(30) = (%v, %v), wants room3", room, err)
+		}
+		if _, err := s.GetRoomByNumber(ctx, "app1", 20); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("GetRoomByNumber(20) error = %v, wants ErrNotFound", err)
+		}
+
+		rooms, err := s.GetRoomsByIds(ctx, "app1", []string{"room1", "room3", "room5"})
+		if err != nil || !equalIds(roomIds(rooms), "room1", "room3") {
+			t.Fatalf("GetRoomsByIds = (%v, %v)", rooms, err)
+		}
+		rooms, err = s.GetRoomsByNumbers(ctx, "app1", []int32{10, 30, 50})
+		if err != nil || !equalIds(roomIds(rooms), "room1", "room3") {
+			t.Fatalf("GetRoomsByNumbers = (%v, %v)", rooms, err)
+		}
+		rooms, err = s.SearchRooms(ctx, "app1", 1, 10)
+		if err != nil || !equalIds(roomIds(rooms), "room1", "room2") {
+			t.Fatalf("SearchRooms = (%v, %v), wants visible rooms", rooms, err)
+		}
+		rooms, err = s.SearchRooms(ctx, "app1", 1, 1)
+		if err != nil || len(rooms) != 1 {
+			t.Fatalf("SearchRooms(limit=1) = (%v, %v)", rooms, err)
+		}
+		rooms, err = s.Rooms(ctx, nil)
+		if err != nil || !equalIds(roomIds(rooms), "room1", "room2", "room3") {
+			t.Fatalf("Rooms = (%v, %v)", rooms, err)
+		}
+
+		room = newTestRoom("room2", 20, false)
+		room.Players = 3
+		if err := s.UpdateRoom(ctx, room); err != nil {
+			t.Fatalf("UpdateRoom: %+v", err)
+		}
+		room, err = s.GetRoomByNumber(ctx, "app1", 20)
+		if err != nil || room.Id != "room2" || room.Players != 3 || room.Visible {
+			t.Fatalf("updated room = (%v, %v)", room, err)
+		}
+
+		if err := s.DeleteRoom(ctx, "room1"); err != nil {
+			t.Fatalf("DeleteRoom: %+v", err)
+		}
+		if _, err := s.GetRoom(ctx, "app1", "room1"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("deleted room error = %v, wants ErrNotFound", err)
+		}
+		// 削除した部屋の番号は再利用できる
+		if err := s.InsertRoom(ctx, newTestRoom("room4", 10, true)); err != nil {
+			t.Fatalf("InsertRoom(room4): %+v", err)
+		}
+	})
+}
+
+func TestRoomTx(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+
+		tx, err := s.BeginRoomTx(ctx)
+		if err != nil {
+			t.Fatalf("BeginRoomTx: %+v", err)
+		}
+		if err := tx.InsertRoom(ctx, newTestRoom("room1", 10, true)); err != nil {
+			t.Fatalf("InsertRoom: %+v", err)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("Rollback: %+v", err)
+		}
+		if _, err := s.GetRoom(ctx, "app1", "room1"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("rollbacked room error = %v, wants ErrNotFound", err)
+		}
+
+		tx, err = s.BeginRoomTx(ctx)
+		if err != nil {
+			t.Fatalf("BeginRoomTx: %+v", err)
+		}
+		if err := tx.InsertRoom(ctx, newTestRoom("room1", 10, true)); err != nil {
+			t.Fatalf("InsertRoom: %+v", err)
+		}
+		if err := tx.InsertRoom(ctx, newTestRoom("room2", 10, true)); err == nil {
+			t.Fatalf("InsertRoom with duplicated number must be failed")
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit: %+v", err)
+		}
+		if r, err := s.GetRoom(ctx, "app1", "room1"); err != nil || r.Number.Number != 10 {
+			t.Fatalf("committed room = (%v, %v)", r, err)
+		}
+	})
+}
+
+func TestRoomHistory(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+		base := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+
+		for i, id := range []string{"old1", "old2", "old3"} {
+			err := s.InsertRoomHistory(ctx, &RoomHistory{
+				AppID:   "app1",
+				HostID:  1,
+				RoomID:  id,
+				Created: base.Add(time.Duration(i) * time.Hour),
+				Closed:  base.Add(time.Duration(i)*time.Hour + 30*time.Minute),
+			})
+			if err != nil {
+				t.Fatalf("InsertRoomHistory: %+v", err)
+			}
+		}
+
+		ids := func(hs []*RoomHistory) []string {
+			ids := make([]string, len(hs))
+			for i, h := range hs {
+				ids[i] = h.RoomID
+			}
+			return ids
+		}
+
+		hs, err := s.RoomHistories(ctx, &RoomHistoryFilter{})
+		if err != nil || !equalIds(ids(hs), "old3", "old2", "old1") {
+			t.Fatalf("RoomHistories = (%v, %v), wants newest first", ids(hs), err)
+		}
+		if !hs[2].Created.Equal(base) || !hs[2].Closed.Equal(base.Add(30*time.Minute)) {
+			t.Fatalf("old1 created=%v closed=%v", hs[2].Created, hs[2].Closed)
+		}
+
+		after := base.Add(time.Hour)
+		hs, err = s.RoomHistories(ctx, &RoomHistoryFilter{CreatedAfter: &after, Limit: 1})
+		if err != nil || !equalIds(ids(hs), "old3") {
+			t.Fatalf("RoomHistories(after, limit) = (%v, %v)", ids(hs), err)
+		}
+		at := base.Add(70 * time.Minute)
+		hs, err = s.RoomHistories(ctx, &RoomHistoryFilter{At: &at})
+		if err != nil || !equalIds(ids(hs), "old2") {
+			t.Fatalf("RoomHistories(at) = (%v, %v)", ids(hs), err)
+		}
+		closedAfter := base.Add(80 * time.Minute)
+		hs, err = s.RoomHistories(ctx, &RoomHistoryFilter{AppId: "app1", ClosedAfter: &closedAfter})
+		if err != nil || !equalIds(ids(hs), "old3", "old2") {
+			t.Fatalf("RoomHistories(closedAfter) = (%v, %v)", ids(hs), err)
+		}
+		hs, err = s.RoomHistories(ctx, &RoomHistoryFilter{AppId: "app2"})
+		if err != nil || len(hs) != 0 {
+			t.Fatalf("RoomHistories(app2) = (%v, %v)", ids(hs), err)
+		}
+		hs, err = s.RoomHistories(ctx, &RoomHistoryFilter{RoomIds: []string{"old1", "old9"}})
+		if err != nil || !equalIds(ids(hs), "old1") {
+			t.Fatalf("RoomHistories(ids) = (%v, %v)", ids(hs), err)
+		}
+
+		for i, msg := range []string{"Create", "Join", "Leave"} {
+			err := s.InsertPlayerLog(ctx, &PlayerLog{
+				RoomID:   "old1",
+				PlayerID: "player1",
+				Message:  msg,
+				Datetime: base.Add(time.Duration(i) * time.Minute),
+			})
+			if err != nil {
+				t.Fatalf("InsertPlayerLog: %+v", err)
+			}
+		}
+		plogs, err := s.PlayerLogs(ctx, []string{"old1"})
+		if err != nil || len(plogs) != 3 {
+			t.Fatalf("PlayerLogs = (%v, %v)", plogs, err)
+		}
+		for i, msg := range []string{"Create", "Join", "Leave"} {
+			if plogs[i].Message != msg {
+				t.Errorf("PlayerLogs[%d] = %v, wants %v", i, plogs[i].Message, msg)
+			}
+		}
+
+		// 残っている部屋を履歴に移す
+		if err := s.InsertRoom(ctx, newTestRoom("room1", 10, true)); err != nil {
+			t.Fatalf("InsertRoom: %+v", err)
+		}
+		for _, b := range []*Ban{
+			{AppID: "app1", UserID: "u1", RoomID: "room1", Created: time.Now()},
+			{AppID: "app1", UserID: "u1", RoomID: "room2", Created: time.Now()},
+			{AppID: "app1", UserID: "u2", Created: time.Now()},
+		} {
+			if err := s.InsertBan(ctx, b); err != nil {
+				t.Fatalf("InsertBan: %+v", err)
+			}
+		}
+		if err := s.ArchiveRooms(ctx, 1); err != nil {
+			t.Fatalf("ArchiveRooms: %+v", err)
+		}
+		if _, err := s.GetRoom(ctx, "app1", "room1"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("archived room error = %v, wants ErrNotFound", err)
+		}
+		hs, err = s.RoomHistories(ctx, &RoomHistoryFilter{RoomIds: []string{"room1"}})
+		if err != nil || len(hs) != 1 || hs[0].Number.Int32 != 10 {
+			t.Fatalf("archived history = (%v, %v)", hs, err)
+		}
+		// 部屋単位のbanは部屋と共に削除する
+		bans, err := s.Bans(ctx, &BanFilter{AppId: "app1"})
+		if err != nil || len(bans) != 2 || bans[0].RoomID == "room1" || bans[1].RoomID == "room1" {
+			t.Fatalf("bans after archive = (%v, %v)", bans, err)
+		}
+	})
+}
+
+func TestPurgeHistory(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+		base := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+
+		for i := 0; i < 5; i++ {
+			id := fmt.Sprintf("room%d", i)
+			created := base.Add(time.Duration(i) * 24 * time.Hour)
+			err := s.InsertRoomHistory(ctx, &RoomHistory{
+				AppID: "app1", HostID: 1, RoomID: id, Created: created, Closed: created.Add(time.Hour),
+			})
+			if err != nil {
+				t.Fatalf("InsertRoomHistory: %+v", err)
+			}
+			err = s.InsertPlayerLog(ctx, &PlayerLog{RoomID: id, PlayerID: "p1", Message: "Create", Datetime: created})
+			if err != nil {
+				t.Fatalf("InsertPlayerLog: %+v", err)
+			}
+		}
+
+		before := base.Add(3 * 24 * time.Hour)
+		for _, test := range []struct {
+			limit, wants int
+		}{{2, 2}, {2, 1}, {2, 0}} {
+			n, err := s.PurgeRoomHistories(ctx, before, test.limit)
+			if err != nil || n != test.wants {
+				t.Fatalf("PurgeRoomHistories = (%v, %v), wants %v", n, err, test.wants)
+			}
+		}
+		if n, err := s.PurgePlayerLogs(ctx, before, 10); err != nil || n != 3 {
+			t.Fatalf("PurgePlayerLogs = (%v, %v), wants 3", n, err)
+		}
+
+		hs, err := s.RoomHistories(ctx, &RoomHistoryFilter{})
+		if err != nil || len(hs) != 2 || hs[1].RoomID != "room3" {
+			t.Fatalf("remaining histories = (%v, %v)", hs, err)
+		}
+		plogs, err := s.PlayerLogs(ctx, []string{"room0", "room3", "room4"})
+		if err != nil || len(plogs) != 2 || plogs[0].RoomID != "room3" {
+			t.Fatalf("remaining player logs = (%v, %v)", plogs, err)
+		}
+	})
+}
+
+func TestArchiveHistory(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+		base := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+
+		for i := 0; i < 3; i++ {
+			id := fmt.Sprintf("room%d", i)
+			created := base.Add(time.Duration(i) * 24 * time.Hour)
+			err := s.InsertRoomHistory(ctx, &RoomHistory{
+				AppID: "app1", HostID: 1, RoomID: id, Number: sql.NullInt32{Int32: int32(i), Valid: true},
+				PublicProps: []byte{1, 2, 3}, Created: created, Closed: created.Add(time.Hour),
+			})
+			if err != nil {
+				t.Fatalf("InsertRoomHistory: %+v", err)
+			}
+			err = s.InsertPlayerLog(ctx, &PlayerLog{RoomID: id, PlayerID: "p1", Message: "Create", Datetime: created})
+			if err != nil {
+				t.Fatalf("InsertPlayerLog: %+v", err)
+			}
+		}
+
+		before := base.Add(2 * 24 * time.Hour)
+		errArchive := errors.New("archive failed")
+		n, err := s.ArchiveRoomHistories(ctx, before, 10, func([]*RoomHistory) error { return errArchive })
+		if !errors.Is(err, errArchive) || n != 0 {
+			t.Fatalf("ArchiveRoomHistories = (%v, %v), wants errArchive", n, err)
+		}
+
+		var archived []*RoomHistory
+		for _, wants := range []int{1, 1, 0} {
+			n, err := s.ArchiveRoomHistories(ctx, before, 1, func(hs []*RoomHistory) error {
+				archived = append(archived, hs...)
+				return nil
+			})
+			if err != nil || n != wants {
+				t.Fatalf("ArchiveRoomHistories = (%v, %v), wants %v", n, err, wants)
+			}
+		}
+		if len(archived) != 2 || archived[0].RoomID != "room0" || archived[1].RoomID != "room1" ||
+			archived[1].Number.Int32 != 1 || len(archived[1].PublicProps) != 3 || !archived[1].Created.Equal(base.Add(24*time.Hour)) {
+			t.Fatalf("archived histories = %v", archived)
+		}
+
+		var plogs []*PlayerLog
+		n, err = s.ArchivePlayerLogs(ctx, before, 10, func(ls []*PlayerLog) error {
+			plogs = append(plogs, ls...)
+			return nil
+		})
+		if err != nil || n != 2 || len(plogs) != 2 || plogs[0].RoomID != "room0" || !plogs[0].Datetime.Equal(base) {
+			t.Fatalf("ArchivePlayerLogs = (%v, %v) %v", n, err, plogs)
+		}
+
+		hs, err := s.RoomHistories(ctx, &RoomHistoryFilter{})
+		if err != nil || len(hs) != 1 || hs[0].RoomID != "room2" {
+			t.Fatalf("remaining histories = (%v, %v)", hs, err)
+		}
+		ls, err := s.PlayerLogs(ctx, []string{"room0", "room1", "room2"})
+		if err != nil || len(ls) != 1 || ls[0].RoomID != "room2" {
+			t.Fatalf("remaining player logs = (%v, %v)", ls, err)
+		}
+	})
+}
+
+func TestPlayerEvent(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+		base := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+
+		if err := s.InsertPlayerEvents(ctx, []*PlayerEvent{
+			{AppID: "app1", RoomID: "room1", PlayerID: "p1", Event: "Join", Detail: `{"source":"create"}`, Datetime: base},
+			{AppID: "app1", RoomID: "room1", PlayerID: "p2", Event: "Join", Detail: `{"source":"id"}`, Datetime: base.Add(time.Second)},
+			{AppID: "app1", RoomID: "room2", PlayerID: "p1", Event: "Join", Detail: `{"source":"random"}`, Datetime: base.Add(2 * time.Second)},
+			{AppID: "app2", RoomID: "room3", PlayerID: "p1", Event: "Leave", Detail: `{}`, Datetime: base.Add(3 * time.Second)},
+		}); err != nil {
+			t.Fatalf("InsertPlayerEvents: %+v", err)
+		}
+		if err := s.InsertPlayerEvents(ctx, nil); err != nil {
+			t.Fatalf("InsertPlayerEvents(nil): %+v", err)
+		}
+
+		since := base.Add(time.Second)
+		until := base.Add(3 * time.Second)
+		tests := []struct {
+			filter PlayerEventFilter
+			wants  []string
+		}{
+			{PlayerEventFilter{PlayerId: "p1"}, []string{"room1", "room2", "room3"}},
+			{PlayerEventFilter{PlayerId: "p1", AppId: "app1"}, []string{"room1", "room2"}},
+			{PlayerEventFilter{PlayerId: "p1", Since: &since, Until: &until}, []string{"room2"}},
+			{PlayerEventFilter{RoomId: "room1"}, []string{"room1", "room1"}},
+			{PlayerEventFilter{PlayerId: "p1", Limit: 1}, []string{"room1"}},
+		}
+		for _, test := range tests {
+			evs, err := s.PlayerEvents(ctx, &test.filter)
+			if err != nil {
+				t.Fatalf("PlayerEvents(%+v): %+v", test.filter, err)
+			}
+			rooms := []string{}
+			for _, ev := range evs {
+				rooms = append(rooms, ev.RoomID)
+			}
+			if fmt.Sprint(rooms) != fmt.Sprint(test.wants) {
+				t.Errorf("PlayerEvents(%+v) rooms = %v, wants %v", test.filter, rooms, test.wants)
+			}
+		}
+
+		evs, _ := s.PlayerEvents(ctx, &PlayerEventFilter{PlayerId: "p2"})
+		if len(evs) != 1 || evs[0].Detail != `{"source":"id"}` || evs[0].AppID != "app1" || !evs[0].Datetime.Equal(since) {
+			t.Errorf("PlayerEvents(p2) = %v", evs)
+		}
+	})
+}
+
+func TestBan(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+		base := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+		expires := func(d time.Duration) sql.NullTime {
+			return sql.NullTime{Time: base.Add(d), Valid: true}
+		}
+
+		for _, b := range []*Ban{
+			{AppID: "app1", UserID: "u1", Reason: "cheat", BannedBy: "admin", Created: base},
+			{AppID: "app1", UserID: "u2", RoomID: "room1", BannedBy: "u1", Expires: expires(time.Hour), Created: base.Add(time.Second)},
+			{AppID: "app1", UserID: "u3", Expires: expires(time.Minute), Created: base.Add(2 * time.Second)},
+			{AppID: "app2", UserID: "u1", Expires: expires(time.Hour), Created: base.Add(3 * time.Second)},
+		} {
+			if err := s.InsertBan(ctx, b); err != nil {
+				t.Fatalf("InsertBan(%+v): %+v", b, err)
+			}
+		}
+		// 同じapp, user, roomなら上書き
+		if err := s.InsertBan(ctx, &Ban{AppID: "app1", UserID: "u3", Reason: "again", Expires: expires(2 * time.Hour), Created: base.Add(4 * time.Second)}); err != nil {
+			t.Fatalf("InsertBan(overwrite): %+v", err)
+		}
+
+		at := base.Add(90 * time.Minute)
+		tests := []struct {
+			filter BanFilter
+			wants  []string
+		}{
+			{BanFilter{}, []string{"app1/u3/", "app2/u1/", "app1/u2/room1", "app1/u1/"}},
+			{BanFilter{AppId: "app1"}, []string{"app1/u3/", "app1/u2/room1", "app1/u1/"}},
+			{BanFilter{UserId: "u1"}, []string{"app2/u1/", "app1/u1/"}},
+			{BanFilter{ActiveAt: &at}, []string{"app1/u3/", "app1/u1/"}},
+			{BanFilter{Limit: 1}, []string{"app1/u3/"}},
+		}
+		for _, test := range tests {
+			bans, err := s.Bans(ctx, &test.filter)
+			if err != nil {
+				t.Fatalf("Bans(%+v): %+v", test.filter, err)
+			}
+			keys := []string{}
+			for _, b := range bans {
+				keys = append(keys, b.AppID+"/"+b.UserID+"/"+b.RoomID)
+			}
+			if fmt.Sprint(keys) != fmt.Sprint(test.wants) {
+				t.Errorf("Bans(%+v) = %v, wants %v", test.filter, keys, test.wants)
+			}
+		}
+
+		bans, err := s.ActiveBans(ctx, base.Add(30*time.Minute))
+		if err != nil || len(bans) != 4 {
+			t.Fatalf("ActiveBans = (%v, %v)", bans, err)
+		}
+		if b := bans[0]; b.Reason != "again" || !b.Expires.Valid || !b.Expires.Time.Equal(base.Add(2*time.Hour)) {
+			t.Errorf("overwritten ban = %+v", b)
+		}
+		if b := bans[3]; b.Expires.Valid || b.Reason != "cheat" || b.BannedBy != "admin" || !b.Created.Equal(base) {
+			t.Errorf("permanent ban = %+v", b)
+		}
+
+		if err := s.DeleteBan(ctx, "app1", "u2", "room1"); err != nil {
+			t.Fatalf("DeleteBan: %+v", err)
+		}
+		if err := s.DeleteBan(ctx, "app1", "u2", "room1"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("DeleteBan(deleted) error = %v, wants ErrNotFound", err)
+		}
+		if err := s.DeleteBan(ctx, "app1", "u1", "room1"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("DeleteBan(other room) error = %v, wants ErrNotFound", err)
+		}
+		if bans, _ := s.Bans(ctx, &BanFilter{AppId: "app1"}); len(bans) != 2 {
+			t.Errorf("Bans after delete = %v", bans)
+		}
+
+		if err := s.InsertBan(ctx, &Ban{AppID: "app1", UserID: "u4", RoomID: "room2", Created: base}); err != nil {
+			t.Fatalf("InsertBan(room2): %+v", err)
+		}
+		if err := s.DeleteRoomBans(ctx, "room2"); err != nil {
+			t.Fatalf("DeleteRoomBans: %+v", err)
+		}
+		if err := s.DeleteRoomBans(ctx, ""); err == nil {
+			t.Fatalf("DeleteRoomBans must fail with empty room id")
+		}
+		if bans, _ := s.Bans(ctx, &BanFilter{}); len(bans) != 3 {
+			t.Errorf("Bans after DeleteRoomBans = %v", bans)
+		}
+	})
+}
+
+func TestHub(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s testStorage) {
+		ctx := context.Background()
+
+		id1, err := s.InsertHub(ctx, 1, "room1")
+		if err != nil {
+			t.Fatalf("InsertHub: %+v", err)
+		}
+		if _, err := s.InsertHub(ctx, 1, "room1"); err == nil {
+			t.Fatalf("InsertHub must fail with duplicate host and room")
+		}
+		id2, err := s.InsertHub(ctx, 2, "room1")
+		if err != nil {
+			t.Fatalf("InsertHub: %+v", err)
+		}
+		if _, err := s.InsertHub(ctx, 2, "room2"); err != nil {
+			t.Fatalf("InsertHub: %+v", err)
+		}
+
+		if err := s.UpdateHubWatchers(ctx, id1, 5); err != nil {
+			t.Fatalf("UpdateHubWatchers: %+v", err)
+		}
+		hubs, err := s.GetRoomHubs(ctx, "room1")
+		if err != nil || len(hubs) != 2 {
+			t.Fatalf("GetRoomHubs = (%v, %v)", hubs, err)
+		}
+		for _, h := range hubs {
+			if h.Id == id1 && h.Watchers != 5 {
+				t.Errorf("watchers = %v, wants 5", h.Watchers)
+			}
+		}
+
+		if err := s.DeleteHub(ctx, id2); err != nil {
+			t.Fatalf("DeleteHub: %+v", err)
+		}
+		if err := s.DeleteHostHubs(ctx, 1); err != nil {
+			t.Fatalf("DeleteHostHubs: %+v", err)
+		}
+		if hubs, err := s.GetRoomHubs(ctx, "room1"); err != nil || len(hubs) != 0 {
+			t.Fatalf("GetRoomHubs after delete = (%v, %v)", hubs, err)
+		}
+		if hubs, err := s.GetRoomHubs(ctx, "room2"); err != nil || len(hubs) != 1 {
+			t.Fatalf("GetRoomHubs(room2) = (%v, %v)", hubs, err)
+		}
+	})
+}
@@ -0,0 +1,306 @@
+// Package testserver : lobby/game/hubを1プロセスで起動するテスト用のサーバ.
+//
+// MySQLの代わりに storage.Memory を使い、各サーバは空いているポートで待ち受ける.
+//
+//	ts, err := testserver.Start(nil)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	t.Cleanup(ts.Close)
+//
+//	accinfo, _ := ts.AccessInfo("user1")
+//	room, conn, err := client.Create(ctx, accinfo, roomopt, clinfo, nil)
+package testserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"wsnet2/client"
+	"wsnet2/config"
+	"wsnet2/game"
+	gamesvc "wsnet2/game/service"
+	hubsvc "wsnet2/hub/service"
+	lobbysvc "wsnet2/lobby/service"
+	"wsnet2/log"
+	"wsnet2/pb"
+	"wsnet2/storage"
+)
+
+const (
+	DefaultAppId  = "testapp"
+	DefaultAppKey = "testappkey"
+
+	host = "127.0.0.1"
+)
+
+// Options : 起動オプション. ゼロ値の項目は既定値を使う
+type Options struct {
+	// Apps : 登録するapp. 空なら DefaultAppId/DefaultAppKey のappのみ
+	Apps []*pb.App
+
+	// Config : 各サーバの設定. nilなら config.Default() をテスト向けに調整したもの.
+	// ポートとホスト名は常に上書きされる.
+	Config *config.Config
+
+	// LogLevel : 既定は log.ERROR. ログの設定はプロセスで共通なので、最初のStartの指定のみ有効
+	LogLevel log.Level
+
+	// Hubs : 起動するhubの数. 0なら1台.
+	// 2台目以降はConfig.Hubをコピーし、ホスト名を 127.0.0.2, 127.0.0.3, ... として区別する.
+	Hubs int
+
+	// BroadcastHook : 全appのBroadcastの配信先を決めるhook (see: game.BroadcastHook)
+	BroadcastHook game.BroadcastHook
+}
+
+// Server : 起動中のlobby/game/hub
+type Server struct {
+	Storage *storage.Memory
+	Config  *config.Config
+
+	// LobbyURL : lobbyのAPIのURL (http://host:port)
+	LobbyURL string
+
+	GameHostId uint32
+	HubHostId  uint32
+
+	// Hubs : 起動したhubの設定. Hubs[0]はConfig.Hubと同じ
+	Hubs       []*config.HubConf
+	HubHostIds []uint32
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	errs []error
+}
+
+var initLogger sync.Once
+
+// Start : lobby/game/hubを起動し、lobbyがgame/hubを選べる状態になるまで待つ
+func Start(opts *Options) (*Server, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	conf := opts.Config
+	if conf == nil {
+		conf = DefaultConfig()
+	}
+	apps := opts.Apps
+	if len(apps) == 0 {
+		apps = []*pb.App{{Id: DefaultAppId, Key: DefaultAppKey}}
+	}
+	loglevel := opts.LogLevel
+	if loglevel == 0 {
+		loglevel = log.ERROR
+	}
+
+	initLogger.Do(func() {
+		log.InitLogger(&config.LogConf{
+			LogStdoutConsole: true,
+			LogStdoutLevel:   uint32(loglevel),
+		})
+		log.SetLevel(loglevel)
+	})
+
+	nhubs := opts.Hubs
+	if nhubs < 1 {
+		nhubs = 1
+	}
+
+	ports, err := freePorts(6 + (nhubs-1)*2)
+	if err != nil {
+		return nil, xerrors.Errorf("free ports: %w", err)
+	}
+	conf.Game.Hostname, conf.Game.PublicName = host, host
+	conf.Game.GRPCPort, conf.Game.WebsocketPort, conf.Game.PprofPort = ports[0], ports[1], 0
+	conf.Hub.Hostname, conf.Hub.PublicName = host, host
+	conf.Hub.GRPCPort, conf.Hub.WebsocketPort, conf.Hub.PprofPort = ports[2], ports[3], 0
+	conf.Lobby.Hostname = host
+	conf.Lobby.Net, conf.Lobby.Port, conf.Lobby.PprofPort = "tcp", ports[4], 0
+	conf.Lobby.GRPCHost, conf.Lobby.GRPCPort = host, ports[5]
+
+	hubConfs := []*config.HubConf{&conf.Hub}
+	for i := 1; i < nhubs; i++ {
+		hc := conf.Hub
+		// storageはホスト名でhubを区別するので、loopbackの別アドレスを使う
+		hc.Hostname = fmt.Sprintf("127.0.0.%d", i+1)
+		hc.PublicName = hc.Hostname
+		hc.GRPCPort, hc.WebsocketPort = ports[4+i*2], ports[5+i*2]
+		hubConfs = append(hubConfs, &hc)
+	}
+
+	store := storage.NewMemory(apps...)
+
+	gs, err := gamesvc.New(store, &conf.Game)
+	if err != nil {
+		return nil, xerrors.Errorf("game service: %w", err)
+	}
+	if opts.BroadcastHook != nil {
+		for _, app := range apps {
+			if err := gs.SetBroadcastHook(app.Id, opts.BroadcastHook); err != nil {
+				return nil, xerrors.Errorf("broadcast hook: %w", err)
+			}
+		}
+	}
+	hubs := make([]*hubsvc.HubService, nhubs)
+	for i, hc := range hubConfs {
+		hubs[i], err = hubsvc.New(store, hc)
+		if err != nil {
+			return nil, xerrors.Errorf("hub service: %w", err)
+		}
+	}
+	lobby, err := lobbysvc.New(store, &conf.Lobby)
+	if err != nil {
+		return nil, xerrors.Errorf("lobby service: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		Storage:    store,
+		Config:     conf,
+		LobbyURL:   fmt.Sprintf("http://%s:%d", host, conf.Lobby.Port),
+		GameHostId: uint32(gs.HostId),
+		HubHostId:  uint32(hubs[0].HostId),
+		Hubs:       hubConfs,
+		cancel:     cancel,
+	}
+	s.serve("game", func() error { return gs.Serve(ctx) })
+	for _, hub := range hubs {
+		hub := hub
+		s.HubHostIds = append(s.HubHostIds, uint32(hub.HostId))
+		s.serve(fmt.Sprintf("hub(%v)", hub.HostId), func() error { return hub.Serve(ctx) })
+	}
+	s.serve("lobby", func() error { return lobby.Serve(ctx) })
+
+	if err := s.waitReady(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// DefaultConfig : テスト向けの設定. heartbeatの間隔を短くして起動を速くしている
+func DefaultConfig() *config.Config {
+	conf := config.Default()
+	conf.Game.HeartBeatInterval = config.Duration(100 * time.Millisecond)
+	conf.Game.PlayerEventFlushInterval = config.Duration(100 * time.Millisecond)
+	conf.Game.RoomUpdateInterval = config.Duration(100 * time.Millisecond)
+	conf.Game.LogPath = ""
+	conf.Hub.HeartBeatInterval = config.Duration(100 * time.Millisecond)
+	conf.Hub.LogPath = ""
+	conf.Lobby.HeartBeatInterval = config.Duration(100 * time.Millisecond)
+	conf.Lobby.BanCacheExpire = config.Duration(100 * time.Millisecond)
+	conf.Lobby.LogPath = ""
+	return conf
+}
+
+func (s *Server) serve(name string, serve func() error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := serve(); err != nil {
+			s.mu.Lock()
+			s.errs = append(s.errs, xerrors.Errorf("%s: %w", name, err))
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// Err : サーバが異常終了していればそのエラー
+func (s *Server) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.errs) == 0 {
+		return nil
+	}
+	return s.errs[0]
+}
+
+func (s *Server) waitReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	t := time.NewTicker(20 * time.Millisecond)
+	defer t.Stop()
+	for {
+		if err := s.Err(); err != nil {
+			return err
+		}
+		if s.ready(ctx) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return xerrors.Errorf("servers not ready: %w", ctx.Err())
+		case <-t.C:
+		}
+	}
+}
+
+// ready : game/hub/lobbyのheartbeatが記録され、lobbyがリクエストを受け付けられる
+func (s *Server) ready(ctx context.Context) bool {
+	since := time.Now().Add(-time.Duration(s.Config.Lobby.ValidHeartBeat)).Unix()
+	games, _ := s.Storage.AliveGameServers(ctx, since)
+	hubs, _ := s.Storage.AliveHubServers(ctx, since)
+	if len(games) == 0 || len(hubs) < len(s.Hubs) {
+		return false
+	}
+	if s.Config.Lobby.GRPCPort != 0 {
+		lobbies, _ := s.Storage.AliveLobbyServers(ctx, since)
+		if len(lobbies) == 0 {
+			return false
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.LobbyURL+"/health", nil)
+	if err != nil {
+		return false
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusOK
+}
+
+// Close : 全てのサーバを停止する
+func (s *Server) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// AccessInfo : DefaultAppIdのappでlobbyにアクセスするための情報
+func (s *Server) AccessInfo(userId string) (*client.AccessInfo, error) {
+	return client.GenAccessInfo(s.LobbyURL, DefaultAppId, DefaultAppKey, userId)
+}
+
+// freePorts : 空いているポートをn個選ぶ
+func freePorts(n int) ([]int, error) {
+	ports := make([]int, n)
+	listeners := make([]net.Listener, n)
+	defer func() {
+		for _, l := range listeners {
+			if l != nil {
+				l.Close()
+			}
+		}
+	}()
+	for i := range ports {
+		l, err := net.Listen("tcp", host+":0")
+		if err != nil {
+			return nil, err
+		}
+		listeners[i] = l
+		ports[i] = l.Addr().(*net.TCPAddr).Port
+	}
+	return ports, nil
+}
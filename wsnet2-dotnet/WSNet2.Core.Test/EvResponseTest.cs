@@ -54,5 +54,19 @@ namespace WSNet2.Core.Test
             Assert.AreEqual(publicProps, payload.PublicProps);
             Assert.AreEqual(privateProps, payload.PrivateProps);
         }
+
+        [Test]
+        public void TestBanPayload()
+        {
+            var seqnum = msgpool.PostBan("target", 3600, "cheat");
+
+            var msg = msgpool.Take(seqnum).Value;
+            var buf = new byte[3 + msg.Count];
+            msg.CopyTo(buf, 3);
+            var reader = WSNet2Serializer.NewReader(new ArraySegment<byte>(buf));
+            var ev = new EvResponse(EvType.PermissionDenied, reader);
+
+            Assert.AreEqual("target", ev.GetBanPayload());
+        }
     }
 }
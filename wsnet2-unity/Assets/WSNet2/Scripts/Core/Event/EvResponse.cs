@@ -19,6 +19,7 @@ namespace WSNet2
     ///     - ClientProp
     ///     - SwitchMaster
     ///     - Kick
+    ///     - Ban
     ///   </para>
     /// </remarks>
     public class EvResponse : Event
@@ -104,5 +105,11 @@ namespace WSNet2
             var reader = WSNet2Serializer.NewReader(Payload);
             return reader.ReadString();
         }
+
+        public string GetBanPayload()
+        {
+            var reader = WSNet2Serializer.NewReader(Payload);
+            return reader.ReadString();
+        }
     }
 }
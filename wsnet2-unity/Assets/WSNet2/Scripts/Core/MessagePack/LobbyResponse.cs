@@ -24,5 +24,6 @@ namespace WSNet2
         RoomLimit,
         NoRoomFound,
         RoomFull,
+        Banned,
     }
 }
@@ -12,6 +12,8 @@
         ToMaster,
         Broadcast,
         Kick,
+
+        Ban = MsgTypeExt.regularMsgType + 14,
     }
 
     static class MsgTypeExt
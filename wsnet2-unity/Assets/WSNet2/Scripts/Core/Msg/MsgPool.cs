@@ -183,6 +183,23 @@ namespace WSNet2
             }
         }
 
+        /// <summary>
+        ///   入室禁止メッセージを投下
+        /// </summary>
+        /// <param name="durationSec">禁止する秒数. 0なら部屋が終了するまで</param>
+        public int PostBan(string targetId, uint durationSec, string message)
+        {
+            lock (this)
+            {
+                var writer = writeMsgType(MsgType.Ban);
+                writer.Write(targetId);
+                writer.Write(durationSec);
+                writer.Write(message);
+                writer.AppendHMAC(hmac);
+                return sequenceNum;
+            }
+        }
+
         /// <summary>
         ///   RPCメッセージを投下
         /// </summary>
@@ -635,6 +652,7 @@ namespace WSNet2
                         Param = NetworkInformer.CutOutOne(reader),
                     };
                 case MsgType.Kick:
+                case MsgType.Ban:
                     return new NetworkInformer.RoomSendKickInfo()
                     {
                         BodySize = bodysize,
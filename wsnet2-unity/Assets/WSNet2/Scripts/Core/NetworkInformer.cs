@@ -170,7 +170,7 @@ namespace WSNet2
         }
 
         /// <summary>
-        ///   Kick送信情報
+        ///   Kick, Ban送信情報
         /// </summary>
         [Serializable]
         public class RoomSendKickInfo : RoomSendInfo
@@ -745,6 +745,59 @@ namespace WSNet2
             return seqNum;
         }
 
+        /// <summary>
+        ///   対象のプレイヤーを強制退室させ、部屋が終了するまで入室できなくする
+        /// </summary>
+        /// <param name="targetId">対象プレイヤーのID. 退室済みのプレイヤーも指定できる</param>
+        /// <param name="onErrorResponse">サーバ側でエラーになったときのコールバック</param>
+        /// <remarks>
+        ///   この操作はMasterのみ呼び出せる。
+        /// </remarks>
+        public int Ban(string targetId, Action<EvType, string> onErrorResponse = null)
+        {
+            return Ban(targetId, TimeSpan.Zero, "", onErrorResponse);
+        }
+
+        /// <summary>
+        ///   対象のプレイヤーを強制退室させ、指定した期間この部屋に入室できなくする
+        /// </summary>
+        /// <param name="targetId">対象プレイヤーのID. 退室済みのプレイヤーも指定できる</param>
+        /// <param name="duration">入室禁止の期間（秒単位）. TimeSpan.Zeroなら部屋が終了するまで</param>
+        /// <param name="message">メッセージ</param>
+        /// <param name="onErrorResponse">サーバ側でエラーになったときのコールバック</param>
+        /// <remarks>
+        ///   この操作はMasterのみ呼び出せる。
+        /// </remarks>
+        public int Ban(string targetId, TimeSpan duration, string message, Action<EvType, string> onErrorResponse = null)
+        {
+            if (Me != Master)
+            {
+                throw new Exception("Ban is for master only");
+            }
+
+            if (targetId == Me.Id)
+            {
+                throw new Exception("Master cannot ban itself");
+            }
+
+            if (duration < TimeSpan.Zero)
+            {
+                throw new ArgumentOutOfRangeException(nameof(duration), "duration must not be negative");
+            }
+
+            var seqNum = con.msgPool.PostBan(targetId, (uint)duration.TotalSeconds, message);
+
+            if (onErrorResponse != null)
+            {
+                errorResponseHandler[seqNum] = (ev) =>
+                {
+                    onErrorResponse(ev.Type, ev.GetBanPayload());
+                };
+            }
+
+            return seqNum;
+        }
+
         /// <summary>
         ///   RPC呼び出し
         /// </summary>
@@ -476,6 +476,8 @@ namespace WSNet2
                         throw new RoomNotFoundException(res.msg);
                     case LobbyResponseType.RoomFull:
                         throw new RoomFullException(res.msg);
+                    case LobbyResponseType.Banned:
+                        throw new BannedException(res.msg);
                 }
 
                 var logger = prepareLogger(roomLogger);
@@ -514,6 +516,11 @@ namespace WSNet2
             try
             {
                 var res = await post(path, content);
+                if (res.type == LobbyResponseType.Banned)
+                {
+                    throw new BannedException(res.msg);
+                }
+
                 var count = res.rooms?.Length ?? 0;
                 var rooms = new PublicRoom[count];
                 for (var i = 0; i < count; i++)